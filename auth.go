@@ -0,0 +1,39 @@
+package websocket
+
+import "github.com/gin-gonic/gin"
+
+// AuthExtractor derives the auth context of an upgrade request, as the headers forwarded to the
+// backend. The default extractor picks the auth headers set by krakend-auth or upstream (X-User-*,
+// X-Auth-*, X-Group-*, or the forward_headers and forward_header_prefixes of the endpoint).
+// Extractors may read any part of the request: query parameters, cookies, claims of a token...
+type AuthExtractor interface {
+	Extract(c *gin.Context) map[string][]string
+}
+
+// AuthExtractorFunc adapts a function to the AuthExtractor interface
+type AuthExtractorFunc func(c *gin.Context) map[string][]string
+
+// Extract implements AuthExtractor
+func (f AuthExtractorFunc) Extract(c *gin.Context) map[string][]string {
+	return f(c)
+}
+
+// SetAuthExtractor replaces the extractor deriving the auth context of upgrade requests.
+// As with auth headers injected upstream, a non-empty context skips the auth middleware chain.
+// A nil extractor restores the default header-based one.
+func (w *HandlerFactory) SetAuthExtractor(extractor AuthExtractor) {
+	w.authExtractor = extractor
+}
+
+// extractAuthContext returns the auth context of the request found by the configured extractor
+func (w *HandlerFactory) extractAuthContext(c *gin.Context, wsConfig Config) map[string][]string {
+	if w.authExtractor == nil {
+		return w.extractAuthHeaders(c.Request.Header, wsConfig)
+	}
+
+	authHeaders := w.authExtractor.Extract(c)
+	if authHeaders == nil {
+		authHeaders = make(map[string][]string)
+	}
+	return authHeaders
+}
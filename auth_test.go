@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+func TestAuthExtractor(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		received <- r.Header.Clone()
+		conn.Read(ctx)
+	})
+
+	factory := NewHandlerFactory(logging.NoOp)
+	factory.SetAuthExtractor(AuthExtractorFunc(func(c *gin.Context) map[string][]string {
+		if token := c.Query("token"); token != "" {
+			return map[string][]string{"X-Auth-Token": {token}}
+		}
+		return nil
+	}))
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, backend.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, tt := range []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "token", query: "?token=abc123", want: "abc123"},
+		{name: "no token", query: "", want: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _, err := websocket.Dial(ctx, gateway.URL+"/ws"+tt.query, &websocket.DialOptions{
+				HTTPHeader: http.Header{"X-User-Id": {"ignored-by-the-extractor"}},
+			})
+			if err != nil {
+				t.Fatalf("dial failed: %v", err)
+			}
+			defer client.Close(websocket.StatusNormalClosure, "")
+
+			select {
+			case headers := <-received:
+				if got := headers.Get("X-Auth-Token"); got != tt.want {
+					t.Errorf("backend X-Auth-Token = %q, want %q", got, tt.want)
+				}
+				if got := headers.Get("X-User-Id"); got != "" {
+					t.Errorf("backend X-User-Id = %q, want the header-based extraction replaced", got)
+				}
+			case <-ctx.Done():
+				t.Fatal("backend was never dialed")
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package websocket
+
+import (
+	"context"
+	"time"
+)
+
+// handshakeBudget bounds the whole sequence preceding the proxy: the auth middleware chain,
+// the client accept and the backend dial. The zero value is an unlimited budget.
+type handshakeBudget struct {
+	deadline time.Time
+}
+
+// newHandshakeBudget starts a budget of total, unlimited when total is not positive
+func newHandshakeBudget(total time.Duration) handshakeBudget {
+	if total <= 0 {
+		return handshakeBudget{}
+	}
+	return handshakeBudget{deadline: time.Now().Add(total)}
+}
+
+// context returns parent bounded by the budget deadline
+func (b handshakeBudget) context(parent context.Context) (context.Context, context.CancelFunc) {
+	if b.deadline.IsZero() {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, b.deadline)
+}
+
+// exceeded reports whether the budget is spent
+func (b handshakeBudget) exceeded() bool {
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
@@ -0,0 +1,207 @@
+package websocket
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// captureQueueSize is the number of captured messages buffered before new ones are dropped
+const captureQueueSize = 1024
+
+// CapturedMessage is a copy of a frame proxied on a sampled connection
+type CapturedMessage struct {
+	ConnectionID string
+	Endpoint     string
+	Direction    string
+	Type         websocket.MessageType
+	Payload      []byte
+	Time         time.Time
+}
+
+// MessageCaptureSink receives the messages of the connections sampled by capture_sample_rate.
+// Capture is called from a single goroutine, never from the proxy loop.
+type MessageCaptureSink interface {
+	Capture(msg CapturedMessage)
+}
+
+// SetCaptureSink sets the destination of sampled message payloads. Captures are best-effort:
+// they are handed over through a bounded buffer and dropped when the sink falls behind. The sink
+// set previously stops receiving captures, and a nil sink disables capturing.
+// It is safe to call while connections are proxied.
+func (w *HandlerFactory) SetCaptureSink(sink MessageCaptureSink) {
+	var next *asyncCaptureSink
+	if sink != nil {
+		next = newAsyncCaptureSink(sink)
+	}
+
+	w.captureSinkMu.Lock()
+	previous := w.captureSink
+	w.captureSink = next
+	w.captureSinkMu.Unlock()
+
+	if previous != nil {
+		previous.stop()
+	}
+}
+
+// currentCaptureSink returns the sink set by SetCaptureSink, nil when capturing is disabled
+func (w *HandlerFactory) currentCaptureSink() *asyncCaptureSink {
+	w.captureSinkMu.Lock()
+	defer w.captureSinkMu.Unlock()
+	return w.captureSink
+}
+
+// sampleConnection decides whether a new connection is captured
+func sampleConnection(rate float64) bool {
+	return rate > 0 && (rate >= 1 || rand.Float64() < rate)
+}
+
+// asyncCaptureSink feeds a MessageCaptureSink from a dedicated goroutine so capturing never blocks the proxy
+type asyncCaptureSink struct {
+	sink     MessageCaptureSink
+	messages chan CapturedMessage
+	done     chan struct{} // Closed by stop, ending the goroutine feeding the sink
+	once     sync.Once
+}
+
+func newAsyncCaptureSink(sink MessageCaptureSink) *asyncCaptureSink {
+	s := &asyncCaptureSink{
+		sink:     sink,
+		messages: make(chan CapturedMessage, captureQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// capture enqueues a copy of a proxied message, dropping it when the buffer is full or the sink
+// has been replaced
+func (s *asyncCaptureSink) capture(pc *proxyConnection, direction string, messageType websocket.MessageType, message []byte) {
+	if s == nil {
+		return
+	}
+
+	msg := CapturedMessage{
+		ConnectionID: pc.id,
+		Endpoint:     pc.endpoint,
+		Direction:    direction,
+		Type:         messageType,
+		Payload:      append([]byte(nil), message...),
+		Time:         time.Now(),
+	}
+
+	select {
+	case <-s.done:
+	case s.messages <- msg:
+	default:
+	}
+}
+
+func (s *asyncCaptureSink) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.messages:
+			s.sink.Capture(msg)
+		}
+	}
+}
+
+// stop stops feeding the sink, the messages still buffered are dropped
+func (s *asyncCaptureSink) stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// MemoryCaptureSink keeps the most recent captured messages in memory
+type MemoryCaptureSink struct {
+	mu       sync.Mutex
+	capacity int
+	messages []CapturedMessage
+}
+
+// NewMemoryCaptureSink returns a sink retaining up to capacity messages (0 = unbounded)
+func NewMemoryCaptureSink(capacity int) *MemoryCaptureSink {
+	return &MemoryCaptureSink{capacity: capacity}
+}
+
+// Capture implements MessageCaptureSink
+func (s *MemoryCaptureSink) Capture(msg CapturedMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = append(s.messages, msg)
+	if s.capacity > 0 && len(s.messages) > s.capacity {
+		s.messages = s.messages[len(s.messages)-s.capacity:]
+	}
+}
+
+// Messages returns a snapshot of the retained messages, oldest first
+func (s *MemoryCaptureSink) Messages() []CapturedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CapturedMessage(nil), s.messages...)
+}
+
+// FileCaptureSink appends captured messages to a file, one JSON object per line.
+// Text payloads are written as strings, binary payloads base64 encoded.
+type FileCaptureSink struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+type fileCaptureRecord struct {
+	Time          time.Time `json:"time"`
+	ConnectionID  string    `json:"connection_id"`
+	Endpoint      string    `json:"endpoint"`
+	Direction     string    `json:"direction"`
+	Payload       string    `json:"payload,omitempty"`
+	PayloadBase64 []byte    `json:"payload_base64,omitempty"`
+}
+
+// NewFileCaptureSink opens, creating it if needed, the file captured messages are appended to
+func NewFileCaptureSink(path string) (*FileCaptureSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileCaptureSink{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// Capture implements MessageCaptureSink. Write errors are ignored, capturing is best-effort.
+func (s *FileCaptureSink) Capture(msg CapturedMessage) {
+	record := fileCaptureRecord{
+		Time:         msg.Time,
+		ConnectionID: msg.ConnectionID,
+		Endpoint:     msg.Endpoint,
+		Direction:    msg.Direction,
+	}
+	if msg.Type == websocket.MessageText {
+		record.Payload = string(msg.Payload)
+	} else {
+		record.PayloadBase64 = msg.Payload
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoder.Encode(record)
+}
+
+// Close closes the capture file
+func (s *FileCaptureSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,272 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+func newEchoBackend(t *testing.T) string {
+	t.Helper()
+
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			messageType, message, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if err := conn.Write(ctx, messageType, message); err != nil {
+				return
+			}
+		}
+	})
+
+	return backend.URL
+}
+
+func exchangeMessages(t *testing.T, client *websocket.Conn, messages ...string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for _, message := range messages {
+		if err := client.Write(ctx, websocket.MessageText, []byte(message)); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+		if _, _, err := client.Read(ctx); err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+	}
+}
+
+func TestSampleConnection(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if sampleConnection(0) {
+			t.Fatalf("a connection was sampled with rate 0")
+		}
+		if !sampleConnection(1) {
+			t.Fatalf("a connection was not sampled with rate 1")
+		}
+	}
+}
+
+func TestCaptureSampledConnection(t *testing.T) {
+	sink := NewMemoryCaptureSink(0)
+	factory := NewHandlerFactory(logging.NoOp)
+	factory.SetCaptureSink(sink)
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"capture_sample_rate": 1.0,
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	exchangeMessages(t, client, "first", "second")
+
+	var captured []CapturedMessage
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if captured = sink.Messages(); len(captured) == 4 {
+			break
+		}
+	}
+	if len(captured) != 4 {
+		t.Fatalf("captured %d messages, want 4: %v", len(captured), captured)
+	}
+
+	expected := []struct {
+		direction string
+		payload   string
+	}{
+		{directionClientToBackend, "first"},
+		{directionBackendToClient, "first"},
+		{directionClientToBackend, "second"},
+		{directionBackendToClient, "second"},
+	}
+	for i, msg := range captured {
+		if msg.Direction != expected[i].direction || string(msg.Payload) != expected[i].payload {
+			t.Errorf("captured message %d = %s %q, want %s %q", i, msg.Direction, msg.Payload, expected[i].direction, expected[i].payload)
+		}
+		if msg.Endpoint != "/ws" || msg.ConnectionID != captured[0].ConnectionID || msg.ConnectionID == "" {
+			t.Errorf("captured message %d has endpoint %q and connection %q", i, msg.Endpoint, msg.ConnectionID)
+		}
+	}
+}
+
+func TestCaptureUnsampledConnection(t *testing.T) {
+	sink := NewMemoryCaptureSink(0)
+	factory := NewHandlerFactory(logging.NoOp)
+	factory.SetCaptureSink(sink)
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	exchangeMessages(t, client, "hello")
+	time.Sleep(20 * time.Millisecond)
+
+	if captured := sink.Messages(); len(captured) != 0 {
+		t.Errorf("captured %d messages without sampling, want 0", len(captured))
+	}
+}
+
+type blockingCaptureSink struct {
+	release chan struct{}
+}
+
+func (s *blockingCaptureSink) Capture(msg CapturedMessage) {
+	<-s.release
+}
+
+func TestCaptureNeverBlocksProxy(t *testing.T) {
+	sink := &blockingCaptureSink{release: make(chan struct{})}
+	defer close(sink.release)
+
+	factory := NewHandlerFactory(logging.NoOp)
+	factory.SetCaptureSink(sink)
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"capture_sample_rate": 1.0,
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	// Overflow the capture buffer while the sink is stuck
+	messages := make([]string, captureQueueSize)
+	for i := range messages {
+		messages[i] = "message"
+	}
+	exchangeMessages(t, client, messages...)
+}
+
+func TestSetCaptureSinkStopsPreviousSink(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	first, second := NewMemoryCaptureSink(0), NewMemoryCaptureSink(0)
+
+	factory.SetCaptureSink(first)
+	previous := factory.currentCaptureSink()
+	factory.SetCaptureSink(second)
+
+	select {
+	case <-previous.done:
+	default:
+		t.Error("the sink replaced by SetCaptureSink is still fed")
+	}
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"capture_sample_rate": 1.0,
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+	exchangeMessages(t, client, "hello")
+
+	deadline := time.Now().Add(time.Second)
+	for len(second.Messages()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(second.Messages()); got != 2 {
+		t.Errorf("second sink captured %d messages, want 2", got)
+	}
+	if got := len(first.Messages()); got != 0 {
+		t.Errorf("replaced sink captured %d messages, want 0", got)
+	}
+
+	factory.SetCaptureSink(nil)
+	if factory.currentCaptureSink() != nil {
+		t.Error("a nil sink did not disable capturing")
+	}
+}
+
+func TestSetCaptureSinkDuringTraffic(t *testing.T) {
+	// Run with -race: the proxy loops read the sink while it is swapped
+	factory := NewHandlerFactory(logging.NoOp)
+	factory.SetCaptureSink(NewMemoryCaptureSink(0))
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"capture_sample_rate": 1.0,
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		for i := 0; i < 200; i++ {
+			if err := client.Write(ctx, websocket.MessageText, []byte("hello")); err != nil {
+				done <- err
+				return
+			}
+			if _, _, err := client.Read(ctx); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	last := NewMemoryCaptureSink(0)
+	for i := 0; i < 50; i++ {
+		factory.SetCaptureSink(NewMemoryCaptureSink(0))
+		factory.SetCaptureSink(nil)
+	}
+	factory.SetCaptureSink(last)
+	if err := <-done; err != nil {
+		t.Fatalf("traffic failed while the sink was swapped: %v", err)
+	}
+
+	exchangeMessages(t, client, "last")
+	deadline := time.Now().Add(time.Second)
+	for len(last.Messages()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(last.Messages()); got < 2 {
+		t.Errorf("last sink captured %d messages, want at least 2", got)
+	}
+}
+
+func TestFileCaptureSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	sink, err := NewFileCaptureSink(path)
+	if err != nil {
+		t.Fatalf("NewFileCaptureSink() failed: %v", err)
+	}
+
+	sink.Capture(CapturedMessage{ConnectionID: "c1", Endpoint: "/ws", Direction: directionClientToBackend, Type: websocket.MessageText, Payload: []byte("hello")})
+	sink.Capture(CapturedMessage{ConnectionID: "c1", Endpoint: "/ws", Direction: directionBackendToClient, Type: websocket.MessageBinary, Payload: []byte{0x00, 0xff}})
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open capture file: %v", err)
+	}
+	defer file.Close()
+
+	var records []fileCaptureRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record fileCaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid capture record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if records[0].Payload != "hello" || records[0].Direction != directionClientToBackend || records[0].ConnectionID != "c1" {
+		t.Errorf("text record = %+v", records[0])
+	}
+	if string(records[1].PayloadBase64) != "\x00\xff" || records[1].Payload != "" {
+		t.Errorf("binary record = %+v", records[1])
+	}
+}
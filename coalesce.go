@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// writeFunc forwards a single message to the destination of a proxy direction
+type writeFunc func(messageType websocket.MessageType, message []byte) error
+
+// messageCoalescer batches small text frames into a single JSON array frame
+//
+// A batch is flushed when the coalesce window expires (measured from the first
+// buffered frame), when it reaches maxBatch frames, when a non-text frame has to
+// be forwarded (to preserve ordering) or when the proxy direction stops.
+// Frames holding valid JSON are embedded as-is, any other payload is embedded as
+// a JSON string.
+type messageCoalescer struct {
+	mu       sync.Mutex
+	dest     writeFunc
+	window   time.Duration
+	maxBatch int
+	pending  []json.RawMessage
+	timer    *time.Timer
+	batch    uint64 // Incremented by every flush, so a timer outliving its batch is ignored
+	err      error
+}
+
+// newMessageCoalescer returns a coalescer writing batches to dest
+func newMessageCoalescer(dest writeFunc, window time.Duration, maxBatch int) *messageCoalescer {
+	return &messageCoalescer{
+		dest:     dest,
+		window:   window,
+		maxBatch: maxBatch,
+	}
+}
+
+// write buffers text frames and forwards any other frame after flushing the pending batch
+func (m *messageCoalescer) write(messageType websocket.MessageType, message []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Surface errors from flushes triggered by the window timer
+	if m.err != nil {
+		return m.err
+	}
+
+	if messageType != websocket.MessageText {
+		if err := m.flushLocked(); err != nil {
+			return err
+		}
+		return m.dest(messageType, message)
+	}
+
+	m.pending = append(m.pending, batchElement(message))
+
+	if m.maxBatch > 0 && len(m.pending) >= m.maxBatch {
+		return m.flushLocked()
+	}
+
+	if m.timer == nil {
+		batch := m.batch
+		m.timer = time.AfterFunc(m.window, func() { m.flushOnTimer(batch) })
+	}
+
+	return nil
+}
+
+// close stops the window timer and flushes whatever is still pending
+func (m *messageCoalescer) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	return m.flushLocked()
+}
+
+// flushOnTimer flushes batch when its window expires. The timer may have fired while a size or
+// ordering flush held the lock, the batch pending by then has its own window.
+func (m *messageCoalescer) flushOnTimer(batch uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err == nil && m.batch == batch {
+		m.err = m.flushLocked()
+	}
+}
+
+func (m *messageCoalescer) flushLocked() error {
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.batch++
+
+	if len(m.pending) == 0 {
+		return nil
+	}
+
+	batch, err := json.Marshal(m.pending)
+	m.pending = nil
+	if err != nil {
+		return err
+	}
+
+	return m.dest(websocket.MessageText, batch)
+}
+
+// batchElement returns the JSON representation of a text frame inside a batch
+func batchElement(message []byte) json.RawMessage {
+	if json.Valid(message) {
+		return append(json.RawMessage(nil), message...)
+	}
+
+	quoted, _ := json.Marshal(string(message))
+	return quoted
+}
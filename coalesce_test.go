@@ -0,0 +1,186 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+func TestParseWebSocketConfigCoalescing(t *testing.T) {
+	cfg, _ := parseWebSocketConfig(map[string]interface{}{
+		ConfigNamespace: map[string]interface{}{
+			"coalesce_window":    "50ms",
+			"coalesce_max_batch": 10.0,
+		},
+	})
+
+	if cfg.CoalesceWindow != 50*time.Millisecond {
+		t.Errorf("CoalesceWindow = %v, want %v", cfg.CoalesceWindow, 50*time.Millisecond)
+	}
+
+	if cfg.CoalesceMaxBatch != 10 {
+		t.Errorf("CoalesceMaxBatch = %v, want %v", cfg.CoalesceMaxBatch, 10)
+	}
+}
+
+func TestBatchElement(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		expected string
+	}{
+		{name: "json object", message: `{"cpu":0.5}`, expected: `{"cpu":0.5}`},
+		{name: "json number", message: `42`, expected: `42`},
+		{name: "plain text", message: `hello`, expected: `"hello"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(batchElement([]byte(tt.message))); got != tt.expected {
+				t.Errorf("batchElement(%q) = %s, want %s", tt.message, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   map[string]interface{}
+		frames   []string
+		expected [][]string
+	}{
+		{
+			name: "frames within window are batched",
+			config: map[string]interface{}{
+				"coalesce_window": "200ms",
+			},
+			frames:   []string{`{"n":1}`, `{"n":2}`, `{"n":3}`},
+			expected: [][]string{{`{"n":1}`, `{"n":2}`, `{"n":3}`}},
+		},
+		{
+			name: "batch is flushed when max batch is reached",
+			config: map[string]interface{}{
+				"coalesce_window":    "200ms",
+				"coalesce_max_batch": 2.0,
+			},
+			frames:   []string{`{"n":1}`, `{"n":2}`, `{"n":3}`},
+			expected: [][]string{{`{"n":1}`, `{"n":2}`}, {`{"n":3}`}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan []byte, 10)
+			backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+				for {
+					_, message, err := conn.Read(ctx)
+					if err != nil {
+						return
+					}
+					received <- message
+				}
+			})
+
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), tt.config, backend.URL)
+			client := dialTestGateway(t, gateway, nil)
+
+			for _, frame := range tt.frames {
+				if err := client.Write(context.Background(), websocket.MessageText, []byte(frame)); err != nil {
+					t.Fatalf("client write failed: %v", err)
+				}
+			}
+
+			for i, expected := range tt.expected {
+				select {
+				case message := <-received:
+					var batch []json.RawMessage
+					if err := json.Unmarshal(message, &batch); err != nil {
+						t.Fatalf("batch %d is not a JSON array: %s", i, message)
+					}
+					if len(batch) != len(expected) {
+						t.Fatalf("batch %d has %d frames, want %d: %s", i, len(batch), len(expected), message)
+					}
+					for j, frame := range expected {
+						if string(batch[j]) != frame {
+							t.Errorf("batch %d frame %d = %s, want %s", i, j, batch[j], frame)
+						}
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("timed out waiting for batch %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalescingFlushesBeforeBinaryFrames(t *testing.T) {
+	type frame struct {
+		messageType websocket.MessageType
+		payload     string
+	}
+
+	received := make(chan frame, 10)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			messageType, message, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			received <- frame{messageType, string(message)}
+		}
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"coalesce_window": "1s",
+	}, backend.URL)
+	client := dialTestGateway(t, gateway, nil)
+
+	client.Write(context.Background(), websocket.MessageText, []byte("first"))
+	client.Write(context.Background(), websocket.MessageBinary, []byte{0x01, 0x02})
+
+	expected := []frame{
+		{websocket.MessageText, `["first"]`},
+		{websocket.MessageBinary, "\x01\x02"},
+	}
+
+	for i, want := range expected {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("frame %d = %v, want %v", i, got, want)
+			}
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("timed out waiting for frame %d", i)
+		}
+	}
+}
+
+func TestCoalescingIgnoresTimerOfFlushedBatch(t *testing.T) {
+	var batches []string
+	coalescer := newMessageCoalescer(func(messageType websocket.MessageType, message []byte) error {
+		batches = append(batches, string(message))
+		return nil
+	}, time.Hour, 2)
+
+	coalescer.write(websocket.MessageText, []byte("first"))
+	coalescer.write(websocket.MessageText, []byte("second"))
+	coalescer.write(websocket.MessageText, []byte("third"))
+
+	// The timer of the first batch fired while its size flush held the lock
+	coalescer.flushOnTimer(0)
+
+	if len(batches) != 1 || batches[0] != `["first","second"]` {
+		t.Fatalf("batches = %q, want only the size flush", batches)
+	}
+
+	coalescer.close()
+	if len(batches) != 2 || batches[1] != `["third"]` {
+		t.Errorf("batches = %q, want the third frame flushed on close", batches)
+	}
+}
@@ -0,0 +1,247 @@
+package websocket
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes an active client connection
+type ConnInfo struct {
+	ID          string
+	Endpoint    string
+	Backend     string // Backend WebSocket URL, empty while the backend is being dialed
+	BackendName string // Resolved backend name, or the configured host for endpoint backends
+	ClientIP    string
+	StartedAt   time.Time
+	BytesIn     int64 // Message bytes received from the client
+	BytesOut    int64 // Message bytes sent to the client
+}
+
+// Stats is a snapshot of the activity of a HandlerFactory
+type Stats struct {
+	ActiveConnections  int
+	ProxyGoroutines    int
+	BackendConnections map[string]int // Active connections per resolved backend name
+}
+
+// Stats returns the current activity counters of the factory
+func (w *HandlerFactory) Stats() Stats {
+	w.connections.mu.Lock()
+	defer w.connections.mu.Unlock()
+
+	backends := make(map[string]int, len(w.connections.backends))
+	for name, count := range w.connections.backends {
+		backends[name] = count
+	}
+
+	return Stats{
+		ActiveConnections:  len(w.connections.connections),
+		ProxyGoroutines:    w.connections.goroutines,
+		BackendConnections: backends,
+	}
+}
+
+// goProxy runs fn in a goroutine counted in Stats and the proxy goroutines gauge
+func (w *HandlerFactory) goProxy(fn func()) {
+	w.trackProxyGoroutine(1)
+	go func() {
+		defer w.trackProxyGoroutine(-1)
+		fn()
+	}()
+}
+
+func (w *HandlerFactory) trackProxyGoroutine(delta int) {
+	w.connections.mu.Lock()
+	defer w.connections.mu.Unlock()
+
+	w.connections.goroutines += delta
+	w.metrics.setProxyGoroutines(w.connections.goroutines)
+	if w.connections.goroutines == 0 && w.connections.stopped != nil {
+		close(w.connections.stopped)
+		w.connections.stopped = nil
+	}
+}
+
+// ActiveConnections returns a snapshot of the currently active connections, oldest first
+func (w *HandlerFactory) ActiveConnections() []ConnInfo {
+	w.connections.mu.Lock()
+	infos := make([]ConnInfo, 0, len(w.connections.connections))
+	for _, pc := range w.connections.connections {
+		bytesIn, _ := pc.stats.bytes(directionClientToBackend)
+		bytesOut, _ := pc.stats.bytes(directionBackendToClient)
+		infos = append(infos, ConnInfo{
+			ID:          pc.id,
+			Endpoint:    pc.endpoint,
+			Backend:     pc.backend.url,
+			BackendName: pc.backend.name,
+			ClientIP:    pc.clientIP,
+			StartedAt:   pc.startedAt,
+			BytesIn:     bytesIn,
+			BytesOut:    bytesOut,
+		})
+	}
+	w.connections.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+
+	return infos
+}
+
+// connectionRegistry tracks the live client connections of a factory
+type connectionRegistry struct {
+	mu          sync.Mutex // Also guards the backend of the registered connections
+	connections map[string]*proxyConnection
+	drained     chan struct{}  // Closed once no connection is left, set by the first wait
+	goroutines  int            // Running proxy goroutines, a leak shows as a count that never drops
+	stopped     chan struct{}  // Closed once no proxy goroutine is left, set by the first waitGoroutines
+	backends    map[string]int // Connections per backend name, backends without connections are dropped
+	identities  map[string]int // Connections per endpoint and client identity, under max_connections_per_identity
+	closing     bool           // Set by shutdown, no connection is registered from then on
+}
+
+// add registers pc, unless the registry is shutting down
+func (r *connectionRegistry) add(pc *proxyConnection) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closing {
+		return false
+	}
+	if r.connections == nil {
+		r.connections = make(map[string]*proxyConnection)
+	}
+	r.connections[pc.id] = pc
+	return true
+}
+
+func (r *connectionRegistry) remove(pc *proxyConnection, metrics *Metrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.untrackBackend(pc, metrics)
+	delete(r.connections, pc.id)
+	if len(r.connections) == 0 && r.drained != nil {
+		close(r.drained)
+		r.drained = nil
+	}
+}
+
+// setBackend records the backend a connection was proxied to and counts it against that backend
+func (r *connectionRegistry) setBackend(pc *proxyConnection, target backendTarget, metrics *Metrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.untrackBackend(pc, metrics)
+	pc.backend = target
+
+	if r.backends == nil {
+		r.backends = make(map[string]int)
+	}
+	r.backends[target.name]++
+	metrics.setBackendConnections(target.name, r.backends[target.name])
+}
+
+// untrackBackend removes a connection from the count of its backend, if it has one yet
+func (r *connectionRegistry) untrackBackend(pc *proxyConnection, metrics *Metrics) {
+	if pc.backend.url == "" {
+		return
+	}
+
+	name := pc.backend.name
+	r.backends[name]--
+	metrics.setBackendConnections(name, r.backends[name])
+	if r.backends[name] <= 0 {
+		delete(r.backends, name)
+	}
+	pc.backend = backendTarget{}
+}
+
+// backendOf returns the backend a connection is proxied to
+func (r *connectionRegistry) backendOf(pc *proxyConnection) backendTarget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return pc.backend
+}
+
+// acquireIdentity counts a new connection against key, unless key already holds max of them
+func (r *connectionRegistry) acquireIdentity(key string, max int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.identities[key] >= max {
+		return false
+	}
+	if r.identities == nil {
+		r.identities = make(map[string]int)
+	}
+	r.identities[key]++
+	return true
+}
+
+// releaseIdentity gives back a connection acquired for key
+func (r *connectionRegistry) releaseIdentity(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.identities[key]--; r.identities[key] <= 0 {
+		delete(r.identities, key)
+	}
+}
+
+// snapshot returns the currently live connections
+func (r *connectionRegistry) snapshot() []*proxyConnection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	connections := make([]*proxyConnection, 0, len(r.connections))
+	for _, pc := range r.connections {
+		connections = append(connections, pc)
+	}
+	return connections
+}
+
+// shutdown stops registering connections and returns the live ones. Connections still upgrading
+// are refused by add, so none can be missed by the caller draining the snapshot.
+func (r *connectionRegistry) shutdown() []*proxyConnection {
+	r.mu.Lock()
+	r.closing = true
+	r.mu.Unlock()
+
+	return r.snapshot()
+}
+
+// wait returns a channel closed once every live connection is gone
+func (r *connectionRegistry) wait() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.connections) == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	if r.drained == nil {
+		r.drained = make(chan struct{})
+	}
+	return r.drained
+}
+
+// waitGoroutines returns a channel closed once every proxy goroutine has returned
+func (r *connectionRegistry) waitGoroutines() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.goroutines == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	if r.stopped == nil {
+		r.stopped = make(chan struct{})
+	}
+	return r.stopped
+}
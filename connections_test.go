@@ -0,0 +1,339 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+)
+
+func TestActiveConnections(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	backendURL := newEchoBackend(t)
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, backendURL)
+
+	if infos := factory.ActiveConnections(); len(infos) != 0 {
+		t.Fatalf("got %d active connections before any client, want 0", len(infos))
+	}
+
+	before := time.Now()
+	first := dialTestGateway(t, gateway, nil)
+	exchangeMessages(t, first, "hello")
+	second := dialTestGateway(t, gateway, nil)
+	exchangeMessages(t, second, "hi", "there")
+
+	infos := factory.ActiveConnections()
+	if len(infos) != 2 {
+		t.Fatalf("got %d active connections, want 2: %+v", len(infos), infos)
+	}
+
+	expectedBackend := "ws" + strings.TrimPrefix(backendURL, "http") + "/ws"
+	expectedBytes := []int64{int64(len("hello")), int64(len("hi") + len("there"))}
+
+	for i, info := range infos {
+		if info.ID == "" || info.Endpoint != "/ws" || info.Backend != expectedBackend || info.ClientIP != "127.0.0.1" {
+			t.Errorf("connection %d = %+v, want endpoint /ws, backend %s and client 127.0.0.1", i, info, expectedBackend)
+		}
+		if info.StartedAt.Before(before) || info.StartedAt.After(time.Now()) {
+			t.Errorf("connection %d started at %v, want after %v", i, info.StartedAt, before)
+		}
+		if info.BytesIn != expectedBytes[i] || info.BytesOut != expectedBytes[i] {
+			t.Errorf("connection %d transferred %d/%d bytes, want %d both ways", i, info.BytesIn, info.BytesOut, expectedBytes[i])
+		}
+	}
+	if infos[0].ID == infos[1].ID {
+		t.Errorf("both connections share the ID %s", infos[0].ID)
+	}
+
+	first.Close(websocket.StatusNormalClosure, "")
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if infos = factory.ActiveConnections(); len(infos) == 1 {
+			break
+		}
+	}
+	if len(infos) != 1 || infos[0].BytesIn != expectedBytes[1] {
+		t.Errorf("active connections after closing the first client = %+v, want only the second one", infos)
+	}
+}
+
+func TestProxyGoroutinesTracking(t *testing.T) {
+	metrics := NewMetrics()
+	factory := NewHandlerFactoryWithMetrics(logging.NoOp, metrics)
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, newEchoBackend(t))
+
+	waitFor := func(goroutines int) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if factory.Stats().ProxyGoroutines == goroutines {
+				break
+			}
+		}
+		if stats := factory.Stats(); stats.ProxyGoroutines != goroutines {
+			t.Fatalf("proxy goroutines = %d, want %d", stats.ProxyGoroutines, goroutines)
+		}
+		if got := testutil.ToFloat64(metrics.ProxyGoroutines); got != float64(goroutines) {
+			t.Fatalf("proxy goroutines gauge = %v, want %d", got, goroutines)
+		}
+	}
+
+	for round := 0; round < 3; round++ {
+		clients := []*websocket.Conn{
+			dialTestGateway(t, gateway, nil),
+			dialTestGateway(t, gateway, nil),
+		}
+		for _, client := range clients {
+			exchangeMessages(t, client, "hello")
+		}
+
+		waitFor(2 * len(clients))
+		if stats := factory.Stats(); stats.ActiveConnections != len(clients) {
+			t.Errorf("active connections = %d, want %d", stats.ActiveConnections, len(clients))
+		}
+
+		for _, client := range clients {
+			client.Close(websocket.StatusNormalClosure, "")
+		}
+		waitFor(0)
+	}
+}
+
+func TestProxyGoroutinesTrackingPings(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"ping_interval": "1h",
+	}, newEchoBackend(t))
+
+	waitFor := func(goroutines int) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if factory.Stats().ProxyGoroutines == goroutines {
+				return
+			}
+		}
+		t.Fatalf("proxy goroutines = %d, want %d", factory.Stats().ProxyGoroutines, goroutines)
+	}
+
+	// Both proxy directions and the pinger
+	client := dialTestGateway(t, gateway, nil)
+	exchangeMessages(t, client, "hello")
+	waitFor(3)
+
+	client.Close(websocket.StatusNormalClosure, "")
+	waitFor(0)
+}
+
+func TestBackendConnectionCounts(t *testing.T) {
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"chat": "ws" + strings.TrimPrefix(newEchoBackend(t), "http"),
+		"game": "ws" + strings.TrimPrefix(newEchoBackend(t), "http"),
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	metrics := NewMetrics()
+	factory := NewHandlerFactoryWithMetrics(logging.NoOp, metrics)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	endpointConfig := &config.EndpointConfig{
+		Endpoint: "/ws/*path",
+		Method:   http.MethodGet,
+		Backend: []*config.Backend{
+			{
+				Host:       []string{newEchoBackend(t)},
+				URLPattern: "/ws",
+			},
+		},
+		ExtraConfig: config.ExtraConfig{
+			ConfigNamespace: map[string]interface{}{
+				"path_prefix_backends": map[string]interface{}{
+					"/ws/chat/": "chat",
+					"/ws/game/": "game",
+				},
+			},
+		},
+	}
+	standardHandlerFactory := func(*config.EndpointConfig, proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		}
+	}
+	engine.GET("/ws/*path", factory.HandlerWrapper(standardHandlerFactory)(endpointConfig, dummyProxy))
+
+	gateway := httptest.NewServer(engine)
+	t.Cleanup(gateway.Close)
+
+	dial := func(path string) *websocket.Conn {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, _, err := websocket.Dial(ctx, gateway.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to dial gateway: %v", err)
+		}
+		t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+
+		// A first round trip guarantees the backend is connected
+		exchangeMessages(t, conn, "hello")
+		return conn
+	}
+
+	assertCounts := func(expected map[string]int) {
+		t.Helper()
+		var stats Stats
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if stats = factory.Stats(); reflect.DeepEqual(stats.BackendConnections, expected) {
+				break
+			}
+		}
+		if !reflect.DeepEqual(stats.BackendConnections, expected) {
+			t.Fatalf("backend connections = %v, want %v", stats.BackendConnections, expected)
+		}
+		for backend, count := range expected {
+			if got := testutil.ToFloat64(metrics.BackendConnections.WithLabelValues(backend)); got != float64(count) {
+				t.Errorf("backend connections gauge for %s = %v, want %d", backend, got, count)
+			}
+		}
+	}
+
+	firstChat := dial("/ws/chat/room-1")
+	dial("/ws/chat/room-2")
+	dial("/ws/game/lobby")
+	assertCounts(map[string]int{"chat": 2, "game": 1})
+
+	for _, info := range factory.ActiveConnections() {
+		if info.BackendName != "chat" && info.BackendName != "game" {
+			t.Errorf("connection %s backend name = %q, want chat or game", info.ID, info.BackendName)
+		}
+	}
+
+	firstChat.Close(websocket.StatusNormalClosure, "")
+	assertCounts(map[string]int{"chat": 1, "game": 1})
+}
+
+func TestMaxConnectionsPerIdentity(t *testing.T) {
+	metrics := NewMetrics()
+	gateway := newTestGateway(t, NewHandlerFactoryWithMetrics(logging.NoOp, metrics), map[string]interface{}{
+		"max_connections_per_identity": float64(2),
+	}, newEchoBackend(t))
+
+	dial := func(user string) (*websocket.Conn, int) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", &websocket.DialOptions{
+			HTTPHeader: http.Header{"X-User-Id": []string{user}},
+		})
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("failed to dial gateway: %v", err)
+			}
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+		return conn, resp.StatusCode
+	}
+
+	first, _ := dial("42")
+	second, _ := dial("42")
+	exchangeMessages(t, first, "hello")
+	exchangeMessages(t, second, "hello")
+
+	if _, status := dial("42"); status != http.StatusTooManyRequests {
+		t.Fatalf("third connection of user 42 got status %d, want %d", status, http.StatusTooManyRequests)
+	}
+	if got := testutil.ToFloat64(metrics.UpgradeRejections.WithLabelValues("/ws", rejectionIdentityLimit)); got != 1 {
+		t.Errorf("ws_upgrade_rejections_total{reason=%q} = %v, want 1", rejectionIdentityLimit, got)
+	}
+	if other, status := dial("7"); other == nil {
+		t.Fatalf("connection of another user got status %d, want an upgrade", status)
+	}
+
+	// Closing a connection frees a slot for the user
+	first.Close(websocket.StatusNormalClosure, "")
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, status := dial("42")
+		if conn != nil {
+			exchangeMessages(t, conn, "hello again")
+			break
+		}
+		if status != http.StatusTooManyRequests || time.Now().After(deadline) {
+			t.Fatalf("connection of user 42 after a close got status %d, want an upgrade", status)
+		}
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	factory := NewHandlerFactoryWithConfig(logging.NoOp, config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{
+			"websocket_backends": map[string]interface{}{
+				"max_connections": float64(2),
+			},
+		},
+	})
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, newEchoBackend(t))
+	unreachableGateway := newTestGateway(t, factory, map[string]interface{}{}, "http://127.0.0.1:1")
+
+	dial := func(gateway *httptest.Server) (*websocket.Conn, *http.Response) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", nil)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("failed to dial gateway: %v", err)
+			}
+			return nil, resp
+		}
+		t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+		return conn, resp
+	}
+
+	first, _ := dial(gateway)
+	second, _ := dial(gateway)
+	exchangeMessages(t, first, "hello")
+	exchangeMessages(t, second, "hello")
+
+	conn, resp := dial(gateway)
+	if conn != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("third connection got status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("rejected upgrade has no Retry-After header")
+	}
+
+	// Slots are given back when a connection ends, also when its backend cannot be dialed
+	waitForSlot := func(gateway *httptest.Server) *websocket.Conn {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			conn, resp := dial(gateway)
+			if conn != nil {
+				return conn
+			}
+			if resp.StatusCode != http.StatusServiceUnavailable || time.Now().After(deadline) {
+				t.Fatalf("connection after a close got status %d, want an upgrade", resp.StatusCode)
+			}
+		}
+	}
+
+	first.Close(websocket.StatusNormalClosure, "")
+	failed := waitForSlot(unreachableGateway)
+	if _, _, err := failed.Read(context.Background()); websocket.CloseStatus(err) != websocket.StatusInternalError {
+		t.Fatalf("connection to an unreachable backend read %v, want a close with %v", err, websocket.StatusInternalError)
+	}
+	exchangeMessages(t, waitForSlot(gateway), "hello again")
+}
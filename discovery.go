@@ -0,0 +1,85 @@
+package websocket
+
+import (
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/sd"
+)
+
+// defaultDiscoveryProvider is the SD provider of backends not naming one, as in lura backends
+const defaultDiscoveryProvider = "static"
+
+// discoveredBackend resolves the hosts of a named backend through the lura SD register
+type discoveredBackend struct {
+	subscriber sd.Subscriber
+	balancer   sd.Balancer
+}
+
+// parseDiscoveryConfig reads a websocket_backends entry such as {"sd": "dns", "host": [...]} into
+// the backend configuration handed to the SD provider
+func parseDiscoveryConfig(entry map[string]interface{}) *config.Backend {
+	backend := &config.Backend{SD: defaultDiscoveryProvider}
+	if provider, ok := entry["sd"].(string); ok && provider != "" {
+		backend.SD = provider
+	}
+	if hosts, ok := entry["host"].([]interface{}); ok {
+		for _, host := range hosts {
+			if hostStr, ok := host.(string); ok {
+				backend.Host = append(backend.Host, hostStr)
+			}
+		}
+	}
+	return backend
+}
+
+// discoveryConfig returns the SD configuration of backendName in the backend registry
+func discoveryConfig(backendName string) (*config.Backend, bool) {
+	if globalBackendRegistry == nil {
+		return nil, false
+	}
+	backend, ok := globalBackendRegistry.Discovery[backendName]
+	return backend, ok && backend != nil
+}
+
+// discoveredBackend returns the SD resolution of backendName, created on first use with the
+// subscriber factory of its SD provider, or nil when the backend has no SD configuration
+func (w *HandlerFactory) discoveredBackend(backendName string) *discoveredBackend {
+	if d, ok := w.discoveredBackends.Load(backendName); ok {
+		return d.(*discoveredBackend)
+	}
+
+	backend, ok := discoveryConfig(backendName)
+	if !ok || len(backend.Host) == 0 {
+		return nil
+	}
+
+	subscriber := sd.GetRegister().Get(backend.SD)(backend)
+	d, _ := w.discoveredBackends.LoadOrStore(backendName, &discoveredBackend{
+		subscriber: subscriber,
+		balancer:   sd.NewBalancer(subscriber),
+	})
+	return d.(*discoveredBackend)
+}
+
+// discoveredHost picks a host of backendName with the lura balancer, the way HTTP backends are
+// balanced. It reports false when SD has no host for the name.
+func (w *HandlerFactory) discoveredHost(backendName string) (string, bool) {
+	d := w.discoveredBackend(backendName)
+	if d == nil {
+		return "", false
+	}
+	host, err := d.balancer.Host()
+	if err != nil || host == "" {
+		return "", false
+	}
+	return host, true
+}
+
+// isDiscovered reports whether SD has hosts for backendName
+func (w *HandlerFactory) isDiscovered(backendName string) bool {
+	d := w.discoveredBackend(backendName)
+	if d == nil {
+		return false
+	}
+	hosts, err := d.subscriber.Hosts()
+	return err == nil && len(hosts) > 0
+}
@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/sd/dnssrv"
+)
+
+func TestInitializeBackendRegistryDiscovery(t *testing.T) {
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = nil
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	InitializeBackendRegistry(config.ServiceConfig{ExtraConfig: config.ExtraConfig{
+		"websocket_backends": map[string]interface{}{
+			"backends": map[string]interface{}{
+				"registered": "ws://registry:1",
+				"static":     map[string]interface{}{"host": []interface{}{"http://10.0.0.1:8080"}},
+				"dns":        map[string]interface{}{"sd": "dns", "host": []interface{}{"_chat._tcp.service.consul"}},
+			},
+		},
+	}})
+
+	if got := globalBackendRegistry.Backends["registered"]; got != "ws://registry:1" {
+		t.Errorf("registered backend URL = %q, want ws://registry:1", got)
+	}
+	if got := globalBackendRegistry.Discovery["static"]; got == nil || got.SD != "static" || strings.Join(got.Host, ",") != "http://10.0.0.1:8080" {
+		t.Errorf("static backend = %+v, want the static provider with its host", got)
+	}
+	if got := globalBackendRegistry.Discovery["dns"]; got == nil || got.SD != "dns" || strings.Join(got.Host, ",") != "_chat._tcp.service.consul" {
+		t.Errorf("dns backend = %+v, want the dns provider with its SRV name", got)
+	}
+}
+
+func TestDeriveWebSocketURLServiceDiscovery(t *testing.T) {
+	// The dns provider is registered the way KrakenD does, resolving SRV names with a fake lookup
+	previousLookup := dnssrv.DefaultLookup
+	dnssrv.DefaultLookup = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_chat._tcp.service.consul" {
+			return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return "", []*net.SRV{{Target: "10.0.0.3", Port: 9000, Weight: 1}}, nil
+	}
+	t.Cleanup(func() { dnssrv.DefaultLookup = previousLookup })
+	dnssrv.Register()
+
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{
+		Backends: map[string]string{
+			"registered-chat": "ws://registry:2",
+		},
+		Discovery: map[string]*config.Backend{
+			"static-chat":  {SD: "static", Host: []string{"http://10.0.0.1:8080", "https://10.0.0.2:8443"}},
+			"dns-chat":     {SD: "dns", Host: []string{"_chat._tcp.service.consul"}},
+			"missing-chat": {SD: "dns", Host: []string{"_missing._tcp.service.consul"}},
+		},
+	}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	factory := NewHandlerFactory(logging.NoOp)
+
+	t.Run("static", func(t *testing.T) {
+		// Every host is picked in turn by the balancer
+		seen := map[string]bool{}
+		for i := 0; i < 100 && len(seen) < 2; i++ {
+			wsURL, err := factory.deriveWebSocketURL("static-chat", "/ws", "")
+			if err != nil {
+				t.Fatalf("deriveWebSocketURL() error = %v", err)
+			}
+			seen[wsURL] = true
+		}
+
+		var urls []string
+		for wsURL := range seen {
+			urls = append(urls, wsURL)
+		}
+		sort.Strings(urls)
+		if got := strings.Join(urls, ","); got != "ws://10.0.0.1:8080/ws,wss://10.0.0.2:8443/ws" {
+			t.Errorf("derived URLs = %s, want both static hosts", got)
+		}
+		if !factory.isKnownBackend("static-chat") {
+			t.Errorf("static backend is not known")
+		}
+	})
+
+	t.Run("dns", func(t *testing.T) {
+		wsURL, err := factory.deriveWebSocketURL("dns-chat", "/ws", "")
+		if err != nil || wsURL != "ws://10.0.0.3:9000/ws" {
+			t.Errorf("deriveWebSocketURL() = %q, %v, want the SRV target", wsURL, err)
+		}
+	})
+
+	t.Run("no discovered host", func(t *testing.T) {
+		if wsURL, err := factory.deriveWebSocketURL("missing-chat", "/ws", ""); err == nil {
+			t.Errorf("deriveWebSocketURL() = %q, want an error for a name SD resolves to no host", wsURL)
+		}
+		if factory.isKnownBackend("missing-chat") {
+			t.Errorf("backend without discovered hosts is known")
+		}
+	})
+
+	t.Run("registry fallback", func(t *testing.T) {
+		wsURL, err := factory.deriveWebSocketURL("registered-chat", "/ws", "")
+		if err != nil || wsURL != "ws://registry:2/ws" {
+			t.Errorf("deriveWebSocketURL() = %q, %v, want the registry URL", wsURL, err)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if wsURL, err := factory.deriveWebSocketURL("unknown-chat", "/ws", ""); err == nil {
+			t.Errorf("deriveWebSocketURL() = %q, want an error for a backend known nowhere", wsURL)
+		}
+		if factory.isKnownBackend("unknown-chat") {
+			t.Errorf("unknown backend is known")
+		}
+	})
+}
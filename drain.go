@@ -0,0 +1,109 @@
+package websocket
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// Shutdown closes every live connection with StatusGoingAway and waits for their proxies
+// to stop. It returns ctx.Err() when ctx is done before every connection is gone.
+// Connections of endpoints with drain_quiesce_window are only closed once no message flowed
+// for the window, or when ctx is done. Upgrade requests received from then on are rejected
+// with HTTP 503, and the ones already past that check are closed with StatusGoingAway as
+// soon as they are accepted.
+func (w *HandlerFactory) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&w.draining, 1)
+
+	connections := w.connections.shutdown()
+	w.logger.Info("Shutting down WebSocket proxy, closing", len(connections), "connection(s)")
+
+	for _, pc := range connections {
+		go drainConnection(ctx, pc)
+	}
+
+	for _, done := range []<-chan struct{}{w.connections.wait(), w.connections.waitGoroutines()} {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// shutdownReason is the close reason of the connections closed by Shutdown
+const shutdownReason = "Server shutting down"
+
+// drainConnection closes pc with StatusGoingAway once it has been quiet for its drain_quiesce_window,
+// so that the message exchange in progress is not cut short, or when ctx is done
+func drainConnection(ctx context.Context, pc *proxyConnection) {
+	for pc.quiesce > 0 {
+		wait := pc.quiesce - time.Since(time.Unix(0, atomic.LoadInt64(&pc.lastSeen)))
+		if wait <= 0 {
+			break
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			pc.closeClient(websocket.StatusGoingAway, shutdownReason)
+			return
+		case <-timer.C:
+		}
+	}
+	pc.closeClient(websocket.StatusGoingAway, shutdownReason)
+}
+
+// markActive records a message of pc read or written now
+func (pc *proxyConnection) markActive() {
+	atomic.StoreInt64(&pc.lastSeen, time.Now().UnixNano())
+}
+
+// isDraining reports whether Shutdown was called
+func (w *HandlerFactory) isDraining() bool {
+	return atomic.LoadInt32(&w.draining) == 1
+}
+
+// Drainer is implemented by HandlerFactory
+type Drainer interface {
+	Shutdown(ctx context.Context) error
+}
+
+// RegisterSignalDrain shuts d down, giving its connections up to grace to close, when the
+// process receives one of signals (SIGTERM and os.Interrupt when none are given).
+// The result of Shutdown is delivered on the returned channel. Registering a signal stops
+// it from terminating the process: the embedder remains in charge of exiting.
+func RegisterSignalDrain(d Drainer, grace time.Duration, signals ...os.Signal) <-chan error {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, signals...)
+
+	return drainOnSignal(d, grace, sigs, func() { signal.Stop(sigs) })
+}
+
+// drainOnSignal calls Shutdown with a grace deadline on the first signal received from sigs
+func drainOnSignal(d Drainer, grace time.Duration, sigs <-chan os.Signal, stop func()) <-chan error {
+	result := make(chan error, 1)
+
+	go func() {
+		<-sigs
+		stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+
+		result <- d.Shutdown(ctx)
+	}()
+
+	return result
+}
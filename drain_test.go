@@ -0,0 +1,257 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/logging"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+)
+
+func TestShutdownClosesConnections(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, newEchoBackend(t))
+
+	clients := []*websocket.Conn{
+		dialTestGateway(t, gateway, nil),
+		dialTestGateway(t, gateway, nil),
+	}
+	for _, client := range clients {
+		exchangeMessages(t, client, "hello")
+	}
+
+	closed := make(chan websocket.StatusCode, len(clients))
+	for _, client := range clients {
+		go func(client *websocket.Conn) {
+			_, _, err := client.Read(context.Background())
+			closed <- websocket.CloseStatus(err)
+		}(client)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := factory.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v, want nil", err)
+	}
+
+	for range clients {
+		if code := <-closed; code != websocket.StatusGoingAway {
+			t.Errorf("client closed with status %v, want %v", code, websocket.StatusGoingAway)
+		}
+	}
+
+	if remaining := factory.connections.snapshot(); len(remaining) != 0 {
+		t.Errorf("%d connections still tracked after Shutdown", len(remaining))
+	}
+}
+
+func TestShutdownRejectsUpgrades(t *testing.T) {
+	metrics := NewMetrics()
+	factory := NewHandlerFactoryWithMetrics(logging.NoOp, metrics)
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+	exchangeMessages(t, client, "hello")
+	go client.Read(context.Background()) // Completes the close handshake
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := factory.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v, want nil", err)
+	}
+	if goroutines := factory.Stats().ProxyGoroutines; goroutines != 0 {
+		t.Errorf("%d proxy goroutines still running after Shutdown", goroutines)
+	}
+
+	_, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("upgrade after Shutdown = %v, %v, want HTTP %d", resp, err, http.StatusServiceUnavailable)
+	}
+	if got := testutil.ToFloat64(metrics.UpgradeRejections.WithLabelValues("/ws", rejectionShuttingDown)); got != 1 {
+		t.Errorf("shutting_down rejections = %v, want 1", got)
+	}
+
+	// Plain HTTP requests are still served while draining
+	resp, err = http.Get(gateway.URL + "/ws")
+	if err != nil {
+		t.Fatalf("plain HTTP request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("plain HTTP status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestShutdownDuringUpgrade(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+
+	// Shutdown runs once the upgrade is past the draining check, before the connection is registered
+	factory.SetAcceptOptionsFunc(func(c *gin.Context, opts websocket.AcceptOptions) websocket.AcceptOptions {
+		if err := factory.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown() = %v, want nil", err)
+		}
+		return opts
+	})
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, _, err := client.Read(ctx)
+	if code := websocket.CloseStatus(err); code != websocket.StatusGoingAway {
+		t.Errorf("client closed with %v, want %v", err, websocket.StatusGoingAway)
+	}
+	if remaining := factory.connections.snapshot(); len(remaining) != 0 {
+		t.Errorf("%d connections tracked after Shutdown", len(remaining))
+	}
+}
+
+func TestShutdownWithoutConnections(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := NewHandlerFactory(logging.NoOp).Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() = %v, want nil", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, newEchoBackend(t))
+
+	// The client never reads, so it never completes the close handshake
+	client := dialTestGateway(t, gateway, nil)
+	exchangeMessages(t, client, "hello")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := factory.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestShutdownQuiesceWindow(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"drain_quiesce_window": "300ms",
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- factory.Shutdown(ctx) }()
+
+	// The connection is left open while messages keep flowing
+	for i := 0; i < 5; i++ {
+		exchangeMessages(t, client, "tick")
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	quietSince := time.Now()
+	_, _, err := client.Read(ctx)
+	if code := websocket.CloseStatus(err); code != websocket.StatusGoingAway {
+		t.Fatalf("client read = %v, want a close with %v", err, websocket.StatusGoingAway)
+	}
+	if quiet := time.Since(quietSince); quiet < 150*time.Millisecond {
+		t.Errorf("connection closed after %s of quiet, want it idle for the window first", quiet)
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() = %v, want nil", err)
+	}
+}
+
+func TestShutdownQuiesceWindowDeadline(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"drain_quiesce_window": "1s",
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	go factory.Shutdown(ctx)
+
+	// A connection that never goes quiet is closed when the grace expires
+	readCtx, readCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer readCancel()
+	start := time.Now()
+	for {
+		if err := client.Write(readCtx, websocket.MessageText, []byte("tick")); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+		_, _, err := client.Read(readCtx)
+		if err == nil {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		if code := websocket.CloseStatus(err); code != websocket.StatusGoingAway {
+			t.Fatalf("client read = %v, want a close with %v", err, websocket.StatusGoingAway)
+		}
+		break
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection closed after %s, want it closed when the 300ms grace expired", elapsed)
+	}
+}
+
+type recordingDrainer struct {
+	deadlines chan time.Duration
+}
+
+func (d *recordingDrainer) Shutdown(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		d.deadlines <- 0
+		return nil
+	}
+	d.deadlines <- time.Until(deadline)
+	return nil
+}
+
+func TestDrainOnSignal(t *testing.T) {
+	drainer := &recordingDrainer{deadlines: make(chan time.Duration, 1)}
+	sigs := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+
+	grace := 30 * time.Second
+	result := drainOnSignal(drainer, grace, sigs, func() { close(stopped) })
+
+	select {
+	case <-drainer.deadlines:
+		t.Fatalf("Shutdown was called before any signal")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	sigs <- os.Interrupt
+
+	select {
+	case remaining := <-drainer.deadlines:
+		if remaining <= 0 || remaining > grace || remaining < grace-time.Second {
+			t.Errorf("Shutdown deadline in %v, want about %v", remaining, grace)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Shutdown was not called after the signal")
+	}
+
+	if err := <-result; err != nil {
+		t.Errorf("drain result = %v, want nil", err)
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Errorf("signal notifications were not stopped")
+	}
+}
@@ -0,0 +1,35 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Connection events written under event_log
+const (
+	eventConnectionOpened = "connection_opened"
+	eventConnectionClosed = "connection_closed"
+)
+
+// Event log fields added to the access log fields. Keys and value types are stable.
+const (
+	eventLogEvent    = "event"     // string, one of the event constants
+	eventLogTime     = "time"      // string, RFC 3339 with nanoseconds
+	eventLogClosedBy = "closed_by" // string, side that ended the connection, empty on open
+)
+
+// logConnectionEvent writes event as a single-line JSON object at info level. Both events carry the
+// same keys, the traffic and close fields of an opened connection being zero.
+func (w *HandlerFactory) logConnectionEvent(event string, pc *proxyConnection, backend backendTarget, duration time.Duration) {
+	fields := accessLogFields(pc, backend, duration)
+	fields[eventLogEvent] = event
+	fields[eventLogTime] = time.Now().UTC().Format(time.RFC3339Nano)
+	fields[eventLogClosedBy] = pc.closedBy
+
+	line, err := json.Marshal(fields)
+	if err != nil {
+		w.logger.Error("Failed to encode the connection event:", err)
+		return
+	}
+	w.logger.Info(string(line))
+}
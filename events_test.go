@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// connectionEvents decodes the event log lines recorded by logger
+func connectionEvents(t *testing.T, logger *testLogger) []map[string]interface{} {
+	t.Helper()
+
+	var events []map[string]interface{}
+	for _, line := range logger.Contains(`"event":`) {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO: ")), &event); err != nil {
+			t.Fatalf("event line %q is not a JSON object: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// waitForAccessLog waits for the access log line written once the connection is closed
+func waitForAccessLog(t *testing.T, logger *testLogger) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if len(logger.Contains("Connection closed duration=")) > 0 {
+			return
+		}
+	}
+	t.Fatalf("access log not written: %v", logger.Lines())
+}
+
+func TestEventLog(t *testing.T) {
+	backend := newEchoBackend(t)
+
+	t.Run("disabled", func(t *testing.T) {
+		logger := &testLogger{}
+		gateway := newTestGateway(t, NewHandlerFactory(logger), map[string]interface{}{}, backend)
+
+		client := dialTestGateway(t, gateway, nil)
+		exchangeMessages(t, client, "hello")
+		client.Close(websocket.StatusNormalClosure, "")
+		waitForAccessLog(t, logger)
+
+		if events := connectionEvents(t, logger); len(events) != 0 {
+			t.Fatalf("events = %v, want none without event_log", events)
+		}
+	})
+
+	t.Run("open and close", func(t *testing.T) {
+		logger := &testLogger{}
+		gateway := newTestGateway(t, NewHandlerFactory(logger), map[string]interface{}{
+			"event_log": true,
+		}, backend)
+
+		client := dialTestGateway(t, gateway, nil)
+		exchangeMessages(t, client, "hello")
+		client.Close(websocket.StatusNormalClosure, "")
+		waitForAccessLog(t, logger)
+
+		events := connectionEvents(t, logger)
+		if len(events) != 2 {
+			t.Fatalf("events = %v, want an open and a close event", events)
+		}
+		opened, closed := events[0], events[1]
+
+		keys := []string{"event", "time", "conn_id", "endpoint", "backend", "client_ip", "duration_ms", "bytes_up", "bytes_down", "close_code", "closed_by"}
+		for _, event := range events {
+			if len(event) != len(keys) {
+				t.Errorf("event %v has %d fields, want %d", event, len(event), len(keys))
+			}
+			for _, key := range keys {
+				if _, ok := event[key]; !ok {
+					t.Errorf("event %v lacks %q", event, key)
+				}
+			}
+			if _, err := time.Parse(time.RFC3339Nano, event["time"].(string)); err != nil {
+				t.Errorf("event time %v: %v", event["time"], err)
+			}
+		}
+
+		if opened["event"] != eventConnectionOpened || closed["event"] != eventConnectionClosed {
+			t.Errorf("events = %v, %v, want %s then %s", opened["event"], closed["event"], eventConnectionOpened, eventConnectionClosed)
+		}
+		if opened["conn_id"] == "" || opened["conn_id"] != closed["conn_id"] {
+			t.Errorf("conn_id = %v then %v, want the same connection ID", opened["conn_id"], closed["conn_id"])
+		}
+		if closed["endpoint"] != "/ws" || !strings.HasPrefix(closed["backend"].(string), "ws") {
+			t.Errorf("closed endpoint, backend = %v, %v, want /ws and the dialed URL", closed["endpoint"], closed["backend"])
+		}
+		if closed["bytes_up"] != float64(5) || closed["bytes_down"] != float64(5) {
+			t.Errorf("closed bytes = %v up, %v down, want 5 each way", closed["bytes_up"], closed["bytes_down"])
+		}
+		if closed["close_code"] != float64(websocket.StatusNormalClosure) || closed["closed_by"] != initiatorClient {
+			t.Errorf("closed close_code, closed_by = %v, %v, want %d by the client", closed["close_code"], closed["closed_by"], websocket.StatusNormalClosure)
+		}
+	})
+}
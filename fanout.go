@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+// fanoutQueueSize is the number of client messages buffered per fan-out backend. A backend letting
+// more pile up is dropped, so a slow sink never holds back the client.
+const fanoutQueueSize = 64
+
+// Close reasons sent to the fan-out backends dropped from a connection
+const (
+	fanoutQueueFullReason = "Fan-out queue full"
+	fanoutFailedReason    = "Fan-out backend failed"
+)
+
+// fanoutMessage is a client message copied to a fan-out backend
+type fanoutMessage struct {
+	messageType websocket.MessageType
+	message     []byte
+}
+
+// fanoutBackend is a secondary backend receiving a copy of the client messages
+type fanoutBackend struct {
+	name     string
+	conn     *websocket.Conn
+	messages chan fanoutMessage
+	dropped  chan struct{} // Closed once the backend is dropped from the connection
+	once     sync.Once
+}
+
+// fanoutWriter writes the client messages to the primary backend, then hands a copy to every
+// fan-out backend attached so far. Fan-out backends failing or falling behind are dropped, the
+// primary backend alone decides the fate of the connection. Their messages are read and discarded.
+type fanoutWriter struct {
+	ctx          context.Context
+	primary      *reconnectableBackend
+	logger       logging.Logger
+	closeTimeout time.Duration
+	spawn        func(fn func()) // Starts the goroutines of the secondaries, counted like the proxy ones
+
+	mu          sync.Mutex
+	secondaries []*fanoutBackend
+	closed      bool // Set by close, the secondaries attached later are closed at once
+}
+
+// newFanoutWriter returns a writer copying the client messages to the secondaries attached to it,
+// until ctx is done
+func newFanoutWriter(ctx context.Context, primary *reconnectableBackend, logger logging.Logger, closeTimeout time.Duration, spawn func(fn func())) *fanoutWriter {
+	return &fanoutWriter{
+		ctx:          ctx,
+		primary:      primary,
+		logger:       logger,
+		closeTimeout: closeTimeout,
+		spawn:        spawn,
+	}
+}
+
+// attach starts copying the next client messages to b
+func (f *fanoutWriter) attach(b *fanoutBackend) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		closeWithin(b.conn, nil, f.closeTimeout, websocket.StatusNormalClosure, "Connection closed")
+		return
+	}
+	f.secondaries = append(f.secondaries, b)
+	f.mu.Unlock()
+
+	f.spawn(func() { f.write(f.ctx, b) })
+	f.spawn(func() { f.discard(f.ctx, b) })
+}
+
+// Write writes to the primary backend and queues a copy of the message for the secondaries
+func (f *fanoutWriter) Write(ctx context.Context, messageType websocket.MessageType, message []byte) error {
+	if err := f.primary.Write(ctx, messageType, message); err != nil {
+		return err
+	}
+
+	// The message may be a pooled buffer, reused once Write returns
+	f.mu.Lock()
+	secondaries := f.secondaries
+	f.mu.Unlock()
+	if len(secondaries) == 0 {
+		return nil
+	}
+
+	copied := fanoutMessage{messageType: messageType, message: append([]byte(nil), message...)}
+	for _, b := range secondaries {
+		select {
+		case <-b.dropped:
+			continue
+		default:
+		}
+
+		select {
+		case b.messages <- copied:
+		default:
+			f.drop(b, websocket.StatusPolicyViolation, fanoutQueueFullReason, fmt.Errorf("%d messages pending", fanoutQueueSize))
+		}
+	}
+	return nil
+}
+
+// write writes the messages queued for b until it is dropped
+func (f *fanoutWriter) write(ctx context.Context, b *fanoutBackend) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.dropped:
+			return
+		case m := <-b.messages:
+			if err := b.conn.Write(ctx, m.messageType, m.message); err != nil {
+				f.drop(b, websocket.StatusInternalError, fanoutFailedReason, err)
+				return
+			}
+		}
+	}
+}
+
+// discard reads and discards the messages of b, which also answers its pings and close frame
+func (f *fanoutWriter) discard(ctx context.Context, b *fanoutBackend) {
+	for {
+		if _, _, err := b.conn.Read(ctx); err != nil {
+			if ctx.Err() == nil {
+				f.drop(b, websocket.StatusInternalError, fanoutFailedReason, err)
+			}
+			return
+		}
+	}
+}
+
+// drop closes b and stops copying the client messages to it. The connection carries on.
+func (f *fanoutWriter) drop(b *fanoutBackend, code websocket.StatusCode, reason string, err error) {
+	b.once.Do(func() {
+		f.logger.Warning(fmt.Sprintf("Dropping fan-out backend %s: %v", b.name, err))
+		close(b.dropped)
+		f.spawn(func() { closeWithin(b.conn, nil, f.closeTimeout, code, reason) })
+	})
+}
+
+// close closes the secondaries still attached to the connection
+func (f *fanoutWriter) close(code websocket.StatusCode, reason string) {
+	f.mu.Lock()
+	f.closed = true
+	secondaries := f.secondaries
+	f.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, b := range secondaries {
+		b.once.Do(func() {
+			close(b.dropped)
+			wg.Add(1)
+			go func(conn *websocket.Conn) {
+				defer wg.Done()
+				closeWithin(conn, nil, f.closeTimeout, code, reason)
+			}(b.conn)
+		})
+	}
+	wg.Wait()
+}
+
+// dialFanoutBackend dials the fan-out backend backendName and attaches it to f. It is resolved like
+// a backend named in the endpoint configuration, on the same path, and is offered the subprotocol
+// of the primary backend. A fan-out backend that cannot be dialed is logged and left out.
+func (w *HandlerFactory) dialFanoutBackend(ctx context.Context, r *http.Request, pc *proxyConnection, cfg *config.EndpointConfig, wsConfig Config, forwardHeaders map[string][]string, subprotocol string, backendName string, f *fanoutWriter) {
+	var subprotocols []string
+	if subprotocol != "" {
+		subprotocols = []string{subprotocol}
+	}
+
+	// A fan-out backend failing over to the fallback would get the traffic twice
+	wsConfig.FallbackBackend = ""
+
+	targets, err := w.resolveNamedBackendTargets(r, cfg, wsConfig, backendName)
+	if err != nil {
+		pc.logger.Warning(fmt.Sprintf("Fan-out backend %s unavailable, continuing without it: %v", backendName, err))
+		return
+	}
+	conn, target, err := w.dialBackendTargets(ctx, targets, cfg, wsConfig, forwardHeaders, subprotocols)
+	if err != nil {
+		if ctx.Err() == nil {
+			pc.logger.Warning(fmt.Sprintf("Fan-out backend %s unavailable, continuing without it: %v", backendName, err))
+		}
+		return
+	}
+
+	f.attach(&fanoutBackend{
+		name:     backendName,
+		conn:     conn,
+		messages: make(chan fanoutMessage, fanoutQueueSize),
+		dropped:  make(chan struct{}),
+	})
+	pc.logger.Debug(fmt.Sprintf("Connected to fan-out backend %s at %s", backendName, target.url))
+}
@@ -0,0 +1,130 @@
+package websocket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestFanoutBackends(t *testing.T) {
+	// The sink records the client messages and answers each of them, which must not reach the client
+	received := make(chan string, 10)
+	sink := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			_, message, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			received <- string(message)
+			if err := conn.Write(ctx, websocket.MessageText, []byte("from sink")); err != nil {
+				return
+			}
+		}
+	})
+
+	// The failing sink leaves after the first message
+	failing := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		conn.Read(ctx)
+		conn.Close(websocket.StatusGoingAway, "")
+	})
+
+	// The stalled sink accepts TCP connections and never answers the handshake
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { stalled.Close() })
+	go func() {
+		for {
+			conn, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"sink":        "ws" + strings.TrimPrefix(sink.URL, "http"),
+		"failing":     "ws" + strings.TrimPrefix(failing.URL, "http"),
+		"unavailable": "ws://127.0.0.1:1",
+		"stalled":     "ws://" + stalled.Addr().String(),
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	logger := &testLogger{}
+	gateway := newTestGateway(t, NewHandlerFactory(logger), map[string]interface{}{
+		"fanout_backends":   []interface{}{"stalled", "sink", "failing", "unavailable"},
+		"handshake_timeout": "30s",
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Fan-out backends are dialed in the background: the stalled one does not hold back the
+	// client, and the others get the messages sent once they are connected
+	start := time.Now()
+	exchangeMessages(t, client, "before the sinks")
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("first exchange took %v, want it not to wait for the fan-out dials", elapsed)
+	}
+	waitForLogLine(t, logger, "Connected to fan-out backend sink")
+	waitForLogLine(t, logger, "Connected to fan-out backend failing")
+	select {
+	case got := <-received:
+		t.Fatalf("sink received %q sent before it was connected", got)
+	default:
+	}
+
+	for _, message := range []string{"first", "second", "third"} {
+		if err := client.Write(ctx, websocket.MessageText, []byte(message)); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+		_, reply, err := client.Read(ctx)
+		if err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+		if string(reply) != message {
+			t.Errorf("client received %q, want the echo of the primary backend %q", reply, message)
+		}
+
+		select {
+		case got := <-received:
+			if got != message {
+				t.Errorf("sink received %q, want %q", got, message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sink did not receive %q", message)
+		}
+	}
+
+	waitForLogLine(t, logger, "Fan-out backend unavailable unavailable")
+	if lines := logger.Contains("Fan-out backend unavailable unavailable"); len(lines) != 1 {
+		t.Errorf("log lines about the unavailable fan-out backend = %q, want 1", lines)
+	}
+	// The failing sink is dropped once its close is read, which may come after the replies
+	waitForLogLine(t, logger, "Dropping fan-out backend failing")
+	if lines := logger.Contains("Dropping fan-out backend failing"); len(lines) != 1 {
+		t.Errorf("log lines about the failing fan-out backend = %q, want 1", lines)
+	}
+}
+
+// waitForLogLine waits for logger to record a line containing substr
+func waitForLogLine(t *testing.T, logger *testLogger, substr string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(logger.Contains(substr)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no log line containing %q", substr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
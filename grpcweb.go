@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"nhooyr.io/websocket"
+)
+
+// FramingGRPCWeb makes the proxy parse binary messages as gRPC-Web length-prefixed frames
+const FramingGRPCWeb = "grpc_web"
+
+// grpcWebFrameHeaderSize is the size of the flag byte plus the 4 byte big-endian length prefix
+const grpcWebFrameHeaderSize = 5
+
+// inspectGRPCWebFrames validates that message holds a sequence of complete gRPC-Web frames
+// and returns how many frames it contains. Frames whose payload exceeds maxSize (when > 0)
+// are rejected with StatusMessageTooBig, malformed framing with StatusProtocolError.
+func inspectGRPCWebFrames(message []byte, maxSize int64) (int, error) {
+	frames := 0
+
+	for offset := 0; offset < len(message); {
+		if len(message)-offset < grpcWebFrameHeaderSize {
+			return frames, &proxyCloseError{
+				code:   websocket.StatusProtocolError,
+				reason: "truncated gRPC-Web frame header",
+			}
+		}
+
+		length := int64(binary.BigEndian.Uint32(message[offset+1 : offset+grpcWebFrameHeaderSize]))
+		if maxSize > 0 && length > maxSize {
+			return frames, &proxyCloseError{
+				code:   websocket.StatusMessageTooBig,
+				reason: fmt.Sprintf("gRPC message of %d bytes exceeds the %d bytes limit", length, maxSize),
+			}
+		}
+
+		offset += grpcWebFrameHeaderSize
+		if int64(len(message)-offset) < length {
+			return frames, &proxyCloseError{
+				code:   websocket.StatusProtocolError,
+				reason: "truncated gRPC-Web frame payload",
+			}
+		}
+
+		offset += int(length)
+		frames++
+	}
+
+	return frames, nil
+}
@@ -0,0 +1,119 @@
+package websocket
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+)
+
+// grpcWebFrames encodes each payload as a gRPC-Web data frame
+func grpcWebFrames(payloads ...string) []byte {
+	var message []byte
+	for _, payload := range payloads {
+		header := make([]byte, grpcWebFrameHeaderSize)
+		binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+		message = append(message, header...)
+		message = append(message, payload...)
+	}
+	return message
+}
+
+func TestInspectGRPCWebFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		maxSize int64
+		frames  int
+		code    websocket.StatusCode
+	}{
+		{name: "single frame", message: grpcWebFrames("hello"), frames: 1},
+		{name: "several frames", message: grpcWebFrames("a", "bb", "ccc"), frames: 3},
+		{name: "empty frame", message: grpcWebFrames(""), frames: 1},
+		{name: "frames within limit", message: grpcWebFrames("1234", "12"), maxSize: 4, frames: 2},
+		{name: "frame over limit", message: grpcWebFrames("12", "12345"), maxSize: 4, frames: 1, code: websocket.StatusMessageTooBig},
+		{name: "truncated header", message: []byte{0, 0, 0}, code: websocket.StatusProtocolError},
+		{name: "truncated payload", message: grpcWebFrames("hello")[:7], code: websocket.StatusProtocolError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, err := inspectGRPCWebFrames(tt.message, tt.maxSize)
+
+			if frames != tt.frames {
+				t.Errorf("frames = %d, want %d", frames, tt.frames)
+			}
+
+			if tt.code == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			var closeErr *proxyCloseError
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("error = %v, want a close error", err)
+			}
+			if closeErr.code != tt.code {
+				t.Errorf("close code = %v, want %v", closeErr.code, tt.code)
+			}
+		})
+	}
+}
+
+func TestGRPCWebFraming(t *testing.T) {
+	received := make(chan []byte, 10)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			_, message, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			received <- message
+		}
+	})
+
+	metrics := NewMetrics()
+	gateway := newTestGateway(t, NewHandlerFactoryWithMetrics(logging.NoOp, metrics), map[string]interface{}{
+		"framing":               "grpc_web",
+		"grpc_max_message_size": 8.0,
+	}, backend.URL)
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client.Write(ctx, websocket.MessageBinary, grpcWebFrames("first", "second"))
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("framed message was not forwarded")
+	}
+
+	counter := metrics.GRPCMessages.WithLabelValues("/ws", directionClientToBackend)
+	if got := testutil.ToFloat64(counter); got != 2 {
+		t.Errorf("gRPC messages = %v, want 2", got)
+	}
+
+	// A gRPC message over the limit closes the connection
+	client.Write(ctx, websocket.MessageBinary, grpcWebFrames("way too large"))
+
+	_, _, err := client.Read(ctx)
+	if status := websocket.CloseStatus(err); status != websocket.StatusMessageTooBig {
+		t.Errorf("close status = %v, want %v (err %v)", status, websocket.StatusMessageTooBig, err)
+	}
+
+	select {
+	case message := <-received:
+		t.Errorf("oversized message was forwarded: %v", message)
+	default:
+	}
+}
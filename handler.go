@@ -1,11 +1,20 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,11 +22,19 @@ import (
 	"github.com/luraproject/lura/logging"
 	"github.com/luraproject/lura/proxy"
 	router "github.com/luraproject/lura/router/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 	"nhooyr.io/websocket"
 )
 
 const ConfigNamespace = "websocket"
 
+// Proxy directions used in logs and per-direction behavior
+const (
+	directionClientToBackend = "client->backend"
+	directionBackendToClient = "backend->client"
+)
+
 // Config holds the configuration for WebSocket endpoints
 type Config struct {
 	ReadBufferSize     int           `json:"read_buffer_size"`
@@ -27,14 +44,294 @@ type Config struct {
 	Subprotocols       []string      `json:"subprotocols"`
 	BackendScheme      string        `json:"backend_scheme"`      // "ws" or "wss" to override scheme detection
 	MaxMessageSize     int64         `json:"max_message_size"`    // Maximum message size in bytes (0 = no limit)
+	MaxFrameSize       int64         `json:"max_frame_size"`      // Abort reads of messages over this size as their bytes arrive (0 = no limit)
 	PassthroughHeaders []string      `json:"passthrough_headers"` // Additional headers to forward to backend
 	PassAllHeaders     bool          `json:"pass_all_headers"`    // Pass all headers except excluded ones
 	ExcludeHeaders     []string      `json:"exclude_headers"`     // Headers to exclude when pass_all_headers is true
+	CoalesceWindow     time.Duration `json:"coalesce_window"`     // Batch client text frames received within this window (0 = disabled)
+	CoalesceMaxBatch   int           `json:"coalesce_max_batch"`  // Flush a batch once it holds this many frames (0 = no limit)
+	SendQueueSize      int           `json:"send_queue_size"`     // Messages buffered per direction between read and write (0 = unbuffered)
+	OverflowPolicy     string        `json:"overflow_policy"`     // What a full send queue does: "block" (default), "drop_oldest" or "close"
+
+	CompressionEnableHeader string   `json:"compression_enable_header"` // Request header deciding compression per connection
+	CompressionEnableValues []string `json:"compression_enable_values"` // Header values that enable compression
+	CompressionMode         string   `json:"compression_mode"`          // One of the CompressionMode constants, overriding compression on both legs (empty = compression decides)
+	CompressionThreshold    int      `json:"compression_threshold"`     // Smallest message compressed, in bytes, on both legs (0 = 512 without context takeover, 128 with it)
+
+	StrictValidation bool `json:"strict_validation"` // Refuse upgrades on endpoints whose configuration fails validation
+	RequireUpgrade   bool `json:"require_upgrade"`   // Answer plain HTTP requests with 426 instead of the standard handler
+
+	RequireSubprotocol bool     `json:"require_subprotocol"` // Only proxy when the backend accepts the subprotocol negotiated with the client
+	DefaultSubprotocol string   `json:"default_subprotocol"` // Subprotocol spoken with the backend for clients requesting none (empty = none)
+	DeniedSubprotocols []string `json:"denied_subprotocols"` // Subprotocols whose request rejects the upgrade
+	SubprotocolHeader  string   `json:"subprotocol_header"`  // Header carrying the negotiated subprotocol to the backend (empty = not sent)
+
+	Framing            string `json:"framing"`               // Message framing understood by the proxy ("grpc_web"), empty for opaque frames
+	GRPCMaxMessageSize int64  `json:"grpc_max_message_size"` // Maximum size of a single gRPC message under grpc_web framing (0 = no limit)
+
+	ForwardHeaders        []string `json:"forward_headers"`         // Auth headers picked from the request, replacing the X-User-* defaults (case-insensitive)
+	ForwardHeaderPrefixes []string `json:"forward_header_prefixes"` // Prefixes of the auth headers picked from the request, replacing X-User-, X-Auth- and X-Group-
+
+	AuthSignatureSecret redactedString `json:"auth_signature_secret"` // Shared secret verifying the X-Auth-Signature of the auth headers (empty = disabled)
+
+	CaptureSampleRate float64 `json:"capture_sample_rate"` // Fraction of connections whose messages are copied to the capture sink (0 = none)
+	TraceSampleRate   float64 `json:"trace_sample_rate"`   // Fraction of connections without incoming trace context that are traced (default 1)
+	VerboseTracing    bool    `json:"verbose_tracing"`     // Add a span event per proxied message to the span of traced connections
+
+	EventLog bool `json:"event_log"` // Log connection opens and closes as JSON objects at info level
+
+	AllowedOrigins []string `json:"allowed_origins"` // Origin host patterns allowed to connect, e.g. "*.example.com" (empty = any origin)
+
+	StrictUpgradeHeaders bool `json:"strict_upgrade_headers"` // Reject upgrades listing other protocols besides websocket or duplicating Sec-WebSocket-Key
+	MaxHeaderCount       int  `json:"max_header_count"`       // Header fields an upgrade request may carry, others get HTTP 431 (0 = unlimited)
+
+	PathPrefixBackends map[string]string `json:"path_prefix_backends"` // Request path prefixes mapped to backend names, the longest match wins
+	FirstFrameRouting  map[string]string `json:"first_frame_routing"`  // Routes of the first client message ({"route":...}) mapped to backend names
+	RoutingTimeout     time.Duration     `json:"routing_timeout"`      // Time the client has to send its routing directive (0 = handshake_timeout)
+
+	AllowedUpgradePaths []string `json:"allowed_upgrade_paths"` // Request path patterns allowed to upgrade (empty = any path)
+	DeniedUpgradePaths  []string `json:"denied_upgrade_paths"`  // Request path patterns refused the upgrade, even when allowed
+	UpgradePathAction   string   `json:"upgrade_path_action"`   // Action on upgrades of refused paths: "reject" (default) or "http"
+
+	InferSchemeFromPort bool `json:"infer_scheme_from_port"` // Use wss for scheme-less backend hosts on port 443 (ws otherwise)
+	AutocorrectScheme   bool `json:"autocorrect_scheme"`     // Dial http(s) backend URLs as ws(s) instead of failing
+
+	BackendPathSuffix  string `json:"backend_path_suffix"`  // Appended to every derived backend path (e.g. "/ws")
+	DefaultBackendPath string `json:"default_backend_path"` // Path used for named backends without backend_path (empty = the request path)
+	ForwardQueryString bool   `json:"forward_query_string"` // Append the query string of the upgrade request to the backend URL (default true)
+	FallbackBackend    string `json:"fallback_backend"`     // Backend name dialed last, when the primary backend is not registered or cannot be dialed
+
+	FanoutBackends []string `json:"fanout_backends"` // Backend names also receiving every client message, their messages are discarded
+
+	BackendHeaders backendHeaders `json:"backend_headers"` // Static headers sent to the backend on every dial, overridden by the forwarded headers of the same name
+
+	BackendFailureMessage string `json:"backend_failure_message"` // Text message sent to the client before closing it when the backend dial fails (empty = none)
+
+	BackendLocalAddr     string `json:"backend_local_addr"`      // Local IP backend connections originate from (empty = chosen by the system)
+	BackendTLSMinVersion string `json:"backend_tls_min_version"` // Lowest TLS version accepted from wss backends ("1.2", "1.3", empty = Go default)
+	BackendTLSCertFile   string `json:"backend_tls_cert_file"`   // PEM client certificate presented to wss backends requiring mutual TLS
+	BackendTLSKeyFile    string `json:"backend_tls_key_file"`    // PEM private key of backend_tls_cert_file
+	BackendCAFile        string `json:"backend_ca_file"`         // PEM CA bundle trusted for wss backends instead of the system roots
+
+	WriteTimeout                  time.Duration `json:"write_timeout"`                      // Base time allowed to write a message (0 = no deadline)
+	MinWriteThroughputBytesPerSec int64         `json:"min_write_throughput_bytes_per_sec"` // Extends the write deadline by size / throughput (0 = fixed deadline)
+
+	SlowWriteThreshold time.Duration `json:"slow_write_threshold"` // Backend writes taking longer are counted in ws_slow_backend_writes_total (0 = not measured)
+
+	WriteRetryCount int `json:"write_retry_count"` // Times a lost backend connection is redialed, the failed write retried on it (0 = never)
+
+	DialRetries int           `json:"dial_retries"` // Times a backend dial failing at the connection level is retried (0 = never)
+	DialBackoff time.Duration `json:"dial_backoff"` // Wait before the first dial retry, doubled on each further one (default 100ms)
+
+	ReconnectOnCloseCodes []int `json:"reconnect_on_close_codes"` // Backend close statuses that redial the backend instead of closing the client
+
+	MaxConnectionsPerIdentity int    `json:"max_connections_per_identity"` // Simultaneous connections allowed per identity on the endpoint (0 = unlimited)
+	IdentityHeader            string `json:"identity_header"`              // Request header identifying the client, set by the auth middleware
+
+	TotalHandshakeBudget time.Duration `json:"total_handshake_budget"` // Bounds the middleware chain, accept and backend dial together (0 = no bound)
+
+	MaxConcurrentHandshakes int           `json:"max_concurrent_handshakes"` // Client accepts of the endpoint running at once, others wait in line (0 = unlimited)
+	AcceptQueueWaitTimeout  time.Duration `json:"accept_queue_wait_timeout"` // Longest wait in line for an accept slot before HTTP 503 (0 = no bound)
+
+	ClientIdleTimeout  time.Duration `json:"client_idle_timeout"`  // Close connections whose client sends no message for this long (0 = never)
+	BackendIdleTimeout time.Duration `json:"backend_idle_timeout"` // Close connections whose backend sends no message for this long (0 = never)
+
+	IdleTimeout time.Duration `json:"idle_timeout"` // Close connections on which no message flows in either direction for this long (0 = never)
+
+	DrainQuiesceWindow time.Duration `json:"drain_quiesce_window"` // On Shutdown, wait for connections to be quiet this long before closing them (0 = close at once)
+
+	MaxSingleReadDuration time.Duration `json:"max_single_read_duration"` // Time allowed to receive a message once it started arriving (0 = no bound)
+
+	CloseHandshakeTimeout time.Duration `json:"close_handshake_timeout"` // Time a peer has to answer our close frame before its connection is dropped (0 = the library bound of 5s)
+
+	PingInterval time.Duration `json:"ping_interval"` // Interval between pings sent to both peers, a failed ping closes the connection (0 = no pings)
+
+	TranscodeBase64 bool `json:"transcode_base64"` // Decode client text frames from base64 into binary, encode backend binary frames into base64 text
+
+	CompressAfterMessages      int     `json:"compress_after_messages"`      // Compress the messages sent to the client after this many of them (0 = never)
+	AdaptiveCompression        float64 `json:"adaptive_compression"`         // Minimum compression ratio to keep compressing after sampling (0 = always compress)
+	AdaptiveCompressionSamples int     `json:"adaptive_compression_samples"` // Compressed messages sampled before deciding (default: 10)
+
+	ClientMessageRateLimit float64 `json:"client_message_rate_limit"` // Messages per second a client may send (0 = unlimited)
+	ClientMessageBurst     int     `json:"client_message_burst"`      // Messages a client may send at once above the rate (default: one second worth)
+	RateLimitAction        string  `json:"rate_limit_action"`         // Action on messages over the rate: "block" (default) or "close"
+
+	MaxInflightBytes    int64  `json:"max_inflight_bytes"`    // Payload bytes a connection may have read but not written yet (0 = unlimited)
+	InflightLimitAction string `json:"inflight_limit_action"` // Action on messages over max_inflight_bytes: "block" (default) or "close"
+
+	InterceptorBufferPool bool `json:"interceptor_buffer_pool"` // Lend pooled buffers to interceptors rewriting messages instead of allocating them
+}
+
+// proxyCloseError is returned by the proxy when the gateway closes a connection with a specific status
+type proxyCloseError struct {
+	code   websocket.StatusCode
+	reason string
+}
+
+func (e *proxyCloseError) Error() string {
+	return fmt.Sprintf("closing connection with status %d: %s", e.code, e.reason)
+}
+
+// peerCloseStatus returns the status a peer closed its side with, when err reports one. Statuses
+// that cannot be sent in a close frame, such as 1005 (no status received), become a normal closure.
+func peerCloseStatus(err error) (websocket.StatusCode, string, bool) {
+	var closeErr websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return 0, "", false
+	}
+
+	switch closeErr.Code {
+	case websocket.StatusNoStatusRcvd, websocket.StatusAbnormalClosure, websocket.StatusTLSHandshake:
+		return websocket.StatusNormalClosure, "", true
+	}
+	return closeErr.Code, closeErr.Reason, true
+}
+
+// proxyConnection holds the state of a single proxied client connection
+type proxyConnection struct {
+	id        string
+	endpoint  string
+	logger    logging.Logger
+	client    *websocket.Conn
+	clientNet net.Conn // Hijacked socket under client, closed to drop clients stalling the close handshake
+	clientIP  string
+	backend   backendTarget // Guarded by the registry lock
+	stats     *connStats
+	startedAt time.Time
+	captured  bool // Copies of the frames go to the capture sink
+	traced    bool // The session is recorded in a websocket.proxy span
+	verbose   bool // Each proxied message is added to the recorded span as an event, set once the span started
+
+	interceptors []MessageInterceptor
+
+	closeCode    int32         // First status the client was closed with, accessed atomically (0 = not closed yet)
+	closeTimeout time.Duration // close_handshake_timeout, 0 leaves the close handshake to the library bound
+
+	activity *activityTimer  // Connection-wide idle_timeout, touched by the messages of both directions
+	lastSeen int64           // UnixNano of the last message read or written in either direction, accessed atomically
+	quiesce  time.Duration   // drain_quiesce_window, quiet time Shutdown waits for before closing the connection
+	inflight *inflightBudget // max_inflight_bytes, shared by both directions (nil = unlimited)
+
+	closedBy string // Side that ended the connection, one of the initiator constants, set by the lifecycle
+}
+
+// Sides ending a connection, as reported by ws_connection_closes_total
+const (
+	initiatorGateway = "gateway"
+	initiatorClient  = "client"
+	initiatorBackend = "backend"
+)
+
+// writeError is returned by proxyMessages when writing to the destination of a direction failed
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string { return e.err.Error() }
+
+func (e *writeError) Unwrap() error { return e.err }
+
+// errorInitiator returns the side that ended a proxy direction with err: the gateway for its own
+// closes, otherwise the destination for write errors and the source for read errors
+func errorInitiator(direction string, err error) string {
+	var closeErr *proxyCloseError
+	if errors.As(err, &closeErr) {
+		return initiatorGateway
+	}
+
+	var wErr *writeError
+	fromClient := direction == directionClientToBackend
+	if errors.As(err, &wErr) {
+		fromClient = !fromClient
+	}
+	if fromClient {
+		return initiatorClient
+	}
+	return initiatorBackend
+}
+
+// closeClient closes the client connection, recording the status for the access log
+func (pc *proxyConnection) closeClient(code websocket.StatusCode, reason string) error {
+	atomic.CompareAndSwapInt32(&pc.closeCode, 0, int32(code))
+	err := closeWithin(pc.client, pc.clientNet, pc.closeTimeout, code, reason)
+	if errors.Is(err, errCloseHandshakeTimeout) {
+		pc.logger.Warning(logFields("Client did not complete the close handshake, dropping it", "close_handshake_timeout", pc.closeTimeout))
+	}
+	return err
+}
+
+// errCloseHandshakeTimeout is returned by closeWithin when the peer did not answer the close frame in time
+var errCloseHandshakeTimeout = errors.New("close handshake timed out")
+
+// closeWithin closes conn, waiting at most timeout for the peer to answer the close frame. A peer
+// not answering in time has netConn, the socket under conn, closed instead. Without netConn the
+// handshake is left to finish in the background, within the 5s nhooyr allows it.
+func closeWithin(conn *websocket.Conn, netConn net.Conn, timeout time.Duration, code websocket.StatusCode, reason string) error {
+	if timeout <= 0 {
+		return conn.Close(code, reason)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Close(code, reason)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	if netConn != nil {
+		// Close returns as soon as its pending read fails
+		netConn.Close()
+		<-done
+	}
+	return errCloseHandshakeTimeout
+}
+
+// clientCloseCode returns the first status the client was closed with, 0 when it was not closed yet
+func (pc *proxyConnection) clientCloseCode() websocket.StatusCode {
+	return websocket.StatusCode(atomic.LoadInt32(&pc.closeCode))
 }
 
-// BackendRegistry holds the mapping of backend names to WebSocket URLs
+// supportedWebSocketVersion is the only Sec-WebSocket-Version defined by RFC 6455
+const supportedWebSocketVersion = "13"
+
+// Reasons of the upgrade requests rejected before the accept, as reported by ws_upgrade_rejections_total
+const (
+	rejectionInvalidConfig      = "invalid_config"
+	rejectionAmbiguousUpgrade   = "ambiguous_upgrade"
+	rejectionTooManyHeaders     = "too_many_headers"
+	rejectionAuthFailed         = "auth_failed"
+	rejectionInvalidSignature   = "invalid_signature"
+	rejectionHandshakeTimeout   = "handshake_timeout"
+	rejectionNoBackend          = "no_backend"
+	rejectionUnsupportedVersion = "unsupported_version"
+	rejectionDeniedSubprotocol  = "denied_subprotocol"
+	rejectionHijackUnsupported  = "hijack_unsupported"
+	rejectionIdentityLimit      = "identity_limit"
+	rejectionAtCapacity         = "at_capacity"
+	rejectionQueueTimeout       = "queue_timeout"
+	rejectionShuttingDown       = "shutting_down"
+	rejectionDeniedPath         = "denied_path"
+	rejectionUnmatchedPathParam = "unmatched_path_param"
+	rejectionAcceptFailed       = "accept_failed"
+)
+
+// maxConnectionsRetryAfter is the Retry-After, in seconds, of upgrades rejected under max_connections
+const maxConnectionsRetryAfter = 5
+
+// minRecommendedMaxMessageSize is the max_message_size below which the limit is most likely a misconfiguration
+const minRecommendedMaxMessageSize = 1024
+
+// BackendRegistry holds the mapping of backend names to WebSocket URLs, and the service discovery
+// configuration of the backends whose hosts are resolved through lura SD
 type BackendRegistry struct {
-	Backends map[string]string `json:"backends"`
+	Backends  map[string]string          `json:"backends"`
+	Discovery map[string]*config.Backend `json:"-"` // Backends entries holding an object with "sd" and "host"
 }
 
 // Global backend registry - should be initialized from configuration
@@ -45,8 +342,36 @@ type HandlerFactory struct {
 	logger                logging.Logger
 	serviceConfig         config.ServiceConfig
 	fullMiddlewareFactory router.HandlerFactory // The complete middleware chain including auth
+	metrics               *Metrics              // Optional Prometheus collectors, nil disables metrics
+	connections           connectionRegistry    // Live client connections, closed on Shutdown
+	acceptOptionsFunc     AcceptOptionsFunc     // Optional per-request customization of the accept options
+	authExtractor         AuthExtractor         // Optional source of the auth context, nil uses the auth headers
+	transformer           MessageTransformer    // Optional rewriter of the proxied messages
+	legacyFormatWarned    sync.Map              // Endpoints already warned about the old backend format
+	subprotocolValidators sync.Map              // Client message validators by subprotocol
+	handshakeQueues       sync.Map              // Accept queues by endpoint, under max_concurrent_handshakes
+	backendCertificates   sync.Map              // TLS material of each endpoint dialing wss backends, loaded when its handler is built
+	discoveredBackends    sync.Map              // SD subscriber and balancer of each named backend
+
+	endpointsMu        sync.Mutex
+	maxWSEndpoints     int             // Distinct endpoints wrapped as WebSocket handlers at most (0 = unlimited)
+	wrappedWSEndpoints map[string]bool // Endpoints wrapped as WebSocket handlers so far
+
+	draining        int32 // Set to 1 by Shutdown, new upgrades are then rejected
+	maxConnections  int32 // Simultaneous client connections accepted at most (0 = unlimited)
+	liveConnections int32 // Client connections currently holding a slot under maxConnections
+
+	backendHostsMu      sync.Mutex
+	backendHostCounters map[string]int // Next old-format backend host to dial first, by endpoint
+
+	captureSinkMu sync.Mutex
+	captureSink   *asyncCaptureSink // Optional destination of sampled message payloads, swapped by SetCaptureSink
 }
 
+// AcceptOptionsFunc customizes the options used to accept a client connection. It receives
+// the options derived from the endpoint configuration and returns the ones to use.
+type AcceptOptionsFunc func(c *gin.Context, base websocket.AcceptOptions) websocket.AcceptOptions
+
 // Define custom context key type for Gin compatibility
 type contextKey string
 
@@ -62,9 +387,88 @@ func NewHandlerFactory(logger logging.Logger) *HandlerFactory {
 // NewHandlerFactoryWithConfig returns a new WebSocket HandlerFactory with service configuration
 func NewHandlerFactoryWithConfig(logger logging.Logger, serviceConfig config.ServiceConfig) *HandlerFactory {
 	return &HandlerFactory{
-		logger:        logger,
-		serviceConfig: serviceConfig,
+		logger:         logger,
+		serviceConfig:  serviceConfig,
+		maxConnections: parseMaxConnections(serviceConfig),
+	}
+}
+
+// parseMaxConnections reads max_connections from the websocket_backends service extra config
+func parseMaxConnections(serviceConfig config.ServiceConfig) int32 {
+	registryMap, ok := serviceConfig.ExtraConfig["websocket_backends"].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	if maxConnections, ok := registryMap["max_connections"].(float64); ok && maxConnections > 0 {
+		return int32(maxConnections)
+	}
+	return 0
+}
+
+// acquireConnectionSlot counts a new client connection under max_connections, unless the limit is reached
+func (w *HandlerFactory) acquireConnectionSlot() bool {
+	if w.maxConnections <= 0 {
+		return true
+	}
+	if atomic.AddInt32(&w.liveConnections, 1) > w.maxConnections {
+		atomic.AddInt32(&w.liveConnections, -1)
+		return false
+	}
+	return true
+}
+
+// releaseConnectionSlot gives back a slot taken by acquireConnectionSlot
+func (w *HandlerFactory) releaseConnectionSlot() {
+	if w.maxConnections > 0 {
+		atomic.AddInt32(&w.liveConnections, -1)
+	}
+}
+
+// NewHandlerFactoryWithMetrics returns a new WebSocket HandlerFactory reporting to the given metrics.
+// The caller is responsible for registering the metrics with a Prometheus registry.
+func NewHandlerFactoryWithMetrics(logger logging.Logger, metrics *Metrics) *HandlerFactory {
+	return &HandlerFactory{
+		logger:  logger,
+		metrics: metrics,
+	}
+}
+
+// SetAcceptOptionsFunc sets a hook called with the config-derived accept options right
+// before every client connection is accepted. A nil func uses the derived options as is.
+func (w *HandlerFactory) SetAcceptOptionsFunc(fn AcceptOptionsFunc) {
+	w.acceptOptionsFunc = fn
+}
+
+// WithMaxWebSocketEndpoints caps to n the distinct endpoints HandlerWrapper wraps as WebSocket
+// handlers. Endpoints with a WebSocket configuration beyond the first n are served by the standard
+// handler instead. A non-positive n removes the cap. It returns the factory, and must be called
+// before the router is built.
+func (w *HandlerFactory) WithMaxWebSocketEndpoints(n int) *HandlerFactory {
+	w.endpointsMu.Lock()
+	defer w.endpointsMu.Unlock()
+
+	w.maxWSEndpoints = n
+	return w
+}
+
+// admitWebSocketEndpoint reports whether endpoint can be wrapped as a WebSocket handler under the
+// WithMaxWebSocketEndpoints cap, counting it when it is wrapped for the first time
+func (w *HandlerFactory) admitWebSocketEndpoint(endpoint string) bool {
+	w.endpointsMu.Lock()
+	defer w.endpointsMu.Unlock()
+
+	if w.wrappedWSEndpoints[endpoint] {
+		return true
+	}
+	if w.maxWSEndpoints > 0 && len(w.wrappedWSEndpoints) >= w.maxWSEndpoints {
+		return false
+	}
+
+	if w.wrappedWSEndpoints == nil {
+		w.wrappedWSEndpoints = make(map[string]bool)
 	}
+	w.wrappedWSEndpoints[endpoint] = true
+	return true
 }
 
 // InitializeBackendRegistry initializes the global backend registry from configuration
@@ -73,16 +477,20 @@ func InitializeBackendRegistry(serviceConfig config.ServiceConfig) {
 	if registryConfig, ok := serviceConfig.ExtraConfig["websocket_backends"]; ok {
 		if registryMap, ok := registryConfig.(map[string]interface{}); ok {
 			backends := make(map[string]string)
+			discovery := make(map[string]*config.Backend)
 			if backendsInterface, ok := registryMap["backends"]; ok {
 				if backendsMap, ok := backendsInterface.(map[string]interface{}); ok {
 					for name, url := range backendsMap {
-						if urlStr, ok := url.(string); ok {
-							backends[name] = urlStr
+						switch backend := url.(type) {
+						case string:
+							backends[name] = backend
+						case map[string]interface{}:
+							discovery[name] = parseDiscoveryConfig(backend)
 						}
 					}
 				}
 			}
-			globalBackendRegistry = &BackendRegistry{Backends: backends}
+			globalBackendRegistry = &BackendRegistry{Backends: backends, Discovery: discovery}
 		}
 	}
 
@@ -102,8 +510,32 @@ func (w *HandlerFactory) HandlerWrapper(standardHandlerFactory router.HandlerFac
 
 		// Check if this is a WebSocket endpoint
 		wsConfig, hasWebSocketConfig := parseWebSocketConfig(cfg.ExtraConfig)
+		if hasWebSocketConfig && !w.admitWebSocketEndpoint(cfg.Endpoint) {
+			w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Maximum of %d WebSocket endpoints reached, serving it as a standard endpoint", cfg.Endpoint, w.maxWSEndpoints))
+			hasWebSocketConfig = false
+		}
 		if hasWebSocketConfig {
 			w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] WebSocket configuration detected: %+v", cfg.Endpoint, wsConfig))
+
+			// Catch misconfigurations early
+			if warnings := validateConfig(wsConfig); len(warnings) > 0 {
+				for _, warning := range warnings {
+					w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] WebSocket configuration: %s", cfg.Endpoint, warning))
+				}
+
+				if wsConfig.StrictValidation {
+					w.logger.Error(fmt.Sprintf("[ENDPOINT: %s] Invalid WebSocket configuration, upgrades will be refused", cfg.Endpoint))
+					return w.invalidConfigHandler(cfg, wsConfig, standardHandlerFactory(cfg, p))
+				}
+			}
+
+			// Unreadable backend certificates would fail every dial, refuse the upgrades instead.
+			// NewWithConfigChecked and LoadBackendCertificates report them before the router is built.
+			if err := w.loadBackendCertificates(cfg.Endpoint, wsConfig); err != nil {
+				w.logger.Error(fmt.Sprintf("[ENDPOINT: %s] WebSocket backend TLS: %v, upgrades will be refused", cfg.Endpoint, err))
+				return w.invalidConfigHandler(cfg, wsConfig, standardHandlerFactory(cfg, p))
+			}
+
 			// For WebSocket endpoints, we need to handle upgrade requests
 			return func(c *gin.Context) {
 				// Log all incoming headers for debugging
@@ -111,6 +543,11 @@ func (w *HandlerFactory) HandlerWrapper(standardHandlerFactory router.HandlerFac
 
 				// Check if this is a WebSocket upgrade request
 				if !isWebSocketUpgrade(c.Request) {
+					if wsConfig.RequireUpgrade {
+						w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Not a WebSocket upgrade request, answering 426", cfg.Endpoint))
+						respondUpgradeRequired(c)
+						return
+					}
 					w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Not a WebSocket upgrade request, handling as HTTP", cfg.Endpoint))
 					// Not a WebSocket upgrade, handle as regular HTTP request
 					standardHandler := standardHandlerFactory(cfg, p)
@@ -120,21 +557,79 @@ func (w *HandlerFactory) HandlerWrapper(standardHandlerFactory router.HandlerFac
 
 				w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] WebSocket upgrade request detected", cfg.Endpoint))
 
+				// Only some sub-paths of a catch-all route may be allowed to upgrade
+				if !upgradePathAllowed(c.Request.URL.Path, wsConfig.AllowedUpgradePaths, wsConfig.DeniedUpgradePaths) {
+					if wsConfig.UpgradePathAction == UpgradePathActionHTTP {
+						w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Upgrades are not allowed on %s, handling as HTTP", cfg.Endpoint, c.Request.URL.Path))
+						standardHandlerFactory(cfg, p)(c)
+						return
+					}
+					w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Rejecting WebSocket upgrade on %s: path not allowed", cfg.Endpoint, c.Request.URL.Path))
+					w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionDeniedPath)
+					c.JSON(http.StatusForbidden, gin.H{"error": "WebSocket upgrade not allowed on this path"})
+					return
+				}
+
+				// Connections accepted now would be cut short by the ongoing Shutdown
+				if w.isDraining() {
+					w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Rejecting WebSocket upgrade: shutting down", cfg.Endpoint))
+					w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionShuttingDown)
+					c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server shutting down"})
+					return
+				}
+
+				// Refuse upgrades whose headers could be read differently by another hop
+				if wsConfig.StrictUpgradeHeaders {
+					if reason := ambiguousUpgrade(c.Request); reason != "" {
+						w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Rejecting ambiguous WebSocket upgrade: %s", cfg.Endpoint, reason))
+						w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionAmbiguousUpgrade)
+						c.JSON(http.StatusBadRequest, gin.H{"error": "Ambiguous WebSocket upgrade headers"})
+						return
+					}
+				}
+
+				// Refuse requests flooding the gateway with header fields
+				if wsConfig.MaxHeaderCount > 0 {
+					if count := headerCount(c.Request.Header); count > wsConfig.MaxHeaderCount {
+						w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Rejecting WebSocket upgrade carrying %d header fields, above max_header_count of %d", cfg.Endpoint, count, wsConfig.MaxHeaderCount))
+						w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionTooManyHeaders)
+						c.JSON(http.StatusRequestHeaderFieldsTooLarge, gin.H{"error": "Too many request headers"})
+						return
+					}
+				}
+
+				// Bound the middleware chain, the accept and the backend dial as a whole
+				budget := newHandshakeBudget(wsConfig.TotalHandshakeBudget)
+
 				// Check if this endpoint requires authentication
-				authHeaders := w.runAuthenticationIfNeeded(c, cfg, p)
+				authHeaders := w.runAuthenticationIfNeeded(c, cfg, p, wsConfig, budget)
 				if authHeaders == nil {
 					// Authentication failed, response already sent
 					return
 				}
+				if budget.exceeded() {
+					w.rejectExceededHandshakeBudget(c, cfg, "after the middleware chain")
+					return
+				}
 
 				w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Auth headers for WebSocket: %v", cfg.Endpoint, authHeaders))
 
+				// Reject auth headers that were not signed by the upstream
+				if wsConfig.AuthSignatureSecret != "" {
+					if err := verifyAuthSignature(authHeaders, string(wsConfig.AuthSignatureSecret)); err != nil {
+						w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Rejecting WebSocket upgrade: %v", cfg.Endpoint, err))
+						w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionInvalidSignature)
+						c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid auth header signature"})
+						return
+					}
+				}
+
 				// Extract all headers to forward based on configuration
 				forwardHeaders := w.extractHeadersToForward(c.Request.Header, wsConfig, authHeaders)
 				w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Headers to forward: %v", cfg.Endpoint, forwardHeaders))
 
 				// Handle the WebSocket upgrade and connection with all forward headers
-				w.handleWebSocketConnection(c, cfg, p, wsConfig, forwardHeaders)
+				w.handleWebSocketConnection(c, cfg, p, wsConfig, forwardHeaders, budget)
 			}
 		}
 
@@ -143,21 +638,91 @@ func (w *HandlerFactory) HandlerWrapper(standardHandlerFactory router.HandlerFac
 	}
 }
 
-// isWebSocketUpgrade checks if the HTTP request is a WebSocket upgrade request
+// invalidConfigHandler refuses the upgrades to an endpoint whose WebSocket configuration cannot be
+// served. Plain HTTP requests are still handled by standardHandler, unless upgrades are required.
+func (w *HandlerFactory) invalidConfigHandler(cfg *config.EndpointConfig, wsConfig Config, standardHandler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isWebSocketUpgrade(c.Request) {
+			if wsConfig.RequireUpgrade {
+				respondUpgradeRequired(c)
+				return
+			}
+			standardHandler(c)
+			return
+		}
+		w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionInvalidConfig)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid WebSocket configuration"})
+	}
+}
+
+// isWebSocketUpgrade checks if the HTTP request is a WebSocket upgrade request.
+// Every value of the Upgrade and Connection headers is considered, not only the first one.
 func isWebSocketUpgrade(r *http.Request) bool {
-	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
-	connection := strings.ToLower(r.Header.Get("Connection"))
-	key := r.Header.Get("Sec-WebSocket-Key")
+	return headerContainsToken(r.Header, "Upgrade", "websocket") &&
+		headerContainsToken(r.Header, "Connection", "upgrade") &&
+		r.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+// respondUpgradeRequired tells a client sending a plain HTTP request to a require_upgrade endpoint
+// to switch to WebSocket
+func respondUpgradeRequired(c *gin.Context) {
+	c.Header("Upgrade", "websocket")
+	c.Header("Connection", "Upgrade")
+	c.JSON(http.StatusUpgradeRequired, gin.H{"error": "WebSocket upgrade required"})
+}
+
+// headerCount returns the number of header fields of a request, counting every value of repeated headers
+func headerCount(header http.Header) int {
+	count := 0
+	for _, values := range header {
+		count += len(values)
+	}
+	return count
+}
+
+// ambiguousUpgrade explains why the headers of a WebSocket upgrade request are ambiguous,
+// or returns an empty string when they are not
+func ambiguousUpgrade(r *http.Request) string {
+	for _, token := range headerTokens(r.Header, "Upgrade") {
+		if token != "websocket" {
+			return fmt.Sprintf("Upgrade header requests %q along with websocket", token)
+		}
+	}
+
+	if keys := r.Header.Values("Sec-WebSocket-Key"); len(keys) > 1 {
+		return fmt.Sprintf("request carries %d Sec-WebSocket-Key headers", len(keys))
+	}
+
+	return ""
+}
+
+// headerTokens returns the lowercased comma-separated tokens of every value of a header
+func headerTokens(h http.Header, key string) []string {
+	var tokens []string
+	for _, value := range h.Values(key) {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
 
-	return upgrade == "websocket" &&
-		strings.Contains(connection, "upgrade") &&
-		key != ""
+// headerContainsToken checks if any value of a header lists token, case-insensitively
+func headerContainsToken(h http.Header, key, token string) bool {
+	for _, t := range headerTokens(h, key) {
+		if t == token {
+			return true
+		}
+	}
+	return false
 }
 
 // runAuthenticationIfNeeded runs authentication middleware for WebSocket upgrades if required
-func (w *HandlerFactory) runAuthenticationIfNeeded(c *gin.Context, cfg *config.EndpointConfig, p proxy.Proxy) map[string]string {
+func (w *HandlerFactory) runAuthenticationIfNeeded(c *gin.Context, cfg *config.EndpointConfig, p proxy.Proxy, wsConfig Config, budget handshakeBudget) map[string][]string {
 	// First, check if auth headers are already present in the request
-	authHeaders := w.extractAuthHeaders(c.Request.Header)
+	authHeaders := w.extractAuthContext(c, wsConfig)
 
 	// If we already have auth headers, assume authentication was handled upstream
 	if len(authHeaders) > 0 {
@@ -169,7 +734,7 @@ func (w *HandlerFactory) runAuthenticationIfNeeded(c *gin.Context, cfg *config.E
 	authHeader := c.Request.Header.Get("Authorization")
 	if authHeader == "" {
 		w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] No Authorization header found, proceeding without auth", cfg.Endpoint))
-		return make(map[string]string) // Return empty map, not nil
+		return make(map[string][]string) // Return empty map, not nil
 	}
 
 	// Run the full middleware chain to handle authentication
@@ -188,27 +753,42 @@ func (w *HandlerFactory) runAuthenticationIfNeeded(c *gin.Context, cfg *config.E
 
 	// Run just the auth part of the middleware chain, not the full handler
 	// This avoids the expensive proxy operations
+	// The middleware sees the handshake budget as its request deadline
+	originalCtx := c.Request.Context()
+	budgetCtx, cancel := budget.context(originalCtx)
+	c.Request = c.Request.WithContext(budgetCtx)
+
 	authHandler := w.fullMiddlewareFactory(cfg, dummyProxy)
 	authHandler(c)
+	cancel()
 
-	// Restore the original response writer and path
+	// Restore the original response writer, path and context
 	c.Writer = originalWriter
+	c.Request = c.Request.WithContext(originalCtx)
 	c.Request.URL.Path = originalPath
 
 	// Check if auth middleware failed
 	if recorder.statusCode == http.StatusUnauthorized || recorder.statusCode == http.StatusForbidden {
 		w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Authentication failed with status %d", cfg.Endpoint, recorder.statusCode))
+		w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionAuthFailed)
 		c.JSON(recorder.statusCode, gin.H{"error": "Authentication failed"})
 		return nil
 	}
 
 	// Auth succeeded, extract the headers that were added by auth middleware
-	authHeaders = w.extractAuthHeaders(c.Request.Header)
+	authHeaders = w.extractAuthContext(c, wsConfig)
 	w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Authentication succeeded, extracted headers: %v", cfg.Endpoint, authHeaders))
 
 	return authHeaders
 }
 
+// rejectExceededHandshakeBudget answers an upgrade whose total_handshake_budget ran out with HTTP 504
+func (w *HandlerFactory) rejectExceededHandshakeBudget(c *gin.Context, cfg *config.EndpointConfig, stage string) {
+	w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] WebSocket handshake budget exceeded %s", cfg.Endpoint, stage))
+	w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionHandshakeTimeout)
+	c.JSON(http.StatusGatewayTimeout, gin.H{"error": "WebSocket handshake timed out"})
+}
+
 // authResponseRecorder captures auth middleware responses while preserving WebSocket upgrade capability
 type authResponseRecorder struct {
 	gin.ResponseWriter
@@ -263,6 +843,11 @@ func parseWebSocketConfig(extraConfig config.ExtraConfig) (Config, bool) {
 		PassthroughHeaders: []string{},
 		PassAllHeaders:     false,
 		ExcludeHeaders:     []string{"Authorization", "Cookie"}, // Default exclusions for security
+		IdentityHeader:     "X-User-Id",
+		ForwardQueryString: true,
+
+		AdaptiveCompressionSamples: 10,
+		TraceSampleRate:            1,
 	}
 
 	if readBufferSize, ok := wsConfigMap["read_buffer_size"].(float64); ok {
@@ -299,6 +884,10 @@ func parseWebSocketConfig(extraConfig config.ExtraConfig) (Config, bool) {
 		cfg.MaxMessageSize = int64(maxMessageSize)
 	}
 
+	if maxFrameSize, ok := wsConfigMap["max_frame_size"].(float64); ok {
+		cfg.MaxFrameSize = int64(maxFrameSize)
+	}
+
 	if passthroughHeaders, ok := wsConfigMap["passthrough_headers"].([]interface{}); ok {
 		for _, header := range passthroughHeaders {
 			if headerStr, ok := header.(string); ok {
@@ -307,6 +896,22 @@ func parseWebSocketConfig(extraConfig config.ExtraConfig) (Config, bool) {
 		}
 	}
 
+	if forwardHeaders, ok := wsConfigMap["forward_headers"].([]interface{}); ok {
+		for _, header := range forwardHeaders {
+			if headerStr, ok := header.(string); ok {
+				cfg.ForwardHeaders = append(cfg.ForwardHeaders, headerStr)
+			}
+		}
+	}
+
+	if forwardHeaderPrefixes, ok := wsConfigMap["forward_header_prefixes"].([]interface{}); ok {
+		for _, prefix := range forwardHeaderPrefixes {
+			if prefixStr, ok := prefix.(string); ok {
+				cfg.ForwardHeaderPrefixes = append(cfg.ForwardHeaderPrefixes, prefixStr)
+			}
+		}
+	}
+
 	if passAllHeaders, ok := wsConfigMap["pass_all_headers"].(bool); ok {
 		cfg.PassAllHeaders = passAllHeaders
 	}
@@ -320,209 +925,1664 @@ func parseWebSocketConfig(extraConfig config.ExtraConfig) (Config, bool) {
 		}
 	}
 
-	return cfg, true
-}
-
-// handleWebSocketConnection manages the WebSocket upgrade and connection lifecycle
-func (w *HandlerFactory) handleWebSocketConnection(c *gin.Context, cfg *config.EndpointConfig, p proxy.Proxy, wsConfig Config, forwardHeaders map[string]string) {
-
-	// Validate backend configuration
-	if len(cfg.Backend) == 0 {
-		w.logger.Error("No backend configured for WebSocket endpoint")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "No backend configured"})
-		return
+	if coalesceWindowStr, ok := wsConfigMap["coalesce_window"].(string); ok {
+		if duration, err := time.ParseDuration(coalesceWindowStr); err == nil {
+			cfg.CoalesceWindow = duration
+		}
 	}
 
-	// Accept the WebSocket connection
-	acceptOpts := &websocket.AcceptOptions{
-		Subprotocols:       wsConfig.Subprotocols,
-		CompressionMode:    websocket.CompressionNoContextTakeover,
-		InsecureSkipVerify: true, // Allow cross-origin connections for development
+	if coalesceMaxBatch, ok := wsConfigMap["coalesce_max_batch"].(float64); ok {
+		cfg.CoalesceMaxBatch = int(coalesceMaxBatch)
 	}
 
-	if wsConfig.Compression {
-		acceptOpts.CompressionMode = websocket.CompressionContextTakeover
+	if sendQueueSize, ok := wsConfigMap["send_queue_size"].(float64); ok {
+		cfg.SendQueueSize = int(sendQueueSize)
 	}
 
-	conn, err := websocket.Accept(c.Writer, c.Request, acceptOpts)
-	if err != nil {
-		w.logger.Error("WebSocket upgrade failed:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "WebSocket upgrade failed"})
-		return
+	if overflowPolicy, ok := wsConfigMap["overflow_policy"].(string); ok {
+		cfg.OverflowPolicy = overflowPolicy
 	}
-	defer conn.Close(websocket.StatusInternalError, "Internal error")
 
-	// Set read limit for client connection
-	if wsConfig.MaxMessageSize > 0 {
-		conn.SetReadLimit(wsConfig.MaxMessageSize)
-		w.logger.Debug(fmt.Sprintf("Set client read limit to %d bytes", wsConfig.MaxMessageSize))
+	if strictValidation, ok := wsConfigMap["strict_validation"].(bool); ok {
+		cfg.StrictValidation = strictValidation
 	}
 
-	w.logger.Debug("WebSocket connection established for:", cfg.Endpoint)
-
-	// Handle the WebSocket connection lifecycle with forward headers
-	w.handleConnectionLifecycle(c.Request.Context(), conn, cfg, p, wsConfig, forwardHeaders)
-}
-
-// handleConnectionLifecycle manages the WebSocket connection lifecycle and establishes backend proxy
-func (w *HandlerFactory) handleConnectionLifecycle(ctx context.Context, clientConn *websocket.Conn, cfg *config.EndpointConfig, p proxy.Proxy, wsConfig Config, forwardHeaders map[string]string) {
-	// Create a context for this connection
-	connCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	// Establish WebSocket connection to backend
-	backendConn, err := w.connectToBackend(connCtx, cfg, wsConfig, forwardHeaders)
-	if err != nil {
-		w.logger.Error("Failed to connect to backend WebSocket:", err)
-		clientConn.Close(websocket.StatusInternalError, "Backend connection failed")
-		return
+	if requireUpgrade, ok := wsConfigMap["require_upgrade"].(bool); ok {
+		cfg.RequireUpgrade = requireUpgrade
 	}
-	defer backendConn.Close(websocket.StatusNormalClosure, "Connection closed")
 
-	w.logger.Debug("Established proxy connection between client and backend")
+	if framing, ok := wsConfigMap["framing"].(string); ok {
+		cfg.Framing = framing
+	}
 
-	// Start bidirectional proxying
-	errChan := make(chan error, 2)
+	if grpcMaxMessageSize, ok := wsConfigMap["grpc_max_message_size"].(float64); ok {
+		cfg.GRPCMaxMessageSize = int64(grpcMaxMessageSize)
+	}
 
-	// Proxy: Client -> Backend
-	go func() {
-		errChan <- w.proxyMessages(connCtx, clientConn, backendConn, "client->backend")
-	}()
+	if defaultSubprotocol, ok := wsConfigMap["default_subprotocol"].(string); ok {
+		cfg.DefaultSubprotocol = defaultSubprotocol
+	}
 
-	// Proxy: Backend -> Client
-	go func() {
-		errChan <- w.proxyMessages(connCtx, backendConn, clientConn, "backend->client")
-	}()
+	if requireSubprotocol, ok := wsConfigMap["require_subprotocol"].(bool); ok {
+		cfg.RequireSubprotocol = requireSubprotocol
+	}
 
-	// Wait for either direction to fail or context to be cancelled
-	select {
-	case err := <-errChan:
-		if err != nil {
-			w.logger.Error("WebSocket proxy error:", err)
+	if deniedSubprotocols, ok := wsConfigMap["denied_subprotocols"].([]interface{}); ok {
+		for _, sp := range deniedSubprotocols {
+			if spStr, ok := sp.(string); ok {
+				cfg.DeniedSubprotocols = append(cfg.DeniedSubprotocols, spStr)
+			}
 		}
-	case <-connCtx.Done():
-		w.logger.Debug("WebSocket proxy context cancelled")
 	}
-}
-
-// connectToBackend establishes a WebSocket connection to the backend service
-func (w *HandlerFactory) connectToBackend(ctx context.Context, cfg *config.EndpointConfig, wsConfig Config, forwardHeaders map[string]string) (*websocket.Conn, error) {
-	// Support both old and new configuration formats
-	var wsURL string
-	var err error
 
-	// Try new format first (backend/backend_path in extra_config)
-	if backendName, ok := cfg.ExtraConfig["backend"].(string); ok {
-		if backendPath, ok := cfg.ExtraConfig["backend_path"].(string); ok {
-			wsURL, err = w.deriveWebSocketURL(backendName, backendPath, wsConfig.BackendScheme)
-			if err != nil {
-				return nil, err
+	if allowedUpgradePaths, ok := wsConfigMap["allowed_upgrade_paths"].([]interface{}); ok {
+		for _, pattern := range allowedUpgradePaths {
+			if patternStr, ok := pattern.(string); ok {
+				cfg.AllowedUpgradePaths = append(cfg.AllowedUpgradePaths, patternStr)
 			}
-		} else {
-			return nil, fmt.Errorf("no backend_path configured in endpoint")
-		}
-	} else {
-		// Fallback to old format (backend array)
-		if len(cfg.Backend) == 0 {
-			return nil, fmt.Errorf("no backend configured for WebSocket endpoint")
 		}
+	}
 
-		backend := cfg.Backend[0]
-		if len(backend.Host) == 0 {
-			return nil, fmt.Errorf("no host configured in backend")
+	if deniedUpgradePaths, ok := wsConfigMap["denied_upgrade_paths"].([]interface{}); ok {
+		for _, pattern := range deniedUpgradePaths {
+			if patternStr, ok := pattern.(string); ok {
+				cfg.DeniedUpgradePaths = append(cfg.DeniedUpgradePaths, patternStr)
+			}
 		}
+	}
 
-		// Convert HTTP backend to WebSocket URL
-		httpHost := backend.Host[0]
-		urlPattern := backend.URLPattern
+	if upgradePathAction, ok := wsConfigMap["upgrade_path_action"].(string); ok {
+		cfg.UpgradePathAction = upgradePathAction
+	}
 
-		wsURL, err = w.convertHTTPToWebSocketURL(httpHost, urlPattern, wsConfig.BackendScheme)
-		if err != nil {
-			return nil, err
-		}
+	if eventLog, ok := wsConfigMap["event_log"].(bool); ok {
+		cfg.EventLog = eventLog
 	}
 
-	// Override scheme if specified in config
-	if wsConfig.BackendScheme != "" {
-		parsedURL, err := url.Parse(wsURL)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse WebSocket URL: %w", err)
-		}
-		parsedURL.Scheme = wsConfig.BackendScheme
-		wsURL = parsedURL.String()
+	if inferSchemeFromPort, ok := wsConfigMap["infer_scheme_from_port"].(bool); ok {
+		cfg.InferSchemeFromPort = inferSchemeFromPort
 	}
 
-	w.logger.Debug(fmt.Sprintf("Connecting to backend WebSocket: %s", wsURL))
+	if subprotocolHeader, ok := wsConfigMap["subprotocol_header"].(string); ok {
+		cfg.SubprotocolHeader = subprotocolHeader
+	}
+
+	if compressionEnableHeader, ok := wsConfigMap["compression_enable_header"].(string); ok {
+		cfg.CompressionEnableHeader = compressionEnableHeader
+	}
+
+	if compressionEnableValues, ok := wsConfigMap["compression_enable_values"].([]interface{}); ok {
+		for _, value := range compressionEnableValues {
+			if valueStr, ok := value.(string); ok {
+				cfg.CompressionEnableValues = append(cfg.CompressionEnableValues, valueStr)
+			}
+		}
+	}
+
+	if compressionMode, ok := wsConfigMap["compression_mode"].(string); ok {
+		cfg.CompressionMode = compressionMode
+	}
+
+	if compressionThreshold, ok := wsConfigMap["compression_threshold"].(float64); ok {
+		cfg.CompressionThreshold = int(compressionThreshold)
+	}
+
+	if authSignatureSecret, ok := wsConfigMap["auth_signature_secret"].(string); ok {
+		cfg.AuthSignatureSecret = redactedString(authSignatureSecret)
+	}
+
+	if captureSampleRate, ok := wsConfigMap["capture_sample_rate"].(float64); ok {
+		cfg.CaptureSampleRate = captureSampleRate
+	}
+
+	if traceSampleRate, ok := wsConfigMap["trace_sample_rate"].(float64); ok {
+		cfg.TraceSampleRate = traceSampleRate
+	}
+
+	if verboseTracing, ok := wsConfigMap["verbose_tracing"].(bool); ok {
+		cfg.VerboseTracing = verboseTracing
+	}
+
+	if allowedOrigins, ok := wsConfigMap["allowed_origins"].([]interface{}); ok {
+		for _, origin := range allowedOrigins {
+			if originStr, ok := origin.(string); ok {
+				cfg.AllowedOrigins = append(cfg.AllowedOrigins, originStr)
+			}
+		}
+	}
+
+	if strictUpgradeHeaders, ok := wsConfigMap["strict_upgrade_headers"].(bool); ok {
+		cfg.StrictUpgradeHeaders = strictUpgradeHeaders
+	}
+
+	if maxHeaderCount, ok := wsConfigMap["max_header_count"].(float64); ok {
+		cfg.MaxHeaderCount = int(maxHeaderCount)
+	}
+
+	if writeTimeout, ok := wsConfigMap["write_timeout"].(string); ok {
+		if duration, err := time.ParseDuration(writeTimeout); err == nil {
+			cfg.WriteTimeout = duration
+		}
+	}
+
+	if minWriteThroughput, ok := wsConfigMap["min_write_throughput_bytes_per_sec"].(float64); ok {
+		cfg.MinWriteThroughputBytesPerSec = int64(minWriteThroughput)
+	}
+
+	if slowWriteThreshold, ok := wsConfigMap["slow_write_threshold"].(string); ok {
+		if duration, err := time.ParseDuration(slowWriteThreshold); err == nil {
+			cfg.SlowWriteThreshold = duration
+		}
+	}
+
+	if writeRetryCount, ok := wsConfigMap["write_retry_count"].(float64); ok {
+		cfg.WriteRetryCount = int(writeRetryCount)
+	}
+
+	if dialRetries, ok := wsConfigMap["dial_retries"].(float64); ok {
+		cfg.DialRetries = int(dialRetries)
+	}
+
+	if dialBackoffStr, ok := wsConfigMap["dial_backoff"].(string); ok {
+		if duration, err := time.ParseDuration(dialBackoffStr); err == nil {
+			cfg.DialBackoff = duration
+		}
+	}
+
+	if reconnectOnCloseCodes, ok := wsConfigMap["reconnect_on_close_codes"].([]interface{}); ok {
+		for _, code := range reconnectOnCloseCodes {
+			if codeNum, ok := code.(float64); ok {
+				cfg.ReconnectOnCloseCodes = append(cfg.ReconnectOnCloseCodes, int(codeNum))
+			}
+		}
+	}
+
+	if backendPathSuffix, ok := wsConfigMap["backend_path_suffix"].(string); ok {
+		cfg.BackendPathSuffix = backendPathSuffix
+	}
+
+	if defaultBackendPath, ok := wsConfigMap["default_backend_path"].(string); ok {
+		cfg.DefaultBackendPath = defaultBackendPath
+	}
+
+	if forwardQueryString, ok := wsConfigMap["forward_query_string"].(bool); ok {
+		cfg.ForwardQueryString = forwardQueryString
+	}
+
+	if fallbackBackend, ok := wsConfigMap["fallback_backend"].(string); ok {
+		cfg.FallbackBackend = fallbackBackend
+	}
+
+	if fanoutBackends, ok := wsConfigMap["fanout_backends"].([]interface{}); ok {
+		for _, backend := range fanoutBackends {
+			if backendStr, ok := backend.(string); ok {
+				cfg.FanoutBackends = append(cfg.FanoutBackends, backendStr)
+			}
+		}
+	}
+
+	if autocorrectScheme, ok := wsConfigMap["autocorrect_scheme"].(bool); ok {
+		cfg.AutocorrectScheme = autocorrectScheme
+	}
+
+	if backendFailureMessage, ok := wsConfigMap["backend_failure_message"].(string); ok {
+		cfg.BackendFailureMessage = backendFailureMessage
+	}
+
+	if backendLocalAddr, ok := wsConfigMap["backend_local_addr"].(string); ok {
+		cfg.BackendLocalAddr = backendLocalAddr
+	}
+
+	if backendTLSMinVersion, ok := wsConfigMap["backend_tls_min_version"].(string); ok {
+		cfg.BackendTLSMinVersion = backendTLSMinVersion
+	}
+
+	if backendTLSCertFile, ok := wsConfigMap["backend_tls_cert_file"].(string); ok {
+		cfg.BackendTLSCertFile = backendTLSCertFile
+	}
+
+	if backendTLSKeyFile, ok := wsConfigMap["backend_tls_key_file"].(string); ok {
+		cfg.BackendTLSKeyFile = backendTLSKeyFile
+	}
+
+	if backendCAFile, ok := wsConfigMap["backend_ca_file"].(string); ok {
+		cfg.BackendCAFile = backendCAFile
+	}
+
+	if maxConnectionsPerIdentity, ok := wsConfigMap["max_connections_per_identity"].(float64); ok {
+		cfg.MaxConnectionsPerIdentity = int(maxConnectionsPerIdentity)
+	}
+
+	if identityHeader, ok := wsConfigMap["identity_header"].(string); ok && identityHeader != "" {
+		cfg.IdentityHeader = identityHeader
+	}
+
+	if totalHandshakeBudgetStr, ok := wsConfigMap["total_handshake_budget"].(string); ok {
+		if duration, err := time.ParseDuration(totalHandshakeBudgetStr); err == nil {
+			cfg.TotalHandshakeBudget = duration
+		}
+	}
+
+	if maxConcurrentHandshakes, ok := wsConfigMap["max_concurrent_handshakes"].(float64); ok {
+		cfg.MaxConcurrentHandshakes = int(maxConcurrentHandshakes)
+	}
+
+	if acceptQueueWaitTimeoutStr, ok := wsConfigMap["accept_queue_wait_timeout"].(string); ok {
+		if duration, err := time.ParseDuration(acceptQueueWaitTimeoutStr); err == nil {
+			cfg.AcceptQueueWaitTimeout = duration
+		}
+	}
+
+	if clientIdleTimeoutStr, ok := wsConfigMap["client_idle_timeout"].(string); ok {
+		if duration, err := time.ParseDuration(clientIdleTimeoutStr); err == nil {
+			cfg.ClientIdleTimeout = duration
+		}
+	}
+
+	if backendIdleTimeoutStr, ok := wsConfigMap["backend_idle_timeout"].(string); ok {
+		if duration, err := time.ParseDuration(backendIdleTimeoutStr); err == nil {
+			cfg.BackendIdleTimeout = duration
+		}
+	}
+
+	if drainQuiesceWindowStr, ok := wsConfigMap["drain_quiesce_window"].(string); ok {
+		if duration, err := time.ParseDuration(drainQuiesceWindowStr); err == nil {
+			cfg.DrainQuiesceWindow = duration
+		}
+	}
+
+	if maxSingleReadDurationStr, ok := wsConfigMap["max_single_read_duration"].(string); ok {
+		if duration, err := time.ParseDuration(maxSingleReadDurationStr); err == nil {
+			cfg.MaxSingleReadDuration = duration
+		}
+	}
+
+	if closeHandshakeTimeoutStr, ok := wsConfigMap["close_handshake_timeout"].(string); ok {
+		if duration, err := time.ParseDuration(closeHandshakeTimeoutStr); err == nil {
+			cfg.CloseHandshakeTimeout = duration
+		}
+	}
+
+	if idleTimeoutStr, ok := wsConfigMap["idle_timeout"].(string); ok {
+		if duration, err := time.ParseDuration(idleTimeoutStr); err == nil {
+			cfg.IdleTimeout = duration
+		}
+	}
+
+	if pingIntervalStr, ok := wsConfigMap["ping_interval"].(string); ok {
+		if duration, err := time.ParseDuration(pingIntervalStr); err == nil {
+			cfg.PingInterval = duration
+		}
+	}
+
+	if transcodeBase64, ok := wsConfigMap["transcode_base64"].(bool); ok {
+		cfg.TranscodeBase64 = transcodeBase64
+	}
+
+	if compressAfterMessages, ok := wsConfigMap["compress_after_messages"].(float64); ok {
+		cfg.CompressAfterMessages = int(compressAfterMessages)
+	}
+
+	if adaptiveCompression, ok := wsConfigMap["adaptive_compression"].(float64); ok {
+		cfg.AdaptiveCompression = adaptiveCompression
+	}
+
+	if adaptiveCompressionSamples, ok := wsConfigMap["adaptive_compression_samples"].(float64); ok && adaptiveCompressionSamples > 0 {
+		cfg.AdaptiveCompressionSamples = int(adaptiveCompressionSamples)
+	}
+
+	if clientMessageRateLimit, ok := wsConfigMap["client_message_rate_limit"].(float64); ok {
+		cfg.ClientMessageRateLimit = clientMessageRateLimit
+	}
+
+	if clientMessageBurst, ok := wsConfigMap["client_message_burst"].(float64); ok {
+		cfg.ClientMessageBurst = int(clientMessageBurst)
+	}
+
+	if rateLimitAction, ok := wsConfigMap["rate_limit_action"].(string); ok {
+		cfg.RateLimitAction = rateLimitAction
+	}
+
+	if maxInflightBytes, ok := wsConfigMap["max_inflight_bytes"].(float64); ok {
+		cfg.MaxInflightBytes = int64(maxInflightBytes)
+	}
+
+	if inflightLimitAction, ok := wsConfigMap["inflight_limit_action"].(string); ok {
+		cfg.InflightLimitAction = inflightLimitAction
+	}
+
+	if interceptorBufferPool, ok := wsConfigMap["interceptor_buffer_pool"].(bool); ok {
+		cfg.InterceptorBufferPool = interceptorBufferPool
+	}
+
+	if staticHeaders, ok := wsConfigMap["backend_headers"].(map[string]interface{}); ok {
+		cfg.BackendHeaders = make(backendHeaders, len(staticHeaders))
+		for name, value := range staticHeaders {
+			if valueStr, ok := value.(string); ok {
+				cfg.BackendHeaders[name] = valueStr
+			}
+		}
+	}
+
+	if pathPrefixBackends, ok := wsConfigMap["path_prefix_backends"].(map[string]interface{}); ok {
+		cfg.PathPrefixBackends = make(map[string]string, len(pathPrefixBackends))
+		for prefix, backend := range pathPrefixBackends {
+			if backendStr, ok := backend.(string); ok {
+				cfg.PathPrefixBackends[prefix] = backendStr
+			}
+		}
+	}
+
+	if firstFrameRouting, ok := wsConfigMap["first_frame_routing"].(map[string]interface{}); ok {
+		cfg.FirstFrameRouting = make(map[string]string, len(firstFrameRouting))
+		for route, backend := range firstFrameRouting {
+			if backendStr, ok := backend.(string); ok {
+				cfg.FirstFrameRouting[route] = backendStr
+			}
+		}
+	}
+
+	if routingTimeoutStr, ok := wsConfigMap["routing_timeout"].(string); ok {
+		if duration, err := time.ParseDuration(routingTimeoutStr); err == nil {
+			cfg.RoutingTimeout = duration
+		}
+	}
+
+	// The timeouts block takes precedence over the flat keys of the same timeouts
+	if timeouts, ok := wsConfigMap["timeouts"].(map[string]interface{}); ok {
+		cfg.setTimeouts(parseTimeouts(timeouts, cfg.timeouts()))
+	}
+
+	return cfg, true
+}
+
+// validateConfig returns a warning for every suspicious combination of WebSocket settings
+func validateConfig(cfg Config) []string {
+	var warnings []string
+
+	if cfg.MaxMessageSize > 0 && cfg.MaxMessageSize < minRecommendedMaxMessageSize {
+		warnings = append(warnings, fmt.Sprintf("max_message_size of %d bytes is suspiciously small (below %d bytes)", cfg.MaxMessageSize, minRecommendedMaxMessageSize))
+	}
+
+	if cfg.MaxMessageSize > 0 && cfg.MaxMessageSize < int64(cfg.ReadBufferSize) {
+		warnings = append(warnings, fmt.Sprintf("max_message_size of %d bytes is smaller than read_buffer_size of %d bytes", cfg.MaxMessageSize, cfg.ReadBufferSize))
+	}
+
+	if cfg.MaxFrameSize > 0 && cfg.MaxMessageSize > 0 && cfg.MaxFrameSize >= cfg.MaxMessageSize {
+		warnings = append(warnings, fmt.Sprintf("max_frame_size of %d bytes is not below max_message_size of %d bytes: it never triggers", cfg.MaxFrameSize, cfg.MaxMessageSize))
+	}
+
+	if cfg.MaxMessageSize == 0 && cfg.SendQueueSize > 0 {
+		warnings = append(warnings, fmt.Sprintf("max_message_size is 0 (no limit) while send_queue_size is %d: the queue bounds the number of buffered messages but not their size", cfg.SendQueueSize))
+	}
+
+	switch cfg.OverflowPolicy {
+	case "", OverflowPolicyBlock, OverflowPolicyDropOldest, OverflowPolicyClose:
+		if cfg.OverflowPolicy != "" && cfg.SendQueueSize == 0 {
+			warnings = append(warnings, "overflow_policy has no effect without send_queue_size")
+		}
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown overflow_policy %q, a full send queue will block", cfg.OverflowPolicy))
+	}
+
+	if cfg.Framing != "" && cfg.Framing != FramingGRPCWeb {
+		warnings = append(warnings, fmt.Sprintf("unknown framing %q, messages will be proxied opaquely", cfg.Framing))
+	}
+
+	if _, ok := compressionModes[cfg.CompressionMode]; cfg.CompressionMode != "" && !ok {
+		warnings = append(warnings, fmt.Sprintf("unknown compression_mode %q, compression follows the compression option", cfg.CompressionMode))
+	}
+
+	if cfg.RateLimitAction != "" && cfg.RateLimitAction != RateLimitActionBlock && cfg.RateLimitAction != RateLimitActionClose {
+		warnings = append(warnings, fmt.Sprintf("unknown rate_limit_action %q, clients over the rate will be blocked", cfg.RateLimitAction))
+	}
+
+	if cfg.InflightLimitAction != "" && cfg.InflightLimitAction != InflightLimitActionBlock && cfg.InflightLimitAction != InflightLimitActionClose {
+		warnings = append(warnings, fmt.Sprintf("unknown inflight_limit_action %q, connections over max_inflight_bytes will be blocked", cfg.InflightLimitAction))
+	}
+
+	warnings = append(warnings, upgradePathWarnings(cfg)...)
+
+	if cfg.AdaptiveCompression > 0 && cfg.CompressAfterMessages == 0 {
+		warnings = append(warnings, "adaptive_compression has no effect without compress_after_messages")
+	}
+
+	if cfg.MinWriteThroughputBytesPerSec > 0 && cfg.WriteTimeout == 0 {
+		warnings = append(warnings, "min_write_throughput_bytes_per_sec has no effect without write_timeout")
+	}
+
+	if cfg.CaptureSampleRate < 0 || cfg.CaptureSampleRate > 1 {
+		warnings = append(warnings, fmt.Sprintf("capture_sample_rate of %v is outside [0, 1]", cfg.CaptureSampleRate))
+	}
+
+	if cfg.TraceSampleRate < 0 || cfg.TraceSampleRate > 1 {
+		warnings = append(warnings, fmt.Sprintf("trace_sample_rate of %v is outside [0, 1]", cfg.TraceSampleRate))
+	}
+
+	if cfg.BackendLocalAddr != "" && net.ParseIP(cfg.BackendLocalAddr) == nil {
+		warnings = append(warnings, fmt.Sprintf("backend_local_addr %q is not an IP address, backend connections will fail", cfg.BackendLocalAddr))
+	}
+
+	if _, ok := tlsVersions[cfg.BackendTLSMinVersion]; cfg.BackendTLSMinVersion != "" && !ok {
+		warnings = append(warnings, fmt.Sprintf("unknown backend_tls_min_version %q, backend connections will fail", cfg.BackendTLSMinVersion))
+	}
+
+	warnings = append(warnings, cfg.timeouts().validate()...)
+
+	return warnings
+}
+
+// handleWebSocketConnection manages the WebSocket upgrade and connection lifecycle
+func (w *HandlerFactory) handleWebSocketConnection(c *gin.Context, cfg *config.EndpointConfig, p proxy.Proxy, wsConfig Config, forwardHeaders map[string][]string, budget handshakeBudget) {
+
+	// Validate backend configuration
+	if len(cfg.Backend) == 0 {
+		w.logger.Error("No backend configured for WebSocket endpoint")
+		w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionNoBackend)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "No backend configured"})
+		return
+	}
+
+	// Fail before the accept on backend_path placeholders the route does not capture
+	if backendPath, ok := cfg.ExtraConfig["backend_path"].(string); ok {
+		if _, err := expandBackendPath(backendPath, c.Params); err != nil {
+			w.logger.Error(fmt.Sprintf("[ENDPOINT: %s] Cannot resolve the backend path: %v", cfg.Endpoint, err))
+			w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionUnmatchedPathParam)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Backend path cannot be resolved"})
+			return
+		}
+	}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), pathParamsContextKey, c.Params))
+
+	// Only version 13 exists, tell clients requesting another one which version to use
+	if version := c.Request.Header.Get("Sec-WebSocket-Version"); version != supportedWebSocketVersion {
+		w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Rejecting upgrade requesting unsupported WebSocket version %q", cfg.Endpoint, version))
+		c.Header("Sec-WebSocket-Version", supportedWebSocketVersion)
+		w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionUnsupportedVersion)
+		c.JSON(http.StatusUpgradeRequired, gin.H{"error": fmt.Sprintf("Unsupported WebSocket version %q, only version %s is supported", version, supportedWebSocketVersion)})
+		return
+	}
+
+	// Reject clients asking for a forbidden subprotocol
+	if denied := deniedSubprotocol(requestedSubprotocols(c.Request), wsConfig.DeniedSubprotocols); denied != "" {
+		w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Rejecting upgrade requesting denied subprotocol %s", cfg.Endpoint, denied))
+		w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionDeniedSubprotocol)
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Subprotocol %s is not allowed", denied)})
+		return
+	}
+
+	// Accepting hijacks the underlying connection, fail clearly when that is not possible
+	if !supportsHijacking(c.Writer, c.Request) {
+		w.logger.Error(fmt.Sprintf("[ENDPOINT: %s] Cannot upgrade to WebSocket: the response writer does not support hijacking (protocol %s)", cfg.Endpoint, c.Request.Proto))
+		w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionHijackUnsupported)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebSocket upgrade not supported: connection cannot be hijacked (HTTP/2 or a wrapping response writer)"})
+		return
+	}
+
+	// Cap the simultaneous connections of the whole factory, before any of them is accepted
+	if !w.acquireConnectionSlot() {
+		w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Rejecting upgrade: %d connection(s) already open, the max_connections limit", cfg.Endpoint, w.maxConnections))
+		w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionAtCapacity)
+		c.Header("Retry-After", strconv.Itoa(maxConnectionsRetryAfter))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many WebSocket connections, retry later"})
+		return
+	}
+	defer w.releaseConnectionSlot()
+
+	// Cap the simultaneous connections of a single client identity
+	if wsConfig.MaxConnectionsPerIdentity > 0 {
+		if identity := c.Request.Header.Get(wsConfig.IdentityHeader); identity != "" {
+			key := cfg.Endpoint + "\x00" + identity
+			if !w.connections.acquireIdentity(key, wsConfig.MaxConnectionsPerIdentity) {
+				w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Rejecting upgrade: %s %s already holds %d connection(s)", cfg.Endpoint, wsConfig.IdentityHeader, identity, wsConfig.MaxConnectionsPerIdentity))
+				w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionIdentityLimit)
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many WebSocket connections"})
+				return
+			}
+			defer w.connections.releaseIdentity(key)
+		}
+	}
+
+	// Wait in line for an accept slot of the endpoint, within what is left of the handshake budget
+	queue := w.handshakeQueue(cfg.Endpoint, wsConfig)
+	queueCtx, cancelQueue := budget.context(c.Request.Context())
+	acquired := queue.acquire(queueCtx)
+	cancelQueue()
+	if !acquired {
+		if budget.exceeded() {
+			w.rejectExceededHandshakeBudget(c, cfg, "waiting for an accept slot")
+			return
+		}
+		w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Rejecting upgrade: no accept slot freed within %s", cfg.Endpoint, wsConfig.AcceptQueueWaitTimeout))
+		w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionQueueTimeout)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Timed out waiting for a WebSocket accept slot"})
+		return
+	}
+
+	// Accept the WebSocket connection. No Sec-WebSocket-Protocol header is sent when none is negotiated.
+	// Without allowed_origins any origin may connect, otherwise nhooyr rejects other origins with HTTP 403
+	acceptOpts := &websocket.AcceptOptions{
+		Subprotocols:         wsConfig.Subprotocols,
+		CompressionMode:      compressionMode(c.Request, wsConfig),
+		CompressionThreshold: wsConfig.CompressionThreshold,
+		InsecureSkipVerify:   len(wsConfig.AllowedOrigins) == 0,
+		OriginPatterns:       wsConfig.AllowedOrigins,
+	}
+	if w.acceptOptionsFunc != nil {
+		customized := w.acceptOptionsFunc(c, *acceptOpts)
+		acceptOpts = &customized
+	}
+
+	if budget.exceeded() {
+		queue.release()
+		w.rejectExceededHandshakeBudget(c, cfg, "before the accept")
+		return
+	}
+
+	// Count the client socket traffic to report the achieved compression ratio
+	stats := &connStats{}
+
+	// Cut off clients that stall the handshake, Accept itself has no timeout
+	handshakeWriter := &handshakeResponseWriter{ResponseWriter: c.Writer, timeout: wsConfig.HandshakeTimeout}
+
+	countingWriter := &countingResponseWriter{ResponseWriter: handshakeWriter, stats: stats}
+	conn, err := websocket.Accept(countingWriter, c.Request, acceptOpts)
+	queue.release()
+	if err != nil {
+		w.logger.Error("WebSocket upgrade failed:", err)
+		w.metrics.addUpgradeRejection(cfg.Endpoint, rejectionAcceptFailed)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "WebSocket upgrade failed"})
+		return
+	}
+	if err := handshakeWriter.done(); err != nil {
+		w.logger.Error("Failed to clear the handshake deadline:", err)
+		conn.Close(websocket.StatusInternalError, "Internal error")
+		return
+	}
+	defer conn.Close(websocket.StatusInternalError, "Internal error")
+
+	// Tell the backend which subprotocol the session speaks
+	subprotocol := sessionSubprotocol(c.Request, conn, wsConfig)
+	if wsConfig.SubprotocolHeader != "" {
+		setNegotiatedSubprotocolHeader(forwardHeaders, wsConfig.SubprotocolHeader, subprotocol)
+	}
+
+	// Tag every log line of this connection with its ID and user
+	connID := newConnectionID()
+	logger := newConnectionLogger(w.logger, cfg.Endpoint, connID, forwardHeaders)
+
+	// Set read limit for client connection
+	if wsConfig.MaxMessageSize > 0 {
+		conn.SetReadLimit(wsConfig.MaxMessageSize)
+		logger.Debug(fmt.Sprintf("Set client read limit to %d bytes", wsConfig.MaxMessageSize))
+	}
+
+	logger.Debug("WebSocket connection established for:", cfg.Endpoint)
+
+	pc := &proxyConnection{
+		id:        connID,
+		endpoint:  cfg.Endpoint,
+		logger:    logger,
+		client:    conn,
+		clientNet: countingWriter.conn,
+		clientIP:  c.ClientIP(),
+		stats:     stats,
+		startedAt: time.Now(),
+		captured:  w.currentCaptureSink() != nil && sampleConnection(wsConfig.CaptureSampleRate),
+		traced:    sampleTrace(c.Request, wsConfig.TraceSampleRate),
+
+		interceptors: newConnectionInterceptors(wsConfig, subprotocol, w.subprotocolValidator(subprotocol)),
+
+		closeTimeout: wsConfig.CloseHandshakeTimeout,
+
+		inflight: newInflightBudget(wsConfig.MaxInflightBytes),
+		quiesce:  wsConfig.DrainQuiesceWindow,
+	}
+	pc.markActive()
+	if pc.captured {
+		logger.Debug("Capturing the messages of this connection")
+	}
+
+	// Shutdown started since the upgrade was let through and would not drain this connection
+	if !w.connections.add(pc) {
+		logger.Warning("Closing WebSocket connection: shutting down")
+		pc.closeClient(websocket.StatusGoingAway, shutdownReason)
+		return
+	}
+	defer w.connections.remove(pc, w.metrics)
+	w.metrics.connectionOpened(pc.endpoint)
+	if wsConfig.EventLog {
+		w.logConnectionEvent(eventConnectionOpened, pc, backendTarget{}, 0)
+	}
+
+	// Trace the session, the backend dial carrying its trace context
+	ctx, span := startProxySpan(c.Request, pc, subprotocol, forwardHeaders)
+	pc.verbose = wsConfig.VerboseTracing && span.IsRecording()
+
+	// Handle the WebSocket connection lifecycle with forward headers
+	w.handleConnectionLifecycle(ctx, c.Request, pc, conn, cfg, p, wsConfig, forwardHeaders, budget)
+
+	// Close the client before logging, so the access log reports the status it got
+	pc.closeClient(websocket.StatusInternalError, "Internal error")
+	endProxySpan(span, pc, w.connections.backendOf(pc))
+	if pc.inflight != nil {
+		logger.Debug(logFields("In-flight bytes high-water mark", "bytes", pc.inflight.highWaterMark(), "max_inflight_bytes", wsConfig.MaxInflightBytes))
+	}
+	duration := time.Since(pc.startedAt)
+	w.metrics.addConnectionClose(pc.endpoint, pc.clientCloseCode(), pc.closedBy)
+	w.metrics.connectionClosed(pc.endpoint, duration)
+	if wsConfig.EventLog {
+		w.logConnectionEvent(eventConnectionClosed, pc, w.connections.backendOf(pc), duration)
+	}
+
+	if structured, ok := w.logger.(StructuredLogger); ok {
+		structured.InfoFields("Connection closed", accessLogFields(pc, w.connections.backendOf(pc), duration))
+		return
+	}
+	logger.Info(stats.accessLogLine(duration))
+}
+
+// requestedSubprotocols returns the subprotocols offered by the client in Sec-WebSocket-Protocol
+func requestedSubprotocols(r *http.Request) []string {
+	var subprotocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, sp := range strings.Split(value, ",") {
+			if sp = strings.TrimSpace(sp); sp != "" {
+				subprotocols = append(subprotocols, sp)
+			}
+		}
+	}
+	return subprotocols
+}
+
+// sessionSubprotocol returns the subprotocol negotiated with the client, or default_subprotocol when
+// the client requested none. The default is only spoken with the backend: the client is never
+// answered a subprotocol it did not offer, which RFC 6455 clients reject.
+func sessionSubprotocol(r *http.Request, clientConn *websocket.Conn, wsConfig Config) string {
+	if subprotocol := clientConn.Subprotocol(); subprotocol != "" {
+		return subprotocol
+	}
+	if len(requestedSubprotocols(r)) == 0 {
+		return wsConfig.DefaultSubprotocol
+	}
+	return ""
+}
+
+// deniedSubprotocol returns the first requested subprotocol present in the denylist, or ""
+func deniedSubprotocol(requested, denied []string) string {
+	for _, sp := range requested {
+		for _, deniedSp := range denied {
+			if strings.EqualFold(sp, deniedSp) {
+				return sp
+			}
+		}
+	}
+	return ""
+}
+
+// supportsHijacking reports whether the connection behind w can be taken over for a WebSocket upgrade
+func supportsHijacking(w http.ResponseWriter, r *http.Request) bool {
+	// HTTP/2 and later multiplex streams over a shared connection that cannot be hijacked
+	if r.ProtoMajor != 1 {
+		return false
+	}
+
+	for {
+		if _, ok := w.(http.Hijacker); !ok {
+			return false
+		}
+
+		if unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+			w = unwrapper.Unwrap()
+			continue
+		}
+
+		// gin's writer always implements http.Hijacker and panics when the writer it
+		// embeds does not, so look through embedded response writers as well
+		inner, ok := embeddedResponseWriter(w)
+		if !ok {
+			return true
+		}
+		w = inner
+	}
+}
+
+// embeddedResponseWriter returns the http.ResponseWriter embedded in a wrapping writer struct
+func embeddedResponseWriter(w http.ResponseWriter) (http.ResponseWriter, bool) {
+	v := reflect.ValueOf(w)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	field := v.FieldByName("ResponseWriter")
+	if !field.IsValid() || !field.CanInterface() {
+		return nil, false
+	}
+
+	inner, ok := field.Interface().(http.ResponseWriter)
+	return inner, ok && inner != nil
+}
+
+// setNegotiatedSubprotocolHeader sets header to the negotiated subprotocol, replacing any value
+// forwarded from the client, and drops it when no subprotocol was negotiated
+func setNegotiatedSubprotocolHeader(headers map[string][]string, header, subprotocol string) {
+	for key := range headers {
+		if strings.EqualFold(key, header) {
+			delete(headers, key)
+		}
+	}
+	if subprotocol != "" {
+		headers[header] = []string{subprotocol}
+	}
+}
+
+// Values of compression_mode
+const (
+	CompressionModeDisabled          = "disabled"            // No permessage-deflate
+	CompressionModeNoContextTakeover = "no-context-takeover" // A fresh compression window per message
+	CompressionModeContextTakeover   = "context-takeover"    // A compression window kept across the messages of the connection
+)
+
+var compressionModes = map[string]websocket.CompressionMode{
+	CompressionModeDisabled:          websocket.CompressionDisabled,
+	CompressionModeNoContextTakeover: websocket.CompressionNoContextTakeover,
+	CompressionModeContextTakeover:   websocket.CompressionContextTakeover,
+}
+
+// compressionMode selects the compression mode negotiated with the client: compression_mode when
+// set, context takeover or not depending on compression otherwise. When compression_enable_header
+// is configured, compression is only enabled for requests carrying one of the configured header values.
+func compressionMode(r *http.Request, wsConfig Config) websocket.CompressionMode {
+	enabled, configured := compressionModes[wsConfig.CompressionMode]
+	if !configured {
+		enabled = websocket.CompressionContextTakeover
+	}
+
+	if wsConfig.CompressionEnableHeader != "" {
+		value := strings.TrimSpace(r.Header.Get(wsConfig.CompressionEnableHeader))
+		for _, enableValue := range wsConfig.CompressionEnableValues {
+			if value != "" && value == enableValue {
+				return enabled
+			}
+		}
+		return websocket.CompressionDisabled
+	}
+
+	if configured || wsConfig.Compression {
+		return enabled
+	}
+	return websocket.CompressionNoContextTakeover
+}
+
+// backendCompressionMode returns the compression mode offered to the backend: compression_mode
+// when set, the library default otherwise
+func backendCompressionMode(wsConfig Config) websocket.CompressionMode {
+	if mode, ok := compressionModes[wsConfig.CompressionMode]; ok {
+		return mode
+	}
+	return websocket.CompressionNoContextTakeover
+}
+
+// handleConnectionLifecycle manages the WebSocket connection lifecycle and establishes backend proxy
+func (w *HandlerFactory) handleConnectionLifecycle(ctx context.Context, r *http.Request, pc *proxyConnection, clientConn *websocket.Conn, cfg *config.EndpointConfig, p proxy.Proxy, wsConfig Config, forwardHeaders map[string][]string, budget handshakeBudget) {
+	logger := pc.logger
+	pc.closedBy = initiatorGateway
+
+	// Create a context for this connection
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The first client message selects the backend under first_frame_routing, and is not proxied
+	if len(wsConfig.FirstFrameRouting) > 0 {
+		routingTimeout := wsConfig.RoutingTimeout
+		if routingTimeout == 0 {
+			routingTimeout = wsConfig.HandshakeTimeout
+		}
+		backendName, err := readRoutingDirective(connCtx, pc, wsConfig.FirstFrameRouting, routingTimeout)
+		if err != nil {
+			var closeErr *proxyCloseError
+			if errors.As(err, &closeErr) {
+				logger.Warning(fmt.Sprintf("Rejecting connection: %s", closeErr.reason))
+				pc.closeClient(closeErr.code, closeErr.reason)
+				return
+			}
+			logger.Debug("Client left before sending its routing directive:", err)
+			pc.closedBy = initiatorClient
+			return
+		}
+		logger.Debug(fmt.Sprintf("Routing directive selected backend %s", backendName))
+		r = r.WithContext(context.WithValue(r.Context(), firstFrameBackendContextKey, backendName))
+	}
+
+	// Establish WebSocket connection to backend, within what is left of the handshake budget
+	dialCtx, cancelDial := budget.context(connCtx)
+	backendConn, target, err := w.dialBackend(dialCtx, r, clientConn, cfg, wsConfig, forwardHeaders)
+	cancelDial()
+	if err != nil {
+		if budget.exceeded() {
+			logger.Warning("Handshake budget exceeded while dialing the backend:", err)
+			pc.closeClient(websocket.StatusTryAgainLater, "Handshake budget exceeded")
+			return
+		}
+		var closeErr *proxyCloseError
+		if errors.As(err, &closeErr) {
+			logger.Warning(fmt.Sprintf("Rejecting connection: %s", closeErr.reason))
+			pc.closeClient(closeErr.code, closeErr.reason)
+			return
+		}
+		logger.Error("Failed to connect to backend WebSocket:", err)
+		pc.closedBy = initiatorBackend
+		if wsConfig.BackendFailureMessage != "" {
+			w.sendBackendFailureMessage(connCtx, pc, wsConfig)
+		}
+		// A backend too slow to upgrade may well answer a later attempt
+		if errors.Is(err, errBackendHandshakeTimeout) {
+			pc.closeClient(websocket.StatusTryAgainLater, "Backend handshake timed out")
+			return
+		}
+		pc.closeClient(websocket.StatusInternalError, "Backend connection failed")
+		return
+	}
+	backend := newReconnectableBackend(backendConn)
+	backend.closeTimeout = wsConfig.CloseHandshakeTimeout
+	defer backend.close(websocket.StatusNormalClosure, "Connection closed")
+	backendSubprotocol := backendConn.Subprotocol()
+	w.connections.setBackend(pc, target, w.metrics)
+
+	logger.Debug("Established proxy connection between client and backend")
+
+	// Tee the client messages to the fan-out backends. Only the primary backend answers the client.
+	// They are dialed in the background, each receiving the messages sent once it is connected.
+	var clientDest messageWriter = backend
+	if len(wsConfig.FanoutBackends) > 0 {
+		fanout := newFanoutWriter(connCtx, backend, logger, wsConfig.CloseHandshakeTimeout, w.goProxy)
+		defer fanout.close(websocket.StatusNormalClosure, "Connection closed")
+		for _, name := range wsConfig.FanoutBackends {
+			name := name
+			w.goProxy(func() {
+				w.dialFanoutBackend(connCtx, r, pc, cfg, wsConfig, forwardHeaders, backendSubprotocol, name, fanout)
+			})
+		}
+		clientDest = fanout
+	}
+
+	// Close the connection once no message flows in either direction for the idle timeout
+	pc.activity = newActivityTimer(wsConfig.IdleTimeout, func() {
+		logger.Info(fmt.Sprintf("No message in either direction for %s, closing idle connection", wsConfig.IdleTimeout))
+		pc.closeClient(websocket.StatusPolicyViolation, connectionIdleReason)
+	})
+	defer pc.activity.stop()
+
+	// Start bidirectional proxying
+	results := make(chan proxyResult, 2)
+
+	// Proxy: Client -> Backend, across backend reconnections
+	w.goProxy(func() {
+		results <- proxyResult{directionClientToBackend, w.proxyMessages(connCtx, pc, clientConn, clientDest, directionClientToBackend, wsConfig)}
+	})
+
+	// Proxy: Backend -> Client
+	proxyBackend := func(conn *websocket.Conn) {
+		results <- proxyResult{directionBackendToClient, w.proxyMessages(connCtx, pc, conn, clientConn, directionBackendToClient, wsConfig)}
+	}
+	w.goProxy(func() { proxyBackend(backendConn) })
+
+	// Keep both legs alive through intermediaries dropping idle TCP connections
+	if wsConfig.PingInterval > 0 {
+		w.goProxy(func() { w.pingPeers(connCtx, cancel, pc, clientConn, backend, wsConfig.PingInterval) })
+	}
+
+	// Wait for either direction to fail or context to be cancelled
+	redials := 0
+	for {
+		select {
+		case result := <-results:
+			err := result.err
+
+			// Redial a backend whose connection was lost. A client message whose write failed on
+			// it waits for the replacement and is written again there.
+			if result.direction == directionBackendToClient && redials < wsConfig.WriteRetryCount && backendConnectionLost(err) && connCtx.Err() == nil {
+				redials++
+				logger.Info(logFields("Backend connection lost, redialing", "attempt", redials, "max_attempts", wsConfig.WriteRetryCount, "error", err))
+
+				select {
+				case <-connCtx.Done():
+				case <-time.After(time.Duration(redials) * writeRetryBackoff):
+				}
+				newConn, newTarget, dialErr := w.dialBackendSubprotocol(connCtx, r, cfg, wsConfig, forwardHeaders, backendSubprotocol)
+				if dialErr == nil {
+					backend.replace(newConn)
+					w.connections.setBackend(pc, newTarget, w.metrics)
+					w.goProxy(func() { proxyBackend(newConn) })
+					continue
+				}
+				logger.Error("Failed to redial the backend WebSocket:", dialErr)
+			}
+
+			// Replace the backend when it closed with a status asking for it
+			if closeStatus, ok := reconnectOnClose(err, wsConfig.ReconnectOnCloseCodes); ok && result.direction == directionBackendToClient {
+				logger.Info(fmt.Sprintf("Backend closed with status %d, reconnecting", closeStatus.Code))
+
+				// The client keeps speaking the subprotocol of the first backend, its replacement must too
+				newConn, newTarget, err := w.dialBackendSubprotocol(connCtx, r, cfg, wsConfig, forwardHeaders, backendSubprotocol)
+				if err != nil {
+					logger.Error("Failed to reconnect to backend WebSocket:", err)
+					pc.closedBy = initiatorBackend
+					code, reason := closeStatus.Code, closeStatus.Reason
+					var closeErr *proxyCloseError
+					if errors.As(err, &closeErr) {
+						pc.closedBy = initiatorGateway
+						code, reason = closeErr.code, closeErr.reason
+					}
+					backend.close(code, reason)
+					pc.closeClient(code, reason)
+					return
+				}
+
+				backend.replace(newConn)
+				w.connections.setBackend(pc, newTarget, w.metrics)
+				w.goProxy(func() { proxyBackend(newConn) })
+				continue
+			}
+
+			// A client the gateway already closed (shutdown, idle timeout) fails its reads as well
+			pc.closedBy = errorInitiator(result.direction, err)
+			if pc.clientCloseCode() != 0 {
+				pc.closedBy = initiatorGateway
+			}
+
+			var closeErr *proxyCloseError
+			if errors.As(err, &closeErr) {
+				logger.Debug(logFields("Closing connection", "status", int(closeErr.code), "reason", closeErr.reason))
+				pc.closeClient(closeErr.code, closeErr.reason)
+				backend.close(closeErr.code, closeErr.reason)
+				return
+			}
+
+			// Hand the close status of a peer, reason included, to the other side as is
+			if code, reason, ok := peerCloseStatus(err); ok {
+				logger.Debug(logFields("Peer closed, forwarding its status", "direction", result.direction, "status", int(code), "reason", reason))
+				pc.closeClient(code, reason)
+				backend.close(code, reason)
+				return
+			}
+			if err != nil {
+				logger.Error("WebSocket proxy error:", err)
+			}
+		case <-connCtx.Done():
+			logger.Debug("WebSocket proxy context cancelled")
+		}
+		return
+	}
+}
+
+// sendBackendFailureMessage sends backend_failure_message to a client whose backend could not be dialed
+func (w *HandlerFactory) sendBackendFailureMessage(ctx context.Context, pc *proxyConnection, wsConfig Config) {
+	message := []byte(wsConfig.BackendFailureMessage)
+	if timeout := writeTimeout(len(message), wsConfig); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := pc.client.Write(ctx, websocket.MessageText, message); err != nil {
+		pc.logger.Debug("Failed to send the backend failure message:", err)
+	}
+}
+
+// pingPeers pings the client and the backend every interval until ctx is done. A ping failing,
+// or not answered within the interval, cancels the connection.
+func (w *HandlerFactory) pingPeers(ctx context.Context, cancel context.CancelFunc, pc *proxyConnection, clientConn *websocket.Conn, backend *reconnectableBackend, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ping := func(peer string, pinger func(context.Context) error) bool {
+		pingCtx, cancelPing := context.WithTimeout(ctx, interval)
+		defer cancelPing()
+
+		if err := pinger(pingCtx); err != nil {
+			if ctx.Err() == nil {
+				pc.logger.Warning(fmt.Sprintf("Ping to the %s failed, closing the connection: %v", peer, err))
+				cancel()
+			}
+			return false
+		}
+		return true
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !ping("client", clientConn.Ping) || !ping("backend", backend.Ping) {
+				return
+			}
+		}
+	}
+}
+
+// dialBackend connects to the backend of a client connection. With require_subprotocol, the backend
+// is offered the subprotocol of the session and a *proxyCloseError is returned when it does not
+// accept it. Otherwise only default_subprotocol is offered, to clients requesting none.
+func (w *HandlerFactory) dialBackend(ctx context.Context, r *http.Request, clientConn *websocket.Conn, cfg *config.EndpointConfig, wsConfig Config, forwardHeaders map[string][]string) (*websocket.Conn, backendTarget, error) {
+	subprotocol := sessionSubprotocol(r, clientConn, wsConfig)
+	if wsConfig.RequireSubprotocol {
+		return w.dialBackendSubprotocol(ctx, r, cfg, wsConfig, forwardHeaders, subprotocol)
+	}
+
+	var subprotocols []string
+	if subprotocol != "" && clientConn.Subprotocol() == "" {
+		subprotocols = []string{subprotocol}
+	}
+	return w.connectToBackend(ctx, r, cfg, wsConfig, forwardHeaders, subprotocols)
+}
+
+// dialBackendSubprotocol connects to the backend offering it the required subprotocol, if any, and
+// returns a *proxyCloseError when the backend selects another one
+func (w *HandlerFactory) dialBackendSubprotocol(ctx context.Context, r *http.Request, cfg *config.EndpointConfig, wsConfig Config, forwardHeaders map[string][]string, required string) (*websocket.Conn, backendTarget, error) {
+	var subprotocols []string
+	if required != "" {
+		subprotocols = []string{required}
+	}
+
+	conn, target, err := w.connectToBackend(ctx, r, cfg, wsConfig, forwardHeaders, subprotocols)
+	if err != nil || required == "" || conn.Subprotocol() == required {
+		return conn, target, err
+	}
+
+	reason := fmt.Sprintf("Backend does not support subprotocol %s", required)
+	conn.Close(websocket.StatusProtocolError, reason)
+	return nil, target, &proxyCloseError{code: websocket.StatusProtocolError, reason: reason}
+}
+
+// connectToBackend establishes a WebSocket connection to the backend service
+func (w *HandlerFactory) connectToBackend(ctx context.Context, r *http.Request, cfg *config.EndpointConfig, wsConfig Config, forwardHeaders map[string][]string, subprotocols []string) (*websocket.Conn, backendTarget, error) {
+	targets, err := w.resolveBackendTargets(r, cfg, wsConfig)
+	if err != nil {
+		return nil, backendTarget{}, err
+	}
+	return w.dialBackendTargets(ctx, targets, cfg, wsConfig, forwardHeaders, subprotocols)
+}
+
+// dialBackendTargets dials targets in order and returns the first connection established
+func (w *HandlerFactory) dialBackendTargets(ctx context.Context, targets []backendTarget, cfg *config.EndpointConfig, wsConfig Config, forwardHeaders map[string][]string, subprotocols []string) (*websocket.Conn, backendTarget, error) {
+	// Create request headers with forward headers (may include auth and other headers)
+	headers := make(map[string][]string)
+	for key, values := range forwardHeaders {
+		headers[key] = append([]string(nil), values...)
+		w.logger.Debug(fmt.Sprintf("Adding header to backend connection: %s = %v", key, values))
+	}
+
+	// Static headers fill in what the request did not set, so a per-request token wins
+	if added := wsConfig.BackendHeaders.addStaticHeaders(headers); len(added) > 0 {
+		w.logger.Debug(fmt.Sprintf("Adding static headers to backend connection: %v", added))
+	}
+
+	// Headers are filtered based on websocket configuration (pass_all_headers, passthrough_headers, exclude_headers)
+	// By default, Authorization and Cookie headers are excluded for security
+
+	certs, err := w.backendCertificatesFor(cfg.Endpoint, wsConfig)
+	if err != nil {
+		return nil, backendTarget{}, err
+	}
+	httpClient, err := backendHTTPClient(wsConfig, certs)
+	if err != nil {
+		return nil, backendTarget{}, err
+	}
+
+	// Dial the backend WebSocket, falling through to the next host on failure
+	var failures []string
+	var timeouts int
+	for _, target := range targets {
+		w.logger.Debug(fmt.Sprintf("Connecting to backend WebSocket: %s", target.url))
+
+		conn, dialErr := w.dialWithRetries(ctx, target.url, &websocket.DialOptions{
+			HTTPClient:           httpClient,
+			HTTPHeader:           headers,
+			Subprotocols:         subprotocols,
+			CompressionMode:      backendCompressionMode(wsConfig),
+			CompressionThreshold: wsConfig.CompressionThreshold,
+		}, wsConfig)
+		if dialErr != nil {
+			err = fmt.Errorf("failed to connect to backend WebSocket %s: %w", target.url, dialErr)
+			failures = append(failures, err.Error())
+			if errors.Is(dialErr, errBackendHandshakeTimeout) {
+				timeouts++
+			}
+			if len(targets) > 1 {
+				w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] Backend host %s unavailable: %v", cfg.Endpoint, target.name, dialErr))
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		// Set read limit for backend connection
+		if wsConfig.MaxMessageSize > 0 {
+			conn.SetReadLimit(wsConfig.MaxMessageSize)
+			w.logger.Debug(fmt.Sprintf("Set backend read limit to %d bytes", wsConfig.MaxMessageSize))
+		}
+
+		if len(targets) > 1 {
+			w.logger.Debug(fmt.Sprintf("[ENDPOINT: %s] Connected to backend host %s", cfg.Endpoint, target.name))
+		}
+		return conn, target, nil
+	}
+
+	if len(targets) > 1 {
+		err = fmt.Errorf("no backend host accepted the WebSocket connection (tried %d of %d): %s", len(failures), len(targets), strings.Join(failures, "; "))
+		if timeouts == len(failures) {
+			err = fmt.Errorf("%w: %v", errBackendHandshakeTimeout, err)
+		}
+	}
+	return nil, backendTarget{}, err
+}
+
+// Bounds of the backoff between backend dial retries
+const (
+	defaultDialBackoff = 100 * time.Millisecond
+	maxDialBackoff     = 10 * time.Second
+)
+
+// dialWithRetries dials wsURL, retrying up to dial_retries times when no handshake response is
+// received. Backends answering the handshake, even to reject it, are not dialed again.
+func (w *HandlerFactory) dialWithRetries(ctx context.Context, wsURL string, opts *websocket.DialOptions, wsConfig Config) (*websocket.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, resp, err := dialBackendHandshake(ctx, wsURL, opts, wsConfig.HandshakeTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		if resp != nil || attempt >= wsConfig.DialRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		delay := dialRetryDelay(wsConfig.DialBackoff, attempt)
+		w.logger.Warning(fmt.Sprintf("Backend WebSocket dial of %s failed, retry %d/%d in %s: %v", wsURL, attempt+1, wsConfig.DialRetries, delay, err))
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+	}
+}
 
-	// Create request headers with forward headers (may include auth and other headers)
-	headers := make(map[string][]string)
-	for key, value := range forwardHeaders {
-		headers[key] = []string{value}
-		w.logger.Debug(fmt.Sprintf("Adding header to backend connection: %s = %s", key, value))
+// errBackendHandshakeTimeout is wrapped by the dial errors of backends not completing the upgrade
+// within handshake_timeout
+var errBackendHandshakeTimeout = errors.New("backend WebSocket handshake timed out")
+
+// dialBackendHandshake dials wsURL, abandoning backends that do not complete the upgrade within
+// timeout (0 = no bound)
+func dialBackendHandshake(ctx context.Context, wsURL string, opts *websocket.DialOptions, timeout time.Duration) (*websocket.Conn, *http.Response, error) {
+	if timeout <= 0 {
+		conn, resp, err := websocket.Dial(ctx, wsURL, opts)
+		return conn, resp, describeHandshakeFailure(wsURL, resp, err)
 	}
 
-	// Headers are filtered based on websocket configuration (pass_all_headers, passthrough_headers, exclude_headers)
-	// By default, Authorization and Cookie headers are excluded for security
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	// Dial the backend WebSocket
-	conn, _, err := websocket.Dial(ctx, wsURL, &websocket.DialOptions{
-		HTTPHeader: headers,
-	})
+	conn, resp, err := websocket.Dial(dialCtx, wsURL, opts)
+	if err != nil && ctx.Err() == nil && errors.Is(dialCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %s: %v", errBackendHandshakeTimeout, timeout, err)
+	}
+	return conn, resp, describeHandshakeFailure(wsURL, resp, err)
+}
+
+// describeHandshakeFailure names the status of backends answering the handshake with something
+// else than 101 Switching Protocols, typically a plain HTTP endpoint behind a misconfigured URL
+func describeHandshakeFailure(wsURL string, resp *http.Response, err error) error {
+	if err == nil || resp == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		return err
+	}
+	return fmt.Errorf("backend at %s did not complete WebSocket handshake (status %d): %w", wsURL, resp.StatusCode, err)
+}
+
+// dialRetryDelay returns the wait before dial retry attempt+1: backoff doubled on each attempt,
+// capped to maxDialBackoff, plus up to half of it of random jitter
+func dialRetryDelay(backoff time.Duration, attempt int) time.Duration {
+	if backoff <= 0 {
+		backoff = defaultDialBackoff
+	}
+
+	delay := maxDialBackoff
+	if attempt < 32 && backoff<<uint(attempt) < maxDialBackoff {
+		delay = backoff << uint(attempt)
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// resolveBackendTargets returns the backend WebSocket URLs to dial for a request, in the order to
+// try them. Only the old format lists several hosts, rotated round-robin across connections.
+func (w *HandlerFactory) resolveBackendTargets(r *http.Request, cfg *config.EndpointConfig, wsConfig Config) ([]backendTarget, error) {
+	// Support both old and new configuration formats
+	var targets []backendTarget
+	var backendPath string // Also dialed on the fallback backend
+	var err error
+
+	// The routing directive of the client, when there is one, takes precedence over the request path
+	if backendName, ok := r.Context().Value(firstFrameBackendContextKey).(string); ok {
+		return w.resolveNamedBackendTargets(r, cfg, wsConfig, backendName)
+	} else if backendName, ok := matchPathPrefixBackend(wsConfig.PathPrefixBackends, r.URL.Path); ok {
+		// Route by request path when prefixes are mapped to backends
+		w.logger.Debug(fmt.Sprintf("Request path %s routed to backend %s", r.URL.Path, backendName))
+		backendPath = appendPathSuffix(r.URL.Path, wsConfig.BackendPathSuffix)
+		if targets, err = w.namedBackendTargets(backendName, backendPath, wsConfig); err != nil {
+			return nil, err
+		}
+	} else if backendName, ok := cfg.ExtraConfig["backend"].(string); ok {
+		// New format (backend/backend_path in extra_config)
+		path, err := namedBackendPath(r, cfg, wsConfig)
+		if err != nil {
+			return nil, err
+		}
+		backendPath = appendPathSuffix(path, wsConfig.BackendPathSuffix)
+		if targets, err = w.namedBackendTargets(backendName, backendPath, wsConfig); err != nil {
+			return nil, err
+		}
+	} else {
+		// Fallback to old format (backend array)
+		w.warnLegacyBackendFormat(cfg.Endpoint)
+		if len(cfg.Backend) == 0 {
+			return nil, fmt.Errorf("no backend configured for WebSocket endpoint")
+		}
+
+		backend := cfg.Backend[0]
+		if len(backend.Host) == 0 {
+			return nil, fmt.Errorf("no host configured in backend")
+		}
+
+		// Convert every HTTP backend host to a WebSocket URL, starting from the next in rotation
+		backendPath = appendPathSuffix(backend.URLPattern, wsConfig.BackendPathSuffix)
+		first := w.nextBackendHost(cfg.Endpoint, len(backend.Host))
+		for i := range backend.Host {
+			httpHost := backend.Host[(first+i)%len(backend.Host)]
+			wsURL, err := w.convertHTTPToWebSocketURL(httpHost, backendPath, wsConfig.BackendScheme, wsConfig.InferSchemeFromPort)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, backendTarget{name: httpHost, url: wsURL})
+		}
+	}
+
+	return w.completeBackendTargets(r, targets, backendPath, wsConfig)
+}
+
+// resolveNamedBackendTargets returns the backend WebSocket URLs to dial for the backend named
+// backendName, on the backend path of the endpoint
+func (w *HandlerFactory) resolveNamedBackendTargets(r *http.Request, cfg *config.EndpointConfig, wsConfig Config, backendName string) ([]backendTarget, error) {
+	path, err := namedBackendPath(r, cfg, wsConfig)
+	if err != nil {
+		return nil, err
+	}
+	backendPath := appendPathSuffix(path, wsConfig.BackendPathSuffix)
+	targets, err := w.namedBackendTargets(backendName, backendPath, wsConfig)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to backend WebSocket %s: %w", wsURL, err)
+		return nil, err
 	}
+	return w.completeBackendTargets(r, targets, backendPath, wsConfig)
+}
 
-	// Set read limit for backend connection
-	if wsConfig.MaxMessageSize > 0 {
-		conn.SetReadLimit(wsConfig.MaxMessageSize)
-		w.logger.Debug(fmt.Sprintf("Set backend read limit to %d bytes", wsConfig.MaxMessageSize))
+// completeBackendTargets appends the fallback backend to targets, on backendPath, and normalizes
+// the URLs of all of them
+func (w *HandlerFactory) completeBackendTargets(r *http.Request, targets []backendTarget, backendPath string, wsConfig Config) ([]backendTarget, error) {
+	// Dial the fallback backend last, once every primary target failed or could not be resolved
+	if fallback := wsConfig.FallbackBackend; fallback != "" && !(len(targets) == 1 && targets[0].name == fallback) {
+		wsURL, err := w.deriveWebSocketURL(fallback, backendPath, wsConfig.BackendScheme)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, backendTarget{name: fallback, url: wsURL})
 	}
 
-	return conn, nil
+	for i := range targets {
+		wsURL, err := w.normalizeBackendURL(targets[i].url, wsConfig)
+		if err != nil {
+			return nil, err
+		}
+		if wsConfig.ForwardQueryString {
+			if wsURL, err = mergeQueryString(wsURL, r.URL.RawQuery); err != nil {
+				return nil, err
+			}
+		}
+		targets[i].url = wsURL
+	}
+	return targets, nil
 }
 
-// deriveWebSocketURL converts backend name and path to WebSocket URL
-func (w *HandlerFactory) deriveWebSocketURL(backendName, backendPath, forceScheme string) (string, error) {
-	// Try to get from registry first (if configured)
+// namedBackendTargets returns the target of a backend resolved by name. With fallback_backend, a name
+// missing from the backend registry resolves to no target, leaving the connection to the fallback.
+func (w *HandlerFactory) namedBackendTargets(backendName, backendPath string, wsConfig Config) ([]backendTarget, error) {
+	if wsConfig.FallbackBackend != "" && !w.isKnownBackend(backendName) {
+		w.logger.Warning(fmt.Sprintf("Backend %s cannot be resolved, using the fallback backend %s", backendName, wsConfig.FallbackBackend))
+		return nil, nil
+	}
+
+	wsURL, err := w.deriveWebSocketURL(backendName, backendPath, wsConfig.BackendScheme)
+	if err != nil {
+		return nil, err
+	}
+	return []backendTarget{{name: backendName, url: wsURL}}, nil
+}
+
+// isKnownBackend reports whether backendName resolves through SD or the backend registry
+func (w *HandlerFactory) isKnownBackend(backendName string) bool {
+	if w.isDiscovered(backendName) {
+		return true
+	}
 	if globalBackendRegistry != nil {
-		if registryURL, exists := globalBackendRegistry.Backends[backendName]; exists {
-			return registryURL + backendPath, nil
+		if _, exists := globalBackendRegistry.Backends[backendName]; exists {
+			return true
 		}
 	}
+	return false
+}
 
-	// Fallback: Use the same backend resolution logic as HTTP endpoints
-	// This makes WebSocket work exactly like HTTP endpoints
+// mergeQueryString appends rawQuery to the query of wsURL, keeping the parameters it already has
+func mergeQueryString(wsURL, rawQuery string) (string, error) {
+	if rawQuery == "" {
+		return wsURL, nil
+	}
 
-	// For now, use a simple mapping based on backend names
-	// In a real implementation, this should use the same service discovery
-	// mechanism as regular HTTP backends
-	defaultMappings := map[string]string{
-		"albus": "localhost:3000", // Your service default
+	parsedURL, err := url.Parse(wsURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse WebSocket URL: %w", err)
+	}
+	if parsedURL.RawQuery != "" {
+		parsedURL.RawQuery += "&" + rawQuery
+	} else {
+		parsedURL.RawQuery = rawQuery
 	}
+	return parsedURL.String(), nil
+}
 
-	host, exists := defaultMappings[backendName]
-	if !exists {
-		// Default: assume localhost with common WebSocket port
-		host = "localhost:8080"
-		w.logger.Debug(fmt.Sprintf("Using default host %s for unknown backend %s", host, backendName))
+// namedBackendPath returns the path dialed on a backend resolved by name: backend_path, its
+// placeholders substituted, or the default backend path
+func namedBackendPath(r *http.Request, cfg *config.EndpointConfig, wsConfig Config) (string, error) {
+	path, ok := cfg.ExtraConfig["backend_path"].(string)
+	if !ok {
+		return defaultBackendPath(r, wsConfig), nil
 	}
+	return expandBackendPath(path, requestPathParams(r))
+}
 
-	// Determine scheme
-	scheme := "ws"
-	if forceScheme != "" {
-		scheme = forceScheme
+// defaultBackendPath returns the backend path of a named backend without backend_path: the
+// configured default_backend_path, or the request path
+func defaultBackendPath(r *http.Request, wsConfig Config) string {
+	if wsConfig.DefaultBackendPath != "" {
+		return wsConfig.DefaultBackendPath
 	}
+	return r.URL.Path
+}
 
-	wsURL := fmt.Sprintf("%s://%s%s", scheme, host, backendPath)
-	w.logger.Debug(fmt.Sprintf("Derived WebSocket URL: %s", wsURL))
+// nextBackendHost returns the index of the backend host an endpoint dials first, advancing its
+// round-robin counter
+func (w *HandlerFactory) nextBackendHost(endpoint string, hosts int) int {
+	w.backendHostsMu.Lock()
+	defer w.backendHostsMu.Unlock()
 
-	return wsURL, nil
+	if w.backendHostCounters == nil {
+		w.backendHostCounters = make(map[string]int)
+	}
+	next := w.backendHostCounters[endpoint] % hosts
+	w.backendHostCounters[endpoint] = next + 1
+	return next
+}
+
+// normalizeBackendURL applies the configured backend scheme to wsURL and checks the result
+func (w *HandlerFactory) normalizeBackendURL(wsURL string, wsConfig Config) (string, error) {
+	// Override scheme if specified in config
+	if wsConfig.BackendScheme != "" {
+		parsedURL, err := url.Parse(wsURL)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse WebSocket URL: %w", err)
+		}
+		parsedURL.Scheme = wsConfig.BackendScheme
+		wsURL = parsedURL.String()
+	}
+
+	// Catch HTTP schemes copied over from regular endpoints
+	checkedURL, err := checkBackendScheme(wsURL, wsConfig.AutocorrectScheme)
+	if err != nil {
+		return "", err
+	}
+	if checkedURL != wsURL {
+		w.logger.Warning(fmt.Sprintf("Backend WebSocket URL %s corrected to %s", wsURL, checkedURL))
+	}
+	return checkedURL, nil
+}
+
+// checkBackendScheme rejects backend URLs using an http(s) scheme, or rewrites them to ws(s) when autocorrect is set
+func checkBackendScheme(wsURL string, autocorrect bool) (string, error) {
+	parsedURL, err := url.Parse(wsURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse WebSocket URL: %w", err)
+	}
+
+	var corrected string
+	switch strings.ToLower(parsedURL.Scheme) {
+	case "http":
+		corrected = "ws"
+	case "https":
+		corrected = "wss"
+	default:
+		return wsURL, nil
+	}
+
+	if !autocorrect {
+		return "", fmt.Errorf("backend WebSocket URL %s uses the %s scheme: set backend_scheme to %q or enable autocorrect_scheme", wsURL, parsedURL.Scheme, corrected)
+	}
+
+	parsedURL.Scheme = corrected
+	return parsedURL.String(), nil
+}
+
+// warnLegacyBackendFormat logs, once per endpoint, that the old backend format is in use
+func (w *HandlerFactory) warnLegacyBackendFormat(endpoint string) {
+	if _, warned := w.legacyFormatWarned.LoadOrStore(endpoint, true); warned {
+		return
+	}
+	w.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] WebSocket backend resolved from the endpoint backend array, which is deprecated: set \"backend\" and \"backend_path\" in the endpoint extra_config instead", endpoint))
+}
+
+// handshakeResponseWriter bounds the accept handshake with a deadline on the hijacked connection.
+// The server would flush the 101 response while hijacking, before any deadline can be set, so the
+// response is held back and written on the hijacked connection instead.
+type handshakeResponseWriter struct {
+	gin.ResponseWriter
+	timeout time.Duration // No deadline when not positive
+	conn    net.Conn
+}
+
+func (w *handshakeResponseWriter) WriteHeaderNow() {
+	if w.timeout > 0 && w.Status() == http.StatusSwitchingProtocols {
+		return
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *handshakeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriter.Hijack()
+	if err != nil || w.timeout <= 0 {
+		return conn, brw, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(w.timeout)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	w.conn = conn
+
+	if err := writeSwitchingProtocols(brw.Writer, w.Header()); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to write the handshake response: %w", err)
+	}
+
+	return conn, brw, nil
+}
+
+// done lifts the handshake deadline once the connection is accepted
+func (w *handshakeResponseWriter) done() error {
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.SetDeadline(time.Time{})
+}
+
+// writeSwitchingProtocols writes the 101 response completing a WebSocket handshake
+func writeSwitchingProtocols(bw *bufio.Writer, header http.Header) error {
+	if _, err := bw.WriteString("HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(bw); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// idleTimeout returns how long the source of a direction may go without sending a message (0 = forever)
+func idleTimeout(direction string, wsConfig Config) time.Duration {
+	if direction == directionClientToBackend {
+		return wsConfig.ClientIdleTimeout
+	}
+	return wsConfig.BackendIdleTimeout
+}
+
+// idleTimeoutReason is the close reason sent when the source of a direction went idle
+func idleTimeoutReason(direction string) string {
+	if direction == directionClientToBackend {
+		return "Client idle timeout"
+	}
+	return "Backend idle timeout"
+}
+
+// slowReadReason is the close reason sent when a message took longer than max_single_read_duration to arrive
+const slowReadReason = "Message read timeout"
+
+// frameTooBigReason is the close reason sent when a message exceeded max_frame_size
+const frameTooBigReason = "Frame too big"
+
+// readMessage reads the next message of conn. With a positive max, onTimeout is called when the
+// message is not fully received max after its first frame arrived; waiting for it is not bounded.
+// With a positive maxFrame, the read is aborted with StatusMessageTooBig as soon as more than
+// maxFrame bytes arrived, so at most maxFrame+1 bytes of the message are ever buffered.
+func readMessage(ctx context.Context, conn *websocket.Conn, maxFrame int64, max time.Duration, onTimeout func()) (websocket.MessageType, []byte, error) {
+	if max <= 0 && maxFrame <= 0 {
+		return conn.Read(ctx)
+	}
+
+	messageType, r, err := conn.Reader(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if max > 0 {
+		timer := time.AfterFunc(max, onTimeout)
+		defer timer.Stop()
+	}
+
+	if maxFrame > 0 {
+		r = io.LimitReader(r, maxFrame+1)
+	}
+	message, err := io.ReadAll(r)
+	if err == nil && maxFrame > 0 && int64(len(message)) > maxFrame {
+		return messageType, nil, &proxyCloseError{code: websocket.StatusMessageTooBig, reason: frameTooBigReason}
+	}
+	return messageType, message, err
+}
+
+// appendPathSuffix appends suffix to path with a single slash between them
+func appendPathSuffix(path, suffix string) string {
+	if suffix == "" {
+		return path
+	}
+	return strings.TrimSuffix(path, "/") + "/" + strings.TrimPrefix(suffix, "/")
+}
+
+// backendTarget identifies the backend a connection is proxied to
+type backendTarget struct {
+	name string // Backend name, or the configured host for endpoint backends
+	url  string // Dialed WebSocket URL
+}
+
+// writeRetryBackoff is the wait before the first backend redial of write_retry_count, each further
+// redial waiting one more step
+const writeRetryBackoff = 10 * time.Millisecond
+
+// backendConnectionLost reports whether the backend leg ended with err without a close status:
+// reset or dropped connections, and writes failing on them
+func backendConnectionLost(err error) bool {
+	var closeErr websocket.CloseError
+	var proxyErr *proxyCloseError
+	var wErr *writeError
+	return err != nil && !errors.As(err, &closeErr) && !errors.As(err, &proxyErr) && !errors.As(err, &wErr)
+}
+
+// Close status and reason sent to the peer left when the other one did not take a message within
+// the write timeout. 4408 sits in the private range, after HTTP 408 Request Timeout.
+const (
+	statusWriteTimeout websocket.StatusCode = 4408
+	writeTimeoutReason                      = "Write timed out"
+)
+
+// writeTimeout returns the deadline for writing a message of size bytes: write_timeout plus the time
+// needed to transfer it at min_write_throughput_bytes_per_sec. Zero means no deadline.
+func writeTimeout(size int, wsConfig Config) time.Duration {
+	if wsConfig.WriteTimeout <= 0 {
+		return 0
+	}
+
+	timeout := wsConfig.WriteTimeout
+	if wsConfig.MinWriteThroughputBytesPerSec > 0 {
+		timeout += time.Duration(int64(size) * int64(time.Second) / wsConfig.MinWriteThroughputBytesPerSec)
+	}
+	return timeout
+}
+
+// matchPathPrefixBackend returns the backend mapped to the longest prefix of path
+func matchPathPrefixBackend(prefixBackends map[string]string, path string) (string, bool) {
+	var backendName, matched string
+	found := false
+	for prefix, backend := range prefixBackends {
+		if strings.HasPrefix(path, prefix) && (!found || len(prefix) > len(matched)) {
+			backendName, matched, found = backend, prefix, true
+		}
+	}
+	return backendName, found
+}
+
+// deriveWebSocketURL converts backend name and path to WebSocket URL. The name is resolved through
+// lura SD first, like HTTP backends, then through the websocket_backends registry.
+func (w *HandlerFactory) deriveWebSocketURL(backendName, backendPath, forceScheme string) (string, error) {
+	if host, ok := w.discoveredHost(backendName); ok {
+		return w.convertHTTPToWebSocketURL(host, backendPath, forceScheme, false)
+	}
+
+	if globalBackendRegistry != nil {
+		if registryURL, exists := globalBackendRegistry.Backends[backendName]; exists {
+			return registryURL + backendPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("backend %s is neither in service discovery nor in websocket_backends (registered: %v)", backendName, w.getAvailableBackends())
 }
 
 // convertHTTPToWebSocketURL converts HTTP backend configuration to WebSocket URL
-func (w *HandlerFactory) convertHTTPToWebSocketURL(httpHost, urlPattern, forceScheme string) (string, error) {
-	// Parse the HTTP host URL
-	parsedURL, err := url.Parse(httpHost)
+func (w *HandlerFactory) convertHTTPToWebSocketURL(httpHost, urlPattern, forceScheme string, inferSchemeFromPort bool) (string, error) {
+	// Parse the HTTP host URL, bare host:port values have no scheme
+	rawHost := httpHost
+	if !strings.Contains(rawHost, "://") {
+		rawHost = "//" + rawHost
+	}
+	parsedURL, err := url.Parse(rawHost)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse backend host %s: %w", httpHost, err)
 	}
@@ -533,6 +2593,11 @@ func (w *HandlerFactory) convertHTTPToWebSocketURL(httpHost, urlPattern, forceSc
 		scheme = "wss"
 	}
 
+	// Without a scheme, the well-known TLS port implies wss
+	if inferSchemeFromPort && parsedURL.Scheme == "" && parsedURL.Port() == "443" {
+		scheme = "wss"
+	}
+
 	// Override scheme if specified in config
 	if forceScheme != "" {
 		scheme = forceScheme
@@ -559,31 +2624,218 @@ func (w *HandlerFactory) getAvailableBackends() []string {
 }
 
 // proxyMessages forwards messages between two WebSocket connections
-func (w *HandlerFactory) proxyMessages(ctx context.Context, src, dest *websocket.Conn, direction string) error {
+func (w *HandlerFactory) proxyMessages(ctx context.Context, pc *proxyConnection, src *websocket.Conn, dest messageWriter, direction string, wsConfig Config) error {
+	logger := pc.logger
+
+	// Set when the source took longer than max_single_read_duration to send a message
+	var slowRead int32
+
+	// Close the source once it goes without sending a message for the idle timeout of its direction
+	var idled int32
+	var idleTimer *time.Timer
+	idle := idleTimeout(direction, wsConfig)
+	if idle > 0 {
+		idleTimer = time.AfterFunc(idle, func() {
+			atomic.StoreInt32(&idled, 1)
+			logger.Info(logFields("Closing idle connection", "direction", direction, "idle", idle))
+			src.Close(websocket.StatusPolicyViolation, idleTimeoutReason(direction))
+		})
+		defer idleTimer.Stop()
+	}
+
+	write := func(messageType websocket.MessageType, message []byte) error {
+		// Give larger messages proportionally more time to be written
+		if timeout := writeTimeout(len(message), wsConfig); timeout > 0 {
+			writeCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			// Cancelling the write drops the stalled peer, the read of which may well reach the
+			// lifecycle first. Tell the source why before that.
+			timer := time.AfterFunc(timeout, func() {
+				logger.Info(logFields("Write timed out, closing connection", "direction", direction, "bytes", len(message), "write_timeout", timeout))
+				if src == pc.client {
+					pc.closeClient(statusWriteTimeout, writeTimeoutReason)
+				} else {
+					src.Close(statusWriteTimeout, writeTimeoutReason)
+				}
+				cancel()
+			})
+
+			err := dest.Write(writeCtx, messageType, message)
+			if !timer.Stop() {
+				return &proxyCloseError{code: statusWriteTimeout, reason: writeTimeoutReason}
+			}
+			return err
+		}
+		return dest.Write(ctx, messageType, message)
+	}
+
+	// Surface backends slowing down before their writes time out
+	if direction == directionClientToBackend && wsConfig.SlowWriteThreshold > 0 {
+		timedWrite := write
+		write = func(messageType websocket.MessageType, message []byte) error {
+			start := time.Now()
+			err := timedWrite(messageType, message)
+			if elapsed := time.Since(start); elapsed > wsConfig.SlowWriteThreshold {
+				logger.Debug(logFields("Slow backend write", "bytes", len(message), "duration", elapsed.Round(time.Millisecond)))
+				w.metrics.addSlowBackendWrite(pc.endpoint)
+			}
+			return err
+		}
+	}
+
+	// Coalesce small client frames into batches when configured
+	if direction == directionClientToBackend && wsConfig.CoalesceWindow > 0 {
+		coalescer := newMessageCoalescer(write, wsConfig.CoalesceWindow, wsConfig.CoalesceMaxBatch)
+		defer coalescer.close()
+		write = coalescer.write
+	}
+
+	// Messages stop counting towards max_inflight_bytes once written. Frames held by the
+	// coalescer are not accounted: it takes them as soon as they are read.
+	if pc.inflight != nil {
+		accountedWrite := write
+		write = func(messageType websocket.MessageType, message []byte) error {
+			defer pc.inflight.release(len(message))
+			return accountedWrite(messageType, message)
+		}
+	}
+
+	// Decouple reads from writes through a bounded queue when configured
+	if wsConfig.SendQueueSize > 0 {
+		depth, full := w.metrics.sendQueueInstruments(pc.endpoint, direction)
+		dropped := func(message []byte) {
+			logger.Debug(logFields("Send queue full, dropping the oldest message", "direction", direction, "bytes", len(message)))
+			pc.inflight.release(len(message))
+		}
+		queue := newSendQueue(ctx, wsConfig.SendQueueSize, wsConfig.OverflowPolicy, write, dropped, depth, full)
+		defer queue.close()
+		write = queue.push
+	}
+
+	// Buffers lent to interceptors are reused once the message is written. Queued and coalesced
+	// messages outlive the write call, they are copied out of the buffers.
+	var buffers *interceptBuffers
+	if wsConfig.InterceptorBufferPool && len(pc.interceptors) > 0 {
+		buffers = &interceptBuffers{}
+		defer buffers.release()
+	}
+	var interceptorDuration prometheus.Observer
+	if len(pc.interceptors) > 0 {
+		interceptorDuration = w.metrics.interceptorDuration(pc.endpoint, direction)
+	}
+	asyncWrite := wsConfig.SendQueueSize > 0 || (direction == directionClientToBackend && wsConfig.CoalesceWindow > 0)
+
+	// Only the messages of the client are rate limited
+	var limiter *rate.Limiter
+	if direction == directionClientToBackend {
+		limiter = newClientRateLimiter(wsConfig)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			messageType, message, err := src.Read(ctx)
+			messageType, message, err := readMessage(ctx, src, wsConfig.MaxFrameSize, wsConfig.MaxSingleReadDuration, func() {
+				atomic.StoreInt32(&slowRead, 1)
+				logger.Info(logFields("Closing slow connection", "direction", direction, "read_timeout", wsConfig.MaxSingleReadDuration))
+				src.Close(websocket.StatusPolicyViolation, slowReadReason)
+			})
 			if err != nil {
-				w.logger.Debug(fmt.Sprintf("WebSocket read error (%s): %v", direction, err))
+				if atomic.LoadInt32(&slowRead) == 1 {
+					return &proxyCloseError{code: websocket.StatusPolicyViolation, reason: slowReadReason}
+				}
+				if atomic.LoadInt32(&idled) == 1 {
+					return &proxyCloseError{code: websocket.StatusPolicyViolation, reason: idleTimeoutReason(direction)}
+				}
+				if pc.activity.expired() {
+					return &proxyCloseError{code: websocket.StatusPolicyViolation, reason: connectionIdleReason}
+				}
+				logger.Debug(logFields("WebSocket read error", "direction", direction, "error", err))
+				return err
+			}
+			if idleTimer != nil {
+				idleTimer.Reset(idle)
+			}
+			pc.activity.touch()
+			pc.markActive()
+
+			if err := waitForMessageToken(ctx, limiter, wsConfig.RateLimitAction); err != nil {
+				logger.Debug(logFields("Client message rate limit", "direction", direction, "error", err))
 				return err
 			}
 
-			w.logger.Debug(fmt.Sprintf("Proxying message (%s): %d bytes", direction, len(message)))
+			logger.Debug(logFields("Proxying message", "direction", direction, "bytes", len(message)))
+			pc.stats.addPayload(direction, len(message))
+			w.metrics.addMessage(pc.endpoint, direction, len(message))
+
+			if pc.captured {
+				w.currentCaptureSink().capture(pc, direction, messageType, message)
+			}
+			if pc.verbose {
+				addMessageEvent(ctx, direction, len(message))
+			}
+
+			if wsConfig.Framing == FramingGRPCWeb && messageType == websocket.MessageBinary {
+				frames, err := inspectGRPCWebFrames(message, wsConfig.GRPCMaxMessageSize)
+				if err != nil {
+					logger.Debug(logFields("Invalid gRPC-Web message", "direction", direction, "error", err))
+					return err
+				}
+				w.metrics.addGRPCMessages(pc.endpoint, direction, frames)
+			}
+
+			messageType, message, err = intercept(pc.interceptors, buffers, interceptorDuration, direction, messageType, message)
+			if err != nil {
+				logger.Debug(logFields("WebSocket interceptor error", "direction", direction, "error", err))
+				return err
+			}
+			messageType, message, err = w.transform(ctx, direction, messageType, message)
+			if err != nil {
+				logger.Debug(logFields("WebSocket transformer error", "direction", direction, "error", err))
+				return err
+			}
+			if message == nil {
+				logger.Debug(logFields("Dropping message", "direction", direction))
+				buffers.release()
+				continue
+			}
+			if asyncWrite && buffers.holding() {
+				message = append([]byte(nil), message...)
+			}
 
-			if err := dest.Write(ctx, messageType, message); err != nil {
-				w.logger.Debug(fmt.Sprintf("WebSocket write error (%s): %v", direction, err))
+			if err := pc.inflight.acquire(ctx, len(message), wsConfig.InflightLimitAction); err != nil {
+				logger.Debug(logFields("In-flight bytes limit", "direction", direction, "bytes", len(message), "error", err))
+				var closeErr *proxyCloseError
+				if errors.As(err, &closeErr) {
+					closeStalledDirection(pc, src, dest, closeErr)
+				}
+				return err
+			}
+			err = write(messageType, message)
+			buffers.release()
+			if errors.Is(err, errSendQueueOverflow) {
+				logger.Debug(logFields("Send queue full, closing connection", "direction", direction, "send_queue_size", wsConfig.SendQueueSize))
+				closeStalledDirection(pc, src, dest, errSendQueueOverflow)
+				return err
+			}
+			var closeErr *proxyCloseError
+			if errors.As(err, &closeErr) {
 				return err
 			}
+			if err != nil {
+				logger.Debug(logFields("WebSocket write error", "direction", direction, "error", err))
+				return &writeError{err: err}
+			}
+			pc.markActive()
 		}
 	}
 }
 
 // extractHeadersToForward extracts headers to forward based on websocket configuration
-func (w *HandlerFactory) extractHeadersToForward(headers map[string][]string, wsConfig Config, authHeaders map[string]string) map[string]string {
-	forwardHeaders := make(map[string]string)
+func (w *HandlerFactory) extractHeadersToForward(headers map[string][]string, wsConfig Config, authHeaders map[string][]string) map[string][]string {
+	forwardHeaders := make(map[string][]string)
 
 	// Always include auth headers first
 	for key, value := range authHeaders {
@@ -603,8 +2855,8 @@ func (w *HandlerFactory) extractHeadersToForward(headers map[string][]string, ws
 			if !excludeMap[lowerKey] && len(values) > 0 {
 				// Don't override auth headers that were already processed
 				if _, exists := forwardHeaders[key]; !exists {
-					forwardHeaders[key] = values[0]
-					w.logger.Debug(fmt.Sprintf("Forwarding header %s: %s", key, values[0]))
+					forwardHeaders[key] = values
+					w.logger.Debug(fmt.Sprintf("Forwarding header %s: %v", key, values))
 				}
 			}
 		}
@@ -615,8 +2867,8 @@ func (w *HandlerFactory) extractHeadersToForward(headers map[string][]string, ws
 				if strings.EqualFold(key, passthroughHeader) && len(values) > 0 {
 					// Don't override auth headers that were already processed
 					if _, exists := forwardHeaders[key]; !exists {
-						forwardHeaders[key] = values[0]
-						w.logger.Debug(fmt.Sprintf("Forwarding passthrough header %s: %s", key, values[0]))
+						forwardHeaders[key] = values
+						w.logger.Debug(fmt.Sprintf("Forwarding passthrough header %s: %v", key, values))
 					}
 				}
 			}
@@ -626,12 +2878,10 @@ func (w *HandlerFactory) extractHeadersToForward(headers map[string][]string, ws
 	return forwardHeaders
 }
 
-// extractAuthHeaders extracts auth headers from the incoming request
-func (w *HandlerFactory) extractAuthHeaders(headers map[string][]string) map[string]string {
-	authHeaders := make(map[string]string)
-
+// Auth headers picked by extractAuthHeaders when neither forward_headers nor forward_header_prefixes is set
+var (
 	// Common auth headers that might be present or injected by krakend-auth
-	authHeaderNames := []string{
+	defaultAuthHeaderNames = []string{
 		"X-User-Id",
 		"X-User-Uid",
 		"X-User-Email",
@@ -640,28 +2890,44 @@ func (w *HandlerFactory) extractAuthHeaders(headers map[string][]string) map[str
 	}
 
 	// Also check for any headers with common auth prefixes
-	authHeaderPrefixes := []string{
+	defaultAuthHeaderPrefixes = []string{
 		"X-User-",
 		"X-Auth-",
 		"X-Group-",
 	}
+)
+
+// extractAuthHeaders extracts auth headers from the incoming request, the ones named by
+// forward_headers and forward_header_prefixes or, without either, the default auth headers
+func (w *HandlerFactory) extractAuthHeaders(headers map[string][]string, wsConfig Config) map[string][]string {
+	authHeaders := make(map[string][]string)
+
+	authHeaderNames, authHeaderPrefixes := wsConfig.ForwardHeaders, wsConfig.ForwardHeaderPrefixes
+	if len(authHeaderNames) == 0 && len(authHeaderPrefixes) == 0 {
+		authHeaderNames, authHeaderPrefixes = defaultAuthHeaderNames, defaultAuthHeaderPrefixes
+	}
 
 	for key, values := range headers {
 		// Check exact matches
 		for _, authHeader := range authHeaderNames {
 			if strings.EqualFold(key, authHeader) && len(values) > 0 {
-				authHeaders[key] = values[0]
-				w.logger.Debug(fmt.Sprintf("Found auth header %s: %s", key, values[0]))
+				authHeaders[key] = values
+				w.logger.Debug(fmt.Sprintf("Found auth header %s: %v", key, values))
 			}
 		}
 
 		// Check prefix matches
 		for _, prefix := range authHeaderPrefixes {
 			if strings.HasPrefix(strings.ToUpper(key), strings.ToUpper(prefix)) && len(values) > 0 {
-				authHeaders[key] = values[0]
-				w.logger.Debug(fmt.Sprintf("Found prefixed auth header %s: %s", key, values[0]))
+				authHeaders[key] = values
+				w.logger.Debug(fmt.Sprintf("Found prefixed auth header %s: %v", key, values))
 			}
 		}
+
+		// The signature is checked whatever headers are picked
+		if wsConfig.AuthSignatureSecret != "" && strings.EqualFold(key, AuthSignatureHeader) && len(values) > 0 {
+			authHeaders[key] = values
+		}
 	}
 
 	return authHeaders
@@ -681,3 +2947,15 @@ func NewWithConfig(handlerFactory router.HandlerFactory, logger logging.Logger,
 	wsFactory := NewHandlerFactoryWithConfig(logger, serviceConfig)
 	return wsFactory.HandlerWrapper(handlerFactory)
 }
+
+// NewWithConfigChecked is NewWithConfig returning an error, instead of a handler refusing the
+// upgrades, when the backend certificate files of an endpoint cannot be loaded
+func NewWithConfigChecked(handlerFactory router.HandlerFactory, logger logging.Logger, serviceConfig config.ServiceConfig) (router.HandlerFactory, error) {
+	wsFactory := NewHandlerFactoryWithConfig(logger, serviceConfig)
+	if err := wsFactory.LoadBackendCertificates(serviceConfig); err != nil {
+		return nil, err
+	}
+
+	InitializeBackendRegistry(serviceConfig)
+	return wsFactory.HandlerWrapper(handlerFactory), nil
+}
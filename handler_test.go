@@ -1,14 +1,26 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/luraproject/lura/config"
 	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"nhooyr.io/websocket"
 )
 
 func TestParseWebSocketConfig(t *testing.T) {
@@ -163,6 +175,13 @@ func TestConnectToBackend(t *testing.T) {
 	logger := logging.NoOp
 	factory := NewHandlerFactory(logger)
 
+	// The backend name resolves through service discovery
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Discovery: map[string]*config.Backend{
+		"albus": {SD: "static", Host: []string{"http://localhost:8080"}},
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
 	// Test with valid config
 	endpointConfig := &config.EndpointConfig{
 		ExtraConfig: config.ExtraConfig{
@@ -175,13 +194,13 @@ func TestConnectToBackend(t *testing.T) {
 		BackendScheme: "ws",
 	}
 
-	authHeaders := map[string]string{
-		"X-User-Id": "test-user",
+	authHeaders := map[string][]string{
+		"X-User-Id": {"test-user"},
 	}
 
 	// This test will fail because we can't actually connect to a backend
 	// but we can test the URL construction logic
-	_, err := factory.connectToBackend(context.Background(), endpointConfig, wsConfig, authHeaders)
+	_, _, err := factory.connectToBackend(context.Background(), httptest.NewRequest(http.MethodGet, "/ws", nil), endpointConfig, wsConfig, authHeaders, nil)
 	if err == nil {
 		t.Errorf("connectToBackend() should fail when backend is not available")
 	}
@@ -203,9 +222,9 @@ func TestConnectToBackendWithInvalidConfig(t *testing.T) {
 	}
 
 	wsConfig := Config{}
-	authHeaders := map[string]string{}
+	authHeaders := map[string][]string{}
 
-	_, err := factory.connectToBackend(context.Background(), endpointConfig, wsConfig, authHeaders)
+	_, _, err := factory.connectToBackend(context.Background(), httptest.NewRequest(http.MethodGet, "/ws", nil), endpointConfig, wsConfig, authHeaders, nil)
 	if err == nil {
 		t.Errorf("connectToBackend() expected error for missing backend config, got nil")
 	}
@@ -307,4 +326,2709 @@ func TestIsWebSocketUpgrade(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+// newTestBackend starts a WebSocket server that runs handle for every accepted connection
+func newTestBackend(t *testing.T, handle func(ctx context.Context, conn *websocket.Conn, r *http.Request)) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(rw, r, nil)
+		if err != nil {
+			t.Errorf("backend accept failed: %v", err)
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+
+		handle(r.Context(), conn, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// newTestGateway serves a single WebSocket endpoint at /ws proxying to backendURL
+func newTestGateway(t *testing.T, factory *HandlerFactory, wsConfig map[string]interface{}, backendURL string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(newTestEngine(t, factory, wsConfig, backendURL))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// newTestEngine returns a gin engine with a single WebSocket endpoint at /ws proxying to backendURL
+func newTestEngine(t *testing.T, factory *HandlerFactory, wsConfig map[string]interface{}, backendURL string) *gin.Engine {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	endpointConfig := &config.EndpointConfig{
+		Endpoint: "/ws",
+		Method:   http.MethodGet,
+		Backend: []*config.Backend{
+			{
+				Host:       []string{backendURL},
+				URLPattern: "/ws",
+			},
+		},
+		ExtraConfig: config.ExtraConfig{
+			ConfigNamespace: wsConfig,
+		},
+	}
+
+	standardHandlerFactory := func(*config.EndpointConfig, proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		}
+	}
+
+	engine.GET("/ws", factory.HandlerWrapper(standardHandlerFactory)(endpointConfig, dummyProxy))
+
+	return engine
+}
+
+// newUpgradeRequest returns a valid WebSocket upgrade request for path
+func newUpgradeRequest(path string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	return req
+}
+
+// dialTestGateway opens a client WebSocket connection to the gateway endpoint
+func dialTestGateway(t *testing.T, gateway *httptest.Server, opts *websocket.DialOptions) *websocket.Conn {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, gateway.URL+"/ws", opts)
+	if err != nil {
+		t.Fatalf("failed to dial gateway: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close(websocket.StatusNormalClosure, "")
+	})
+
+	return conn
+}
+
+func TestCompressionMode(t *testing.T) {
+	headerConfig := Config{
+		CompressionEnableHeader: "X-Client-Version",
+		CompressionEnableValues: []string{"2.0", "2.1"},
+	}
+
+	tests := []struct {
+		name     string
+		wsConfig Config
+		headers  map[string]string
+		expected websocket.CompressionMode
+	}{
+		{
+			name:     "compression disabled by config",
+			wsConfig: Config{},
+			expected: websocket.CompressionNoContextTakeover,
+		},
+		{
+			name:     "compression enabled by config",
+			wsConfig: Config{Compression: true},
+			expected: websocket.CompressionContextTakeover,
+		},
+		{
+			name:     "header matches an enable value",
+			wsConfig: headerConfig,
+			headers:  map[string]string{"X-Client-Version": "2.1"},
+			expected: websocket.CompressionContextTakeover,
+		},
+		{
+			name:     "header does not match",
+			wsConfig: headerConfig,
+			headers:  map[string]string{"X-Client-Version": "1.9"},
+			expected: websocket.CompressionDisabled,
+		},
+		{
+			name:     "header missing",
+			wsConfig: headerConfig,
+			expected: websocket.CompressionDisabled,
+		},
+		{
+			name: "header takes precedence over compression flag",
+			wsConfig: Config{
+				Compression:             true,
+				CompressionEnableHeader: "X-Client-Version",
+				CompressionEnableValues: []string{"2.0"},
+			},
+			headers:  map[string]string{"X-Client-Version": "1.0"},
+			expected: websocket.CompressionDisabled,
+		},
+		{
+			name:     "mode disabled",
+			wsConfig: Config{Compression: true, CompressionMode: CompressionModeDisabled},
+			expected: websocket.CompressionDisabled,
+		},
+		{
+			name:     "mode without context takeover",
+			wsConfig: Config{Compression: true, CompressionMode: CompressionModeNoContextTakeover},
+			expected: websocket.CompressionNoContextTakeover,
+		},
+		{
+			name:     "mode with context takeover",
+			wsConfig: Config{CompressionMode: CompressionModeContextTakeover},
+			expected: websocket.CompressionContextTakeover,
+		},
+		{
+			name:     "unknown mode",
+			wsConfig: Config{Compression: true, CompressionMode: "brotli"},
+			expected: websocket.CompressionContextTakeover,
+		},
+		{
+			name: "header match negotiates the mode",
+			wsConfig: Config{
+				CompressionMode:         CompressionModeNoContextTakeover,
+				CompressionEnableHeader: "X-Client-Version",
+				CompressionEnableValues: []string{"2.0"},
+			},
+			headers:  map[string]string{"X-Client-Version": "2.0"},
+			expected: websocket.CompressionNoContextTakeover,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			if got := compressionMode(req, tt.wsConfig); got != tt.expected {
+				t.Errorf("compressionMode() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCompressionEnableHeaderNegotiation(t *testing.T) {
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		conn.Read(ctx)
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"compression_enable_header": "X-Client-Version",
+		"compression_enable_values": []interface{}{"2.0"},
+	}, backend.URL)
+
+	tests := []struct {
+		name       string
+		version    string
+		compressed bool
+	}{
+		{name: "supported client", version: "2.0", compressed: true},
+		{name: "unsupported client", version: "1.0", compressed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", &websocket.DialOptions{
+				HTTPHeader:      http.Header{"X-Client-Version": []string{tt.version}},
+				CompressionMode: websocket.CompressionContextTakeover,
+			})
+			if err != nil {
+				t.Fatalf("failed to dial gateway: %v", err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+
+			extensions := resp.Header.Get("Sec-WebSocket-Extensions")
+			if compressed := strings.Contains(extensions, "permessage-deflate"); compressed != tt.compressed {
+				t.Errorf("compression negotiated = %v, want %v (extensions %q)", compressed, tt.compressed, extensions)
+			}
+		})
+	}
+}
+
+func TestBackendCompressionMode(t *testing.T) {
+	offered := make(chan string, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		offered <- r.Header.Get("Sec-WebSocket-Extensions")
+		conn.Read(ctx)
+	})
+
+	tests := []struct {
+		name     string
+		mode     string
+		expected string
+	}{
+		{name: "default", expected: "permessage-deflate; client_no_context_takeover; server_no_context_takeover"},
+		{name: "disabled", mode: CompressionModeDisabled, expected: ""},
+		{name: "context takeover", mode: CompressionModeContextTakeover, expected: "permessage-deflate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extra := map[string]interface{}{}
+			if tt.mode != "" {
+				extra["compression_mode"] = tt.mode
+			}
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), extra, backend.URL)
+			dialTestGateway(t, gateway, nil)
+
+			select {
+			case extensions := <-offered:
+				if extensions != tt.expected {
+					t.Errorf("extensions offered to the backend = %q, want %q", extensions, tt.expected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("backend was not dialed")
+			}
+		})
+	}
+}
+
+// testLogger records every log line, prefixed by its level
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) record(level string, v []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+" "+strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (l *testLogger) Debug(v ...interface{})    { l.record("DEBUG:", v) }
+func (l *testLogger) Info(v ...interface{})     { l.record("INFO:", v) }
+func (l *testLogger) Warning(v ...interface{})  { l.record("WARNING:", v) }
+func (l *testLogger) Error(v ...interface{})    { l.record("ERROR:", v) }
+func (l *testLogger) Critical(v ...interface{}) { l.record("CRITICAL:", v) }
+func (l *testLogger) Fatal(v ...interface{})    { l.record("FATAL:", v) }
+
+// Lines returns a copy of the recorded log lines
+func (l *testLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+// Contains returns the recorded lines containing substr
+func (l *testLogger) Contains(substr string) []string {
+	var matches []string
+	for _, line := range l.Lines() {
+		if strings.Contains(line, substr) {
+			matches = append(matches, line)
+		}
+	}
+	return matches
+}
+
+func TestSupportsHijacking(t *testing.T) {
+	httpRequest := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	http2Request := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	http2Request.ProtoMajor, http2Request.ProtoMinor = 2, 0
+
+	tests := []struct {
+		name     string
+		writer   http.ResponseWriter
+		request  *http.Request
+		expected bool
+	}{
+		{
+			name:     "hijackable writer",
+			writer:   &hijackableRecorder{httptest.NewRecorder()},
+			request:  httpRequest,
+			expected: true,
+		},
+		{
+			name:     "non-hijackable writer",
+			writer:   httptest.NewRecorder(),
+			request:  httpRequest,
+			expected: false,
+		},
+		{
+			name:     "wrapper claiming hijack support around a non-hijackable writer",
+			writer:   &ginLikeWriter{httptest.NewRecorder()},
+			request:  httpRequest,
+			expected: false,
+		},
+		{
+			name:     "HTTP/2 request",
+			writer:   &hijackableRecorder{httptest.NewRecorder()},
+			request:  http2Request,
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := supportsHijacking(tt.writer, tt.request); got != tt.expected {
+				t.Errorf("supportsHijacking() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUpgradeWithNonHijackableWriter(t *testing.T) {
+	engine := newTestEngine(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{}, "http://localhost:8080")
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newUpgradeRequest("/ws"))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+
+	if body := recorder.Body.String(); !strings.Contains(body, "cannot be hijacked") {
+		t.Errorf("body = %s, want an explanation about hijacking", body)
+	}
+}
+
+// hijackableRecorder is a response recorder pretending to support hijacking
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, fmt.Errorf("not implemented")
+}
+
+// ginLikeWriter mimics gin's writer, which implements http.Hijacker regardless of the writer it embeds
+type ginLikeWriter struct {
+	http.ResponseWriter
+}
+
+func (w *ginLikeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    map[string]interface{}
+		warnings []string
+	}{
+		{
+			name:  "defaults are valid",
+			input: map[string]interface{}{},
+		},
+		{
+			name:     "tiny max message size",
+			input:    map[string]interface{}{"max_message_size": 100.0, "read_buffer_size": 64.0},
+			warnings: []string{"max_message_size of 100 bytes is suspiciously small"},
+		},
+		{
+			name:     "max message size smaller than read buffer",
+			input:    map[string]interface{}{"max_message_size": 2048.0, "read_buffer_size": 4096.0},
+			warnings: []string{"smaller than read_buffer_size"},
+		},
+		{
+			name:     "unlimited messages with a bounded queue",
+			input:    map[string]interface{}{"max_message_size": 0.0, "send_queue_size": 16.0},
+			warnings: []string{"max_message_size is 0 (no limit) while send_queue_size is 16"},
+		},
+		{
+			name:  "unlimited messages without queue",
+			input: map[string]interface{}{"max_message_size": 0.0},
+		},
+		{
+			name:     "inconsistent timeouts block",
+			input:    map[string]interface{}{"timeouts": map[string]interface{}{"idle": "30s", "read": "1m"}},
+			warnings: []string{"max_single_read_duration of 1m0s is not below idle_timeout of 30s"},
+		},
+		{
+			name:     "frame size not below message size",
+			input:    map[string]interface{}{"max_message_size": 4096.0, "max_frame_size": 8192.0},
+			warnings: []string{"max_frame_size of 8192 bytes is not below max_message_size of 4096 bytes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := parseWebSocketConfig(config.ExtraConfig{ConfigNamespace: tt.input})
+
+			warnings := validateConfig(cfg)
+			if len(warnings) != len(tt.warnings) {
+				t.Fatalf("validateConfig() = %v, want %d warnings", warnings, len(tt.warnings))
+			}
+
+			for i, expected := range tt.warnings {
+				if !strings.Contains(warnings[i], expected) {
+					t.Errorf("warning %d = %q, want it to contain %q", i, warnings[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidConfigWarning(t *testing.T) {
+	logger := &testLogger{}
+	newTestEngine(t, NewHandlerFactory(logger), map[string]interface{}{
+		"max_message_size": 100.0,
+	}, "http://localhost:8080")
+
+	if warnings := logger.Contains("WARNING: [ENDPOINT: /ws] WebSocket configuration: max_message_size of 100 bytes is suspiciously small"); len(warnings) != 1 {
+		t.Errorf("got %d max_message_size warnings, want 1: %v", len(warnings), logger.Lines())
+	}
+}
+
+func TestStrictValidation(t *testing.T) {
+	engine := newTestEngine(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"max_message_size":  100.0,
+		"strict_validation": true,
+	}, "http://localhost:8080")
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newUpgradeRequest("/ws"))
+
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("upgrade status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+	}
+
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ws", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("plain HTTP status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestRequireUpgrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		extra    map[string]interface{}
+		expected int
+	}{
+		{name: "default", extra: map[string]interface{}{}, expected: http.StatusOK},
+		{name: "required", extra: map[string]interface{}{"require_upgrade": true}, expected: http.StatusUpgradeRequired},
+		{
+			name:     "required with strict validation",
+			extra:    map[string]interface{}{"require_upgrade": true, "strict_validation": true, "max_message_size": 100.0},
+			expected: http.StatusUpgradeRequired,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newTestEngine(t, NewHandlerFactory(logging.NoOp), tt.extra, "http://localhost:8080")
+
+			recorder := httptest.NewRecorder()
+			engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ws", nil))
+
+			if recorder.Code != tt.expected {
+				t.Fatalf("plain HTTP status = %d, want %d", recorder.Code, tt.expected)
+			}
+			if upgrade := recorder.Header().Get("Upgrade"); tt.expected == http.StatusUpgradeRequired && upgrade != "websocket" {
+				t.Errorf("Upgrade header = %q, want %q", upgrade, "websocket")
+			}
+		})
+	}
+}
+
+func TestExtractAuthHeadersMultipleValues(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+
+	authHeaders := factory.extractAuthHeaders(http.Header{
+		"X-User-Id":     {"42"},
+		"X-User-Groups": {"admins", "editors"},
+		"Accept":        {"*/*"},
+	}, Config{})
+
+	if got := authHeaders["X-User-Groups"]; len(got) != 2 || got[0] != "admins" || got[1] != "editors" {
+		t.Errorf("X-User-Groups = %v, want [admins editors]", got)
+	}
+
+	if _, ok := authHeaders["Accept"]; ok {
+		t.Errorf("Accept should not be extracted as an auth header")
+	}
+}
+
+func TestExtractAuthHeadersConfigured(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	headers := http.Header{
+		"X-Tenant-Id":  {"acme"},
+		"X-Org-Name":   {"Acme"},
+		"X-Org-Region": {"eu"},
+		"X-User-Id":    {"42"},
+		"Accept":       {"*/*"},
+	}
+
+	tests := []struct {
+		name     string
+		wsConfig Config
+		want     []string
+	}{
+		{name: "defaults", want: []string{"X-User-Id"}},
+		{
+			name:     "names and prefixes",
+			wsConfig: Config{ForwardHeaders: []string{"x-tenant-id"}, ForwardHeaderPrefixes: []string{"x-org-"}},
+			want:     []string{"X-Org-Name", "X-Org-Region", "X-Tenant-Id"},
+		},
+		{name: "names only", wsConfig: Config{ForwardHeaders: []string{"X-TENANT-ID"}}, want: []string{"X-Tenant-Id"}},
+		{name: "prefixes only", wsConfig: Config{ForwardHeaderPrefixes: []string{"X-Org-"}}, want: []string{"X-Org-Name", "X-Org-Region"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authHeaders := factory.extractAuthHeaders(headers, tt.wsConfig)
+
+			var got []string
+			for key := range authHeaders {
+				got = append(got, key)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("extracted auth headers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiValuedAuthHeadersReachBackend(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		received <- r.Header.Clone()
+		conn.Read(ctx)
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"passthrough_headers": []interface{}{"X-Trace"},
+	}, backend.URL)
+	dialTestGateway(t, gateway, &websocket.DialOptions{
+		HTTPHeader: http.Header{
+			"X-User-Groups": {"admins", "editors"},
+			"X-Trace":       {"a", "b"},
+		},
+	})
+
+	select {
+	case headers := <-received:
+		if got := headers.Values("X-User-Groups"); len(got) != 2 || got[0] != "admins" || got[1] != "editors" {
+			t.Errorf("backend X-User-Groups = %v, want [admins editors]", got)
+		}
+		if got := headers.Values("X-Trace"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+			t.Errorf("backend X-Trace = %v, want [a b]", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("backend connection not received")
+	}
+}
+
+func TestRequestedSubprotocols(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Add("Sec-WebSocket-Protocol", "chat.v2, chat.v1")
+	req.Header.Add("Sec-WebSocket-Protocol", "legacy")
+
+	got := requestedSubprotocols(req)
+	expected := []string{"chat.v2", "chat.v1", "legacy"}
+	if len(got) != len(expected) {
+		t.Fatalf("requestedSubprotocols() = %v, want %v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("requestedSubprotocols()[%d] = %s, want %s", i, got[i], expected[i])
+		}
+	}
+}
+
+func TestDeniedSubprotocols(t *testing.T) {
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		conn.Read(ctx)
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"subprotocols":        []interface{}{"chat.v2", "chat.v1"},
+		"denied_subprotocols": []interface{}{"chat.v1"},
+	}, backend.URL)
+
+	tests := []struct {
+		name         string
+		subprotocols []string
+		status       int
+	}{
+		{name: "denied subprotocol", subprotocols: []string{"chat.v1"}, status: http.StatusBadRequest},
+		{name: "denied subprotocol among allowed ones", subprotocols: []string{"chat.v2", "CHAT.V1"}, status: http.StatusBadRequest},
+		{name: "allowed subprotocol", subprotocols: []string{"chat.v2"}, status: http.StatusSwitchingProtocols},
+		{name: "no subprotocol", status: http.StatusSwitchingProtocols},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", &websocket.DialOptions{
+				Subprotocols: tt.subprotocols,
+			})
+			if conn != nil {
+				defer conn.Close(websocket.StatusNormalClosure, "")
+			}
+
+			if resp == nil {
+				t.Fatalf("no handshake response: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestIsWebSocketUpgradeMultiValuedHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		upgrade    []string
+		connection []string
+		expected   bool
+	}{
+		{name: "websocket in a later Upgrade value", upgrade: []string{"h2c", "websocket"}, connection: []string{"Upgrade"}, expected: true},
+		{name: "websocket in an Upgrade list", upgrade: []string{"h2c, WebSocket"}, connection: []string{"Upgrade"}, expected: true},
+		{name: "upgrade in a later Connection value", upgrade: []string{"websocket"}, connection: []string{"keep-alive", "Upgrade"}, expected: true},
+		{name: "upgrade in a Connection list", upgrade: []string{"websocket"}, connection: []string{"keep-alive, Upgrade"}, expected: true},
+		{name: "no websocket among Upgrade values", upgrade: []string{"h2c", "TLS/1.0"}, connection: []string{"Upgrade"}, expected: false},
+		{name: "no upgrade among Connection values", upgrade: []string{"websocket"}, connection: []string{"keep-alive", "close"}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Header: http.Header{
+					"Upgrade":           tt.upgrade,
+					"Connection":        tt.connection,
+					"Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="},
+				},
+			}
+
+			if result := isWebSocketUpgrade(req); result != tt.expected {
+				t.Errorf("isWebSocketUpgrade() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+// rawUpgrade sends an upgrade request with the given extra header lines and returns the response status
+func rawUpgrade(t *testing.T, gateway *httptest.Server, headerLines ...string) int {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial gateway: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := "GET /ws HTTP/1.1\r\nHost: " + gateway.Listener.Addr().String() + "\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		strings.Join(headerLines, "\r\n") + "\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("failed to write upgrade request: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read upgrade response: %v", err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestStrictUpgradeHeaders(t *testing.T) {
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		conn.Read(ctx)
+	})
+
+	tests := []struct {
+		name        string
+		headerLines []string
+		lenient     int
+		strict      int
+	}{
+		{
+			name:        "single websocket upgrade",
+			headerLines: []string{"Upgrade: websocket", "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ=="},
+			lenient:     http.StatusSwitchingProtocols,
+			strict:      http.StatusSwitchingProtocols,
+		},
+		{
+			name:        "duplicated websocket upgrade",
+			headerLines: []string{"Upgrade: websocket", "Upgrade: websocket", "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ=="},
+			lenient:     http.StatusSwitchingProtocols,
+			strict:      http.StatusSwitchingProtocols,
+		},
+		{
+			name:        "websocket along with another protocol",
+			headerLines: []string{"Upgrade: h2c", "Upgrade: websocket", "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ=="},
+			lenient:     http.StatusSwitchingProtocols,
+			strict:      http.StatusBadRequest,
+		},
+		{
+			name:        "duplicated Sec-WebSocket-Key",
+			headerLines: []string{"Upgrade: websocket", "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==", "Sec-WebSocket-Key: AQIDBAUGBwgJCgsMDQ4PEA=="},
+			lenient:     http.StatusSwitchingProtocols,
+			strict:      http.StatusBadRequest,
+		},
+	}
+
+	lenient := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{}, backend.URL)
+	strict := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"strict_upgrade_headers": true,
+	}, backend.URL)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := rawUpgrade(t, lenient, tt.headerLines...); status != tt.lenient {
+				t.Errorf("lenient status = %d, want %d", status, tt.lenient)
+			}
+			if status := rawUpgrade(t, strict, tt.headerLines...); status != tt.strict {
+				t.Errorf("strict status = %d, want %d", status, tt.strict)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderCount(t *testing.T) {
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"max_header_count": float64(20),
+	}, newEchoBackend(t))
+
+	tests := []struct {
+		name     string
+		headers  int
+		expected int
+	}{
+		{name: "few headers", headers: 2, expected: http.StatusSwitchingProtocols},
+		{name: "excessive header count", headers: 30, expected: http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for i := 0; i < tt.headers; i++ {
+				header.Set(fmt.Sprintf("X-Custom-%d", i), "value")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", &websocket.DialOptions{HTTPHeader: header})
+			if conn != nil {
+				defer conn.Close(websocket.StatusNormalClosure, "")
+			}
+			if resp == nil {
+				t.Fatalf("failed to dial gateway: %v", err)
+			}
+			if resp.StatusCode != tt.expected {
+				t.Errorf("upgrade with %d extra headers got status %d, want %d", tt.headers, resp.StatusCode, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMatchPathPrefixBackend(t *testing.T) {
+	prefixBackends := map[string]string{
+		"/ws/":          "default",
+		"/ws/chat/":     "chat",
+		"/ws/chat/vip/": "vip",
+		"/ws/game/":     "game",
+	}
+
+	tests := []struct {
+		path    string
+		backend string
+		found   bool
+	}{
+		{path: "/ws/chat/room-1", backend: "chat", found: true},
+		{path: "/ws/chat/vip/room-1", backend: "vip", found: true},
+		{path: "/ws/game/lobby", backend: "game", found: true},
+		{path: "/ws/other", backend: "default", found: true},
+		{path: "/api/chat/", found: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			backend, found := matchPathPrefixBackend(prefixBackends, tt.path)
+			if backend != tt.backend || found != tt.found {
+				t.Errorf("matchPathPrefixBackend() = %q, %v, want %q, %v", backend, found, tt.backend, tt.found)
+			}
+		})
+	}
+}
+
+func TestPathPrefixBackendRouting(t *testing.T) {
+	namedBackend := func(name string) *httptest.Server {
+		return newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			conn.Write(ctx, websocket.MessageText, []byte(name+" "+r.URL.Path))
+			conn.Read(ctx)
+		})
+	}
+
+	chat := namedBackend("chat")
+	game := namedBackend("game")
+	fallback := namedBackend("default")
+
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"chat": "ws" + strings.TrimPrefix(chat.URL, "http"),
+		"game": "ws" + strings.TrimPrefix(game.URL, "http"),
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	endpointConfig := &config.EndpointConfig{
+		Endpoint: "/ws/*path",
+		Method:   http.MethodGet,
+		Backend: []*config.Backend{
+			{
+				Host:       []string{fallback.URL},
+				URLPattern: "/ws",
+			},
+		},
+		ExtraConfig: config.ExtraConfig{
+			ConfigNamespace: map[string]interface{}{
+				"path_prefix_backends": map[string]interface{}{
+					"/ws/chat/": "chat",
+					"/ws/game/": "game",
+				},
+			},
+		},
+	}
+	standardHandlerFactory := func(*config.EndpointConfig, proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		}
+	}
+	engine.GET("/ws/*path", NewHandlerFactory(logging.NoOp).HandlerWrapper(standardHandlerFactory)(endpointConfig, dummyProxy))
+
+	gateway := httptest.NewServer(engine)
+	t.Cleanup(gateway.Close)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "/ws/chat/room-1", expected: "chat /ws/chat/room-1"},
+		{path: "/ws/game/lobby", expected: "game /ws/game/lobby"},
+		{path: "/ws/other", expected: "default /ws"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, _, err := websocket.Dial(ctx, gateway.URL+tt.path, nil)
+			if err != nil {
+				t.Fatalf("failed to dial gateway: %v", err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+
+			_, message, err := conn.Read(ctx)
+			if err != nil {
+				t.Fatalf("client read failed: %v", err)
+			}
+			if string(message) != tt.expected {
+				t.Errorf("backend greeting = %q, want %q", message, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUnsupportedWebSocketVersion(t *testing.T) {
+	engine := newTestEngine(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{}, "http://localhost:1")
+
+	for _, version := range []string{"8", ""} {
+		t.Run("version "+version, func(t *testing.T) {
+			req := newUpgradeRequest("/ws")
+			if version == "" {
+				req.Header.Del("Sec-WebSocket-Version")
+			} else {
+				req.Header.Set("Sec-WebSocket-Version", version)
+			}
+			rec := httptest.NewRecorder()
+
+			engine.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusUpgradeRequired {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusUpgradeRequired)
+			}
+			if got := rec.Header().Get("Sec-WebSocket-Version"); got != "13" {
+				t.Errorf("Sec-WebSocket-Version = %q, want %q", got, "13")
+			}
+		})
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	cfg, _ := parseWebSocketConfig(map[string]interface{}{
+		ConfigNamespace: map[string]interface{}{
+			"write_timeout":                      "2s",
+			"min_write_throughput_bytes_per_sec": 1024.0,
+		},
+	})
+
+	if cfg.WriteTimeout != 2*time.Second || cfg.MinWriteThroughputBytesPerSec != 1024 {
+		t.Fatalf("parsed WriteTimeout = %v, MinWriteThroughputBytesPerSec = %v", cfg.WriteTimeout, cfg.MinWriteThroughputBytesPerSec)
+	}
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		size     int
+		expected time.Duration
+	}{
+		{name: "empty message", cfg: cfg, size: 0, expected: 2 * time.Second},
+		{name: "512 bytes", cfg: cfg, size: 512, expected: 2*time.Second + 500*time.Millisecond},
+		{name: "10KiB", cfg: cfg, size: 10 * 1024, expected: 12 * time.Second},
+		{name: "1MiB", cfg: cfg, size: 1 << 20, expected: 2*time.Second + 1024*time.Second},
+		{name: "fixed deadline", cfg: Config{WriteTimeout: time.Second}, size: 1 << 20, expected: time.Second},
+		{name: "no deadline", cfg: Config{MinWriteThroughputBytesPerSec: 1024}, size: 1 << 20, expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := writeTimeout(tt.size, tt.cfg); got != tt.expected {
+				t.Errorf("writeTimeout(%d) = %v, want %v", tt.size, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWriteTimeoutProxying(t *testing.T) {
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"write_timeout":                      "1s",
+		"min_write_throughput_bytes_per_sec": 1024.0,
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	exchangeMessages(t, client, "hello", strings.Repeat("x", 16*1024))
+}
+
+func TestWriteTimeoutStalledClient(t *testing.T) {
+	// The backend floods a client that never reads, until the gateway closes it
+	closed := make(chan error, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		go func() {
+			payload := make([]byte, 64*1024)
+			for conn.Write(ctx, websocket.MessageBinary, payload) == nil {
+			}
+		}()
+		_, _, err := conn.Read(ctx)
+		closed <- err
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"write_timeout": "200ms",
+	}, backend.URL)
+	rawWebSocketConn(t, gateway)
+
+	select {
+	case err := <-closed:
+		var closeErr websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != statusWriteTimeout || closeErr.Reason != writeTimeoutReason {
+			t.Fatalf("backend read = %v, want a close with %d %q", err, statusWriteTimeout, writeTimeoutReason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend not closed while the client stalled the writes")
+	}
+}
+
+func TestSubprotocolHeader(t *testing.T) {
+	received := make(chan []string, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		received <- r.Header.Values("X-Negotiated-Subprotocol")
+		conn.Read(ctx)
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"subprotocols":       []interface{}{"chat.v2", "chat.v1"},
+		"subprotocol_header": "X-Negotiated-Subprotocol",
+		"pass_all_headers":   true,
+	}, backend.URL)
+
+	tests := []struct {
+		name         string
+		subprotocols []string
+		header       http.Header
+		expected     []string
+	}{
+		{name: "negotiated subprotocol", subprotocols: []string{"chat.v1"}, expected: []string{"chat.v1"}},
+		{name: "client value replaced", subprotocols: []string{"chat.v2"}, header: http.Header{"X-Negotiated-Subprotocol": {"admin.v1"}}, expected: []string{"chat.v2"}},
+		{name: "client value dropped without subprotocol", header: http.Header{"X-Negotiated-Subprotocol": {"admin.v1"}}, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialTestGateway(t, gateway, &websocket.DialOptions{
+				Subprotocols: tt.subprotocols,
+				HTTPHeader:   tt.header,
+			})
+
+			select {
+			case values := <-received:
+				if strings.Join(values, ",") != strings.Join(tt.expected, ",") {
+					t.Errorf("backend received X-Negotiated-Subprotocol %v, want %v", values, tt.expected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("backend was not dialed")
+			}
+		})
+	}
+}
+
+func TestConvertHTTPToWebSocketURLInferSchemeFromPort(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+
+	tests := []struct {
+		name        string
+		host        string
+		forceScheme string
+		infer       bool
+		expected    string
+	}{
+		{name: "bare 443", host: "backend:443", infer: true, expected: "wss://backend:443/ws"},
+		{name: "bare 80", host: "backend:80", infer: true, expected: "ws://backend:80/ws"},
+		{name: "bare other port", host: "backend:8443", infer: true, expected: "ws://backend:8443/ws"},
+		{name: "bare 443 without inference", host: "backend:443", infer: false, expected: "ws://backend:443/ws"},
+		{name: "explicit http scheme wins over port", host: "http://backend:443", infer: true, expected: "ws://backend:443/ws"},
+		{name: "backend_scheme overrides inference", host: "backend:443", forceScheme: "ws", infer: true, expected: "ws://backend:443/ws"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsURL, err := factory.convertHTTPToWebSocketURL(tt.host, "/ws", tt.forceScheme, tt.infer)
+			if err != nil {
+				t.Fatalf("convertHTTPToWebSocketURL() failed: %v", err)
+			}
+			if wsURL != tt.expected {
+				t.Errorf("convertHTTPToWebSocketURL() = %s, want %s", wsURL, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCheckBackendScheme(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		autocorrect bool
+		expected    string
+		expectError bool
+	}{
+		{name: "ws url", url: "ws://localhost:8080/ws", expected: "ws://localhost:8080/ws"},
+		{name: "wss url", url: "wss://example.com/ws", expected: "wss://example.com/ws"},
+		{name: "http url", url: "http://localhost:8080/ws", expectError: true},
+		{name: "https url", url: "https://example.com/ws", expectError: true},
+		{name: "corrected http url", url: "http://localhost:8080/ws", autocorrect: true, expected: "ws://localhost:8080/ws"},
+		{name: "corrected https url", url: "https://example.com/ws?room=1", autocorrect: true, expected: "wss://example.com/ws?room=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsURL, err := checkBackendScheme(tt.url, tt.autocorrect)
+			if tt.expectError {
+				if err == nil || !strings.Contains(err.Error(), "autocorrect_scheme") || !strings.Contains(err.Error(), "backend_scheme") {
+					t.Errorf("checkBackendScheme() error = %v, want one naming backend_scheme and autocorrect_scheme", err)
+				}
+				return
+			}
+			if err != nil || wsURL != tt.expected {
+				t.Errorf("checkBackendScheme() = %s, %v, want %s", wsURL, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestConnectToBackendHTTPScheme(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	cfg := &config.EndpointConfig{
+		Endpoint: "/ws",
+		Backend: []*config.Backend{
+			{
+				Host:       []string{newEchoBackend(t)},
+				URLPattern: "/ws",
+			},
+		},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+
+	_, _, err := factory.connectToBackend(context.Background(), r, cfg, Config{BackendScheme: "http"}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), `set backend_scheme to "ws"`) {
+		t.Fatalf("connectToBackend() error = %v, want the descriptive scheme error", err)
+	}
+
+	conn, target, err := factory.connectToBackend(context.Background(), r, cfg, Config{BackendScheme: "http", AutocorrectScheme: true}, nil, nil)
+	if err != nil {
+		t.Fatalf("connectToBackend() with autocorrect_scheme error = %v", err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	if !strings.HasPrefix(target.url, "ws://") {
+		t.Errorf("backend URL = %s, want the ws scheme", target.url)
+	}
+}
+
+func TestConnectToBackendPlainHTTP(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "not found", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte("<html>not a WebSocket</html>"))
+			}))
+			t.Cleanup(backend.Close)
+
+			factory := NewHandlerFactory(logging.NoOp)
+			cfg := &config.EndpointConfig{
+				Endpoint: "/ws",
+				Backend: []*config.Backend{
+					{
+						Host:       []string{backend.URL},
+						URLPattern: "/ws",
+					},
+				},
+			}
+
+			_, _, err := factory.connectToBackend(context.Background(), httptest.NewRequest(http.MethodGet, "/ws", nil), cfg, Config{}, nil, nil)
+			expected := fmt.Sprintf("backend at ws%s/ws did not complete WebSocket handshake (status %d)", strings.TrimPrefix(backend.URL, "http"), tt.status)
+			if err == nil || !strings.Contains(err.Error(), expected) {
+				t.Fatalf("connectToBackend() error = %v, want it to contain %q", err, expected)
+			}
+		})
+	}
+}
+
+func TestConnectToBackendRoundRobin(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	first, second := newEchoBackend(t), newEchoBackend(t)
+	unavailable := "http://127.0.0.1:1"
+
+	cfg := &config.EndpointConfig{
+		Endpoint: "/ws",
+		Backend: []*config.Backend{
+			{
+				Host:       []string{first, unavailable, second},
+				URLPattern: "/ws",
+			},
+		},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+
+	// The unavailable host falls through to the next one in rotation
+	for i, expected := range []string{first, second, second, first} {
+		conn, target, err := factory.connectToBackend(context.Background(), r, cfg, Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("connection %d: connectToBackend() error = %v", i, err)
+		}
+		conn.Close(websocket.StatusNormalClosure, "")
+
+		if target.name != expected {
+			t.Errorf("connection %d: backend host = %s, want %s", i, target.name, expected)
+		}
+	}
+
+	cfg.Backend[0].Host = []string{unavailable, "http://127.0.0.1:2"}
+	_, _, err := factory.connectToBackend(context.Background(), r, cfg, Config{}, nil, nil)
+	if err == nil {
+		t.Fatal("connectToBackend() succeeded with every host unavailable")
+	}
+	for _, url := range []string{"ws://127.0.0.1:1/ws", "ws://127.0.0.1:2/ws"} {
+		if !strings.Contains(err.Error(), url) {
+			t.Errorf("connectToBackend() error = %v, want it to list %s", err, url)
+		}
+	}
+}
+
+// droppingListener closes the first connections it accepts, as a backend still starting up would
+type droppingListener struct {
+	net.Listener
+	drops int32
+}
+
+func (l *droppingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || atomic.AddInt32(&l.drops, -1) < 0 {
+			return conn, err
+		}
+		conn.Close()
+	}
+}
+
+func TestConnectToBackendDialRetries(t *testing.T) {
+	var handshakes int32
+	newBackend := func(drops int32, status int) string {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&handshakes, 1)
+			if status != 0 {
+				rw.WriteHeader(status)
+				return
+			}
+			conn, err := websocket.Accept(rw, r, nil)
+			if err == nil {
+				conn.Close(websocket.StatusNormalClosure, "")
+			}
+		}))
+		server.Listener = &droppingListener{Listener: server.Listener, drops: drops}
+		server.Start()
+		t.Cleanup(server.Close)
+		return server.URL
+	}
+
+	tests := []struct {
+		name       string
+		drops      int32
+		status     int
+		retries    int
+		connected  bool
+		handshakes int32
+	}{
+		{name: "no retries", drops: 1, retries: 0, handshakes: 0},
+		{name: "backend starting up", drops: 2, retries: 2, connected: true, handshakes: 1},
+		{name: "retries exhausted", drops: 3, retries: 2, handshakes: 0},
+		{name: "handshake rejected", status: http.StatusForbidden, retries: 2, handshakes: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&handshakes, 0)
+			factory := NewHandlerFactory(logging.NoOp)
+			cfg := &config.EndpointConfig{
+				Endpoint: "/ws",
+				Backend:  []*config.Backend{{Host: []string{newBackend(tt.drops, tt.status)}, URLPattern: "/ws"}},
+			}
+			wsConfig := Config{DialRetries: tt.retries, DialBackoff: time.Millisecond}
+
+			conn, _, err := factory.connectToBackend(context.Background(), httptest.NewRequest(http.MethodGet, "/ws", nil), cfg, wsConfig, nil, nil)
+			if conn != nil {
+				conn.Close(websocket.StatusNormalClosure, "")
+			}
+			if (err == nil) != tt.connected {
+				t.Errorf("connectToBackend() error = %v, want connected = %v", err, tt.connected)
+			}
+			if got := atomic.LoadInt32(&handshakes); got != tt.handshakes {
+				t.Errorf("backend handshakes = %d, want %d", got, tt.handshakes)
+			}
+		})
+	}
+
+	t.Run("client gone", func(t *testing.T) {
+		factory := NewHandlerFactory(logging.NoOp)
+		cfg := &config.EndpointConfig{
+			Endpoint: "/ws",
+			Backend:  []*config.Backend{{Host: []string{"http://127.0.0.1:1"}, URLPattern: "/ws"}},
+		}
+		wsConfig := Config{DialRetries: 5, DialBackoff: time.Second}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		if _, _, err := factory.connectToBackend(ctx, httptest.NewRequest(http.MethodGet, "/ws", nil), cfg, wsConfig, nil, nil); err == nil {
+			t.Fatal("connectToBackend() succeeded with an unavailable backend")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("connectToBackend() returned after %s, want the retries aborted with the context", elapsed)
+		}
+	})
+}
+
+func TestDialRetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		attempt int
+		min     time.Duration
+	}{
+		{backoff: 0, attempt: 0, min: defaultDialBackoff},
+		{backoff: 10 * time.Millisecond, attempt: 0, min: 10 * time.Millisecond},
+		{backoff: 10 * time.Millisecond, attempt: 3, min: 80 * time.Millisecond},
+		{backoff: time.Second, attempt: 10, min: maxDialBackoff},
+		{backoff: time.Second, attempt: 100, min: maxDialBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := dialRetryDelay(tt.backoff, tt.attempt); got < tt.min || got > tt.min+tt.min/2 {
+			t.Errorf("dialRetryDelay(%s, %d) = %s, want between %s and %s", tt.backoff, tt.attempt, got, tt.min, tt.min+tt.min/2)
+		}
+	}
+}
+
+func TestAcceptOptionsFunc(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+
+	var base websocket.AcceptOptions
+	factory.SetAcceptOptionsFunc(func(c *gin.Context, opts websocket.AcceptOptions) websocket.AcceptOptions {
+		base = opts
+		if version := c.Query("version"); version != "" {
+			opts.Subprotocols = append([]string{"chat." + version}, opts.Subprotocols...)
+		}
+		return opts
+	})
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"subprotocols": []interface{}{"chat.v1"},
+	}, newEchoBackend(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, gateway.URL+"/ws?version=v2", &websocket.DialOptions{
+		Subprotocols: []string{"chat.v2"},
+	})
+	if err != nil {
+		t.Fatalf("failed to dial gateway: %v", err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	if conn.Subprotocol() != "chat.v2" {
+		t.Errorf("negotiated subprotocol = %q, want the dynamically added chat.v2", conn.Subprotocol())
+	}
+	if len(base.Subprotocols) != 1 || base.Subprotocols[0] != "chat.v1" {
+		t.Errorf("base subprotocols = %v, want the configured [chat.v1]", base.Subprotocols)
+	}
+	exchangeMessages(t, conn, "hello")
+}
+
+// pipeRecorder is a response recorder hijacked into one end of an in-memory pipe
+type pipeRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (r *pipeRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.conn, bufio.NewReadWriter(bufio.NewReader(r.conn), bufio.NewWriter(r.conn)), nil
+}
+
+func TestHandshakeTimeoutStalledClient(t *testing.T) {
+	engine := newTestEngine(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"handshake_timeout": "100ms",
+	}, newEchoBackend(t))
+
+	// Writes to a pipe block until the other end reads, which the stalled client never does
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		engine.ServeHTTP(&pipeRecorder{ResponseRecorder: httptest.NewRecorder(), conn: serverConn}, newUpgradeRequest("/ws"))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the handshake with a stalled client was not aborted by handshake_timeout")
+	}
+}
+
+func TestHandshakeTimeoutLiftedAfterAccept(t *testing.T) {
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"handshake_timeout": "100ms",
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	time.Sleep(200 * time.Millisecond)
+	exchangeMessages(t, client, "still open")
+}
+
+func TestHandshakeTimeoutStalledBackend(t *testing.T) {
+	// The backend accepts TCP connections but never answers the upgrade request
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	recorder := &testLogger{}
+	gateway := newTestGateway(t, NewHandlerFactory(recorder), map[string]interface{}{
+		"handshake_timeout": "100ms",
+	}, "http://"+listener.Addr().String())
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, _, err := client.Read(ctx); websocket.CloseStatus(err) != websocket.StatusTryAgainLater {
+		t.Fatalf("client read error = %v, want a close with %v", err, websocket.StatusTryAgainLater)
+	}
+	if lines := recorder.Contains("handshake timed out after 100ms"); len(lines) == 0 {
+		t.Errorf("the backend handshake timeout was not logged: %v", recorder.Contains("ERROR:"))
+	}
+}
+
+func TestLegacyBackendFormatWarning(t *testing.T) {
+	logger := &testLogger{}
+	factory := NewHandlerFactory(logger)
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+
+	legacyEndpoint := func(endpoint string) *config.EndpointConfig {
+		return &config.EndpointConfig{
+			Endpoint: endpoint,
+			Backend: []*config.Backend{
+				{
+					Host:       []string{"http://127.0.0.1:1"},
+					URLPattern: "/ws",
+				},
+			},
+		}
+	}
+	newFormatEndpoint := &config.EndpointConfig{
+		Endpoint: "/ws/new",
+		ExtraConfig: config.ExtraConfig{
+			"backend":      "chat",
+			"backend_path": "/ws",
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		factory.connectToBackend(context.Background(), r, legacyEndpoint("/ws/legacy"), Config{}, nil, nil)
+		factory.connectToBackend(context.Background(), r, newFormatEndpoint, Config{}, nil, nil)
+	}
+
+	warnings := logger.Contains("deprecated")
+	if len(warnings) != 1 {
+		t.Fatalf("got %d deprecation warnings, want 1: %v", len(warnings), warnings)
+	}
+	if !strings.HasPrefix(warnings[0], "WARNING:") || !strings.Contains(warnings[0], "/ws/legacy") || !strings.Contains(warnings[0], "backend_path") {
+		t.Errorf("warning = %q, want a warning naming the endpoint and the new format", warnings[0])
+	}
+
+	factory.connectToBackend(context.Background(), r, legacyEndpoint("/ws/other"), Config{}, nil, nil)
+	if warnings := logger.Contains("deprecated"); len(warnings) != 2 || !strings.Contains(warnings[1], "/ws/other") {
+		t.Errorf("deprecation warnings = %v, want a second one for /ws/other", warnings)
+	}
+}
+
+func TestAppendPathSuffix(t *testing.T) {
+	tests := []struct {
+		path     string
+		suffix   string
+		expected string
+	}{
+		{path: "/chat", suffix: "", expected: "/chat"},
+		{path: "/chat", suffix: "/ws", expected: "/chat/ws"},
+		{path: "/chat/", suffix: "/ws", expected: "/chat/ws"},
+		{path: "/chat", suffix: "ws", expected: "/chat/ws"},
+		{path: "/chat/", suffix: "ws/", expected: "/chat/ws/"},
+		{path: "", suffix: "/ws", expected: "/ws"},
+	}
+
+	for _, tt := range tests {
+		if got := appendPathSuffix(tt.path, tt.suffix); got != tt.expected {
+			t.Errorf("appendPathSuffix(%q, %q) = %q, want %q", tt.path, tt.suffix, got, tt.expected)
+		}
+	}
+}
+
+func TestBackendPathSuffix(t *testing.T) {
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"chat": "ws://127.0.0.1:1",
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	factory := NewHandlerFactory(logging.NoOp)
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	wsConfig := Config{BackendPathSuffix: "/ws"}
+
+	tests := []struct {
+		name     string
+		cfg      *config.EndpointConfig
+		expected string
+	}{
+		{
+			name: "endpoint backend",
+			cfg: &config.EndpointConfig{
+				Endpoint: "/chat",
+				Backend: []*config.Backend{
+					{
+						Host:       []string{"http://127.0.0.1:1"},
+						URLPattern: "/chat/",
+					},
+				},
+			},
+			expected: "ws://127.0.0.1:1/chat/ws",
+		},
+		{
+			name: "named backend",
+			cfg: &config.EndpointConfig{
+				Endpoint: "/chat",
+				ExtraConfig: config.ExtraConfig{
+					"backend":      "chat",
+					"backend_path": "/chat",
+				},
+			},
+			expected: "ws://127.0.0.1:1/chat/ws",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := factory.connectToBackend(context.Background(), r, tt.cfg, wsConfig, nil, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.expected+":") {
+				t.Errorf("connectToBackend() error = %v, want a dial of %s", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOptionalBackendPath(t *testing.T) {
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"chat": "ws://127.0.0.1:1",
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	factory := NewHandlerFactory(logging.NoOp)
+	cfg := &config.EndpointConfig{
+		Endpoint: "/chat/*",
+		ExtraConfig: config.ExtraConfig{
+			"backend": "chat",
+		},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/chat/room-1", nil)
+
+	tests := []struct {
+		name     string
+		wsConfig Config
+		expected string
+	}{
+		{name: "request path", expected: "ws://127.0.0.1:1/chat/room-1"},
+		{name: "default backend path", wsConfig: Config{DefaultBackendPath: "/ws"}, expected: "ws://127.0.0.1:1/ws"},
+		{name: "path suffix", wsConfig: Config{BackendPathSuffix: "/ws"}, expected: "ws://127.0.0.1:1/chat/room-1/ws"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := factory.connectToBackend(context.Background(), r, cfg, tt.wsConfig, nil, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.expected+":") {
+				t.Errorf("connectToBackend() error = %v, want a dial of %s", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestForwardQueryString(t *testing.T) {
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"chat": "ws://127.0.0.1:1",
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	factory := NewHandlerFactory(logging.NoOp)
+	r := httptest.NewRequest(http.MethodGet, "/ws?token=abc", nil)
+
+	tests := []struct {
+		name        string
+		backendPath string
+		forward     bool
+		expected    string
+	}{
+		{name: "forwarded", backendPath: "/ws", forward: true, expected: "ws://127.0.0.1:1/ws?token=abc"},
+		{name: "merged with the backend_path query", backendPath: "/ws?version=2", forward: true, expected: "ws://127.0.0.1:1/ws?version=2&token=abc"},
+		{name: "disabled", backendPath: "/ws", expected: "ws://127.0.0.1:1/ws"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.EndpointConfig{
+				Endpoint: "/ws",
+				ExtraConfig: config.ExtraConfig{
+					"backend":      "chat",
+					"backend_path": tt.backendPath,
+				},
+			}
+			_, _, err := factory.connectToBackend(context.Background(), r, cfg, Config{ForwardQueryString: tt.forward}, nil, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.expected+":") {
+				t.Errorf("connectToBackend() error = %v, want a dial of %s", err, tt.expected)
+			}
+		})
+	}
+
+	t.Run("default", func(t *testing.T) {
+		backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			conn.Write(ctx, websocket.MessageText, []byte(r.URL.RawQuery))
+			conn.Read(ctx)
+		})
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{}, backend.URL)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		client, _, err := websocket.Dial(ctx, gateway.URL+"/ws?token=abc", nil)
+		if err != nil {
+			t.Fatalf("failed to dial gateway: %v", err)
+		}
+		defer client.Close(websocket.StatusNormalClosure, "")
+
+		if _, query, err := client.Read(ctx); err != nil || string(query) != "token=abc" {
+			t.Errorf("backend query = %q, %v, want the client query token=abc", query, err)
+		}
+	})
+}
+
+func TestFallbackBackend(t *testing.T) {
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"fallback":    "ws" + strings.TrimPrefix(newEchoBackend(t), "http"),
+		"unavailable": "ws://127.0.0.1:1",
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	factory := NewHandlerFactory(logging.NoOp)
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	wsConfig := Config{FallbackBackend: "fallback"}
+
+	tests := []struct {
+		name string
+		cfg  *config.EndpointConfig
+	}{
+		{
+			name: "unresolvable backend",
+			cfg: &config.EndpointConfig{
+				Endpoint:    "/ws",
+				ExtraConfig: config.ExtraConfig{"backend": "missing", "backend_path": "/ws"},
+			},
+		},
+		{
+			name: "unavailable backend",
+			cfg: &config.EndpointConfig{
+				Endpoint:    "/ws",
+				ExtraConfig: config.ExtraConfig{"backend": "unavailable", "backend_path": "/ws"},
+			},
+		},
+		{
+			name: "unavailable endpoint hosts",
+			cfg: &config.EndpointConfig{
+				Endpoint: "/ws",
+				Backend:  []*config.Backend{{Host: []string{"http://127.0.0.1:1", "http://127.0.0.1:2"}, URLPattern: "/ws"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, target, err := factory.connectToBackend(context.Background(), r, tt.cfg, wsConfig, nil, nil)
+			if err != nil {
+				t.Fatalf("connectToBackend() error = %v, want the fallback backend dialed", err)
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+
+			if target.name != "fallback" {
+				t.Errorf("backend = %s, want the fallback backend", target.name)
+			}
+		})
+	}
+}
+
+func TestIdleTimeouts(t *testing.T) {
+	// The backend pushes a message every 20ms and never replies to the client
+	pushingBackend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		go func() {
+			for {
+				if _, _, err := conn.Read(ctx); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+				if err := conn.Write(ctx, websocket.MessageText, []byte("tick")); err != nil {
+					return
+				}
+			}
+		}
+	})
+
+	// The backend only reads, it never pushes
+	silentBackend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+
+	tests := []struct {
+		name          string
+		backendURL    string
+		clientSends   bool
+		expectedError string
+	}{
+		{name: "idle client", backendURL: pushingBackend.URL, clientSends: false, expectedError: "Client idle timeout"},
+		{name: "idle backend", backendURL: silentBackend.URL, clientSends: true, expectedError: "Backend idle timeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+				"client_idle_timeout":  "300ms",
+				"backend_idle_timeout": "300ms",
+			}, tt.backendURL)
+			client := dialTestGateway(t, gateway, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// Keep the other direction busy well past the idle timeout
+			if tt.clientSends {
+				go func() {
+					for ctx.Err() == nil {
+						if err := client.Write(ctx, websocket.MessageText, []byte("ping")); err != nil {
+							return
+						}
+						time.Sleep(20 * time.Millisecond)
+					}
+				}()
+			}
+
+			start := time.Now()
+			var err error
+			for err == nil {
+				_, _, err = client.Read(ctx)
+			}
+			elapsed := time.Since(start)
+
+			if status := websocket.CloseStatus(err); status != websocket.StatusPolicyViolation {
+				t.Fatalf("client closed with %v (%v), want %v", status, err, websocket.StatusPolicyViolation)
+			}
+			if tt.expectedError != "" && !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("close error = %v, want the reason %q", err, tt.expectedError)
+			}
+			if elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+				t.Errorf("connection closed after %v, want about the 300ms idle timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutPerDirection(t *testing.T) {
+	// Only the client side is limited: a silent backend must not close the connection
+	silentBackend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"client_idle_timeout": "200ms",
+	}, silentBackend.URL)
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+		if err := client.Write(ctx, websocket.MessageText, []byte("ping")); err != nil {
+			t.Fatalf("client write %d failed after %dms: %v", i, i*50, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestConnectionIdleTimeout(t *testing.T) {
+	// The backend pushes a message every 20ms and never replies to the client
+	pushingBackend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		go func() {
+			for {
+				if _, _, err := conn.Read(ctx); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+				if err := conn.Write(ctx, websocket.MessageText, []byte("tick")); err != nil {
+					return
+				}
+			}
+		}
+	})
+
+	// The backend only reads, it never pushes
+	silentBackend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+
+	tests := []struct {
+		name        string
+		backendURL  string
+		clientSends bool
+		idles       bool
+	}{
+		{name: "silent in both directions", backendURL: silentBackend.URL, idles: true},
+		{name: "backend messages only", backendURL: pushingBackend.URL},
+		{name: "client messages only", backendURL: silentBackend.URL, clientSends: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+				"idle_timeout": "200ms",
+			}, tt.backendURL)
+			client := dialTestGateway(t, gateway, nil)
+
+			// Any close before the deadline is an idle close
+			ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+			defer cancel()
+
+			if tt.clientSends {
+				go func() {
+					for ctx.Err() == nil {
+						if err := client.Write(ctx, websocket.MessageText, []byte("ping")); err != nil {
+							return
+						}
+						time.Sleep(20 * time.Millisecond)
+					}
+				}()
+			}
+
+			start := time.Now()
+			var err error
+			for err == nil {
+				_, _, err = client.Read(ctx)
+			}
+			elapsed := time.Since(start)
+
+			if !tt.idles {
+				if ctx.Err() == nil {
+					t.Fatalf("connection closed after %v (%v), want it kept open by the traffic", elapsed, err)
+				}
+				return
+			}
+
+			if status := websocket.CloseStatus(err); status != websocket.StatusPolicyViolation {
+				t.Fatalf("client closed with %v (%v), want %v", status, err, websocket.StatusPolicyViolation)
+			}
+			if !strings.Contains(err.Error(), "Idle timeout") {
+				t.Errorf("close error = %v, want the reason %q", err, "Idle timeout")
+			}
+			if elapsed < 150*time.Millisecond {
+				t.Errorf("connection closed after %v, want about the 200ms idle timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestRequireSubprotocol(t *testing.T) {
+	// newSubprotocolBackend accepts connections speaking one of subprotocols and reports how they were closed
+	newSubprotocolBackend := func(subprotocols ...string) (*httptest.Server, <-chan error) {
+		closed := make(chan error, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			conn, err := websocket.Accept(rw, r, &websocket.AcceptOptions{Subprotocols: subprotocols})
+			if err != nil {
+				t.Errorf("backend accept failed: %v", err)
+				return
+			}
+			defer conn.Close(websocket.StatusNormalClosure, "")
+
+			for {
+				messageType, message, err := conn.Read(r.Context())
+				if err != nil {
+					closed <- err
+					return
+				}
+				if err := conn.Write(r.Context(), messageType, message); err != nil {
+					return
+				}
+			}
+		}))
+		t.Cleanup(server.Close)
+		return server, closed
+	}
+
+	dial := func(gateway *httptest.Server) *websocket.Conn {
+		t.Helper()
+		return dialTestGateway(t, gateway, &websocket.DialOptions{Subprotocols: []string{"chat.v1"}})
+	}
+
+	wsConfig := map[string]interface{}{
+		"subprotocols":        []interface{}{"chat.v1"},
+		"require_subprotocol": true,
+	}
+
+	t.Run("backend speaking the subprotocol", func(t *testing.T) {
+		backend, _ := newSubprotocolBackend("chat.v1")
+		client := dial(newTestGateway(t, NewHandlerFactory(logging.NoOp), wsConfig, backend.URL))
+
+		if client.Subprotocol() != "chat.v1" {
+			t.Fatalf("client subprotocol = %q, want chat.v1", client.Subprotocol())
+		}
+		exchangeMessages(t, client, "hello")
+	})
+
+	t.Run("backend speaking another subprotocol", func(t *testing.T) {
+		backend, backendClosed := newSubprotocolBackend("chat.v2")
+		client := dial(newTestGateway(t, NewHandlerFactory(logging.NoOp), wsConfig, backend.URL))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_, _, err := client.Read(ctx)
+		if status := websocket.CloseStatus(err); status != websocket.StatusProtocolError {
+			t.Fatalf("client closed with %v (%v), want %v", status, err, websocket.StatusProtocolError)
+		}
+		if !strings.Contains(err.Error(), "chat.v1") {
+			t.Errorf("close error = %v, want a reason naming chat.v1", err)
+		}
+
+		select {
+		case err := <-backendClosed:
+			if status := websocket.CloseStatus(err); status != websocket.StatusProtocolError {
+				t.Errorf("backend closed with %v (%v), want %v", status, err, websocket.StatusProtocolError)
+			}
+		case <-ctx.Done():
+			t.Fatalf("the backend connection was not closed")
+		}
+	})
+}
+
+func TestTotalHandshakeBudget(t *testing.T) {
+	newGateway := func(middlewareDelay time.Duration) *httptest.Server {
+		gin.SetMode(gin.TestMode)
+		engine := gin.New()
+		endpointConfig := &config.EndpointConfig{
+			Endpoint: "/ws",
+			Method:   http.MethodGet,
+			Backend: []*config.Backend{
+				{
+					Host:       []string{newEchoBackend(t)},
+					URLPattern: "/ws",
+				},
+			},
+			ExtraConfig: config.ExtraConfig{
+				ConfigNamespace: map[string]interface{}{
+					"total_handshake_budget": "200ms",
+				},
+			},
+		}
+
+		// The middleware authenticates slowly, giving up when the request context is done
+		middlewareFactory := func(*config.EndpointConfig, proxy.Proxy) gin.HandlerFunc {
+			return func(c *gin.Context) {
+				select {
+				case <-c.Request.Context().Done():
+					return
+				case <-time.After(middlewareDelay):
+				}
+				c.Request.Header.Set("X-User-Id", "42")
+				c.Status(http.StatusOK)
+			}
+		}
+		engine.GET("/ws", NewHandlerFactory(logging.NoOp).HandlerWrapper(middlewareFactory)(endpointConfig, dummyProxy))
+
+		gateway := httptest.NewServer(engine)
+		t.Cleanup(gateway.Close)
+		return gateway
+	}
+
+	dialOptions := &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": []string{"Bearer token"}},
+	}
+
+	t.Run("slow middleware", func(t *testing.T) {
+		gateway := newGateway(5 * time.Second)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		_, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", dialOptions)
+		if err == nil {
+			t.Fatalf("dial succeeded, want the handshake budget to abort it")
+		}
+		if resp == nil || resp.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("dial response = %v (%v), want HTTP 504", resp, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("handshake aborted after %v, want about the 200ms budget", elapsed)
+		}
+	})
+
+	t.Run("handshake within budget", func(t *testing.T) {
+		gateway := newGateway(10 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		client, _, err := websocket.Dial(ctx, gateway.URL+"/ws", dialOptions)
+		if err != nil {
+			t.Fatalf("failed to dial gateway: %v", err)
+		}
+		defer client.Close(websocket.StatusNormalClosure, "")
+
+		// The budget only bounds the handshake, not the proxied connection
+		time.Sleep(300 * time.Millisecond)
+		exchangeMessages(t, client, "hello")
+	})
+}
+
+func TestNegotiatedSubprotocolHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		wsConfig  map[string]interface{}
+		requested string
+		expected  string
+	}{
+		{name: "none configured nor requested", wsConfig: map[string]interface{}{}},
+		{name: "none requested", wsConfig: map[string]interface{}{"subprotocols": []interface{}{"chat"}}},
+		{name: "unsupported requested", wsConfig: map[string]interface{}{"subprotocols": []interface{}{"chat"}}, requested: "other"},
+		{name: "supported requested", wsConfig: map[string]interface{}{"subprotocols": []interface{}{"chat"}}, requested: "chat", expected: "chat"},
+		{name: "default not answered when none requested", wsConfig: map[string]interface{}{"default_subprotocol": "chat"}},
+		{name: "default ignored when one is requested", wsConfig: map[string]interface{}{"subprotocols": []interface{}{"chat"}, "default_subprotocol": "legacy"}, requested: "chat", expected: "chat"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), tt.wsConfig, newEchoBackend(t))
+
+			req, err := http.NewRequest(http.MethodGet, gateway.URL+"/ws", nil)
+			if err != nil {
+				t.Fatalf("failed to build request: %v", err)
+			}
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			if tt.requested != "" {
+				req.Header.Set("Sec-WebSocket-Protocol", tt.requested)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("upgrade request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			values, present := resp.Header["Sec-Websocket-Protocol"]
+			if tt.expected == "" && present {
+				t.Errorf("Sec-WebSocket-Protocol = %v, want the header absent", values)
+			}
+			if tt.expected != "" && (len(values) != 1 || values[0] != tt.expected) {
+				t.Errorf("Sec-WebSocket-Protocol = %v, want %s", values, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDefaultSubprotocol(t *testing.T) {
+	offered := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		offered <- r.Header.Get("Sec-WebSocket-Protocol")
+		conn, err := websocket.Accept(rw, r, &websocket.AcceptOptions{Subprotocols: []string{"chat"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+
+		for {
+			typ, data, err := conn.Read(r.Context())
+			if err != nil {
+				return
+			}
+			conn.Write(r.Context(), typ, data)
+		}
+	}))
+	defer backend.Close()
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"default_subprotocol": "chat",
+	}, backend.URL)
+
+	// Like browsers, nhooyr fails the handshake on a subprotocol it did not request
+	client := dialTestGateway(t, gateway, nil)
+	if sp := client.Subprotocol(); sp != "" {
+		t.Errorf("client negotiated subprotocol %q, want none", sp)
+	}
+	exchangeMessages(t, client, "hello")
+
+	select {
+	case sp := <-offered:
+		if sp != "chat" {
+			t.Errorf("backend was offered subprotocol %q, want %q", sp, "chat")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend was not dialed")
+	}
+}
+
+func TestCloseStatusForwarding(t *testing.T) {
+	// The longest reason fitting in a close frame, with multi-byte characters
+	reason := strings.Repeat("é", 60) + "end"
+
+	t.Run("backend close", func(t *testing.T) {
+		backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			conn.Read(ctx)
+			conn.Close(websocket.StatusCode(4001), reason)
+		})
+		client := dialTestGateway(t, newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{}, backend.URL), nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := client.Write(ctx, websocket.MessageText, []byte("bye")); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+		_, _, err := client.Read(ctx)
+
+		var closeErr websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != 4001 || closeErr.Reason != reason {
+			t.Errorf("client read error = %v, want a close with status 4001 and the backend reason", err)
+		}
+	})
+
+	t.Run("client close", func(t *testing.T) {
+		backendClosed := make(chan error, 1)
+		backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			conn.Write(ctx, websocket.MessageText, []byte("ready"))
+			_, _, err := conn.Read(ctx)
+			backendClosed <- err
+		})
+		client := dialTestGateway(t, newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{}, backend.URL), nil)
+
+		// Once the backend greeting arrives, the gateway is connected to it
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, _, err := client.Read(ctx); err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+		client.Close(websocket.StatusCode(4002), reason)
+
+		select {
+		case err := <-backendClosed:
+			var closeErr websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != 4002 || closeErr.Reason != reason {
+				t.Errorf("backend read error = %v, want a close with status 4002 and the client reason", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the backend connection was not closed")
+		}
+	})
+}
+
+func TestPeerCloseStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		code   websocket.StatusCode
+		reason string
+		ok     bool
+	}{
+		{name: "application status", err: fmt.Errorf("failed to read: %w", websocket.CloseError{Code: 4000, Reason: "custom"}), code: 4000, reason: "custom", ok: true},
+		{name: "no status", err: websocket.CloseError{Code: websocket.StatusNoStatusRcvd}, code: websocket.StatusNormalClosure, ok: true},
+		{name: "not a close", err: io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, reason, ok := peerCloseStatus(tt.err)
+			if code != tt.code || reason != tt.reason || ok != tt.ok {
+				t.Errorf("peerCloseStatus() = %v, %q, %v, want %v, %q, %v", code, reason, ok, tt.code, tt.reason, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWriteRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryCount int
+		delivered  bool
+	}{
+		{name: "no retry", retryCount: 0},
+		{name: "written again on a redialed backend", retryCount: 1, delivered: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first backend connection is dropped without a close frame once it echoed a message
+			var connections int32
+			hijacked := make(chan net.Conn, 2)
+			backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&connections, 1)
+				if n > 1 {
+					// Hold the redial so that the client message is written while the backend is gone
+					time.Sleep(200 * time.Millisecond)
+				}
+				conn, err := websocket.Accept(rw, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "")
+				netConn := <-hijacked
+
+				for {
+					messageType, message, err := conn.Read(r.Context())
+					if err != nil {
+						return
+					}
+					if err := conn.Write(r.Context(), messageType, []byte(fmt.Sprintf("%d:%s", n, message))); err != nil {
+						return
+					}
+					if n == 1 {
+						netConn.Close()
+						return
+					}
+				}
+			}))
+			backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateHijacked {
+					hijacked <- conn
+				}
+			}
+			backend.Start()
+			defer backend.Close()
+
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+				"write_retry_count": float64(tt.retryCount),
+			}, backend.URL)
+			client := dialTestGateway(t, gateway, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := client.Write(ctx, websocket.MessageText, []byte("a")); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+			if _, message, err := client.Read(ctx); err != nil || string(message) != "1:a" {
+				t.Fatalf("client read = %q, %v, want %q", message, err, "1:a")
+			}
+
+			// Let the gateway notice the dropped backend
+			time.Sleep(50 * time.Millisecond)
+			client.Write(ctx, websocket.MessageText, []byte("b"))
+
+			_, message, err := client.Read(ctx)
+			if tt.delivered {
+				if err != nil || string(message) != "2:b" {
+					t.Errorf("client read = %q, %v, want %q from the redialed backend", message, err, "2:b")
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("client read = %q, want the connection closed", message)
+			}
+			if n := atomic.LoadInt32(&connections); n != 1 {
+				t.Errorf("backend dialed %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestBackendConnectionLost(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		lost bool
+	}{
+		{name: "dropped connection", err: fmt.Errorf("failed to get reader: %w", io.EOF), lost: true},
+		{name: "backend close", err: fmt.Errorf("failed to get reader: %w", websocket.CloseError{Code: websocket.StatusGoingAway}), lost: false},
+		{name: "gateway close", err: &proxyCloseError{code: websocket.StatusPolicyViolation}, lost: false},
+		{name: "client write failed", err: &writeError{err: io.EOF}, lost: false},
+		{name: "no error", err: nil, lost: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if lost := backendConnectionLost(tt.err); lost != tt.lost {
+				t.Errorf("backendConnectionLost(%v) = %v, want %v", tt.err, lost, tt.lost)
+			}
+		})
+	}
+}
+
+func TestMaxWebSocketEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	backendURL := newEchoBackend(t)
+
+	var degraded int32
+	standardHandlerFactory := func(*config.EndpointConfig, proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			atomic.AddInt32(&degraded, 1)
+			c.Status(http.StatusOK)
+		}
+	}
+
+	wrapper := NewHandlerFactory(logging.NoOp).WithMaxWebSocketEndpoints(2).HandlerWrapper(standardHandlerFactory)
+	newEndpoint := func(path string, extraConfig config.ExtraConfig) *config.EndpointConfig {
+		return &config.EndpointConfig{
+			Endpoint:    path,
+			Method:      http.MethodGet,
+			Backend:     []*config.Backend{{Host: []string{backendURL}, URLPattern: "/ws"}},
+			ExtraConfig: extraConfig,
+		}
+	}
+	wsExtraConfig := config.ExtraConfig{ConfigNamespace: map[string]interface{}{}}
+
+	// Endpoints without WebSocket configuration do not count against the cap
+	engine.GET("/http", wrapper(newEndpoint("/http", config.ExtraConfig{}), dummyProxy))
+	paths := []string{"/ws0", "/ws1", "/ws2", "/ws3"}
+	for _, path := range paths {
+		engine.GET(path, wrapper(newEndpoint(path, wsExtraConfig), dummyProxy))
+	}
+	// Wrapping an admitted endpoint again, e.g. for another method, does not take a slot
+	engine.HEAD("/ws1", wrapper(newEndpoint("/ws1", wsExtraConfig), dummyProxy))
+
+	gateway := httptest.NewServer(engine)
+	defer gateway.Close()
+
+	for i, path := range paths {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, resp, err := websocket.Dial(ctx, gateway.URL+path, nil)
+		cancel()
+
+		if wantWebSocket := i < 2; wantWebSocket {
+			if err != nil {
+				t.Errorf("%s: failed to dial WebSocket endpoint: %v", path, err)
+				continue
+			}
+			exchangeMessages(t, conn, "hello")
+			conn.Close(websocket.StatusNormalClosure, "")
+		} else if err == nil || resp == nil || resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: dial = %v, want the standard handler response", path, err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&degraded); n != 2 {
+		t.Errorf("standard handler served %d upgrades, want 2", n)
+	}
+}
+
+func TestPingInterval(t *testing.T) {
+	wsConfig := map[string]interface{}{"ping_interval": "50ms"}
+
+	t.Run("responsive peers stay connected", func(t *testing.T) {
+		received := make(chan string, 1)
+		backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			_, message, err := conn.Read(ctx)
+			if err == nil {
+				received <- string(message)
+			}
+			conn.Read(ctx)
+		})
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), wsConfig, backend.URL)
+		client := dialTestGateway(t, gateway, nil)
+
+		// Reading in the background answers the pings
+		ctx := client.CloseRead(context.Background())
+		time.Sleep(300 * time.Millisecond)
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("connection was closed while both peers answered the pings")
+		default:
+		}
+		if err := client.Write(context.Background(), websocket.MessageText, []byte("still there")); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+		select {
+		case message := <-received:
+			if message != "still there" {
+				t.Errorf("backend received %q, want %q", message, "still there")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("backend did not receive the message")
+		}
+	})
+
+	t.Run("unresponsive client", func(t *testing.T) {
+		backendClosed := make(chan struct{})
+		backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			conn.Read(ctx)
+			close(backendClosed)
+		})
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), wsConfig, backend.URL)
+
+		// The client does not read, so it does not answer the pings
+		client := dialTestGateway(t, gateway, nil)
+
+		select {
+		case <-backendClosed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("connection of an unresponsive client was not closed")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		// A ping timing out drops the connection without a close handshake
+		if _, _, err := client.Read(ctx); err == nil || ctx.Err() != nil {
+			t.Errorf("client read = %v, want the connection gone", err)
+		}
+	})
+
+	t.Run("unresponsive backend", func(t *testing.T) {
+		backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			// Never reading, the backend never answers a ping
+			<-ctx.Done()
+		})
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), wsConfig, backend.URL)
+		client := dialTestGateway(t, gateway, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		if _, _, err := client.Read(ctx); err == nil || ctx.Err() != nil {
+			t.Fatalf("client read = %v, want the connection closed before the timeout", err)
+		}
+	})
+}
+
+// rawWebSocketConn upgrades a raw TCP connection to the gateway endpoint, for tests writing frames by hand
+func rawWebSocketConn(t *testing.T, gateway *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial gateway: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := "GET /ws HTTP/1.1\r\nHost: " + gateway.Listener.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("failed to write upgrade request: %v", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade response = %v, %v, want %d", resp, err, http.StatusSwitchingProtocols)
+	}
+
+	return conn, br
+}
+
+func TestCloseHandshakeTimeout(t *testing.T) {
+	// The backend leaves right away, so the gateway closes the client, which never answers
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {})
+
+	logger := &testLogger{}
+	gateway := newTestGateway(t, NewHandlerFactory(logger), map[string]interface{}{
+		"close_handshake_timeout": "200ms",
+	}, backend.URL)
+
+	conn, br := rawWebSocketConn(t, gateway)
+
+	// Read the close frame header, then nothing is sent back
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil || header[0] != 0x88 {
+		t.Fatalf("first frame header = %x, %v, want a close frame", header, err)
+	}
+	closeSent := time.Now()
+	if _, err := io.CopyN(io.Discard, br, int64(header[1]&0x7f)); err != nil {
+		t.Fatalf("failed to read the close frame payload: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("read after the close frame = %v, want the gateway to drop the connection", err)
+	}
+	if elapsed := time.Since(closeSent); elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("connection dropped %s after the close frame, want about 200ms", elapsed)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(logger.Contains("dropping it")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(logger.Contains("close_handshake_timeout=200ms")) == 0 {
+		t.Errorf("logs = %v, want the forced drop reported", logger.Lines())
+	}
+}
+
+func TestMaxSingleReadDuration(t *testing.T) {
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"max_single_read_duration": "200ms",
+	}, newEchoBackend(t))
+
+	t.Run("waiting for a message is not bounded", func(t *testing.T) {
+		client := dialTestGateway(t, gateway, nil)
+		time.Sleep(300 * time.Millisecond)
+		exchangeMessages(t, client, "hello")
+	})
+
+	t.Run("slow-trickle message", func(t *testing.T) {
+		conn, br := rawWebSocketConn(t, gateway)
+
+		// A masked text frame of 20 bytes, the zero mask leaving the payload as is, sent one byte every 50ms
+		if _, err := conn.Write([]byte{0x81, 0x80 | 20, 0, 0, 0, 0}); err != nil {
+			t.Fatalf("failed to write the frame header: %v", err)
+		}
+		start := time.Now()
+		go func() {
+			for i := 0; i < 20; i++ {
+				time.Sleep(50 * time.Millisecond)
+				if _, err := conn.Write([]byte("x")); err != nil {
+					return
+				}
+			}
+		}()
+
+		// The gateway answers with an unmasked close frame: status code, then reason
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(br, header); err != nil {
+			t.Fatalf("failed to read the gateway frame: %v", err)
+		}
+		payload := make([]byte, header[1]&0x7f)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			t.Fatalf("failed to read the gateway frame payload: %v", err)
+		}
+		elapsed := time.Since(start)
+
+		if header[0] != 0x88 || len(payload) < 2 {
+			t.Fatalf("gateway frame = %#x %q, want a close frame", header, payload)
+		}
+		if code := websocket.StatusCode(int(payload[0])<<8 | int(payload[1])); code != websocket.StatusPolicyViolation {
+			t.Errorf("close status = %v, want %v", code, websocket.StatusPolicyViolation)
+		}
+		if reason := string(payload[2:]); reason != "Message read timeout" {
+			t.Errorf("close reason = %q, want %q", reason, "Message read timeout")
+		}
+		if elapsed < 150*time.Millisecond || elapsed > time.Second {
+			t.Errorf("connection closed after %v, want about the 200ms read bound", elapsed)
+		}
+	})
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"max_frame_size": float64(1024),
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	exchangeMessages(t, client, strings.Repeat("x", 1024))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Write(ctx, websocket.MessageText, []byte(strings.Repeat("x", 64*1024))); err != nil {
+		t.Fatalf("client write failed: %v", err)
+	}
+
+	_, _, err := client.Read(ctx)
+	var closeErr websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.StatusMessageTooBig || closeErr.Reason != frameTooBigReason {
+		t.Fatalf("client read = %v, want a close with %v %q", err, websocket.StatusMessageTooBig, frameTooBigReason)
+	}
+}
+
+func TestBackendFailureMessage(t *testing.T) {
+	const guidance = `{"error":"backend unavailable","retry_after":5}`
+
+	tests := []struct {
+		name     string
+		wsConfig map[string]interface{}
+		message  string
+	}{
+		{name: "configured", wsConfig: map[string]interface{}{"backend_failure_message": guidance}, message: guidance},
+		{name: "not configured", wsConfig: map[string]interface{}{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Nothing listens on port 1, so the backend dial fails
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), tt.wsConfig, "http://127.0.0.1:1")
+			client := dialTestGateway(t, gateway, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if tt.message != "" {
+				messageType, message, err := client.Read(ctx)
+				if err != nil {
+					t.Fatalf("client read failed: %v", err)
+				}
+				if messageType != websocket.MessageText || string(message) != tt.message {
+					t.Errorf("client received %v %q, want the text message %q", messageType, message, tt.message)
+				}
+			}
+
+			if _, _, err := client.Read(ctx); websocket.CloseStatus(err) != websocket.StatusInternalError {
+				t.Errorf("client read error = %v, want a close with %v", err, websocket.StatusInternalError)
+			}
+		})
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	backendURL := newEchoBackend(t)
+	restricted := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"allowed_origins": []interface{}{"*.example.com", "partner.org:8443"},
+	}, backendURL)
+	permissive := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{}, backendURL)
+
+	tests := []struct {
+		name    string
+		gateway *httptest.Server
+		origin  string
+		status  int
+	}{
+		{name: "wildcard match", gateway: restricted, origin: "https://app.example.com", status: http.StatusSwitchingProtocols},
+		{name: "exact match with port", gateway: restricted, origin: "https://partner.org:8443", status: http.StatusSwitchingProtocols},
+		{name: "port mismatch", gateway: restricted, origin: "https://partner.org", status: http.StatusForbidden},
+		{name: "other origin", gateway: restricted, origin: "https://evil.com", status: http.StatusForbidden},
+		{name: "parent domain", gateway: restricted, origin: "https://example.com", status: http.StatusForbidden},
+		{name: "no origin", gateway: restricted, status: http.StatusSwitchingProtocols},
+		{name: "any origin without allowlist", gateway: permissive, origin: "https://evil.com", status: http.StatusSwitchingProtocols},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			conn, resp, err := websocket.Dial(ctx, tt.gateway.URL+"/ws", &websocket.DialOptions{HTTPHeader: header})
+			if resp == nil {
+				t.Fatalf("dial failed without a response: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("upgrade status = %d (%v), want %d", resp.StatusCode, err, tt.status)
+			}
+			if conn != nil {
+				exchangeMessages(t, conn, "hello")
+				conn.Close(websocket.StatusNormalClosure, "")
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// secretHeaderMarkers flag, anywhere in their name, the headers whose values must not be logged
+var secretHeaderMarkers = []string{"authorization", "cookie", "token", "secret", "password", "key", "signature"}
+
+// isSecretHeader reports whether the values of the header name look like credentials
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, marker := range secretHeaderMarkers {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// backendHeaders are the static headers sent to the backend on every dial, by name
+type backendHeaders map[string]string
+
+// String keeps the values of secret-looking headers out of logs printing the configuration
+func (h backendHeaders) String() string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]string, 0, len(names))
+	for _, name := range names {
+		value := h[name]
+		if isSecretHeader(name) {
+			value = redactedString(value).String()
+		}
+		fields = append(fields, fmt.Sprintf("%s:%s", name, value))
+	}
+	return "map[" + strings.Join(fields, " ") + "]"
+}
+
+// addStaticHeaders adds the static headers to the backend request headers, unless a header of
+// the same name is already set by the request. It returns the headers added.
+func (h backendHeaders) addStaticHeaders(headers map[string][]string) backendHeaders {
+	added := make(backendHeaders)
+	for name, value := range h {
+		if hasHeader(headers, name) {
+			continue
+		}
+		name = http.CanonicalHeaderKey(name)
+		headers[name] = []string{value}
+		added[name] = value
+	}
+	return added
+}
+
+// hasHeader reports whether headers holds name, in any case
+func hasHeader(headers map[string][]string, name string) bool {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestBackendHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		received <- r.Header.Clone()
+		conn.Read(ctx)
+	})
+
+	recorder := &testLogger{}
+	gateway := newTestGateway(t, NewHandlerFactory(recorder), map[string]interface{}{
+		"backend_headers": map[string]interface{}{
+			"x-gateway-id":  "gw-eu-1",
+			"Authorization": "Bearer backend-token",
+			"X-User-Id":     "anonymous",
+		},
+	}, backend.URL)
+	dialTestGateway(t, gateway, &websocket.DialOptions{
+		HTTPHeader: http.Header{"X-User-Id": {"42"}},
+	})
+
+	var headers http.Header
+	select {
+	case headers = <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend was not dialed")
+	}
+
+	for name, want := range map[string]string{
+		"X-Gateway-Id":  "gw-eu-1",
+		"Authorization": "Bearer backend-token",
+		"X-User-Id":     "42", // The auth header of the request wins over the static one
+	} {
+		if got := headers.Values(name); len(got) != 1 || got[0] != want {
+			t.Errorf("backend %s = %q, want [%q]", name, got, want)
+		}
+	}
+
+	lines := strings.Join(recorder.Lines(), "\n")
+	if strings.Contains(lines, "backend-token") {
+		t.Errorf("the static Authorization value was logged:\n%s", lines)
+	}
+	if !strings.Contains(lines, "Adding static headers to backend connection: map[Authorization:[REDACTED] X-Gateway-Id:gw-eu-1]") {
+		t.Errorf("the static headers applied were not logged:\n%s", lines)
+	}
+}
+
+func TestBackendHeadersString(t *testing.T) {
+	headers := backendHeaders{
+		"X-Gateway-Id": "gw-1",
+		"X-Api-Key":    "k3y",
+		"Cookie":       "session=1",
+	}
+
+	want := "map[Cookie:[REDACTED] X-Api-Key:[REDACTED] X-Gateway-Id:gw-1]"
+	if got := fmt.Sprintf("%+v", struct{ BackendHeaders backendHeaders }{headers}); got != "{BackendHeaders:"+want+"}" {
+		t.Errorf("formatted headers = %s, want {BackendHeaders:%s}", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// connectionIdleReason is the close reason sent when no message flowed in either direction for idle_timeout
+const connectionIdleReason = "Idle timeout"
+
+// activityTimer calls onIdle once no activity was reported for a timeout. A nil *activityTimer is
+// a disabled timer: every method is a no-op.
+type activityTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32 // Accessed atomically, set once onIdle was called
+}
+
+// newActivityTimer starts a timer calling onIdle after timeout without activity, nil when timeout is not positive
+func newActivityTimer(timeout time.Duration, onIdle func()) *activityTimer {
+	if timeout <= 0 {
+		return nil
+	}
+
+	t := &activityTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		if atomic.CompareAndSwapInt32(&t.fired, 0, 1) {
+			onIdle()
+		}
+	})
+	return t
+}
+
+// touch reports activity, restarting the timeout unless it already expired
+func (t *activityTimer) touch() {
+	if t == nil || t.expired() {
+		return
+	}
+	t.timer.Reset(t.timeout)
+}
+
+// expired reports whether the timeout elapsed without activity
+func (t *activityTimer) expired() bool {
+	return t != nil && atomic.LoadInt32(&t.fired) == 1
+}
+
+// stop releases the timer
+func (t *activityTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
@@ -0,0 +1,93 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+// Actions taken on messages that would take a connection over max_inflight_bytes
+const (
+	InflightLimitActionBlock = "block" // Stop reading until enough in-flight bytes are written
+	InflightLimitActionClose = "close" // Close the connection with StatusPolicyViolation
+)
+
+// inflightLimitReason is the close reason of connections exceeding max_inflight_bytes
+const inflightLimitReason = "Too many bytes in flight"
+
+// inflightBudget accounts the payload bytes a connection has read but not written yet, in both
+// directions. A nil budget does not limit anything.
+type inflightBudget struct {
+	max int64
+
+	mu       sync.Mutex
+	bytes    int64
+	peak     int64         // High-water mark of bytes
+	released chan struct{} // Closed and replaced whenever bytes goes down
+}
+
+// newInflightBudget returns the budget of a connection, or nil without max_inflight_bytes
+func newInflightBudget(max int64) *inflightBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &inflightBudget{max: max, released: make(chan struct{})}
+}
+
+// acquire accounts n more bytes in flight. Over the budget, it blocks until enough bytes are
+// released or fails with a *proxyCloseError when the action is to close. A message is always
+// admitted when nothing else is in flight, so messages larger than the budget cannot stall.
+func (b *inflightBudget) acquire(ctx context.Context, n int, action string) error {
+	if b == nil {
+		return nil
+	}
+
+	for {
+		b.mu.Lock()
+		if b.bytes == 0 || b.bytes+int64(n) <= b.max {
+			b.bytes += int64(n)
+			if b.bytes > b.peak {
+				b.peak = b.bytes
+			}
+			b.mu.Unlock()
+			return nil
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		if action == InflightLimitActionClose {
+			return &proxyCloseError{code: websocket.StatusPolicyViolation, reason: inflightLimitReason}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// release accounts n bytes written, or dropped
+func (b *inflightBudget) release(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.bytes -= int64(n)
+	close(b.released)
+	b.released = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// highWaterMark returns the most bytes the connection had in flight at once
+func (b *inflightBudget) highWaterMark() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peak
+}
@@ -0,0 +1,164 @@
+package websocket
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+func TestInflightBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("block", func(t *testing.T) {
+		budget := newInflightBudget(100)
+		if err := budget.acquire(ctx, 60, InflightLimitActionBlock); err != nil {
+			t.Fatalf("acquire within the budget failed: %v", err)
+		}
+
+		acquired := make(chan error, 1)
+		go func() { acquired <- budget.acquire(ctx, 60, InflightLimitActionBlock) }()
+		select {
+		case err := <-acquired:
+			t.Fatalf("acquire over the budget returned %v, want it to block", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		budget.release(60)
+		select {
+		case err := <-acquired:
+			if err != nil {
+				t.Fatalf("acquire after the release failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("acquire still blocked after the release")
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		budget := newInflightBudget(100)
+		if err := budget.acquire(ctx, 60, InflightLimitActionClose); err != nil {
+			t.Fatalf("acquire within the budget failed: %v", err)
+		}
+
+		var closeErr *proxyCloseError
+		if err := budget.acquire(ctx, 60, InflightLimitActionClose); !errors.As(err, &closeErr) || closeErr.code != websocket.StatusPolicyViolation {
+			t.Fatalf("acquire over the budget = %v, want a close with %v", err, websocket.StatusPolicyViolation)
+		}
+	})
+
+	t.Run("message larger than the budget", func(t *testing.T) {
+		budget := newInflightBudget(100)
+		if err := budget.acquire(ctx, 500, InflightLimitActionClose); err != nil {
+			t.Fatalf("acquire with nothing in flight failed: %v", err)
+		}
+		if peak := budget.highWaterMark(); peak != 500 {
+			t.Errorf("high-water mark = %d, want 500", peak)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		budget := newInflightBudget(100)
+		budget.acquire(ctx, 100, InflightLimitActionBlock)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := budget.acquire(cancelled, 1, InflightLimitActionBlock); !errors.Is(err, context.Canceled) {
+			t.Fatalf("acquire with a cancelled context = %v, want %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestMaxInflightBytes(t *testing.T) {
+	// The backend floods a client that never reads while the client floods the backend. Each
+	// direction holds one message at most, a 64KB backend message and a 16KB client message
+	// together go over the budget. Random payloads do not compress, so the socket buffers fill
+	// quickly.
+	closed := make(chan error, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		go func() {
+			payload := randomPayload(t, 64*1024)
+			for conn.Write(ctx, websocket.MessageBinary, payload) == nil {
+			}
+		}()
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				closed <- err
+				return
+			}
+		}
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"max_message_size":        float64(128 * 1024),
+		"max_inflight_bytes":      float64(72 * 1024),
+		"inflight_limit_action":   InflightLimitActionClose,
+		"close_handshake_timeout": "200ms",
+	}, backend.URL)
+	client := dialTestGateway(t, gateway, nil)
+	payload := randomPayload(t, 16*1024)
+	go func() {
+		for client.Write(context.Background(), websocket.MessageBinary, payload) == nil {
+		}
+	}()
+
+	select {
+	case err := <-closed:
+		var closeErr websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.StatusPolicyViolation || closeErr.Reason != inflightLimitReason {
+			t.Fatalf("backend read = %v, want a close with %v %q", err, websocket.StatusPolicyViolation, inflightLimitReason)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("backend not closed while the client stalled the writes")
+	}
+}
+
+func randomPayload(t *testing.T, size int) []byte {
+	t.Helper()
+
+	payload := make([]byte, size)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("failed to generate payload: %v", err)
+	}
+	return payload
+}
+
+func TestMaxInflightBytesSendQueue(t *testing.T) {
+	// The backend floods a client that never reads. The queue would take up to 64 messages of
+	// 64KB, the budget runs out first.
+	closed := make(chan error, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		go func() {
+			payload := make([]byte, 64*1024)
+			for conn.Write(ctx, websocket.MessageBinary, payload) == nil {
+			}
+		}()
+		_, _, err := conn.Read(ctx)
+		closed <- err
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"send_queue_size":         float64(64),
+		"max_message_size":        float64(128 * 1024),
+		"max_inflight_bytes":      float64(256 * 1024),
+		"inflight_limit_action":   InflightLimitActionClose,
+		"close_handshake_timeout": "200ms",
+	}, backend.URL)
+	rawWebSocketConn(t, gateway)
+
+	select {
+	case err := <-closed:
+		var closeErr websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.StatusPolicyViolation || closeErr.Reason != inflightLimitReason {
+			t.Fatalf("backend read = %v, want a close with %v %q", err, websocket.StatusPolicyViolation, inflightLimitReason)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("backend not closed while the client stalled the writes")
+	}
+}
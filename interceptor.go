@@ -0,0 +1,271 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"nhooyr.io/websocket"
+)
+
+// MessageInterceptor inspects or rewrites the messages of a connection in flight.
+// Interceptors are created per connection and each direction is intercepted from a
+// single goroutine, so an interceptor only needs to guard state shared by both directions.
+type MessageInterceptor interface {
+	// Intercept returns the message to forward in place of the received one
+	Intercept(direction string, messageType websocket.MessageType, payload []byte) (websocket.MessageType, []byte, error)
+}
+
+// BufferedMessageInterceptor is a MessageInterceptor writing rewritten messages into a buffer
+// lent by the proxy, when interceptor_buffer_pool is enabled, instead of allocating them.
+//
+// InterceptBuffer receives an empty buf with spare capacity and returns the message to forward,
+// either a slice of buf (typically appended to it) or payload itself. buf, and any slice of it,
+// is only valid until the next message of the direction is read: interceptors must not keep it.
+type BufferedMessageInterceptor interface {
+	MessageInterceptor
+	InterceptBuffer(direction string, messageType websocket.MessageType, payload, buf []byte) (websocket.MessageType, []byte, error)
+}
+
+// interceptBufferSize is the initial capacity of the buffers lent to interceptors
+const interceptBufferSize = 4096
+
+var interceptBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, interceptBufferSize)
+		return &buf
+	},
+}
+
+// interceptBuffers lends pooled buffers to the interceptors of a single message. A nil
+// *interceptBuffers lends none, interceptors then allocate their messages.
+type interceptBuffers struct {
+	lent []*[]byte
+}
+
+// get lends an empty buffer until the next release
+func (b *interceptBuffers) get() []byte {
+	buf := interceptBufferPool.Get().(*[]byte)
+	b.lent = append(b.lent, buf)
+	return (*buf)[:0]
+}
+
+// release returns the buffers lent since the last release to the pool
+func (b *interceptBuffers) release() {
+	if b == nil {
+		return
+	}
+	for i, buf := range b.lent {
+		interceptBufferPool.Put(buf)
+		b.lent[i] = nil
+	}
+	b.lent = b.lent[:0]
+}
+
+// holding reports whether buffers are currently lent
+func (b *interceptBuffers) holding() bool {
+	return b != nil && len(b.lent) > 0
+}
+
+// newConnectionInterceptors returns the built-in interceptors enabled by the endpoint configuration.
+// Base64 transcoding leads, so the validator registered for the negotiated subprotocol, if any,
+// and compression see the messages in the format of the backend.
+func newConnectionInterceptors(wsConfig Config, subprotocol string, validator SubprotocolValidator) []MessageInterceptor {
+	var interceptors []MessageInterceptor
+
+	if wsConfig.TranscodeBase64 {
+		interceptors = append(interceptors, base64Interceptor{})
+	}
+
+	if validator != nil {
+		interceptors = append(interceptors, &validationInterceptor{subprotocol: subprotocol, validator: validator})
+	}
+
+	if wsConfig.CompressAfterMessages > 0 {
+		compression := newCompressionInterceptor(wsConfig.CompressAfterMessages)
+		if wsConfig.AdaptiveCompression > 0 {
+			compression.adapt(wsConfig.AdaptiveCompressionSamples, wsConfig.AdaptiveCompression)
+		}
+		interceptors = append(interceptors, compression)
+	}
+
+	return interceptors
+}
+
+// intercept runs a message through every interceptor, in order. Buffered interceptors are lent a
+// buffer from buffers, when not nil. The time spent in each interceptor is observed by duration,
+// when not nil.
+func intercept(interceptors []MessageInterceptor, buffers *interceptBuffers, duration prometheus.Observer, direction string, messageType websocket.MessageType, payload []byte) (websocket.MessageType, []byte, error) {
+	for _, interceptor := range interceptors {
+		var start time.Time
+		if duration != nil {
+			start = time.Now()
+		}
+
+		var err error
+		if buffered, ok := interceptor.(BufferedMessageInterceptor); ok && buffers != nil {
+			messageType, payload, err = buffered.InterceptBuffer(direction, messageType, payload, buffers.get())
+		} else {
+			messageType, payload, err = interceptor.Intercept(direction, messageType, payload)
+		}
+		if duration != nil {
+			duration.Observe(time.Since(start).Seconds())
+		}
+		if err != nil {
+			return messageType, payload, err
+		}
+	}
+	return messageType, payload, nil
+}
+
+// Original message type markers leading application-layer compressed frames. Stored frames
+// carry the original payload as is, once adaptive compression gave up on the connection.
+const (
+	compressedTextMarker   byte = 0x01
+	compressedBinaryMarker byte = 0x02
+	storedTextMarker       byte = 0x03
+	storedBinaryMarker     byte = 0x04
+)
+
+// compressionInterceptor compresses the messages sent to the client once the connection
+// has delivered more than after of them. Compressed messages are binary frames holding a
+// marker byte with the original message type followed by the raw DEFLATE stream of the payload.
+//
+// When adaptive, the ratio achieved over the first samples compressed messages is checked once:
+// below minRatio, the remaining messages are sent as stored frames instead of being compressed.
+type compressionInterceptor struct {
+	after  int
+	sent   int
+	buf    bytes.Buffer
+	writer *flate.Writer
+
+	samples        int
+	minRatio       float64
+	sampled        int
+	sampledIn      int
+	sampledOut     int
+	incompressible bool
+}
+
+func newCompressionInterceptor(after int) *compressionInterceptor {
+	return &compressionInterceptor{after: after}
+}
+
+// adapt stops compressing once the first samples compressed messages shrank by less than minRatio
+func (i *compressionInterceptor) adapt(samples int, minRatio float64) {
+	i.samples = samples
+	i.minRatio = minRatio
+}
+
+// sample accounts a compressed message towards the adaptive decision
+func (i *compressionInterceptor) sample(payload, compressed int) {
+	if i.samples <= 0 || i.sampled >= i.samples {
+		return
+	}
+
+	i.sampled++
+	i.sampledIn += payload
+	i.sampledOut += compressed
+	if i.sampled == i.samples && float64(i.sampledIn) < i.minRatio*float64(i.sampledOut) {
+		i.incompressible = true
+	}
+}
+
+// Intercept implements MessageInterceptor
+func (i *compressionInterceptor) Intercept(direction string, messageType websocket.MessageType, payload []byte) (websocket.MessageType, []byte, error) {
+	return i.InterceptBuffer(direction, messageType, payload, nil)
+}
+
+// InterceptBuffer implements BufferedMessageInterceptor
+func (i *compressionInterceptor) InterceptBuffer(direction string, messageType websocket.MessageType, payload, buf []byte) (websocket.MessageType, []byte, error) {
+	if direction != directionBackendToClient {
+		return messageType, payload, nil
+	}
+
+	// Short exchanges are left alone, long-lived streams get compressed
+	if i.sent < i.after {
+		i.sent++
+		return messageType, payload, nil
+	}
+
+	if i.incompressible {
+		marker := storedBinaryMarker
+		if messageType == websocket.MessageText {
+			marker = storedTextMarker
+		}
+		return websocket.MessageBinary, append(append(buf, marker), payload...), nil
+	}
+
+	marker := compressedBinaryMarker
+	if messageType == websocket.MessageText {
+		marker = compressedTextMarker
+	}
+
+	i.buf.Reset()
+	i.buf.WriteByte(marker)
+
+	if i.writer == nil {
+		writer, err := flate.NewWriter(&i.buf, flate.DefaultCompression)
+		if err != nil {
+			return messageType, payload, err
+		}
+		i.writer = writer
+	} else {
+		i.writer.Reset(&i.buf)
+	}
+
+	if _, err := i.writer.Write(payload); err != nil {
+		return messageType, payload, err
+	}
+	if err := i.writer.Close(); err != nil {
+		return messageType, payload, err
+	}
+
+	i.sample(len(payload), i.buf.Len()-1)
+
+	// The compression buffer is reused for the next message, hand over a copy
+	return websocket.MessageBinary, append(buf, i.buf.Bytes()...), nil
+}
+
+// invalidBase64Reason is the close reason of clients sending text frames that are not valid base64
+const invalidBase64Reason = "Invalid base64 message"
+
+// base64Interceptor bridges clients limited to text frames with backends speaking binary: client
+// text messages are decoded from standard base64 into binary ones, and backend binary messages are
+// encoded into text ones. Other messages are forwarded as is.
+type base64Interceptor struct{}
+
+// Intercept implements MessageInterceptor
+func (i base64Interceptor) Intercept(direction string, messageType websocket.MessageType, payload []byte) (websocket.MessageType, []byte, error) {
+	return i.InterceptBuffer(direction, messageType, payload, nil)
+}
+
+// InterceptBuffer implements BufferedMessageInterceptor
+func (base64Interceptor) InterceptBuffer(direction string, messageType websocket.MessageType, payload, buf []byte) (websocket.MessageType, []byte, error) {
+	switch {
+	case direction == directionClientToBackend && messageType == websocket.MessageText:
+		decoded := growBuffer(buf, base64.StdEncoding.DecodedLen(len(payload)))
+		n, err := base64.StdEncoding.Decode(decoded, payload)
+		if err != nil {
+			return messageType, payload, &proxyCloseError{code: websocket.StatusInvalidFramePayloadData, reason: invalidBase64Reason}
+		}
+		return websocket.MessageBinary, decoded[:n], nil
+	case direction == directionBackendToClient && messageType == websocket.MessageBinary:
+		encoded := growBuffer(buf, base64.StdEncoding.EncodedLen(len(payload)))
+		base64.StdEncoding.Encode(encoded, payload)
+		return websocket.MessageText, encoded, nil
+	}
+	return messageType, payload, nil
+}
+
+// growBuffer returns buf resized to n bytes, reallocated when its capacity is too small. The
+// result is never nil, which would drop the message.
+func growBuffer(buf []byte, n int) []byte {
+	if buf == nil || cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
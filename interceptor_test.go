@@ -0,0 +1,322 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+// decompressMessage decodes a message compressed, or stored, by compressionInterceptor
+func decompressMessage(t *testing.T, message []byte) (websocket.MessageType, []byte) {
+	t.Helper()
+
+	if len(message) == 0 {
+		t.Fatalf("compressed message is empty")
+	}
+
+	messageType := websocket.MessageBinary
+	switch message[0] {
+	case compressedTextMarker:
+		messageType = websocket.MessageText
+	case compressedBinaryMarker:
+	case storedTextMarker:
+		return websocket.MessageText, message[1:]
+	case storedBinaryMarker:
+		return websocket.MessageBinary, message[1:]
+	default:
+		t.Fatalf("unknown compressed message marker %#x", message[0])
+	}
+
+	payload, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(message[1:])))
+	if err != nil {
+		t.Fatalf("failed to inflate message: %v", err)
+	}
+	return messageType, payload
+}
+
+func TestCompressionInterceptor(t *testing.T) {
+	interceptor := newCompressionInterceptor(2)
+	payload := []byte(strings.Repeat("compressible ", 100))
+
+	// Client messages are never compressed nor counted
+	for i := 0; i < 3; i++ {
+		messageType, message, err := interceptor.Intercept(directionClientToBackend, websocket.MessageText, payload)
+		if err != nil || messageType != websocket.MessageText || !bytes.Equal(message, payload) {
+			t.Fatalf("client message %d was rewritten to %v %q, %v", i, messageType, message, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		messageType, message, err := interceptor.Intercept(directionBackendToClient, websocket.MessageText, payload)
+		if err != nil || messageType != websocket.MessageText || !bytes.Equal(message, payload) {
+			t.Fatalf("message %d was rewritten to %v %q, %v, want it unchanged", i, messageType, message, err)
+		}
+	}
+
+	for _, original := range []websocket.MessageType{websocket.MessageText, websocket.MessageBinary} {
+		messageType, message, err := interceptor.Intercept(directionBackendToClient, original, payload)
+		if err != nil {
+			t.Fatalf("Intercept() error = %v", err)
+		}
+		if messageType != websocket.MessageBinary {
+			t.Errorf("compressed message type = %v, want binary", messageType)
+		}
+		if len(message) >= len(payload) {
+			t.Errorf("compressed message is %d bytes, want less than %d", len(message), len(payload))
+		}
+
+		decodedType, decoded := decompressMessage(t, message)
+		if decodedType != original || !bytes.Equal(decoded, payload) {
+			t.Errorf("decompressed message = %v %q, want %v %q", decodedType, decoded, original, payload)
+		}
+	}
+}
+
+func TestCompressAfterMessages(t *testing.T) {
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"compress_after_messages": float64(2),
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 4; i++ {
+		sent := []byte(strings.Repeat("message ", 50) + string(rune('a'+i)))
+		if err := client.Write(ctx, websocket.MessageText, sent); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+
+		messageType, message, err := client.Read(ctx)
+		if err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+
+		if i < 2 {
+			if messageType != websocket.MessageText || !bytes.Equal(message, sent) {
+				t.Errorf("message %d = %v %q, want it uncompressed", i, messageType, message)
+			}
+			continue
+		}
+
+		if messageType != websocket.MessageBinary {
+			t.Fatalf("message %d type = %v, want a compressed binary message", i, messageType)
+		}
+		if decodedType, decoded := decompressMessage(t, message); decodedType != websocket.MessageText || !bytes.Equal(decoded, sent) {
+			t.Errorf("message %d decompressed to %v %q, want %q", i, decodedType, decoded, sent)
+		}
+	}
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	random := make([]byte, 2048)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("failed to generate a random payload: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		payload        []byte
+		wantCompressed bool
+	}{
+		{name: "incompressible", payload: random, wantCompressed: false},
+		{name: "compressible", payload: []byte(strings.Repeat("compressible ", 100)), wantCompressed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interceptor := newConnectionInterceptors(Config{
+				CompressAfterMessages:      1,
+				AdaptiveCompression:        1.1,
+				AdaptiveCompressionSamples: 3,
+			}, "", nil)
+
+			for i := 0; i < 8; i++ {
+				messageType, message, err := intercept(interceptor, nil, nil, directionBackendToClient, websocket.MessageBinary, tt.payload)
+				if err != nil {
+					t.Fatalf("message %d: intercept() error = %v", i, err)
+				}
+				if i == 0 {
+					if !bytes.Equal(message, tt.payload) {
+						t.Fatalf("message %d was rewritten, want it untouched", i)
+					}
+					continue
+				}
+
+				if messageType != websocket.MessageBinary {
+					t.Fatalf("message %d type = %v, want binary", i, messageType)
+				}
+				// Messages 1 to 3 are sampled, the decision applies from message 4 on
+				wantMarker := compressedBinaryMarker
+				if i > 3 && !tt.wantCompressed {
+					wantMarker = storedBinaryMarker
+				}
+				if message[0] != wantMarker {
+					t.Errorf("message %d marker = %#x, want %#x", i, message[0], wantMarker)
+				}
+				if _, decoded := decompressMessage(t, message); !bytes.Equal(decoded, tt.payload) {
+					t.Errorf("message %d decoded to a different payload", i)
+				}
+			}
+		})
+	}
+}
+
+func TestTranscodeBase64(t *testing.T) {
+	received := make(chan []byte, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			messageType, message, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if messageType != websocket.MessageBinary {
+				t.Errorf("backend received a %v message, want binary", messageType)
+			}
+			received <- message
+			if err := conn.Write(ctx, messageType, message); err != nil {
+				return
+			}
+		}
+	})
+
+	for _, pool := range []bool{false, true} {
+		t.Run(fmt.Sprintf("interceptor_buffer_pool=%v", pool), func(t *testing.T) {
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+				"transcode_base64":        true,
+				"interceptor_buffer_pool": pool,
+			}, backend.URL)
+			client := dialTestGateway(t, gateway, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			binary := make([]byte, 6000)
+			if _, err := rand.Read(binary); err != nil {
+				t.Fatalf("failed to generate a binary payload: %v", err)
+			}
+
+			for _, payload := range [][]byte{binary, {0x00, 0xff}, {}} {
+				encoded := base64.StdEncoding.EncodeToString(payload)
+				if err := client.Write(ctx, websocket.MessageText, []byte(encoded)); err != nil {
+					t.Fatalf("client write failed: %v", err)
+				}
+				select {
+				case got := <-received:
+					if !bytes.Equal(got, payload) {
+						t.Errorf("backend received %d bytes, want the %d decoded bytes", len(got), len(payload))
+					}
+				case <-ctx.Done():
+					t.Fatalf("backend did not receive the %d bytes message", len(payload))
+				}
+
+				messageType, message, err := client.Read(ctx)
+				if err != nil {
+					t.Fatalf("client read failed: %v", err)
+				}
+				if messageType != websocket.MessageText || string(message) != encoded {
+					t.Errorf("client received %v %q, want the text %q", messageType, message, encoded)
+				}
+			}
+
+			if err := client.Write(ctx, websocket.MessageText, []byte("not base64!")); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+			if _, message, err := client.Read(ctx); websocket.CloseStatus(err) != websocket.StatusInvalidFramePayloadData {
+				t.Fatalf("after an invalid message, client read %q, %v, want a close with %v", message, err, websocket.StatusInvalidFramePayloadData)
+			}
+		})
+	}
+}
+
+func TestInterceptorBufferPool(t *testing.T) {
+	const messages = 50
+
+	// The backend pushes distinct messages of varied sizes as fast as it can
+	payload := func(i int) []byte {
+		return []byte(strings.Repeat(fmt.Sprintf("message %d ", i), 1+i*20))
+	}
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		if _, _, err := conn.Read(ctx); err != nil {
+			return
+		}
+		for i := 0; i < messages; i++ {
+			if err := conn.Write(ctx, websocket.MessageText, payload(i)); err != nil {
+				return
+			}
+		}
+		conn.Read(ctx)
+	})
+
+	tests := []struct {
+		name     string
+		wsConfig map[string]interface{}
+	}{
+		{name: "direct writes", wsConfig: map[string]interface{}{}},
+		{name: "send queue", wsConfig: map[string]interface{}{"send_queue_size": float64(messages)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.wsConfig["compress_after_messages"] = float64(1)
+			tt.wsConfig["interceptor_buffer_pool"] = true
+			client := dialTestGateway(t, newTestGateway(t, NewHandlerFactory(logging.NoOp), tt.wsConfig, backend.URL), nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := client.Write(ctx, websocket.MessageText, []byte("start")); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+
+			for i := 0; i < messages; i++ {
+				messageType, message, err := client.Read(ctx)
+				if err != nil {
+					t.Fatalf("client read %d failed: %v", i, err)
+				}
+				if i > 0 {
+					messageType, message = decompressMessage(t, message)
+				}
+				if messageType != websocket.MessageText || !bytes.Equal(message, payload(i)) {
+					t.Fatalf("message %d = %v of %d bytes, want the %d bytes sent by the backend", i, messageType, len(message), len(payload(i)))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompressionInterceptor(b *testing.B) {
+	payload := []byte(strings.Repeat("compressible ", 100))
+
+	benchmarks := []struct {
+		name    string
+		buffers *interceptBuffers
+	}{
+		{name: "allocated"},
+		{name: "pooled", buffers: &interceptBuffers{}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			interceptors := []MessageInterceptor{newCompressionInterceptor(0)}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := intercept(interceptors, bm.buffers, nil, directionBackendToClient, websocket.MessageText, payload); err != nil {
+					b.Fatal(err)
+				}
+				bm.buffers.release()
+			}
+		})
+	}
+}
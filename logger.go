@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/luraproject/lura/logging"
+)
+
+// userIdentifierHeaders are the auth headers checked, in order, to identify the user of a connection
+var userIdentifierHeaders = []string{"X-User-Id", "X-User-Uid"}
+
+// StructuredLogger is implemented by loggers able to emit key-value fields instead of a formatted
+// message. When the factory logger implements it, the access log of every connection is emitted
+// as fields, see accessLogFields for their schema.
+type StructuredLogger interface {
+	InfoFields(message string, fields map[string]interface{})
+}
+
+// connectionLogger prepends a stable per-connection prefix to every log call
+type connectionLogger struct {
+	logging.Logger
+	prefix string
+}
+
+// newConnectionLogger returns a logger tagging every line with the endpoint, the connection ID
+// and, when available, the user identifier found in the auth headers
+func newConnectionLogger(logger logging.Logger, endpoint, connID string, authHeaders map[string][]string) *connectionLogger {
+	prefix := fmt.Sprintf("[ENDPOINT: %s] [CONN: %s]", endpoint, connID)
+	if user := userIdentifier(authHeaders); user != "" {
+		prefix += fmt.Sprintf(" [USER: %s]", user)
+	}
+
+	return &connectionLogger{
+		Logger: logger,
+		prefix: prefix,
+	}
+}
+
+func (l *connectionLogger) Debug(v ...interface{}) {
+	l.Logger.Debug(l.prepend(v)...)
+}
+
+func (l *connectionLogger) Info(v ...interface{}) {
+	l.Logger.Info(l.prepend(v)...)
+}
+
+func (l *connectionLogger) Warning(v ...interface{}) {
+	l.Logger.Warning(l.prepend(v)...)
+}
+
+func (l *connectionLogger) Error(v ...interface{}) {
+	l.Logger.Error(l.prepend(v)...)
+}
+
+func (l *connectionLogger) Critical(v ...interface{}) {
+	l.Logger.Critical(l.prepend(v)...)
+}
+
+func (l *connectionLogger) Fatal(v ...interface{}) {
+	l.Logger.Fatal(l.prepend(v)...)
+}
+
+func (l *connectionLogger) prepend(v []interface{}) []interface{} {
+	return append([]interface{}{l.prefix}, v...)
+}
+
+// userIdentifier returns the first user identifier found in the auth headers
+func userIdentifier(authHeaders map[string][]string) string {
+	for _, name := range userIdentifierHeaders {
+		for key, values := range authHeaders {
+			if strings.EqualFold(key, name) && len(values) > 0 && values[0] != "" {
+				return values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// newConnectionID returns a random RFC 4122 version 4 UUID identifying a connection
+func newConnectionID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// logFields formats message followed by the key=value pairs in kv, so per-message log lines
+// can be parsed and filtered. Values holding spaces or quotes are quoted.
+func logFields(message string, kv ...interface{}) string {
+	var b strings.Builder
+	b.WriteString(message)
+	for i := 0; i+1 < len(kv); i += 2 {
+		value := fmt.Sprint(kv[i+1])
+		if value == "" || strings.ContainsAny(value, " \t\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %v=%s", kv[i], value)
+	}
+	return b.String()
+}
@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestConnectionLogger(t *testing.T) {
+	tests := []struct {
+		name        string
+		authHeaders map[string][]string
+		expected    string
+	}{
+		{
+			name:        "with user id",
+			authHeaders: map[string][]string{"X-User-Id": {"42"}, "X-User-Uid": {"uid-42"}},
+			expected:    "[ENDPOINT: /ws] [CONN: conn-1] [USER: 42] message",
+		},
+		{
+			name:        "falls back to user uid",
+			authHeaders: map[string][]string{"X-User-Uid": {"uid-42"}},
+			expected:    "[ENDPOINT: /ws] [CONN: conn-1] [USER: uid-42] message",
+		},
+		{
+			name:        "without auth headers",
+			authHeaders: map[string][]string{},
+			expected:    "[ENDPOINT: /ws] [CONN: conn-1] message",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &testLogger{}
+			logger := newConnectionLogger(recorder, "/ws", "conn-1", tt.authHeaders)
+
+			logger.Debug("message")
+			logger.Error("message")
+
+			lines := recorder.Lines()
+			if len(lines) != 2 {
+				t.Fatalf("got %d log lines, want 2", len(lines))
+			}
+			for _, line := range lines {
+				if !strings.HasSuffix(line, tt.expected) {
+					t.Errorf("log line = %q, want suffix %q", line, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestNewConnectionID(t *testing.T) {
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	first, second := newConnectionID(), newConnectionID()
+	if !uuidPattern.MatchString(first) {
+		t.Errorf("newConnectionID() = %s, want a version 4 UUID", first)
+	}
+	if first == second {
+		t.Errorf("newConnectionID() returned %s twice", first)
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		kv       []interface{}
+		expected string
+	}{
+		{name: "no fields", message: "Closing", expected: "Closing"},
+		{name: "plain values", message: "Proxying message", kv: []interface{}{"direction", directionClientToBackend, "bytes", 18}, expected: "Proxying message direction=client->backend bytes=18"},
+		{name: "quoted values", message: "Closing connection", kv: []interface{}{"reason", "Going away", "error", ""}, expected: `Closing connection reason="Going away" error=""`},
+		{name: "odd pair ignored", message: "Closing", kv: []interface{}{"status", 1000, "dangling"}, expected: "Closing status=1000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := logFields(tt.message, tt.kv...); got != tt.expected {
+				t.Errorf("logFields() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestConnectionLogPrefix(t *testing.T) {
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		messageType, message, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		conn.Write(ctx, messageType, message)
+		conn.Read(ctx)
+	})
+
+	recorder := &testLogger{}
+	gateway := newTestGateway(t, NewHandlerFactory(recorder), map[string]interface{}{}, backend.URL)
+	client := dialTestGateway(t, gateway, &websocket.DialOptions{
+		HTTPHeader: http.Header{"X-User-Id": []string{"user-7"}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client.Write(ctx, websocket.MessageText, []byte("ping"))
+	if _, _, err := client.Read(ctx); err != nil {
+		t.Fatalf("client read failed: %v", err)
+	}
+
+	proxyLines := recorder.Contains("Proxying message")
+	if len(proxyLines) != 2 {
+		t.Fatalf("got %d proxy log lines, want 2: %v", len(proxyLines), recorder.Lines())
+	}
+	for _, line := range proxyLines {
+		if !strings.Contains(line, "bytes=4") {
+			t.Errorf("proxy log line %q is missing the bytes=4 field", line)
+		}
+	}
+
+	prefix := regexp.MustCompile(`\[ENDPOINT: /ws\] \[CONN: ([0-9a-f-]{36})\] \[USER: user-7\]`)
+	var connID string
+	for _, line := range append(recorder.Contains("Established proxy connection"), proxyLines...) {
+		match := prefix.FindStringSubmatch(line)
+		if match == nil {
+			t.Errorf("log line %q is missing the connection prefix", line)
+			continue
+		}
+		if connID == "" {
+			connID = match[1]
+		} else if match[1] != connID {
+			t.Errorf("log line %q has connection ID %s, want %s", line, match[1], connID)
+		}
+	}
+}
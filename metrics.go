@@ -0,0 +1,273 @@
+package websocket
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"nhooyr.io/websocket"
+)
+
+// MetricsOptions controls the naming and labelling of the WebSocket proxy metrics
+type MetricsOptions struct {
+	Namespace         string            // Optional prefix prepended to every metric name
+	ConstLabels       map[string]string // Static labels added to every metric (e.g. service)
+	OmitEndpointLabel bool              // Drop the endpoint label to reduce cardinality
+}
+
+// Metrics holds the Prometheus collectors updated by the WebSocket proxy.
+// It implements prometheus.Collector so it can be registered with any registry.
+type Metrics struct {
+	SendQueueDepth      *prometheus.GaugeVec
+	SendQueueFullEvents *prometheus.CounterVec
+	GRPCMessages        *prometheus.CounterVec
+	ProxyGoroutines     prometheus.Gauge
+	BackendConnections  *prometheus.GaugeVec
+	UpgradeRejections   *prometheus.CounterVec
+	ConnectionCloses    *prometheus.CounterVec
+	ActiveConnections   *prometheus.GaugeVec
+	Messages            *prometheus.CounterVec
+	MessageBytes        *prometheus.CounterVec
+	ConnectionDuration  *prometheus.HistogramVec
+	SlowBackendWrites   *prometheus.CounterVec
+	InterceptorDuration *prometheus.HistogramVec
+
+	omitEndpointLabel bool
+}
+
+// NewMetrics returns a new set of WebSocket proxy collectors
+func NewMetrics() *Metrics {
+	return NewMetricsWithOptions(MetricsOptions{})
+}
+
+// NewMetricsWithOptions returns a new set of WebSocket proxy collectors named and labelled according to opts
+func NewMetricsWithOptions(opts MetricsOptions) *Metrics {
+	m := &Metrics{
+		omitEndpointLabel: opts.OmitEndpointLabel,
+	}
+
+	constLabels := prometheus.Labels(opts.ConstLabels)
+
+	m.SendQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_send_queue_depth",
+		Help:        "Current number of messages buffered in the send queues of all connections.",
+		ConstLabels: constLabels,
+	}, m.labelNames("direction"))
+	m.SendQueueFullEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_send_queue_full_total",
+		Help:        "Number of times a message found the send queue full.",
+		ConstLabels: constLabels,
+	}, m.labelNames("direction"))
+	m.GRPCMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_grpc_messages_total",
+		Help:        "Number of gRPC messages proxied under grpc_web framing.",
+		ConstLabels: constLabels,
+	}, m.labelNames("direction"))
+	m.ProxyGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_proxy_goroutines",
+		Help:        "Current number of running proxy goroutines.",
+		ConstLabels: constLabels,
+	})
+	m.BackendConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_backend_connections",
+		Help:        "Current number of active connections per resolved backend.",
+		ConstLabels: constLabels,
+	}, []string{"backend"})
+	m.UpgradeRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_upgrade_rejections_total",
+		Help:        "Number of upgrade requests rejected before the accept, by reason.",
+		ConstLabels: constLabels,
+	}, m.labelNames("reason"))
+	m.ConnectionCloses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_connection_closes_total",
+		Help:        "Number of closed connections, by close status sent to the client and side that ended them.",
+		ConstLabels: constLabels,
+	}, m.labelNames("code", "initiator"))
+	m.ActiveConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_active_connections",
+		Help:        "Current number of proxied client connections.",
+		ConstLabels: constLabels,
+	}, m.labelNames())
+	m.Messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_messages_total",
+		Help:        "Number of messages proxied, by direction.",
+		ConstLabels: constLabels,
+	}, m.labelNames("direction"))
+	m.MessageBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_message_bytes_total",
+		Help:        "Number of message payload bytes proxied, by direction.",
+		ConstLabels: constLabels,
+	}, m.labelNames("direction"))
+	m.ConnectionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_connection_duration_seconds",
+		Help:        "Duration of the proxied client connections.",
+		ConstLabels: constLabels,
+		Buckets:     prometheus.ExponentialBuckets(1, 4, 8), // 1s to ~4.5h
+	}, m.labelNames())
+	m.SlowBackendWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_slow_backend_writes_total",
+		Help:        "Number of message writes to the backend taking longer than slow_write_threshold.",
+		ConstLabels: constLabels,
+	}, m.labelNames())
+	m.InterceptorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Name:        "ws_interceptor_duration_seconds",
+		Help:        "Time spent in a message interceptor per call, by direction.",
+		ConstLabels: constLabels,
+		Buckets:     prometheus.ExponentialBuckets(0.00001, 4, 10), // 10µs to ~2.6s
+	}, m.labelNames("direction"))
+
+	return m
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.SendQueueDepth,
+		m.SendQueueFullEvents,
+		m.GRPCMessages,
+		m.ProxyGoroutines,
+		m.BackendConnections,
+		m.UpgradeRejections,
+		m.ConnectionCloses,
+		m.ActiveConnections,
+		m.Messages,
+		m.MessageBytes,
+		m.ConnectionDuration,
+		m.SlowBackendWrites,
+		m.InterceptorDuration,
+	}
+}
+
+// labelNames returns the variable label names of a metric, led by the endpoint label unless omitted
+func (m *Metrics) labelNames(names ...string) []string {
+	if m.omitEndpointLabel {
+		return names
+	}
+	return append([]string{"endpoint"}, names...)
+}
+
+// labelValues returns the label values matching labelNames for an observation on endpoint
+func (m *Metrics) labelValues(endpoint string, values ...string) []string {
+	if m.omitEndpointLabel {
+		return values
+	}
+	return append([]string{endpoint}, values...)
+}
+
+// sendQueueInstruments returns the send queue collectors for a connection direction, or nils when metrics are disabled
+func (m *Metrics) sendQueueInstruments(endpoint, direction string) (prometheus.Gauge, prometheus.Counter) {
+	if m == nil {
+		return nil, nil
+	}
+	labels := m.labelValues(endpoint, direction)
+	return m.SendQueueDepth.WithLabelValues(labels...), m.SendQueueFullEvents.WithLabelValues(labels...)
+}
+
+// addGRPCMessages counts the gRPC messages carried by a proxied WebSocket message
+func (m *Metrics) addGRPCMessages(endpoint, direction string, count int) {
+	if m == nil {
+		return
+	}
+	m.GRPCMessages.WithLabelValues(m.labelValues(endpoint, direction)...).Add(float64(count))
+}
+
+// setProxyGoroutines reports the number of running proxy goroutines
+func (m *Metrics) setProxyGoroutines(count int) {
+	if m == nil {
+		return
+	}
+	m.ProxyGoroutines.Set(float64(count))
+}
+
+// setBackendConnections reports the number of active connections to a backend
+func (m *Metrics) setBackendConnections(backend string, count int) {
+	if m == nil {
+		return
+	}
+	m.BackendConnections.WithLabelValues(backend).Set(float64(count))
+}
+
+// addUpgradeRejection counts an upgrade request rejected before the accept
+func (m *Metrics) addUpgradeRejection(endpoint, reason string) {
+	if m == nil {
+		return
+	}
+	m.UpgradeRejections.WithLabelValues(m.labelValues(endpoint, reason)...).Inc()
+}
+
+// addConnectionClose counts a connection closed with code, ended by initiator
+func (m *Metrics) addConnectionClose(endpoint string, code websocket.StatusCode, initiator string) {
+	if m == nil {
+		return
+	}
+	m.ConnectionCloses.WithLabelValues(m.labelValues(endpoint, strconv.Itoa(int(code)), initiator)...).Inc()
+}
+
+// connectionOpened counts a client connection as active
+func (m *Metrics) connectionOpened(endpoint string) {
+	if m == nil {
+		return
+	}
+	m.ActiveConnections.WithLabelValues(m.labelValues(endpoint)...).Inc()
+}
+
+// connectionClosed stops counting a client connection as active and observes its duration
+func (m *Metrics) connectionClosed(endpoint string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.ActiveConnections.WithLabelValues(m.labelValues(endpoint)...).Dec()
+	m.ConnectionDuration.WithLabelValues(m.labelValues(endpoint)...).Observe(duration.Seconds())
+}
+
+// addMessage counts a proxied message of n bytes
+func (m *Metrics) addMessage(endpoint, direction string, n int) {
+	if m == nil {
+		return
+	}
+	labels := m.labelValues(endpoint, direction)
+	m.Messages.WithLabelValues(labels...).Inc()
+	m.MessageBytes.WithLabelValues(labels...).Add(float64(n))
+}
+
+// addSlowBackendWrite counts a backend write slower than slow_write_threshold
+func (m *Metrics) addSlowBackendWrite(endpoint string) {
+	if m == nil {
+		return
+	}
+	m.SlowBackendWrites.WithLabelValues(m.labelValues(endpoint)...).Inc()
+}
+
+// interceptorDuration returns the collector of the interceptor latencies of a connection direction, or nil when metrics are disabled
+func (m *Metrics) interceptorDuration(endpoint, direction string) prometheus.Observer {
+	if m == nil {
+		return nil
+	}
+	return m.InterceptorDuration.WithLabelValues(m.labelValues(endpoint, direction)...)
+}
@@ -0,0 +1,429 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"nhooyr.io/websocket"
+)
+
+func TestMetricsLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     MetricsOptions
+		expected string
+		series   int
+	}{
+		{
+			name: "default labels",
+			opts: MetricsOptions{},
+			expected: `
+# HELP ws_send_queue_full_total Number of times a message found the send queue full.
+# TYPE ws_send_queue_full_total counter
+ws_send_queue_full_total{direction="backend->client",endpoint="/chat"} 1
+ws_send_queue_full_total{direction="backend->client",endpoint="/game"} 1
+`,
+			series: 2,
+		},
+		{
+			name: "static labels and namespace",
+			opts: MetricsOptions{
+				Namespace:   "gateway",
+				ConstLabels: map[string]string{"service": "realtime"},
+			},
+			expected: `
+# HELP gateway_ws_send_queue_full_total Number of times a message found the send queue full.
+# TYPE gateway_ws_send_queue_full_total counter
+gateway_ws_send_queue_full_total{direction="backend->client",endpoint="/chat",service="realtime"} 1
+gateway_ws_send_queue_full_total{direction="backend->client",endpoint="/game",service="realtime"} 1
+`,
+			series: 2,
+		},
+		{
+			name: "endpoint label omitted",
+			opts: MetricsOptions{
+				ConstLabels:       map[string]string{"service": "realtime"},
+				OmitEndpointLabel: true,
+			},
+			expected: `
+# HELP ws_send_queue_full_total Number of times a message found the send queue full.
+# TYPE ws_send_queue_full_total counter
+ws_send_queue_full_total{direction="backend->client",service="realtime"} 2
+`,
+			series: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewMetricsWithOptions(tt.opts)
+
+			for _, endpoint := range []string{"/chat", "/game"} {
+				_, full := metrics.sendQueueInstruments(endpoint, directionBackendToClient)
+				full.Inc()
+			}
+
+			if err := testutil.CollectAndCompare(metrics.SendQueueFullEvents, strings.NewReader(tt.expected)); err != nil {
+				t.Errorf("unexpected metrics: %v", err)
+			}
+
+			if got := testutil.CollectAndCount(metrics.SendQueueFullEvents); got != tt.series {
+				t.Errorf("series = %d, want %d", got, tt.series)
+			}
+		})
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	var metrics *Metrics
+
+	depth, full := metrics.sendQueueInstruments("/ws", directionClientToBackend)
+	if depth != nil || full != nil {
+		t.Errorf("sendQueueInstruments() on nil metrics = %v, %v, want nils", depth, full)
+	}
+}
+
+func TestUpgradeRejectionMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		wsConfig map[string]interface{}
+		request  func(*http.Request)
+		status   int
+		reason   string
+	}{
+		{
+			name:     "ambiguous upgrade",
+			wsConfig: map[string]interface{}{"strict_upgrade_headers": true},
+			request:  func(r *http.Request) { r.Header.Add("Upgrade", "h2c") },
+			status:   http.StatusBadRequest,
+			reason:   rejectionAmbiguousUpgrade,
+		},
+		{
+			name:     "invalid signature",
+			wsConfig: map[string]interface{}{"auth_signature_secret": "secret"},
+			request:  func(r *http.Request) { r.Header.Set("X-User-Id", "42") },
+			status:   http.StatusUnauthorized,
+			reason:   rejectionInvalidSignature,
+		},
+		{
+			name:     "handshake budget exceeded",
+			wsConfig: map[string]interface{}{"total_handshake_budget": "1ns"},
+			status:   http.StatusGatewayTimeout,
+			reason:   rejectionHandshakeTimeout,
+		},
+		{
+			name:     "unsupported version",
+			wsConfig: map[string]interface{}{},
+			request:  func(r *http.Request) { r.Header.Set("Sec-WebSocket-Version", "8") },
+			status:   http.StatusUpgradeRequired,
+			reason:   rejectionUnsupportedVersion,
+		},
+		{
+			name:     "denied subprotocol",
+			wsConfig: map[string]interface{}{"denied_subprotocols": []interface{}{"chat.v0"}},
+			request:  func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "chat.v0") },
+			status:   http.StatusBadRequest,
+			reason:   rejectionDeniedSubprotocol,
+		},
+		{
+			// httptest.ResponseRecorder cannot be hijacked
+			name:     "hijacking unsupported",
+			wsConfig: map[string]interface{}{},
+			status:   http.StatusInternalServerError,
+			reason:   rejectionHijackUnsupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewMetrics()
+			engine := newTestEngine(t, NewHandlerFactoryWithMetrics(logging.NoOp, metrics), tt.wsConfig, "http://localhost:8000")
+
+			req := newUpgradeRequest("/ws")
+			if tt.request != nil {
+				tt.request(req)
+			}
+			rec := httptest.NewRecorder()
+			engine.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := testutil.ToFloat64(metrics.UpgradeRejections.WithLabelValues("/ws", tt.reason)); got != 1 {
+				t.Errorf("ws_upgrade_rejections_total{reason=%q} = %v, want 1", tt.reason, got)
+			}
+			if got := testutil.CollectAndCount(metrics.UpgradeRejections); got != 1 {
+				t.Errorf("series = %d, want only the %q one", got, tt.reason)
+			}
+		})
+	}
+}
+
+func TestConnectionCloseInitiator(t *testing.T) {
+	// The backend only reads, it never pushes
+	silentBackend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	})
+	// The backend closes normally right after the accept
+	closingBackend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		wsConfig   map[string]interface{}
+		backendURL string
+		client     func(t *testing.T, gateway *httptest.Server)
+		code       string
+		initiator  string
+	}{
+		{
+			name:       "gateway timeout",
+			wsConfig:   map[string]interface{}{"idle_timeout": "100ms"},
+			backendURL: silentBackend.URL,
+			client: func(t *testing.T, gateway *httptest.Server) {
+				client := dialTestGateway(t, gateway, nil)
+				client.Read(context.Background())
+			},
+			code:      "1008",
+			initiator: initiatorGateway,
+		},
+		{
+			name:       "client close",
+			backendURL: silentBackend.URL,
+			client: func(t *testing.T, gateway *httptest.Server) {
+				dialTestGateway(t, gateway, nil).Close(websocket.StatusNormalClosure, "")
+			},
+			code:      "1000",
+			initiator: initiatorClient,
+		},
+		{
+			name:       "client drop",
+			backendURL: silentBackend.URL,
+			client: func(t *testing.T, gateway *httptest.Server) {
+				// Closing the TCP connection without a close handshake
+				conn, _ := rawWebSocketConn(t, gateway)
+				conn.Close()
+			},
+			code:      "1011",
+			initiator: initiatorClient,
+		},
+		{
+			name:       "backend close",
+			backendURL: closingBackend.URL,
+			client: func(t *testing.T, gateway *httptest.Server) {
+				client := dialTestGateway(t, gateway, nil)
+				client.Read(context.Background())
+			},
+			code:      "1000",
+			initiator: initiatorBackend,
+		},
+		{
+			name:       "backend unreachable",
+			backendURL: "http://127.0.0.1:1",
+			client: func(t *testing.T, gateway *httptest.Server) {
+				client := dialTestGateway(t, gateway, nil)
+				client.Read(context.Background())
+			},
+			code:      "1011",
+			initiator: initiatorBackend,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewMetrics()
+			wsConfig := tt.wsConfig
+			if wsConfig == nil {
+				wsConfig = map[string]interface{}{}
+			}
+			gateway := newTestGateway(t, NewHandlerFactoryWithMetrics(logging.NoOp, metrics), wsConfig, tt.backendURL)
+
+			tt.client(t, gateway)
+
+			// The close is counted once the gateway is done with the connection
+			for deadline := time.Now().Add(2 * time.Second); testutil.CollectAndCount(metrics.ConnectionCloses) == 0; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("connection close was not counted")
+				}
+			}
+
+			if got := testutil.ToFloat64(metrics.ConnectionCloses.WithLabelValues("/ws", tt.code, tt.initiator)); got != 1 {
+				t.Errorf("ws_connection_closes_total{code=%q,initiator=%q} = %v, want 1", tt.code, tt.initiator, got)
+			}
+			if got := testutil.CollectAndCount(metrics.ConnectionCloses); got != 1 {
+				t.Errorf("series = %d, want only the %s/%s one", got, tt.code, tt.initiator)
+			}
+		})
+	}
+}
+
+func TestConnectionMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	gateway := newTestGateway(t, NewHandlerFactoryWithMetrics(logging.NoOp, metrics), map[string]interface{}{}, newEchoBackend(t))
+
+	client := dialTestGateway(t, gateway, nil)
+	exchangeMessages(t, client, "hello", "hi")
+
+	if got := testutil.ToFloat64(metrics.ActiveConnections.WithLabelValues("/ws")); got != 1 {
+		t.Errorf("ws_active_connections = %v, want 1", got)
+	}
+	for _, direction := range []string{directionClientToBackend, directionBackendToClient} {
+		if got := testutil.ToFloat64(metrics.Messages.WithLabelValues("/ws", direction)); got != 2 {
+			t.Errorf("ws_messages_total{direction=%q} = %v, want 2", direction, got)
+		}
+		if got := testutil.ToFloat64(metrics.MessageBytes.WithLabelValues("/ws", direction)); got != 7 {
+			t.Errorf("ws_message_bytes_total{direction=%q} = %v, want 7", direction, got)
+		}
+	}
+
+	client.Close(websocket.StatusNormalClosure, "")
+
+	// The connection is accounted for once the gateway is done with it
+	for deadline := time.Now().Add(2 * time.Second); testutil.ToFloat64(metrics.ActiveConnections.WithLabelValues("/ws")) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection is still counted as active after the close")
+		}
+	}
+
+	var duration dto.Metric
+	if err := metrics.ConnectionDuration.WithLabelValues("/ws").(prometheus.Histogram).Write(&duration); err != nil {
+		t.Fatalf("failed to read ws_connection_duration_seconds: %v", err)
+	}
+	if got := duration.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("ws_connection_duration_seconds count = %d, want 1", got)
+	}
+}
+
+// slowWriter takes delay to write the messages starting with "slow"
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (s slowWriter) Write(ctx context.Context, messageType websocket.MessageType, message []byte) error {
+	if strings.HasPrefix(string(message), "slow") {
+		time.Sleep(s.delay)
+	}
+	return nil
+}
+
+func TestSlowBackendWrites(t *testing.T) {
+	metrics := NewMetrics()
+	factory := NewHandlerFactoryWithMetrics(logging.NoOp, metrics)
+	wsConfig := Config{SlowWriteThreshold: 50 * time.Millisecond}
+
+	result := make(chan error, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		src, err := websocket.Accept(rw, r, nil)
+		if err != nil {
+			result <- err
+			return
+		}
+		defer src.Close(websocket.StatusNormalClosure, "")
+
+		pc := &proxyConnection{endpoint: "/ws", logger: logging.NoOp, stats: &connStats{}}
+		direction := directionClientToBackend
+		if r.URL.Path == "/client" {
+			direction = directionBackendToClient
+		}
+		result <- factory.proxyMessages(r.Context(), pc, src, slowWriter{delay: 100 * time.Millisecond}, direction, wsConfig)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Slow writes to the client are not backend writes and are not counted
+	for _, path := range []string{"/backend", "/client"} {
+		client, _, err := websocket.Dial(ctx, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		for _, message := range []string{"fast", "slow 1", "fast", "slow 2"} {
+			if err := client.Write(ctx, websocket.MessageText, []byte(message)); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+		}
+		// The proxy reads the close frame once every message was written
+		client.Close(websocket.StatusNormalClosure, "")
+		<-result
+	}
+
+	if got := testutil.ToFloat64(metrics.SlowBackendWrites.WithLabelValues("/ws")); got != 2 {
+		t.Errorf("ws_slow_backend_writes_total = %v, want 2", got)
+	}
+}
+
+// sleepInterceptor takes delay to intercept each message
+type sleepInterceptor struct {
+	delay time.Duration
+}
+
+func (s sleepInterceptor) Intercept(direction string, messageType websocket.MessageType, payload []byte) (websocket.MessageType, []byte, error) {
+	time.Sleep(s.delay)
+	return messageType, payload, nil
+}
+
+func TestInterceptorDuration(t *testing.T) {
+	metrics := NewMetrics()
+	factory := NewHandlerFactoryWithMetrics(logging.NoOp, metrics)
+
+	result := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		src, err := websocket.Accept(rw, r, nil)
+		if err != nil {
+			result <- err
+			return
+		}
+		defer src.Close(websocket.StatusNormalClosure, "")
+
+		pc := &proxyConnection{
+			endpoint:     "/ws",
+			logger:       logging.NoOp,
+			stats:        &connStats{},
+			interceptors: []MessageInterceptor{sleepInterceptor{delay: 20 * time.Millisecond}},
+		}
+		result <- factory.proxyMessages(r.Context(), pc, src, slowWriter{}, directionClientToBackend, Config{})
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, _, err := websocket.Dial(ctx, server.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	for _, message := range []string{"first", "second"} {
+		if err := client.Write(ctx, websocket.MessageText, []byte(message)); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+	}
+	// The proxy reads the close frame once every message was intercepted
+	client.Close(websocket.StatusNormalClosure, "")
+	<-result
+
+	var duration dto.Metric
+	if err := metrics.InterceptorDuration.WithLabelValues("/ws", directionClientToBackend).(prometheus.Histogram).Write(&duration); err != nil {
+		t.Fatalf("failed to read ws_interceptor_duration_seconds: %v", err)
+	}
+	if got := duration.GetHistogram().GetSampleCount(); got != 2 {
+		t.Errorf("ws_interceptor_duration_seconds count = %d, want 2", got)
+	}
+	if got := duration.GetHistogram().GetSampleSum(); got < 0.04 {
+		t.Errorf("ws_interceptor_duration_seconds sum = %v, want at least the 40ms slept", got)
+	}
+	if got := testutil.CollectAndCount(metrics.InterceptorDuration); got != 1 {
+		t.Errorf("ws_interceptor_duration_seconds series = %d, want only the intercepted direction", got)
+	}
+}
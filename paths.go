@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions taken on upgrade requests whose path is refused by allowed_upgrade_paths or denied_upgrade_paths
+const (
+	UpgradePathActionReject = "reject" // Answer HTTP 403
+	UpgradePathActionHTTP   = "http"   // Hand the request to the standard endpoint handler, as if it were no upgrade
+)
+
+// upgradePathAllowed reports whether requestPath may upgrade: it matches one of allowed, when
+// any is configured, and none of denied. Patterns follow path.Match, * not crossing a slash.
+func upgradePathAllowed(requestPath string, allowed, denied []string) bool {
+	if len(allowed) > 0 && !matchesAnyPath(requestPath, allowed) {
+		return false
+	}
+	return !matchesAnyPath(requestPath, denied)
+}
+
+// matchesAnyPath reports whether requestPath matches one of patterns, malformed patterns matching nothing
+func matchesAnyPath(requestPath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, requestPath); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradePathWarnings reports the malformed upgrade path patterns of cfg and an unknown upgrade_path_action
+func upgradePathWarnings(cfg Config) []string {
+	var warnings []string
+	for _, option := range []struct {
+		name     string
+		patterns []string
+	}{
+		{"allowed_upgrade_paths", cfg.AllowedUpgradePaths},
+		{"denied_upgrade_paths", cfg.DeniedUpgradePaths},
+	} {
+		for _, pattern := range option.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s pattern %q is malformed and matches no path", option.name, pattern))
+			}
+		}
+	}
+
+	if cfg.UpgradePathAction != "" && cfg.UpgradePathAction != UpgradePathActionReject && cfg.UpgradePathAction != UpgradePathActionHTTP {
+		warnings = append(warnings, fmt.Sprintf("unknown upgrade_path_action %q, refused paths will be rejected", cfg.UpgradePathAction))
+	}
+	return warnings
+}
+
+// pathParamsContextKey holds the gin.Params of the upgrade request, substituted in backend_path
+const pathParamsContextKey contextKey = "path-params"
+
+// backendPathPlaceholder matches the {param} placeholders of backend_path
+var backendPathPlaceholder = regexp.MustCompile(`\{([^{}/]+)\}`)
+
+// expandBackendPath substitutes the {param} placeholders of backendPath with the URL parameters
+// captured by the route, escaped as path segments. Placeholders naming no parameter are an error.
+func expandBackendPath(backendPath string, params gin.Params) (string, error) {
+	var missing []string
+	expanded := backendPathPlaceholder.ReplaceAllStringFunc(backendPath, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := params.Get(name)
+		if !ok {
+			missing = append(missing, name)
+			return placeholder
+		}
+
+		// Catch-all parameters hold several segments, keep their slashes
+		segments := strings.Split(strings.TrimPrefix(value, "/"), "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		return strings.Join(segments, "/")
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("backend_path %q references URL parameters not captured by the endpoint: %s", backendPath, strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// requestPathParams returns the URL parameters stored in the context of r by the upgrade
+func requestPathParams(r *http.Request) gin.Params {
+	params, _ := r.Context().Value(pathParamsContextKey).(gin.Params)
+	return params
+}
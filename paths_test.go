@@ -0,0 +1,205 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"nhooyr.io/websocket"
+)
+
+// newCatchAllGateway serves a WebSocket endpoint at /ws/*path proxying to backendURL
+func newCatchAllGateway(t *testing.T, wsConfig map[string]interface{}, backendURL string) *httptest.Server {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	endpointConfig := &config.EndpointConfig{
+		Endpoint: "/ws/*path",
+		Method:   http.MethodGet,
+		Backend: []*config.Backend{
+			{
+				Host:       []string{backendURL},
+				URLPattern: "/ws",
+			},
+		},
+		ExtraConfig: config.ExtraConfig{
+			ConfigNamespace: wsConfig,
+		},
+	}
+	standardHandlerFactory := func(*config.EndpointConfig, proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.Status(http.StatusNoContent)
+		}
+	}
+	engine.GET("/ws/*path", NewHandlerFactory(logging.NoOp).HandlerWrapper(standardHandlerFactory)(endpointConfig, dummyProxy))
+
+	gateway := httptest.NewServer(engine)
+	t.Cleanup(gateway.Close)
+	return gateway
+}
+
+func TestUpgradePaths(t *testing.T) {
+	backend := newEchoBackend(t)
+	patterns := map[string]interface{}{
+		"allowed_upgrade_paths": []interface{}{"/ws/rooms/*", "/ws/lobby"},
+		"denied_upgrade_paths":  []interface{}{"/ws/rooms/private-*"},
+	}
+
+	tests := []struct {
+		name   string
+		action string
+		path   string
+		status int
+	}{
+		{name: "allowed", path: "/ws/rooms/general", status: http.StatusSwitchingProtocols},
+		{name: "allowed exact path", path: "/ws/lobby", status: http.StatusSwitchingProtocols},
+		{name: "not allowed", path: "/ws/admin", status: http.StatusForbidden},
+		{name: "star does not cross a slash", path: "/ws/rooms/general/history", status: http.StatusForbidden},
+		{name: "denied", path: "/ws/rooms/private-1", status: http.StatusForbidden},
+		{name: "not allowed handled as HTTP", action: UpgradePathActionHTTP, path: "/ws/admin", status: http.StatusNoContent},
+		{name: "denied handled as HTTP", action: UpgradePathActionHTTP, path: "/ws/rooms/private-1", status: http.StatusNoContent},
+		{name: "allowed with HTTP action", action: UpgradePathActionHTTP, path: "/ws/rooms/general", status: http.StatusSwitchingProtocols},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsConfig := map[string]interface{}{"upgrade_path_action": tt.action}
+			for key, value := range patterns {
+				wsConfig[key] = value
+			}
+			gateway := newCatchAllGateway(t, wsConfig, backend)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, resp, err := websocket.Dial(ctx, gateway.URL+tt.path, nil)
+			if conn != nil {
+				defer conn.Close(websocket.StatusNormalClosure, "")
+			}
+			if resp == nil || resp.StatusCode != tt.status {
+				t.Fatalf("upgrade of %s = %v, %v, want status %d", tt.path, resp, err, tt.status)
+			}
+		})
+	}
+}
+
+func TestUpgradePathWarnings(t *testing.T) {
+	warnings := validateConfig(Config{
+		AllowedUpgradePaths: []string{"/ws/*", "/ws/[a-"},
+		DeniedUpgradePaths:  []string{"/ws/\\"},
+		UpgradePathAction:   "redirect",
+	})
+	if len(warnings) != 3 {
+		t.Fatalf("warnings = %q, want the two malformed patterns and the unknown action", warnings)
+	}
+}
+
+func TestBackendPathTemplate(t *testing.T) {
+	rooms := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		conn.Write(ctx, websocket.MessageText, []byte(r.URL.EscapedPath()))
+		conn.Read(ctx)
+	})
+
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"rooms": "ws" + strings.TrimPrefix(rooms.URL, "http"),
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	newGateway := func(backendPath string) *httptest.Server {
+		gin.SetMode(gin.TestMode)
+		engine := gin.New()
+		endpointConfig := &config.EndpointConfig{
+			Endpoint: "/rooms/{room_id}/ws/*rest",
+			Method:   http.MethodGet,
+			Backend:  []*config.Backend{{Host: []string{rooms.URL}, URLPattern: "/ws"}},
+			ExtraConfig: config.ExtraConfig{
+				ConfigNamespace: map[string]interface{}{},
+				"backend":       "rooms",
+				"backend_path":  backendPath,
+			},
+		}
+		engine.GET("/rooms/:room_id/ws/*rest", NewHandlerFactory(logging.NoOp).HandlerWrapper(nil)(endpointConfig, dummyProxy))
+
+		gateway := httptest.NewServer(engine)
+		t.Cleanup(gateway.Close)
+		return gateway
+	}
+
+	t.Run("parameters substituted", func(t *testing.T) {
+		gateway := newGateway("/internal/rooms/{room_id}/stream/{rest}")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, _, err := websocket.Dial(ctx, gateway.URL+"/rooms/room%20one/ws/a/b", nil)
+		if err != nil {
+			t.Fatalf("failed to dial gateway: %v", err)
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+
+		_, message, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+		if want := "/internal/rooms/room%20one/stream/a/b"; string(message) != want {
+			t.Errorf("backend path = %q, want %q", message, want)
+		}
+	})
+
+	t.Run("unmatched placeholder", func(t *testing.T) {
+		gateway := newGateway("/internal/rooms/{roomId}/stream")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, resp, err := websocket.Dial(ctx, gateway.URL+"/rooms/42/ws/", nil)
+		if conn != nil {
+			conn.Close(websocket.StatusNormalClosure, "")
+		}
+		if resp == nil || resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("upgrade = %v, %v, want it refused with %d before the accept", resp, err, http.StatusInternalServerError)
+		}
+	})
+}
+
+func TestExpandBackendPath(t *testing.T) {
+	params := gin.Params{{Key: "room_id", Value: "42"}, {Key: "rest", Value: "/a/b c"}}
+
+	tests := []struct {
+		backendPath string
+		expected    string
+		wantErr     bool
+	}{
+		{backendPath: "/internal/rooms/{room_id}/stream", expected: "/internal/rooms/42/stream"},
+		{backendPath: "/files/{rest}", expected: "/files/a/b%20c"},
+		{backendPath: "/static", expected: "/static"},
+		{backendPath: "/rooms/{room_id}/{user}/{team}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.backendPath, func(t *testing.T) {
+			got, err := expandBackendPath(tt.backendPath, params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandBackendPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), "user, team") {
+					t.Errorf("expandBackendPath() error = %v, want it to name the missing parameters", err)
+				}
+				return
+			}
+			if got != tt.expected {
+				t.Errorf("expandBackendPath() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"context"
+	"time"
+)
+
+// handshakeQueue bounds the client accepts of an endpoint running at once. Upgrades finding
+// every slot taken wait in line for one, for at most the configured wait.
+type handshakeQueue struct {
+	slots chan struct{}
+	wait  time.Duration // Longest wait for a slot (0 = until the request ends)
+}
+
+// newHandshakeQueue returns a queue of size slots, or nil, which never queues, when size is not positive
+func newHandshakeQueue(size int, wait time.Duration) *handshakeQueue {
+	if size <= 0 {
+		return nil
+	}
+	return &handshakeQueue{slots: make(chan struct{}, size), wait: wait}
+}
+
+// acquire takes a slot, waiting for one until the queue wait elapses or ctx is done.
+// It reports whether a slot was taken, to be given back with release.
+func (q *handshakeQueue) acquire(ctx context.Context) bool {
+	if q == nil {
+		return true
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if q.wait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.wait)
+		defer cancel()
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release gives back a slot taken by acquire
+func (q *handshakeQueue) release() {
+	if q != nil {
+		<-q.slots
+	}
+}
+
+// handshakeQueue returns the queue of endpoint, created on first use from wsConfig
+func (w *HandlerFactory) handshakeQueue(endpoint string, wsConfig Config) *handshakeQueue {
+	if wsConfig.MaxConcurrentHandshakes <= 0 {
+		return nil
+	}
+	if q, ok := w.handshakeQueues.Load(endpoint); ok {
+		return q.(*handshakeQueue)
+	}
+	q, _ := w.handshakeQueues.LoadOrStore(endpoint, newHandshakeQueue(wsConfig.MaxConcurrentHandshakes, wsConfig.AcceptQueueWaitTimeout))
+	return q.(*handshakeQueue)
+}
@@ -0,0 +1,82 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+func TestAcceptQueueWaitTimeout(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+
+	// The first accept holds the only slot until released
+	var accepts int32
+	holding, release := make(chan struct{}), make(chan struct{})
+	factory.SetAcceptOptionsFunc(func(c *gin.Context, opts websocket.AcceptOptions) websocket.AcceptOptions {
+		if atomic.AddInt32(&accepts, 1) == 1 {
+			close(holding)
+			<-release
+		}
+		return opts
+	})
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"max_concurrent_handshakes": float64(1),
+		"accept_queue_wait_timeout": "200ms",
+	}, newEchoBackend(t))
+
+	dial := func() (*websocket.Conn, int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", nil)
+		if err != nil {
+			if resp == nil {
+				return nil, 0, err
+			}
+			return nil, resp.StatusCode, nil
+		}
+		t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+		return conn, resp.StatusCode, nil
+	}
+
+	type result struct {
+		conn   *websocket.Conn
+		status int
+		err    error
+	}
+	first := make(chan result, 1)
+	go func() {
+		conn, status, err := dial()
+		first <- result{conn, status, err}
+	}()
+	<-holding
+
+	// No slot frees within the wait
+	if _, status, err := dial(); err != nil || status != http.StatusServiceUnavailable {
+		t.Fatalf("queued upgrade got status %d, %v, want %d", status, err, http.StatusServiceUnavailable)
+	}
+
+	// The slot frees while the next upgrade waits
+	queued := make(chan result, 1)
+	go func() {
+		conn, status, err := dial()
+		queued <- result{conn, status, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for _, ch := range []chan result{first, queued} {
+		r := <-ch
+		if r.conn == nil {
+			t.Fatalf("upgrade got status %d, %v, want it to proceed", r.status, r.err)
+		}
+		exchangeMessages(t, r.conn, "hello")
+	}
+}
@@ -0,0 +1,48 @@
+package websocket
+
+import (
+	"context"
+	"math"
+
+	"golang.org/x/time/rate"
+	"nhooyr.io/websocket"
+)
+
+// Actions taken on client messages exceeding client_message_rate_limit
+const (
+	RateLimitActionBlock = "block" // Stop reading from the client until the next message is allowed
+	RateLimitActionClose = "close" // Close the connection with StatusPolicyViolation
+)
+
+// rateLimitReason is the close reason of clients exceeding client_message_rate_limit
+const rateLimitReason = "Message rate limit exceeded"
+
+// newClientRateLimiter returns the limiter of the messages a client sends, or nil without client_message_rate_limit.
+// The burst defaults to one second worth of messages.
+func newClientRateLimiter(wsConfig Config) *rate.Limiter {
+	if wsConfig.ClientMessageRateLimit <= 0 {
+		return nil
+	}
+
+	burst := wsConfig.ClientMessageBurst
+	if burst <= 0 {
+		burst = int(math.Ceil(wsConfig.ClientMessageRateLimit))
+	}
+	return rate.NewLimiter(rate.Limit(wsConfig.ClientMessageRateLimit), burst)
+}
+
+// waitForMessageToken takes a token for a client message from limiter, blocking until one is available
+// or failing with a *proxyCloseError when the action is to close. A nil limiter allows every message.
+func waitForMessageToken(ctx context.Context, limiter *rate.Limiter, action string) error {
+	if limiter == nil {
+		return nil
+	}
+
+	if action == RateLimitActionClose {
+		if !limiter.Allow() {
+			return &proxyCloseError{code: websocket.StatusPolicyViolation, reason: rateLimitReason}
+		}
+		return nil
+	}
+	return limiter.Wait(ctx)
+}
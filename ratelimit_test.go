@@ -0,0 +1,95 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+func TestClientMessageRateLimit(t *testing.T) {
+	t.Run("close", func(t *testing.T) {
+		received := make(chan string, 3)
+		backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			for {
+				_, message, err := conn.Read(ctx)
+				if err != nil {
+					close(received)
+					return
+				}
+				received <- string(message)
+			}
+		})
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+			"client_message_rate_limit": float64(1),
+			"client_message_burst":      float64(2),
+			"rate_limit_action":         RateLimitActionClose,
+		}, backend.URL)
+		client := dialTestGateway(t, gateway, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		for _, message := range []string{"a", "b", "c"} {
+			if err := client.Write(ctx, websocket.MessageText, []byte(message)); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+		}
+		if _, _, err := client.Read(ctx); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+			t.Fatalf("client read after the burst = %v, want a close with %v", err, websocket.StatusPolicyViolation)
+		}
+
+		// The burst is forwarded, the message over it is not
+		var forwarded []string
+		for message := range received {
+			forwarded = append(forwarded, message)
+		}
+		if len(forwarded) != 2 || forwarded[0] != "a" || forwarded[1] != "b" {
+			t.Errorf("backend received %v, want the burst [a b]", forwarded)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+			"client_message_rate_limit": float64(20),
+			"client_message_burst":      float64(1),
+		}, newEchoBackend(t))
+		client := dialTestGateway(t, gateway, nil)
+
+		// Five messages at 20 per second take at least 200ms past the first one
+		start := time.Now()
+		exchangeMessages(t, client, "a", "b", "c", "d", "e")
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Errorf("five messages were proxied in %s, want them delayed to the rate", elapsed)
+		}
+	})
+
+	t.Run("backend messages", func(t *testing.T) {
+		backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			for i := 0; i < 10; i++ {
+				if err := conn.Write(ctx, websocket.MessageText, []byte("push")); err != nil {
+					return
+				}
+			}
+			conn.Read(ctx)
+		})
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+			"client_message_rate_limit": float64(1),
+			"client_message_burst":      float64(1),
+			"rate_limit_action":         RateLimitActionClose,
+		}, backend.URL)
+		client := dialTestGateway(t, gateway, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		for i := 0; i < 10; i++ {
+			if _, _, err := client.Read(ctx); err != nil {
+				t.Fatalf("backend message %d was not delivered: %v", i, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// messageWriter is the destination of a proxy direction
+type messageWriter interface {
+	Write(ctx context.Context, messageType websocket.MessageType, message []byte) error
+}
+
+// proxyResult is the outcome of a proxy direction
+type proxyResult struct {
+	direction string
+	err       error
+}
+
+// reconnectableBackend is the backend side of a proxied connection, which can be replaced
+// by a new connection when the backend closes with a reconnect_on_close_codes status
+type reconnectableBackend struct {
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	settled chan struct{} // Closed once the fate of conn is decided: replaced or closed
+
+	closeTimeout time.Duration // close_handshake_timeout, the lifecycle stops waiting for the backend after it
+}
+
+func newReconnectableBackend(conn *websocket.Conn) *reconnectableBackend {
+	return &reconnectableBackend{
+		conn:    conn,
+		settled: make(chan struct{}),
+	}
+}
+
+// Write writes to the current backend connection. A write failing because the backend went away
+// waits for the lifecycle to decide whether it is replaced, and is retried on the new connection.
+func (b *reconnectableBackend) Write(ctx context.Context, messageType websocket.MessageType, message []byte) error {
+	return b.do(ctx, func(conn *websocket.Conn) error {
+		return conn.Write(ctx, messageType, message)
+	})
+}
+
+// Ping pings the current backend connection, retried on the new connection like Write
+func (b *reconnectableBackend) Ping(ctx context.Context) error {
+	return b.do(ctx, func(conn *websocket.Conn) error {
+		return conn.Ping(ctx)
+	})
+}
+
+// do runs op on the current backend connection. When op fails, it waits for the fate of that
+// connection and runs op again on its replacement, if any.
+func (b *reconnectableBackend) do(ctx context.Context, op func(conn *websocket.Conn) error) error {
+	for {
+		b.mu.Lock()
+		conn, settled := b.conn, b.settled
+		b.mu.Unlock()
+
+		err := op(conn)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-settled:
+		case <-ctx.Done():
+			return err
+		}
+
+		b.mu.Lock()
+		replaced := b.conn != conn
+		b.mu.Unlock()
+		if !replaced {
+			return err
+		}
+	}
+}
+
+// replace swaps in a new backend connection
+func (b *reconnectableBackend) replace(conn *websocket.Conn) {
+	b.mu.Lock()
+	previous := b.conn
+	b.conn = conn
+	close(b.settled)
+	b.settled = make(chan struct{})
+	b.mu.Unlock()
+
+	closeWithin(previous, nil, b.closeTimeout, websocket.StatusNormalClosure, "Reconnected")
+}
+
+// close closes the current backend connection for good
+func (b *reconnectableBackend) close(code websocket.StatusCode, reason string) {
+	b.mu.Lock()
+	conn := b.conn
+	select {
+	case <-b.settled:
+	default:
+		close(b.settled)
+	}
+	b.mu.Unlock()
+
+	closeWithin(conn, nil, b.closeTimeout, code, reason)
+}
+
+// reconnectOnClose returns the close status of err when the backend closed with one of codes
+func reconnectOnClose(err error, codes []int) (websocket.CloseError, bool) {
+	var closeErr websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return closeErr, false
+	}
+
+	for _, code := range codes {
+		if websocket.StatusCode(code) == closeErr.Code {
+			return closeErr, true
+		}
+	}
+	return closeErr, false
+}
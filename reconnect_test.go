@@ -0,0 +1,203 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+// newClosingBackend starts a backend whose first connection echoes one message and then closes
+// with code, while later connections echo every message. Replies are tagged with the connection number.
+func newClosingBackend(t *testing.T, code websocket.StatusCode) (string, *int32) {
+	t.Helper()
+
+	var connections int32
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		n := atomic.AddInt32(&connections, 1)
+
+		for {
+			messageType, message, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if err := conn.Write(ctx, messageType, []byte(fmt.Sprintf("%d:%s", n, message))); err != nil {
+				return
+			}
+			if n == 1 {
+				conn.Close(code, "restarting")
+				return
+			}
+		}
+	})
+
+	return backend.URL, &connections
+}
+
+func TestReconnectOnListedCloseCode(t *testing.T) {
+	backendURL, connections := newClosingBackend(t, websocket.StatusServiceRestart)
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"reconnect_on_close_codes": []interface{}{float64(websocket.StatusServiceRestart)},
+	}, backendURL)
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, expected := range []string{"1:a", "2:b", "2:c"} {
+		if err := client.Write(ctx, websocket.MessageText, []byte(expected[2:])); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+		_, message, err := client.Read(ctx)
+		if err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+		if string(message) != expected {
+			t.Errorf("reply = %q, want %q", message, expected)
+		}
+	}
+
+	if n := atomic.LoadInt32(connections); n != 2 {
+		t.Errorf("backend received %d connections, want 2", n)
+	}
+}
+
+func TestCloseOnUnlistedCloseCode(t *testing.T) {
+	backendURL, connections := newClosingBackend(t, websocket.StatusGoingAway)
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"reconnect_on_close_codes": []interface{}{float64(websocket.StatusServiceRestart)},
+	}, backendURL)
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Write(ctx, websocket.MessageText, []byte("a")); err != nil {
+		t.Fatalf("client write failed: %v", err)
+	}
+	if _, message, err := client.Read(ctx); err != nil || string(message) != "1:a" {
+		t.Fatalf("first reply = %q, %v, want %q", message, err, "1:a")
+	}
+
+	if _, message, err := client.Read(ctx); err == nil {
+		t.Fatalf("client read %q, want the connection to be closed", message)
+	}
+
+	if n := atomic.LoadInt32(connections); n != 1 {
+		t.Errorf("backend received %d connections, want 1", n)
+	}
+}
+
+func TestReconnectOnClose(t *testing.T) {
+	codes := []int{int(websocket.StatusServiceRestart), int(websocket.StatusTryAgainLater)}
+
+	tests := []struct {
+		name      string
+		err       error
+		reconnect bool
+	}{
+		{name: "listed code", err: websocket.CloseError{Code: websocket.StatusServiceRestart}, reconnect: true},
+		{name: "wrapped listed code", err: fmt.Errorf("failed to get reader: %w", websocket.CloseError{Code: websocket.StatusTryAgainLater}), reconnect: true},
+		{name: "unlisted code", err: websocket.CloseError{Code: websocket.StatusNormalClosure}, reconnect: false},
+		{name: "not a close", err: context.Canceled, reconnect: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, reconnect := reconnectOnClose(tt.err, codes); reconnect != tt.reconnect {
+				t.Errorf("reconnectOnClose() = %v, want %v", reconnect, tt.reconnect)
+			}
+		})
+	}
+}
+
+func TestReconnectPreservesSubprotocol(t *testing.T) {
+	tests := []struct {
+		name             string
+		reconnectAccepts string
+		wantClose        websocket.StatusCode
+	}{
+		{name: "same subprotocol", reconnectAccepts: "chat.v1"},
+		{name: "different subprotocol", reconnectAccepts: "chat.v2", wantClose: websocket.StatusProtocolError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var connections int32
+			offered := make(chan string, 2)
+			backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&connections, 1)
+				offered <- r.Header.Get("Sec-WebSocket-Protocol")
+
+				accepts := "chat.v1"
+				if n > 1 {
+					accepts = tt.reconnectAccepts
+				}
+				conn, err := websocket.Accept(rw, r, &websocket.AcceptOptions{Subprotocols: []string{accepts}})
+				if err != nil {
+					return
+				}
+				defer conn.Close(websocket.StatusNormalClosure, "")
+
+				for {
+					messageType, message, err := conn.Read(r.Context())
+					if err != nil {
+						return
+					}
+					if err := conn.Write(r.Context(), messageType, []byte(fmt.Sprintf("%d:%s", n, message))); err != nil {
+						return
+					}
+					if n == 1 {
+						conn.Close(websocket.StatusServiceRestart, "restarting")
+						return
+					}
+				}
+			}))
+			defer backend.Close()
+
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+				"subprotocols":             []interface{}{"chat.v1"},
+				"require_subprotocol":      true,
+				"reconnect_on_close_codes": []interface{}{float64(websocket.StatusServiceRestart)},
+			}, backend.URL)
+			client := dialTestGateway(t, gateway, &websocket.DialOptions{Subprotocols: []string{"chat.v1"}})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := client.Write(ctx, websocket.MessageText, []byte("a")); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+			if _, message, err := client.Read(ctx); err != nil || string(message) != "1:a" {
+				t.Fatalf("first reply = %q, %v, want %q", message, err, "1:a")
+			}
+
+			if tt.wantClose != 0 {
+				if _, message, err := client.Read(ctx); websocket.CloseStatus(err) != tt.wantClose {
+					t.Fatalf("client read %q, %v, want a close with %v", message, err, tt.wantClose)
+				}
+			} else {
+				if err := client.Write(ctx, websocket.MessageText, []byte("b")); err != nil {
+					t.Fatalf("client write failed: %v", err)
+				}
+				if _, message, err := client.Read(ctx); err != nil || string(message) != "2:b" {
+					t.Fatalf("reply after reconnecting = %q, %v, want %q", message, err, "2:b")
+				}
+			}
+
+			for i := 1; i <= 2; i++ {
+				if got := <-offered; got != "chat.v1" {
+					t.Errorf("backend connection %d was offered %q, want chat.v1", i, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// firstFrameBackendContextKey holds the backend selected by the routing directive of the client
+const firstFrameBackendContextKey contextKey = "first-frame-backend"
+
+// routingDirective is the first message of clients under first_frame_routing, e.g. {"route":"chat"}
+type routingDirective struct {
+	Route string `json:"route"`
+}
+
+// Close reasons of clients failing to send a usable routing directive
+const (
+	invalidDirectiveReason = "Invalid routing directive"
+	unknownRouteReason     = "Unknown route"
+	missingDirectiveReason = "Routing directive not received"
+)
+
+// readRoutingDirective reads the first client message and returns the backend its route selects
+// in routes. The directive is consumed: only the messages after it are proxied. A client sending
+// no directive within timeout (0 = no bound), an invalid one or an unknown route gets a
+// proxyCloseError with StatusPolicyViolation.
+func readRoutingDirective(ctx context.Context, pc *proxyConnection, routes map[string]string, timeout time.Duration) (string, error) {
+	// Cancelling a read drops the connection without a close frame, close the client instead
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			pc.closeClient(websocket.StatusPolicyViolation, missingDirectiveReason)
+		})
+	}
+
+	messageType, message, err := pc.client.Read(ctx)
+	if timer != nil && !timer.Stop() {
+		return "", &proxyCloseError{code: websocket.StatusPolicyViolation, reason: missingDirectiveReason}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var directive routingDirective
+	if messageType != websocket.MessageText || json.Unmarshal(message, &directive) != nil || directive.Route == "" {
+		return "", &proxyCloseError{code: websocket.StatusPolicyViolation, reason: invalidDirectiveReason}
+	}
+
+	backendName, ok := routes[directive.Route]
+	if !ok {
+		return "", &proxyCloseError{code: websocket.StatusPolicyViolation, reason: unknownRouteReason}
+	}
+	return backendName, nil
+}
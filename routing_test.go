@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+func TestFirstFrameRouting(t *testing.T) {
+	// Each backend answers the first message it reads, tagged with its name
+	namedBackend := func(name string) *httptest.Server {
+		return newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+			_, message, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			conn.Write(ctx, websocket.MessageText, []byte(name+" "+string(message)))
+			conn.Read(ctx)
+		})
+	}
+
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"chat": "ws" + strings.TrimPrefix(namedBackend("chat").URL, "http"),
+		"game": "ws" + strings.TrimPrefix(namedBackend("game").URL, "http"),
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"handshake_timeout": "500ms",
+		"first_frame_routing": map[string]interface{}{
+			"chat":  "chat",
+			"games": "game",
+		},
+	}, namedBackend("default").URL)
+
+	t.Run("directive selects the backend", func(t *testing.T) {
+		for route, backend := range map[string]string{"chat": "chat", "games": "game"} {
+			client := dialTestGateway(t, gateway, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := client.Write(ctx, websocket.MessageText, []byte(`{"route":"`+route+`"}`)); err != nil {
+				t.Fatalf("failed to send the routing directive: %v", err)
+			}
+			if err := client.Write(ctx, websocket.MessageText, []byte("hello")); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+
+			// The backend reads "hello" first: the directive was not forwarded
+			_, message, err := client.Read(ctx)
+			if err != nil {
+				t.Fatalf("client read failed: %v", err)
+			}
+			if want := backend + " hello"; string(message) != want {
+				t.Errorf("route %s: reply = %q, want %q", route, message, want)
+			}
+		}
+	})
+
+	tests := []struct {
+		name      string
+		directive string
+		reason    string
+	}{
+		{name: "unknown route", directive: `{"route":"admin"}`, reason: unknownRouteReason},
+		{name: "not JSON", directive: `chat`, reason: invalidDirectiveReason},
+		{name: "no route", directive: `{"backend":"chat"}`, reason: invalidDirectiveReason},
+		{name: "no directive", reason: missingDirectiveReason},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialTestGateway(t, gateway, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if tt.directive != "" {
+				if err := client.Write(ctx, websocket.MessageText, []byte(tt.directive)); err != nil {
+					t.Fatalf("failed to send the routing directive: %v", err)
+				}
+			}
+
+			_, _, err := client.Read(ctx)
+			var closeErr websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.StatusPolicyViolation || closeErr.Reason != tt.reason {
+				t.Fatalf("client read = %v, want a close with %v %q", err, websocket.StatusPolicyViolation, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRoutingTimeout(t *testing.T) {
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		conn.Read(ctx)
+	})
+	previousRegistry := globalBackendRegistry
+	globalBackendRegistry = &BackendRegistry{Backends: map[string]string{
+		"chat": "ws" + strings.TrimPrefix(backend.URL, "http"),
+	}}
+	t.Cleanup(func() { globalBackendRegistry = previousRegistry })
+
+	routes := map[string]interface{}{"chat": "chat"}
+
+	t.Run("shorter than the handshake timeout", func(t *testing.T) {
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+			"handshake_timeout":   "10s",
+			"routing_timeout":     "100ms",
+			"first_frame_routing": routes,
+		}, backend.URL)
+		client := dialTestGateway(t, gateway, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		_, _, err := client.Read(ctx)
+		var closeErr websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.StatusPolicyViolation || closeErr.Reason != missingDirectiveReason {
+			t.Fatalf("client read = %v, want a close with %v %q", err, websocket.StatusPolicyViolation, missingDirectiveReason)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("client closed after %s, want routing_timeout and not handshake_timeout", elapsed)
+		}
+	})
+
+	t.Run("longer than the handshake timeout", func(t *testing.T) {
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+			"handshake_timeout":   "100ms",
+			"routing_timeout":     "5s",
+			"first_frame_routing": routes,
+		}, backend.URL)
+		client := dialTestGateway(t, gateway, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		time.Sleep(300 * time.Millisecond)
+		if err := client.Write(ctx, websocket.MessageText, []byte(`{"route":"chat"}`)); err != nil {
+			t.Fatalf("failed to send the routing directive: %v", err)
+		}
+
+		// The connection stays open once routed
+		readCtx, cancelRead := context.WithTimeout(ctx, 300*time.Millisecond)
+		defer cancelRead()
+		if _, _, err := client.Read(readCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("client read = %v, want the connection still open", err)
+		}
+	})
+}
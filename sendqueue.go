@@ -0,0 +1,182 @@
+package websocket
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"nhooyr.io/websocket"
+)
+
+// What a full send queue does with the next message, as configured by overflow_policy
+const (
+	OverflowPolicyBlock      = "block"       // Stop reading until the writer frees a slot
+	OverflowPolicyDropOldest = "drop_oldest" // Drop the oldest buffered message to make room
+	OverflowPolicyClose      = "close"       // Close the connection with StatusPolicyViolation
+)
+
+// errSendQueueOverflow is returned by push under OverflowPolicyClose
+var errSendQueueOverflow = &proxyCloseError{code: websocket.StatusPolicyViolation, reason: "Send queue overflow"}
+
+type queuedMessage struct {
+	messageType websocket.MessageType
+	payload     []byte
+}
+
+// sendQueue decouples the read side of a proxy direction from its write side
+// through a bounded buffer drained by a dedicated writer goroutine.
+// When the buffer is full, push applies the overflow policy, blocking by default until
+// the writer frees a slot.
+type sendQueue struct {
+	ctx      context.Context
+	policy   string
+	write    writeFunc
+	dropped  func(message []byte) // Optional, called with the messages dropped under OverflowPolicyDropOldest
+	messages chan queuedMessage
+	done     chan struct{}
+	err      error
+
+	depth prometheus.Gauge
+	full  prometheus.Counter
+}
+
+// newSendQueue starts the writer goroutine of a queue holding up to size messages.
+// depth and full are optional collectors for the queue occupancy and buffer-full events.
+func newSendQueue(ctx context.Context, size int, policy string, write writeFunc, dropped func(message []byte), depth prometheus.Gauge, full prometheus.Counter) *sendQueue {
+	q := &sendQueue{
+		ctx:      ctx,
+		policy:   policy,
+		write:    write,
+		dropped:  dropped,
+		messages: make(chan queuedMessage, size),
+		done:     make(chan struct{}),
+		depth:    depth,
+		full:     full,
+	}
+
+	go q.run()
+
+	return q
+}
+
+// push enqueues a message, applying the overflow policy when the buffer is full
+func (q *sendQueue) push(messageType websocket.MessageType, message []byte) error {
+	select {
+	case <-q.done:
+		return q.err
+	default:
+	}
+
+	msg := queuedMessage{messageType: messageType, payload: message}
+
+	// Count the message before the writer can take it, so the depth never goes negative
+	q.addDepth(1)
+	select {
+	case q.messages <- msg:
+		return nil
+	default:
+	}
+
+	if q.full != nil {
+		q.full.Inc()
+	}
+
+	switch q.policy {
+	case OverflowPolicyClose:
+		q.addDepth(-1)
+		return errSendQueueOverflow
+	case OverflowPolicyDropOldest:
+		q.dropOldest(msg)
+		return nil
+	}
+
+	select {
+	case q.messages <- msg:
+		return nil
+	case <-q.done:
+		q.addDepth(-1)
+		return q.err
+	case <-q.ctx.Done():
+		q.addDepth(-1)
+		return q.ctx.Err()
+	}
+}
+
+// dropOldest enqueues msg, dropping the oldest buffered messages until it fits. Only push
+// enqueues, so the writer taking messages concurrently can only make room.
+func (q *sendQueue) dropOldest(msg queuedMessage) {
+	for {
+		select {
+		case q.messages <- msg:
+			return
+		default:
+		}
+
+		select {
+		case oldest := <-q.messages:
+			q.addDepth(-1)
+			if q.dropped != nil {
+				q.dropped(oldest.payload)
+			}
+		default:
+		}
+	}
+}
+
+// close waits for the writer goroutine to flush the buffered messages
+func (q *sendQueue) close() error {
+	close(q.messages)
+	<-q.done
+
+	// Discard whatever was left behind by a failed writer
+	for range q.messages {
+		q.addDepth(-1)
+	}
+
+	return q.err
+}
+
+func (q *sendQueue) run() {
+	defer close(q.done)
+
+	for msg := range q.messages {
+		q.addDepth(-1)
+
+		if err := q.write(msg.messageType, msg.payload); err != nil {
+			q.err = err
+			return
+		}
+	}
+}
+
+// addDepth adds delta to the depth gauge. The gauge is shared by every queue of the endpoint
+// and direction, each queue only accounts its own messages.
+func (q *sendQueue) addDepth(delta float64) {
+	if q.depth != nil {
+		q.depth.Add(delta)
+	}
+}
+
+// closeStalledDirection closes both peers of a direction whose messages pile up behind a stalled
+// destination. Its send queue cannot be flushed, keeping proxyMessages from returning to the
+// lifecycle closing the peers, until that destination is closed.
+func closeStalledDirection(pc *proxyConnection, src *websocket.Conn, dest messageWriter, closeErr *proxyCloseError) {
+	if src == pc.client {
+		pc.closeClient(closeErr.code, closeErr.reason)
+	} else {
+		src.Close(closeErr.code, closeErr.reason)
+	}
+
+	switch dest := dest.(type) {
+	case *reconnectableBackend:
+		dest.close(closeErr.code, closeErr.reason)
+	case *fanoutWriter:
+		dest.primary.close(closeErr.code, closeErr.reason)
+		dest.close(closeErr.code, closeErr.reason)
+	case *websocket.Conn:
+		if dest == pc.client {
+			pc.closeClient(closeErr.code, closeErr.reason)
+		} else {
+			dest.Close(closeErr.code, closeErr.reason)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+)
+
+func TestParseWebSocketConfigSendQueue(t *testing.T) {
+	cfg, _ := parseWebSocketConfig(map[string]interface{}{
+		ConfigNamespace: map[string]interface{}{
+			"send_queue_size": 64.0,
+		},
+	})
+
+	if cfg.SendQueueSize != 64 {
+		t.Errorf("SendQueueSize = %v, want %v", cfg.SendQueueSize, 64)
+	}
+}
+
+func TestSendQueueMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	depth, full := metrics.sendQueueInstruments("/ws", directionBackendToClient)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	written := make(chan string, 10)
+
+	write := func(messageType websocket.MessageType, message []byte) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		written <- string(message)
+		return nil
+	}
+
+	queue := newSendQueue(context.Background(), 2, OverflowPolicyBlock, write, nil, depth, full)
+
+	// The first message is picked up by the writer, which then blocks
+	queue.push(websocket.MessageText, []byte("1"))
+	<-started
+
+	// The next two fill the buffer
+	queue.push(websocket.MessageText, []byte("2"))
+	queue.push(websocket.MessageText, []byte("3"))
+
+	if got := testutil.ToFloat64(depth); got != 2 {
+		t.Errorf("queue depth = %v, want 2", got)
+	}
+
+	if got := testutil.ToFloat64(full); got != 0 {
+		t.Errorf("queue full events = %v, want 0", got)
+	}
+
+	// The fourth one finds the buffer full and blocks
+	pushed := make(chan error)
+	go func() {
+		pushed <- queue.push(websocket.MessageText, []byte("4"))
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatalf("push on a full queue did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if got := testutil.ToFloat64(full); got != 1 {
+		t.Errorf("queue full events = %v, want 1", got)
+	}
+
+	close(release)
+
+	if err := <-pushed; err != nil {
+		t.Fatalf("blocked push failed: %v", err)
+	}
+
+	if err := queue.close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	for _, expected := range []string{"1", "2", "3", "4"} {
+		if got := <-written; got != expected {
+			t.Errorf("written message = %s, want %s", got, expected)
+		}
+	}
+
+	if got := testutil.ToFloat64(depth); got != 0 {
+		t.Errorf("queue depth after close = %v, want 0", got)
+	}
+}
+
+func TestSendQueueDepthSharedAcrossConnections(t *testing.T) {
+	// Every connection of an endpoint and direction gets the same gauge
+	metrics := NewMetrics()
+	depth, full := metrics.sendQueueInstruments("/ws", directionBackendToClient)
+
+	newStalledQueue := func() (*sendQueue, chan struct{}) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		write := func(messageType websocket.MessageType, message []byte) error {
+			select {
+			case <-started:
+			default:
+				close(started)
+			}
+			<-release
+			return nil
+		}
+		queue := newSendQueue(context.Background(), 4, OverflowPolicyBlock, write, nil, depth, full)
+
+		// The first message is held by the writer, the next ones stay queued
+		queue.push(websocket.MessageText, []byte("held"))
+		<-started
+		return queue, release
+	}
+
+	first, releaseFirst := newStalledQueue()
+	second, releaseSecond := newStalledQueue()
+	for i := 0; i < 3; i++ {
+		first.push(websocket.MessageText, []byte("first"))
+	}
+	second.push(websocket.MessageText, []byte("second"))
+
+	if got := testutil.ToFloat64(depth); got != 4 {
+		t.Errorf("queue depth = %v, want the 4 messages queued by both connections", got)
+	}
+
+	// The second connection going away leaves the depth of the first one
+	close(releaseSecond)
+	if err := second.close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if got := testutil.ToFloat64(depth); got != 3 {
+		t.Errorf("queue depth after the second connection closed = %v, want 3", got)
+	}
+
+	close(releaseFirst)
+	if err := first.close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	if got := testutil.ToFloat64(depth); got != 0 {
+		t.Errorf("queue depth after both connections closed = %v, want 0", got)
+	}
+}
+
+func TestSendQueueProxying(t *testing.T) {
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		for {
+			messageType, message, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if err := conn.Write(ctx, messageType, message); err != nil {
+				return
+			}
+		}
+	})
+
+	factory := NewHandlerFactoryWithMetrics(logging.NoOp, NewMetrics())
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"send_queue_size": 4.0,
+	}, backend.URL)
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for _, message := range []string{"a", "b", "c"} {
+		if err := client.Write(ctx, websocket.MessageText, []byte(message)); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+	}
+
+	for _, expected := range []string{"a", "b", "c"} {
+		_, message, err := client.Read(ctx)
+		if err != nil {
+			t.Fatalf("client read failed: %v", err)
+		}
+		if string(message) != expected {
+			t.Errorf("echoed message = %s, want %s", message, expected)
+		}
+	}
+}
+
+func TestSendQueueOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		err     error
+		written []string
+		dropped []string
+	}{
+		{policy: OverflowPolicyDropOldest, written: []string{"1", "3", "4"}, dropped: []string{"2"}},
+		{policy: OverflowPolicyClose, err: errSendQueueOverflow, written: []string{"1", "2", "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			started := make(chan struct{}, 1)
+			release := make(chan struct{})
+			var written, dropped []string
+
+			write := func(messageType websocket.MessageType, message []byte) error {
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+				<-release
+				written = append(written, string(message))
+				return nil
+			}
+			drop := func(message []byte) {
+				dropped = append(dropped, string(message))
+			}
+
+			queue := newSendQueue(context.Background(), 2, tt.policy, write, drop, nil, nil)
+
+			// The writer blocks on the first message, the next two fill the buffer
+			queue.push(websocket.MessageText, []byte("1"))
+			<-started
+			queue.push(websocket.MessageText, []byte("2"))
+			queue.push(websocket.MessageText, []byte("3"))
+
+			// The fourth one overflows without blocking
+			pushed := make(chan error, 1)
+			go func() {
+				pushed <- queue.push(websocket.MessageText, []byte("4"))
+			}()
+			select {
+			case err := <-pushed:
+				if !errors.Is(err, tt.err) {
+					t.Errorf("push on a full queue = %v, want %v", err, tt.err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("push on a full queue blocked")
+			}
+
+			close(release)
+			queue.close()
+
+			if strings.Join(written, ",") != strings.Join(tt.written, ",") {
+				t.Errorf("written messages = %v, want %v", written, tt.written)
+			}
+			if strings.Join(dropped, ",") != strings.Join(tt.dropped, ",") {
+				t.Errorf("dropped messages = %v, want %v", dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestSendQueueOverflowClose(t *testing.T) {
+	// The backend floods a client that never reads, until the queue overflows
+	closed := make(chan error, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		go func() {
+			payload := make([]byte, 64*1024)
+			for conn.Write(ctx, websocket.MessageBinary, payload) == nil {
+			}
+		}()
+		_, _, err := conn.Read(ctx)
+		closed <- err
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"send_queue_size":         float64(4),
+		"overflow_policy":         OverflowPolicyClose,
+		"close_handshake_timeout": "200ms",
+	}, backend.URL)
+	rawWebSocketConn(t, gateway)
+
+	select {
+	case err := <-closed:
+		var closeErr websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.StatusPolicyViolation || closeErr.Reason != errSendQueueOverflow.reason {
+			t.Fatalf("backend read = %v, want a close with %v %q", err, websocket.StatusPolicyViolation, errSendQueueOverflow.reason)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("backend not closed while the client stalled the writes")
+	}
+}
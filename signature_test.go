@@ -0,0 +1,145 @@
+package websocket
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+const testSignatureSecret = "s3cr3t"
+
+func signedAuthHeaders(headers map[string][]string) map[string][]string {
+	signed := map[string][]string{}
+	for key, values := range headers {
+		signed[key] = values
+	}
+	signed[AuthSignatureHeader] = []string{hex.EncodeToString(signAuthHeaders(headers, testSignatureSecret))}
+	return signed
+}
+
+func TestVerifyAuthSignature(t *testing.T) {
+	valid := signedAuthHeaders(map[string][]string{
+		"X-User-Id":     {"42"},
+		"X-User-Groups": {"admin", "staff"},
+	})
+
+	tampered := signedAuthHeaders(map[string][]string{
+		"X-User-Id": {"42"},
+	})
+	tampered["X-User-Id"] = []string{"1"}
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string][]string
+		err     error
+	}{
+		{name: "valid", headers: valid},
+		{name: "no auth headers", headers: map[string][]string{}},
+		{name: "tampered value", headers: tampered, err: errInvalidAuthSignature},
+		{name: "missing signature", headers: map[string][]string{"X-User-Id": {"42"}}, err: errMissingAuthSignature},
+		{name: "malformed signature", headers: map[string][]string{"X-User-Id": {"42"}, AuthSignatureHeader: {"zz"}}, err: errInvalidAuthSignature},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := verifyAuthSignature(tc.headers, testSignatureSecret); err != tc.err {
+				t.Errorf("verifyAuthSignature() = %v, want %v", err, tc.err)
+			}
+		})
+	}
+
+	if err := verifyAuthSignature(valid, "other"); err != errInvalidAuthSignature {
+		t.Errorf("verifyAuthSignature() with another secret = %v, want %v", err, errInvalidAuthSignature)
+	}
+}
+
+func TestAuthSignatureSecretIsRedacted(t *testing.T) {
+	cfg, _ := parseWebSocketConfig(map[string]interface{}{
+		ConfigNamespace: map[string]interface{}{
+			"auth_signature_secret": testSignatureSecret,
+		},
+	})
+
+	if string(cfg.AuthSignatureSecret) != testSignatureSecret {
+		t.Errorf("AuthSignatureSecret = %q, want %q", string(cfg.AuthSignatureSecret), testSignatureSecret)
+	}
+	if printed := fmt.Sprintf("%+v", cfg); strings.Contains(printed, testSignatureSecret) {
+		t.Errorf("printed configuration leaks the secret: %s", printed)
+	}
+}
+
+func TestAuthSignatureUpgrade(t *testing.T) {
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		conn.Read(ctx)
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"auth_signature_secret": testSignatureSecret,
+	}, backend.URL)
+
+	tampered := signedAuthHeaders(map[string][]string{"X-User-Id": {"42"}})
+	tampered["X-User-Id"] = []string{"1"}
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string][]string
+		allowed bool
+	}{
+		{name: "valid signature", headers: signedAuthHeaders(map[string][]string{"X-User-Id": {"42"}}), allowed: true},
+		{name: "tampered signature", headers: tampered, allowed: false},
+		{name: "unsigned auth headers", headers: map[string][]string{"X-User-Id": {"42"}}, allowed: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			conn, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", &websocket.DialOptions{
+				HTTPHeader: http.Header(tc.headers),
+			})
+			if tc.allowed {
+				if err != nil {
+					t.Fatalf("upgrade with a valid signature failed: %v", err)
+				}
+				conn.Close(websocket.StatusNormalClosure, "")
+				return
+			}
+
+			if err == nil {
+				conn.Close(websocket.StatusNormalClosure, "")
+				t.Fatalf("upgrade with an invalid signature succeeded")
+			}
+			if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("response = %v, want status %d", resp, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestAuthSignatureWithCustomPrefixes(t *testing.T) {
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		conn.Read(ctx)
+	})
+
+	// X-Auth-Signature matches none of the configured prefixes
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"auth_signature_secret":   testSignatureSecret,
+		"forward_header_prefixes": []interface{}{"X-User-", "X-Org-"},
+	}, backend.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	headers := signedAuthHeaders(map[string][]string{"X-User-Id": {"42"}, "X-Org-Id": {"7"}})
+	conn, resp, err := websocket.Dial(ctx, gateway.URL+"/ws", &websocket.DialOptions{
+		HTTPHeader: http.Header(headers),
+	})
+	if err != nil {
+		t.Fatalf("upgrade with a valid signature failed: %v (response %v)", err, resp)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}
@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// connStats accumulates the traffic of a single client connection. Payload counters hold the
+// uncompressed message bytes proxied in each direction, wire counters the bytes actually read
+// from and written to the client socket, i.e. after permessage-deflate and including framing.
+type connStats struct {
+	payloadIn  int64 // Message bytes received from the client (client->backend)
+	payloadOut int64 // Message bytes sent to the client (backend->client)
+	wireIn     int64 // Socket bytes read from the client
+	wireOut    int64 // Socket bytes written to the client
+}
+
+// addPayload records a proxied message of n bytes
+func (s *connStats) addPayload(direction string, n int) {
+	if direction == directionClientToBackend {
+		atomic.AddInt64(&s.payloadIn, int64(n))
+		return
+	}
+	atomic.AddInt64(&s.payloadOut, int64(n))
+}
+
+// bytes returns the payload and wire byte counts of a direction
+func (s *connStats) bytes(direction string) (payload, wire int64) {
+	if direction == directionClientToBackend {
+		return atomic.LoadInt64(&s.payloadIn), atomic.LoadInt64(&s.wireIn)
+	}
+	return atomic.LoadInt64(&s.payloadOut), atomic.LoadInt64(&s.wireOut)
+}
+
+// compressionRatio returns the payload to wire bytes ratio of a direction, 0 when nothing was sent.
+// Frame headers and control frames count as wire bytes, so an uncompressed stream reports slightly below 1.
+func (s *connStats) compressionRatio(direction string) float64 {
+	payload, wire := s.bytes(direction)
+	if wire == 0 {
+		return 0
+	}
+	return float64(payload) / float64(wire)
+}
+
+// accessLogLine summarises a finished connection
+func (s *connStats) accessLogLine(duration time.Duration) string {
+	payloadIn, wireIn := s.bytes(directionClientToBackend)
+	payloadOut, wireOut := s.bytes(directionBackendToClient)
+
+	return fmt.Sprintf("Connection closed duration=%s bytes_in=%d wire_bytes_in=%d compression_ratio_in=%.2f bytes_out=%d wire_bytes_out=%d compression_ratio_out=%.2f",
+		duration.Round(time.Millisecond),
+		payloadIn, wireIn, s.compressionRatio(directionClientToBackend),
+		payloadOut, wireOut, s.compressionRatio(directionBackendToClient))
+}
+
+// Access log fields emitted through a StructuredLogger. Keys and value types are stable.
+const (
+	accessLogConnID     = "conn_id"     // string
+	accessLogEndpoint   = "endpoint"    // string
+	accessLogBackend    = "backend"     // string, the dialed backend URL, empty when the dial failed
+	accessLogClientIP   = "client_ip"   // string
+	accessLogDurationMs = "duration_ms" // int64
+	accessLogBytesUp    = "bytes_up"    // int64, message bytes received from the client
+	accessLogBytesDown  = "bytes_down"  // int64, message bytes sent to the client
+	accessLogCloseCode  = "close_code"  // int, status the client connection was closed with
+)
+
+// accessLogFields summarises a finished connection as structured fields
+func accessLogFields(pc *proxyConnection, backend backendTarget, duration time.Duration) map[string]interface{} {
+	bytesUp, _ := pc.stats.bytes(directionClientToBackend)
+	bytesDown, _ := pc.stats.bytes(directionBackendToClient)
+
+	return map[string]interface{}{
+		accessLogConnID:     pc.id,
+		accessLogEndpoint:   pc.endpoint,
+		accessLogBackend:    backend.url,
+		accessLogClientIP:   pc.clientIP,
+		accessLogDurationMs: duration.Milliseconds(),
+		accessLogBytesUp:    bytesUp,
+		accessLogBytesDown:  bytesDown,
+		accessLogCloseCode:  int(pc.clientCloseCode()),
+	}
+}
+
+// countingConn counts the bytes read from and written to a net.Conn
+type countingConn struct {
+	net.Conn
+	read    *int64
+	written *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+// countingResponseWriter hands a countingConn to websocket.Accept so the wire traffic
+// of the client connection is recorded in stats
+type countingResponseWriter struct {
+	gin.ResponseWriter
+	stats *connStats
+	conn  net.Conn // The hijacked connection, nil before the accept
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.ResponseWriter.Hijack()
+	if err != nil {
+		return conn, brw, err
+	}
+
+	counted := &countingConn{Conn: conn, read: &w.stats.wireIn, written: &w.stats.wireOut}
+
+	// The buffered writer targets the raw conn, route it through the counter as well.
+	// Reads already go through the returned conn once the buffered bytes are consumed.
+	if err := brw.Writer.Flush(); err != nil {
+		return conn, brw, err
+	}
+	brw.Writer.Reset(counted)
+	w.conn = counted
+
+	return counted, brw, nil
+}
@@ -0,0 +1,176 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestConnStatsCompressionRatio(t *testing.T) {
+	stats := &connStats{}
+
+	if got := stats.compressionRatio(directionClientToBackend); got != 0 {
+		t.Errorf("ratio without traffic = %v, want 0", got)
+	}
+
+	stats.addPayload(directionClientToBackend, 1000)
+	stats.wireIn = 250
+	stats.addPayload(directionBackendToClient, 100)
+	stats.wireOut = 100
+
+	if got := stats.compressionRatio(directionClientToBackend); got != 4 {
+		t.Errorf("client->backend ratio = %v, want 4", got)
+	}
+	if got := stats.compressionRatio(directionBackendToClient); got != 1 {
+		t.Errorf("backend->client ratio = %v, want 1", got)
+	}
+}
+
+func TestAccessLogCompressionRatio(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		compression websocket.CompressionMode
+		compressed  bool
+	}{
+		{name: "permessage-deflate", compression: websocket.CompressionContextTakeover, compressed: true},
+		{name: "uncompressed", compression: websocket.CompressionDisabled, compressed: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+				messageType, message, err := conn.Read(ctx)
+				if err != nil {
+					return
+				}
+				conn.Write(ctx, messageType, message)
+				conn.Read(ctx)
+			})
+
+			recorder := &testLogger{}
+			gateway := newTestGateway(t, NewHandlerFactory(recorder), map[string]interface{}{
+				"compression": true,
+			}, backend.URL)
+			client := dialTestGateway(t, gateway, &websocket.DialOptions{
+				CompressionMode: tc.compression,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			payload := bytes.Repeat([]byte("compressible "), 2000)
+			if err := client.Write(ctx, websocket.MessageText, payload); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+			if _, _, err := client.Read(ctx); err != nil {
+				t.Fatalf("client read failed: %v", err)
+			}
+			client.Close(websocket.StatusNormalClosure, "")
+
+			var line string
+			for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if lines := recorder.Contains("Connection closed duration="); len(lines) > 0 {
+					line = lines[0]
+					break
+				}
+			}
+			if line == "" {
+				t.Fatalf("access log line not found: %v", recorder.Lines())
+			}
+
+			for _, field := range []string{"bytes_in", "bytes_out"} {
+				match := regexp.MustCompile(` ` + field + `=(\d+) `).FindStringSubmatch(line)
+				if match == nil || match[1] != strconv.Itoa(len(payload)) {
+					t.Errorf("access log %q does not report %s=%d", line, field, len(payload))
+				}
+			}
+
+			for _, field := range []string{"compression_ratio_in", "compression_ratio_out"} {
+				match := regexp.MustCompile(field + `=([0-9.]+)`).FindStringSubmatch(line)
+				if match == nil {
+					t.Fatalf("access log %q is missing %s", line, field)
+				}
+				ratio, _ := strconv.ParseFloat(match[1], 64)
+
+				if tc.compressed && ratio < 10 {
+					t.Errorf("%s = %v, want a ratio above 10 for repetitive payloads", field, ratio)
+				}
+				if !tc.compressed && (ratio > 1 || ratio < 0.9) {
+					t.Errorf("%s = %v, want slightly below 1 without compression", field, ratio)
+				}
+			}
+		})
+	}
+}
+
+// structuredTestLogger records the structured log entries on top of the formatted lines
+type structuredTestLogger struct {
+	testLogger
+	fields []map[string]interface{}
+}
+
+func (l *structuredTestLogger) InfoFields(message string, fields map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, "INFO: "+message)
+	l.fields = append(l.fields, fields)
+}
+
+// Fields returns a copy of the recorded structured entries
+func (l *structuredTestLogger) Fields() []map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]map[string]interface{}(nil), l.fields...)
+}
+
+func TestStructuredAccessLog(t *testing.T) {
+	backendURL := newEchoBackend(t)
+	recorder := &structuredTestLogger{}
+	gateway := newTestGateway(t, NewHandlerFactory(recorder), map[string]interface{}{}, backendURL)
+	client := dialTestGateway(t, gateway, nil)
+
+	exchangeMessages(t, client, "hello", "world!")
+	client.Close(websocket.StatusNormalClosure, "")
+
+	var fields map[string]interface{}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if entries := recorder.Fields(); len(entries) > 0 {
+			fields = entries[0]
+			break
+		}
+	}
+	if fields == nil {
+		t.Fatalf("structured access log not emitted: %v", recorder.Lines())
+	}
+	if lines := recorder.Contains("Connection closed duration="); len(lines) > 0 {
+		t.Errorf("formatted access log emitted alongside the fields: %v", lines)
+	}
+
+	for key, want := range map[string]interface{}{
+		"endpoint":   "/ws",
+		"backend":    strings.Replace(backendURL, "http://", "ws://", 1) + "/ws",
+		"client_ip":  "127.0.0.1",
+		"bytes_up":   int64(len("hello") + len("world!")),
+		"bytes_down": int64(len("hello") + len("world!")),
+		"close_code": int(websocket.StatusNormalClosure),
+	} {
+		if got := fields[key]; got != want {
+			t.Errorf("%s = %#v, want %#v", key, got, want)
+		}
+	}
+
+	if id, ok := fields["conn_id"].(string); !ok || id == "" {
+		t.Errorf("conn_id = %#v, want a non-empty string", fields["conn_id"])
+	}
+	if _, ok := fields["duration_ms"].(int64); !ok {
+		t.Errorf("duration_ms = %#v, want an int64", fields["duration_ms"])
+	}
+	if len(fields) != 8 {
+		t.Errorf("access log has %d fields, want the 8 of the schema: %v", len(fields), fields)
+	}
+}
@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timeouts gathers the timeouts of a connection, as set by the timeouts block of the endpoint
+// configuration. Each of them is the value of a flat configuration key.
+type Timeouts struct {
+	Handshake   time.Duration `json:"handshake"`    // handshake_timeout
+	Idle        time.Duration `json:"idle"`         // idle_timeout
+	ClientIdle  time.Duration `json:"client_idle"`  // client_idle_timeout
+	BackendIdle time.Duration `json:"backend_idle"` // backend_idle_timeout
+	Read        time.Duration `json:"read"`         // max_single_read_duration
+	Write       time.Duration `json:"write"`        // write_timeout
+}
+
+// timeouts returns the timeouts of cfg
+func (cfg Config) timeouts() Timeouts {
+	return Timeouts{
+		Handshake:   cfg.HandshakeTimeout,
+		Idle:        cfg.IdleTimeout,
+		ClientIdle:  cfg.ClientIdleTimeout,
+		BackendIdle: cfg.BackendIdleTimeout,
+		Read:        cfg.MaxSingleReadDuration,
+		Write:       cfg.WriteTimeout,
+	}
+}
+
+// setTimeouts sets the timeouts of cfg to t
+func (cfg *Config) setTimeouts(t Timeouts) {
+	cfg.HandshakeTimeout = t.Handshake
+	cfg.IdleTimeout = t.Idle
+	cfg.ClientIdleTimeout = t.ClientIdle
+	cfg.BackendIdleTimeout = t.BackendIdle
+	cfg.MaxSingleReadDuration = t.Read
+	cfg.WriteTimeout = t.Write
+}
+
+// parseTimeouts returns base with the durations set in a timeouts block. Keys missing from the
+// block, or not holding a Go duration, keep their base value.
+func parseTimeouts(block map[string]interface{}, base Timeouts) Timeouts {
+	durations := map[string]*time.Duration{
+		"handshake":    &base.Handshake,
+		"idle":         &base.Idle,
+		"client_idle":  &base.ClientIdle,
+		"backend_idle": &base.BackendIdle,
+		"read":         &base.Read,
+		"write":        &base.Write,
+	}
+	for key, field := range durations {
+		if durationStr, ok := block[key].(string); ok {
+			if duration, err := time.ParseDuration(durationStr); err == nil {
+				*field = duration
+			}
+		}
+	}
+	return base
+}
+
+// validate returns a warning for every pair of timeouts where one can never trigger because
+// another always fires first
+func (t Timeouts) validate() []string {
+	var warnings []string
+
+	// The idle timers are only reset once a message is fully read, so a message arriving more
+	// slowly than the idle timeout is closed as idle before its read bound
+	idles := []struct {
+		key     string
+		timeout time.Duration
+	}{
+		{"idle_timeout", t.Idle},
+		{"client_idle_timeout", t.ClientIdle},
+		{"backend_idle_timeout", t.BackendIdle},
+	}
+	for _, idle := range idles {
+		if t.Read > 0 && idle.timeout > 0 && t.Read >= idle.timeout {
+			warnings = append(warnings, fmt.Sprintf("max_single_read_duration of %s is not below %s of %s: slow messages are closed as idle first", t.Read, idle.key, idle.timeout))
+		}
+	}
+
+	// Writes do not reset idle_timeout, so a write stalling longer is closed as idle first
+	if t.Write > 0 && t.Idle > 0 && t.Write >= t.Idle {
+		warnings = append(warnings, fmt.Sprintf("write_timeout of %s is not below idle_timeout of %s: stalled writes are closed as idle first", t.Write, t.Idle))
+	}
+
+	return warnings
+}
@@ -0,0 +1,84 @@
+package websocket
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWebSocketConfigTimeouts(t *testing.T) {
+	cfg, _ := parseWebSocketConfig(map[string]interface{}{
+		ConfigNamespace: map[string]interface{}{
+			"write_timeout":       "1s",
+			"client_idle_timeout": "1m",
+			"timeouts": map[string]interface{}{
+				"handshake":    "5s",
+				"idle":         "2m",
+				"backend_idle": "90s",
+				"read":         "10s",
+				"write":        "5s",
+			},
+		},
+	})
+
+	expected := Timeouts{
+		Handshake:   5 * time.Second,
+		Idle:        2 * time.Minute,
+		ClientIdle:  time.Minute,
+		BackendIdle: 90 * time.Second,
+		Read:        10 * time.Second,
+		Write:       5 * time.Second,
+	}
+	if got := cfg.timeouts(); got != expected {
+		t.Errorf("timeouts = %+v, want %+v", got, expected)
+	}
+}
+
+func TestTimeoutsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts Timeouts
+		warnings []string
+	}{
+		{
+			name:     "consistent",
+			timeouts: Timeouts{Handshake: 10 * time.Second, Idle: time.Minute, ClientIdle: 30 * time.Second, Read: 5 * time.Second, Write: 5 * time.Second},
+		},
+		{
+			name:     "unbounded idleness",
+			timeouts: Timeouts{Read: time.Minute, Write: time.Minute},
+		},
+		{
+			name:     "read not below idle",
+			timeouts: Timeouts{Idle: 30 * time.Second, Read: 30 * time.Second},
+			warnings: []string{"max_single_read_duration of 30s is not below idle_timeout of 30s"},
+		},
+		{
+			name:     "read above the idle of both directions",
+			timeouts: Timeouts{ClientIdle: 10 * time.Second, BackendIdle: 20 * time.Second, Read: time.Minute},
+			warnings: []string{
+				"max_single_read_duration of 1m0s is not below client_idle_timeout of 10s",
+				"max_single_read_duration of 1m0s is not below backend_idle_timeout of 20s",
+			},
+		},
+		{
+			name:     "write above idle",
+			timeouts: Timeouts{Idle: 10 * time.Second, Write: time.Minute},
+			warnings: []string{"write_timeout of 1m0s is not below idle_timeout of 10s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings := tt.timeouts.validate()
+			if len(warnings) != len(tt.warnings) {
+				t.Fatalf("validate() = %q, want %d warnings", warnings, len(tt.warnings))
+			}
+			for i, want := range tt.warnings {
+				if !strings.Contains(warnings[i], want) {
+					t.Errorf("warning %d = %q, want it to contain %q", i, warnings[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing of proxied sessions through the global OpenTelemetry tracer provider, a no-op until the
+// gateway registers one
+const (
+	tracerName       = "github.com/unacademy/krakend-websocket"
+	proxySpanName    = "websocket.proxy"
+	messageEventName = "websocket.message"
+)
+
+// Attributes of the websocket.proxy span
+const (
+	spanAttrEndpoint    = "websocket.endpoint"
+	spanAttrBackendURL  = "websocket.backend_url"
+	spanAttrSubprotocol = "websocket.subprotocol"
+	spanAttrCloseCode   = "websocket.close_code"
+	spanAttrBytesUp     = "websocket.bytes_up"
+	spanAttrBytesDown   = "websocket.bytes_down"
+)
+
+// Attributes of the websocket.message events of verbose_tracing
+const (
+	eventAttrDirection = "websocket.direction"
+	eventAttrSize      = "websocket.message_size"
+)
+
+// traceContext reads and writes the W3C traceparent and tracestate headers
+var traceContext = propagation.TraceContext{}
+
+// sampleTrace decides, when the client is accepted, whether its session is traced. An upgrade
+// request carrying a trace context is traced when that context is sampled, the others at rate.
+func sampleTrace(r *http.Request, rate float64) bool {
+	incoming := trace.SpanContextFromContext(traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header)))
+	if incoming.IsValid() {
+		return incoming.IsSampled()
+	}
+	return sampleConnection(rate)
+}
+
+// startProxySpan starts the span of a proxied session, as a child of the trace context of the
+// upgrade request, and injects it into the headers sent to the backend. Without a tracer provider,
+// or for sessions not traced, the incoming traceparent is forwarded as is.
+func startProxySpan(r *http.Request, pc *proxyConnection, subprotocol string, forwardHeaders map[string][]string) (context.Context, trace.Span) {
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	if !pc.traced {
+		traceContext.Inject(ctx, propagation.HeaderCarrier(forwardHeaders))
+		return ctx, trace.SpanFromContext(ctx)
+	}
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, proxySpanName,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String(spanAttrEndpoint, pc.endpoint),
+			attribute.String(spanAttrSubprotocol, subprotocol),
+		),
+	)
+
+	traceContext.Inject(ctx, propagation.HeaderCarrier(forwardHeaders))
+	return ctx, span
+}
+
+// addMessageEvent adds a proxied message to the span of ctx under verbose_tracing
+func addMessageEvent(ctx context.Context, direction string, size int) {
+	trace.SpanFromContext(ctx).AddEvent(messageEventName, trace.WithAttributes(
+		attribute.String(eventAttrDirection, direction),
+		attribute.Int(eventAttrSize, size),
+	))
+}
+
+// endProxySpan records the outcome of a proxied session on its span and ends it
+func endProxySpan(span trace.Span, pc *proxyConnection, backend backendTarget) {
+	bytesUp, _ := pc.stats.bytes(directionClientToBackend)
+	bytesDown, _ := pc.stats.bytes(directionBackendToClient)
+
+	span.SetAttributes(
+		attribute.String(spanAttrBackendURL, backend.url),
+		attribute.Int(spanAttrCloseCode, int(pc.clientCloseCode())),
+		attribute.Int64(spanAttrBytesUp, bytesUp),
+		attribute.Int64(spanAttrBytesDown, bytesDown),
+	)
+	span.End()
+}
@@ -0,0 +1,315 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"nhooyr.io/websocket"
+)
+
+// incomingTraceparent is the trace context of the upgrade requests of the tracing tests
+const incomingTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// traceparentBackend echoes messages and reports the traceparent of its upgrade request on traceparents
+func traceparentBackend(t *testing.T, traceparents chan<- string) string {
+	t.Helper()
+
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		traceparents <- r.Header.Get("Traceparent")
+		for {
+			messageType, message, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			if err := conn.Write(ctx, messageType, message); err != nil {
+				return
+			}
+		}
+	})
+	return backend.URL
+}
+
+// recordSpans registers a global tracer provider recording the spans in memory for the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	// The global provider cannot be unset, a no-op one behaves as none registered
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+
+	return recorder
+}
+
+func TestProxySpan(t *testing.T) {
+	recorder := recordSpans(t)
+
+	traceparents := make(chan string, 1)
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"subprotocols": []interface{}{"chat.v1"},
+	}, traceparentBackend(t, traceparents))
+
+	client := dialTestGateway(t, gateway, &websocket.DialOptions{
+		Subprotocols: []string{"chat.v1"},
+		HTTPHeader:   http.Header{"Traceparent": {incomingTraceparent}},
+	})
+	exchangeMessages(t, client, "hello")
+	client.Close(websocket.StatusNormalClosure, "")
+
+	var spans []sdktrace.ReadOnlySpan
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if spans = recorder.Ended(); len(spans) > 0 {
+			break
+		}
+	}
+	if len(spans) != 1 {
+		t.Fatalf("ended spans = %d, want the session span", len(spans))
+	}
+	span := spans[0]
+
+	incoming, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	if span.Name() != proxySpanName || span.SpanContext().TraceID() != incoming || span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("span %s in trace %s with parent %s, want %s continuing the incoming trace", span.Name(), span.SpanContext().TraceID(), span.Parent().SpanID(), proxySpanName)
+	}
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if got := attrs[spanAttrEndpoint].AsString(); got != "/ws" {
+		t.Errorf("%s = %q, want /ws", spanAttrEndpoint, got)
+	}
+	if got := attrs[spanAttrSubprotocol].AsString(); got != "chat.v1" {
+		t.Errorf("%s = %q, want chat.v1", spanAttrSubprotocol, got)
+	}
+	if got := attrs[spanAttrBackendURL].AsString(); got == "" {
+		t.Errorf("%s is empty, want the dialed backend URL", spanAttrBackendURL)
+	}
+	if got := attrs[spanAttrCloseCode].AsInt64(); got != int64(websocket.StatusNormalClosure) {
+		t.Errorf("%s = %d, want %d", spanAttrCloseCode, got, websocket.StatusNormalClosure)
+	}
+	if up, down := attrs[spanAttrBytesUp].AsInt64(), attrs[spanAttrBytesDown].AsInt64(); up != 5 || down != 5 {
+		t.Errorf("span bytes = %d up, %d down, want 5 each way", up, down)
+	}
+
+	// The backend sees the session span as the parent of its upgrade
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + span.SpanContext().SpanID().String() + "-01"
+	if got := <-traceparents; got != want {
+		t.Errorf("backend traceparent = %q, want %q", got, want)
+	}
+}
+
+func TestProxySpanWithoutTracerProvider(t *testing.T) {
+	traceparents := make(chan string, 1)
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{}, traceparentBackend(t, traceparents))
+
+	t.Run("incoming traceparent forwarded", func(t *testing.T) {
+		client := dialTestGateway(t, gateway, &websocket.DialOptions{
+			HTTPHeader: http.Header{"Traceparent": {incomingTraceparent}},
+		})
+		exchangeMessages(t, client, "hello")
+		if got := <-traceparents; got != incomingTraceparent {
+			t.Errorf("backend traceparent = %q, want %q", got, incomingTraceparent)
+		}
+	})
+
+	t.Run("no traceparent", func(t *testing.T) {
+		client := dialTestGateway(t, gateway, nil)
+		exchangeMessages(t, client, "hello")
+		if got := <-traceparents; got != "" {
+			t.Errorf("backend traceparent = %q, want none", got)
+		}
+	})
+}
+
+func TestSampleTrace(t *testing.T) {
+	withTraceparent := func(traceparent string) *http.Request {
+		req := newUpgradeRequest("/ws")
+		req.Header.Set("Traceparent", traceparent)
+		return req
+	}
+
+	if !sampleTrace(withTraceparent(incomingTraceparent), 0) {
+		t.Error("a sampled incoming trace context was not traced with trace_sample_rate 0")
+	}
+	if sampleTrace(withTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"), 1) {
+		t.Error("an unsampled incoming trace context was traced with trace_sample_rate 1")
+	}
+	if !sampleTrace(withTraceparent("not a traceparent"), 1) {
+		t.Error("an invalid traceparent was not sampled at trace_sample_rate 1")
+	}
+
+	traced := 0
+	for i := 0; i < 2000; i++ {
+		if sampleTrace(newUpgradeRequest("/ws"), 0.3) {
+			traced++
+		}
+	}
+	if traced < 500 || traced > 700 {
+		t.Errorf("%d of 2000 sessions traced with trace_sample_rate 0.3, want about 600", traced)
+	}
+}
+
+func TestTraceSampleRate(t *testing.T) {
+	endedSpans := func(recorder *tracetest.SpanRecorder, want int) []sdktrace.ReadOnlySpan {
+		var spans []sdktrace.ReadOnlySpan
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if spans = recorder.Ended(); len(spans) >= want {
+				break
+			}
+		}
+		return spans
+	}
+
+	t.Run("fraction of the sessions", func(t *testing.T) {
+		recorder := recordSpans(t)
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+			"trace_sample_rate": 0.5,
+		}, newEchoBackend(t))
+
+		for i := 0; i < 40; i++ {
+			client := dialTestGateway(t, gateway, nil)
+			exchangeMessages(t, client, "hello")
+			client.Close(websocket.StatusNormalClosure, "")
+		}
+
+		// Give the last sessions time to end their spans
+		time.Sleep(100 * time.Millisecond)
+		if spans := len(recorder.Ended()); spans < 8 || spans > 32 {
+			t.Errorf("%d of 40 sessions traced with trace_sample_rate 0.5, want about 20", spans)
+		}
+	})
+
+	t.Run("sampled incoming trace context", func(t *testing.T) {
+		recorder := recordSpans(t)
+		traceparents := make(chan string, 2)
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+			"trace_sample_rate": 0.0,
+		}, traceparentBackend(t, traceparents))
+
+		untraced := dialTestGateway(t, gateway, nil)
+		exchangeMessages(t, untraced, "hello")
+		untraced.Close(websocket.StatusNormalClosure, "")
+		if got := <-traceparents; got != "" {
+			t.Errorf("backend traceparent of an untraced session = %q, want none", got)
+		}
+
+		traced := dialTestGateway(t, gateway, &websocket.DialOptions{
+			HTTPHeader: http.Header{"Traceparent": {incomingTraceparent}},
+		})
+		exchangeMessages(t, traced, "hello")
+		traced.Close(websocket.StatusNormalClosure, "")
+		<-traceparents
+
+		spans := endedSpans(recorder, 1)
+		incoming, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+		if len(spans) != 1 || spans[0].SpanContext().TraceID() != incoming {
+			t.Fatalf("ended spans = %d, want only the session continuing the sampled incoming trace", len(spans))
+		}
+	})
+
+	t.Run("unsampled incoming trace context", func(t *testing.T) {
+		recorder := recordSpans(t)
+		traceparents := make(chan string, 1)
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{}, traceparentBackend(t, traceparents))
+
+		unsampled := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+		client := dialTestGateway(t, gateway, &websocket.DialOptions{
+			HTTPHeader: http.Header{"Traceparent": {unsampled}},
+		})
+		exchangeMessages(t, client, "hello")
+		client.Close(websocket.StatusNormalClosure, "")
+
+		if got := <-traceparents; got != unsampled {
+			t.Errorf("backend traceparent = %q, want the incoming %q", got, unsampled)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if spans := len(recorder.Ended()); spans != 0 {
+			t.Errorf("ended spans = %d, want none for an unsampled incoming trace", spans)
+		}
+	})
+}
+
+func TestVerboseTracing(t *testing.T) {
+	messageEvents := func(t *testing.T, recorder *tracetest.SpanRecorder) []sdktrace.Event {
+		t.Helper()
+		var spans []sdktrace.ReadOnlySpan
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if spans = recorder.Ended(); len(spans) > 0 {
+				break
+			}
+		}
+		if len(spans) != 1 {
+			t.Fatalf("ended spans = %d, want 1", len(spans))
+		}
+		var events []sdktrace.Event
+		for _, event := range spans[0].Events() {
+			if event.Name == messageEventName {
+				events = append(events, event)
+			}
+		}
+		return events
+	}
+
+	for _, test := range []struct {
+		name       string
+		verbose    bool
+		wantEvents int
+	}{
+		{name: "verbose", verbose: true, wantEvents: 4},
+		{name: "not verbose", verbose: false, wantEvents: 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := recordSpans(t)
+			gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+				"verbose_tracing": test.verbose,
+			}, newEchoBackend(t))
+
+			client := dialTestGateway(t, gateway, nil)
+			exchangeMessages(t, client, "hello", "hi")
+			client.Close(websocket.StatusNormalClosure, "")
+
+			events := messageEvents(t, recorder)
+			if len(events) != test.wantEvents {
+				t.Fatalf("message events = %d, want %d", len(events), test.wantEvents)
+			}
+			sizes := map[string]int64{}
+			for _, event := range events {
+				attrs := map[attribute.Key]attribute.Value{}
+				for _, attr := range event.Attributes {
+					attrs[attr.Key] = attr.Value
+				}
+				sizes[attrs[eventAttrDirection].AsString()] += attrs[eventAttrSize].AsInt64()
+			}
+			if test.verbose && (sizes[directionClientToBackend] != 7 || sizes[directionBackendToClient] != 7) {
+				t.Errorf("message event bytes = %v, want 7 in each direction", sizes)
+			}
+		})
+	}
+
+	t.Run("unsampled session", func(t *testing.T) {
+		recorder := recordSpans(t)
+		gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+			"verbose_tracing":   true,
+			"trace_sample_rate": 0.0,
+		}, newEchoBackend(t))
+
+		client := dialTestGateway(t, gateway, nil)
+		exchangeMessages(t, client, "hello")
+		client.Close(websocket.StatusNormalClosure, "")
+
+		time.Sleep(100 * time.Millisecond)
+		if spans := len(recorder.Ended()); spans != 0 {
+			t.Errorf("ended spans = %d, want none for a session left out by trace_sample_rate", spans)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+
+	"nhooyr.io/websocket"
+)
+
+// MessageTransformer rewrites the payloads proxied by every connection of the factory, after the
+// built-in interceptors ran. Returning nil data drops the message, returning an error closes the
+// connection with StatusPolicyViolation. Both directions of a connection call it concurrently.
+type MessageTransformer interface {
+	Transform(ctx context.Context, direction string, messageType websocket.MessageType, data []byte) (websocket.MessageType, []byte, error)
+}
+
+// MessageTransformerFunc adapts a function to the MessageTransformer interface
+type MessageTransformerFunc func(ctx context.Context, direction string, messageType websocket.MessageType, data []byte) (websocket.MessageType, []byte, error)
+
+// Transform implements MessageTransformer
+func (f MessageTransformerFunc) Transform(ctx context.Context, direction string, messageType websocket.MessageType, data []byte) (websocket.MessageType, []byte, error) {
+	return f(ctx, direction, messageType, data)
+}
+
+// nopMessageTransformer forwards every message as is
+type nopMessageTransformer struct{}
+
+// Transform implements MessageTransformer
+func (nopMessageTransformer) Transform(_ context.Context, _ string, messageType websocket.MessageType, data []byte) (websocket.MessageType, []byte, error) {
+	return messageType, data, nil
+}
+
+// transformRejectedReason is the close reason of connections whose message failed the transformer
+const transformRejectedReason = "Message rejected"
+
+// SetMessageTransformer sets the transformer of the proxied messages. A nil transformer restores
+// the default one, forwarding messages untouched. It must be called before serving connections.
+func (w *HandlerFactory) SetMessageTransformer(transformer MessageTransformer) {
+	if transformer == nil {
+		transformer = nopMessageTransformer{}
+	}
+	w.transformer = transformer
+}
+
+// transform runs a message through the transformer of the factory, if any. A nil message must be dropped.
+func (w *HandlerFactory) transform(ctx context.Context, direction string, messageType websocket.MessageType, data []byte) (websocket.MessageType, []byte, error) {
+	if w.transformer == nil {
+		return messageType, data, nil
+	}
+
+	messageType, data, err := w.transformer.Transform(ctx, direction, messageType, data)
+	if err != nil {
+		var closeErr *proxyCloseError
+		if errors.As(err, &closeErr) {
+			return messageType, nil, err
+		}
+		return messageType, nil, &proxyCloseError{code: websocket.StatusPolicyViolation, reason: transformRejectedReason}
+	}
+	return messageType, data, nil
+}
@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+func TestMessageTransformer(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	factory.SetMessageTransformer(MessageTransformerFunc(func(ctx context.Context, direction string, messageType websocket.MessageType, data []byte) (websocket.MessageType, []byte, error) {
+		switch {
+		case direction == directionClientToBackend && string(data) == "drop":
+			return messageType, nil, nil
+		case direction == directionClientToBackend && string(data) == "reject":
+			return messageType, data, errors.New("rejected")
+		case direction == directionBackendToClient:
+			return messageType, bytes.Replace(data, []byte(`,"internal":true`), nil, 1), nil
+		}
+		return messageType, data, nil
+	}))
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, message := range []string{"drop", `{"id":1,"internal":true}`} {
+		if err := client.Write(ctx, websocket.MessageText, []byte(message)); err != nil {
+			t.Fatalf("client write failed: %v", err)
+		}
+	}
+
+	// The dropped message never reached the backend, so the first reply is the rewritten second one
+	if _, message, err := client.Read(ctx); err != nil || string(message) != `{"id":1}` {
+		t.Fatalf("client read %q, %v, want %q", message, err, `{"id":1}`)
+	}
+
+	if err := client.Write(ctx, websocket.MessageText, []byte("reject")); err != nil {
+		t.Fatalf("client write failed: %v", err)
+	}
+	if _, message, err := client.Read(ctx); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Fatalf("client read %q, %v, want a close with %v", message, err, websocket.StatusPolicyViolation)
+	}
+}
+
+func TestNopMessageTransformer(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	factory.SetMessageTransformer(nil)
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{}, newEchoBackend(t))
+	exchangeMessages(t, dialTestGateway(t, gateway, nil), "untouched", "")
+}
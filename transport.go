@@ -0,0 +1,167 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/luraproject/lura/config"
+)
+
+// tlsVersions maps the accepted backend_tls_min_version values to their crypto/tls constant
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// backendDialer returns the dialer of the backend connections, nil when the configuration needs none
+func backendDialer(wsConfig Config) (*net.Dialer, error) {
+	if wsConfig.BackendLocalAddr == "" {
+		return nil, nil
+	}
+
+	ip := net.ParseIP(wsConfig.BackendLocalAddr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid backend_local_addr %q: not an IP address", wsConfig.BackendLocalAddr)
+	}
+
+	// Same timeouts as the dialer of http.DefaultTransport
+	return &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: ip},
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}, nil
+}
+
+// backendCertificates is the TLS material read from the backend_tls_* and backend_ca_file files
+type backendCertificates struct {
+	client  *tls.Certificate // Presented to backends requiring mutual TLS, nil for none
+	rootCAs *x509.CertPool   // Trusted instead of the system roots, nil for the system roots
+}
+
+// readBackendCertificates reads the certificate files of the configuration, nil when it has none
+func readBackendCertificates(wsConfig Config) (*backendCertificates, error) {
+	if wsConfig.BackendTLSCertFile == "" && wsConfig.BackendTLSKeyFile == "" && wsConfig.BackendCAFile == "" {
+		return nil, nil
+	}
+	if (wsConfig.BackendTLSCertFile == "") != (wsConfig.BackendTLSKeyFile == "") {
+		return nil, errors.New("backend_tls_cert_file and backend_tls_key_file must be set together")
+	}
+
+	certs := &backendCertificates{}
+	if wsConfig.BackendTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(wsConfig.BackendTLSCertFile, wsConfig.BackendTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the backend client certificate: %w", err)
+		}
+		certs.client = &cert
+	}
+
+	if wsConfig.BackendCAFile != "" {
+		pem, err := ioutil.ReadFile(wsConfig.BackendCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backend_ca_file: %w", err)
+		}
+		certs.rootCAs = x509.NewCertPool()
+		if !certs.rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("backend_ca_file %s holds no PEM certificate", wsConfig.BackendCAFile)
+		}
+	}
+	return certs, nil
+}
+
+// loadBackendCertificates reads the certificate files of an endpoint once, for all its dials
+func (w *HandlerFactory) loadBackendCertificates(endpoint string, wsConfig Config) error {
+	if _, ok := w.backendCertificates.Load(endpoint); ok {
+		return nil
+	}
+
+	certs, err := readBackendCertificates(wsConfig)
+	if err != nil {
+		return err
+	}
+	if certs != nil {
+		w.backendCertificates.Store(endpoint, certs)
+	}
+	return nil
+}
+
+// LoadBackendCertificates reads the backend certificate files of every WebSocket endpoint of
+// serviceConfig, returning the first unreadable or invalid one. Call it before building the router
+// so that a bad file aborts the startup instead of refusing the upgrades of its endpoint.
+func (w *HandlerFactory) LoadBackendCertificates(serviceConfig config.ServiceConfig) error {
+	for _, endpoint := range serviceConfig.Endpoints {
+		wsConfig, ok := parseWebSocketConfig(endpoint.ExtraConfig)
+		if !ok {
+			continue
+		}
+		if err := w.loadBackendCertificates(endpoint.Endpoint, wsConfig); err != nil {
+			return fmt.Errorf("endpoint %s: WebSocket backend TLS: %w", endpoint.Endpoint, err)
+		}
+	}
+	return nil
+}
+
+// backendCertificatesFor returns the certificates loaded for endpoint when its handler was built,
+// reading them now when it was not
+func (w *HandlerFactory) backendCertificatesFor(endpoint string, wsConfig Config) (*backendCertificates, error) {
+	if certs, ok := w.backendCertificates.Load(endpoint); ok {
+		return certs.(*backendCertificates), nil
+	}
+	return readBackendCertificates(wsConfig)
+}
+
+// backendTLSConfig returns the TLS configuration of wss backend connections, nil when the
+// configuration needs none. The handshake fails on backends negotiating below the minimum version.
+func backendTLSConfig(wsConfig Config, certs *backendCertificates) (*tls.Config, error) {
+	if wsConfig.BackendTLSMinVersion == "" && certs == nil {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if wsConfig.BackendTLSMinVersion != "" {
+		version, ok := tlsVersions[wsConfig.BackendTLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid backend_tls_min_version %q: use \"1.2\" or \"1.3\"", wsConfig.BackendTLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if certs != nil {
+		if certs.client != nil {
+			tlsConfig.Certificates = []tls.Certificate{*certs.client}
+		}
+		tlsConfig.RootCAs = certs.rootCAs
+	}
+	return tlsConfig, nil
+}
+
+// backendHTTPClient returns the HTTP client dialing the backend, nil to use http.DefaultClient
+func backendHTTPClient(wsConfig Config, certs *backendCertificates) (*http.Client, error) {
+	dialer, err := backendDialer(wsConfig)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := backendTLSConfig(wsConfig, certs)
+	if err != nil {
+		return nil, err
+	}
+	if dialer == nil && tlsConfig == nil {
+		return nil, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if dialer != nil {
+		transport.DialContext = dialer.DialContext
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: transport}, nil
+}
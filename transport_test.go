@@ -0,0 +1,349 @@
+package websocket
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+func TestBackendDialer(t *testing.T) {
+	tests := []struct {
+		name      string
+		localAddr string
+		wantIP    string
+		wantErr   bool
+	}{
+		{name: "not configured", localAddr: ""},
+		{name: "IPv4", localAddr: "10.0.0.12", wantIP: "10.0.0.12"},
+		{name: "IPv6", localAddr: "2001:db8::12", wantIP: "2001:db8::12"},
+		{name: "not an IP", localAddr: "eth0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer, err := backendDialer(Config{BackendLocalAddr: tt.localAddr})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("backendDialer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantIP == "" {
+				if dialer != nil {
+					t.Errorf("backendDialer() = %+v, want nil", dialer)
+				}
+				return
+			}
+
+			addr, ok := dialer.LocalAddr.(*net.TCPAddr)
+			if !ok || !addr.IP.Equal(net.ParseIP(tt.wantIP)) || addr.Port != 0 {
+				t.Errorf("dialer LocalAddr = %v, want %s with any port", dialer.LocalAddr, tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestBackendLocalAddr(t *testing.T) {
+	remoteAddrs := make(chan string, 1)
+	backend := newTestBackend(t, func(ctx context.Context, conn *websocket.Conn, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+		conn.Read(ctx)
+	})
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"backend_local_addr": "127.0.0.1",
+	}, backend.URL)
+	dialTestGateway(t, gateway, nil)
+
+	select {
+	case remoteAddr := <-remoteAddrs:
+		if host, _, _ := net.SplitHostPort(remoteAddr); host != "127.0.0.1" {
+			t.Errorf("backend connection came from %s, want 127.0.0.1", remoteAddr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend was not dialed")
+	}
+}
+
+func TestBackendLocalAddrUnavailable(t *testing.T) {
+	// 192.0.2.1 (TEST-NET-1) is assigned to no local interface, so binding to it fails
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"backend_local_addr": "192.0.2.1",
+	}, newEchoBackend(t))
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, _, err := client.Read(ctx); websocket.CloseStatus(err) != websocket.StatusInternalError {
+		t.Errorf("client read error = %v, want a close with %v", err, websocket.StatusInternalError)
+	}
+}
+
+func TestBackendTLSConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		minVersion string
+		want       uint16
+		wantErr    bool
+	}{
+		{name: "not configured", minVersion: ""},
+		{name: "TLS 1.2", minVersion: "1.2", want: tls.VersionTLS12},
+		{name: "TLS 1.3", minVersion: "1.3", want: tls.VersionTLS13},
+		{name: "unknown version", minVersion: "TLSv1.2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := backendHTTPClient(Config{BackendTLSMinVersion: tt.minVersion}, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("backendHTTPClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.want == 0 {
+				if client != nil {
+					t.Errorf("backendHTTPClient() = %+v, want nil", client)
+				}
+				return
+			}
+
+			tlsConfig := client.Transport.(*http.Transport).TLSClientConfig
+			if tlsConfig == nil || tlsConfig.MinVersion != tt.want {
+				t.Errorf("TLSClientConfig = %+v, want MinVersion %#x", tlsConfig, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendTLSMinVersionRejected(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.NotFoundHandler())
+	backend.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	backend.StartTLS()
+	defer backend.Close()
+
+	recorder := &testLogger{}
+	gateway := newTestGateway(t, NewHandlerFactory(recorder), map[string]interface{}{
+		"backend_tls_min_version": "1.3",
+	}, backend.URL)
+	client := dialTestGateway(t, gateway, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, _, err := client.Read(ctx); websocket.CloseStatus(err) != websocket.StatusInternalError {
+		t.Fatalf("client read error = %v, want a close with %v", err, websocket.StatusInternalError)
+	}
+	if lines := recorder.Contains("protocol version not supported"); len(lines) == 0 {
+		t.Errorf("backend dial did not fail on the TLS version: %v", recorder.Contains("ERROR:"))
+	}
+}
+
+// writeClientCertificate writes a client certificate and its key, signed by a new CA, to dir.
+// It returns the pool trusting the CA and the paths of the certificate and key files.
+func writeClientCertificate(t *testing.T, dir string) (*x509.CertPool, string, string) {
+	t.Helper()
+
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate a key: %v", err)
+		}
+		return key
+	}
+
+	caKey := newKey()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create the CA certificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	clientKey := newKey()
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gateway"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, ca, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create the client certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatalf("failed to marshal the client key: %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", clientDER)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCAs, certFile, keyFile := writeClientCertificate(t, dir)
+
+	peers := make(chan string, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(rw, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+
+		peers <- r.TLS.PeerCertificates[0].Subject.CommonName
+		conn.Read(r.Context())
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.StartTLS()
+	defer backend.Close()
+
+	// Trust the self-signed certificate of the test backend through backend_ca_file
+	caFile := filepath.Join(dir, "backend-ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", backend.Certificate().Raw)
+
+	gateway := newTestGateway(t, NewHandlerFactory(logging.NoOp), map[string]interface{}{
+		"backend_tls_cert_file": certFile,
+		"backend_tls_key_file":  keyFile,
+		"backend_ca_file":       caFile,
+	}, backend.URL)
+	dialTestGateway(t, gateway, nil)
+
+	select {
+	case peer := <-peers:
+		if peer != "gateway" {
+			t.Errorf("backend saw client certificate %q, want %q", peer, "gateway")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend did not accept the mutual TLS connection")
+	}
+}
+
+func TestBackendCertificatesUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, keyFile := writeClientCertificate(t, dir)
+
+	tests := []struct {
+		name     string
+		wsConfig map[string]interface{}
+	}{
+		{name: "missing certificate", wsConfig: map[string]interface{}{
+			"backend_tls_cert_file": filepath.Join(dir, "missing.pem"),
+			"backend_tls_key_file":  keyFile,
+		}},
+		{name: "certificate without key", wsConfig: map[string]interface{}{
+			"backend_tls_cert_file": certFile,
+		}},
+		{name: "CA file without certificate", wsConfig: map[string]interface{}{
+			"backend_ca_file": keyFile,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &testLogger{}
+			engine := newTestEngine(t, NewHandlerFactory(logger), tt.wsConfig, "https://localhost:8443")
+			if lines := logger.Contains("[ENDPOINT: /ws] WebSocket backend TLS"); len(lines) == 0 {
+				t.Errorf("no error logged for the endpoint, got %v", logger.Lines())
+			}
+
+			recorder := httptest.NewRecorder()
+			engine.ServeHTTP(recorder, newUpgradeRequest("/ws"))
+			if recorder.Code != http.StatusInternalServerError {
+				t.Errorf("upgrade status = %d, want %d", recorder.Code, http.StatusInternalServerError)
+			}
+		})
+	}
+}
+
+func TestNewWithConfigCheckedUnreadableCertificates(t *testing.T) {
+	dir := t.TempDir()
+	_, _, keyFile := writeClientCertificate(t, dir)
+
+	serviceConfig := config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{
+			{Endpoint: "/plain", Method: http.MethodGet},
+			{Endpoint: "/ws", Method: http.MethodGet, ExtraConfig: config.ExtraConfig{
+				ConfigNamespace: map[string]interface{}{
+					"backend_tls_cert_file": filepath.Join(dir, "missing.pem"),
+					"backend_tls_key_file":  keyFile,
+				},
+			}},
+		},
+	}
+
+	handlerFactory, err := NewWithConfigChecked(nil, logging.NoOp, serviceConfig)
+	if err == nil {
+		t.Fatal("expected an error for the missing certificate file")
+	}
+	if handlerFactory != nil {
+		t.Error("expected no handler factory along with the error")
+	}
+	if !strings.Contains(err.Error(), "endpoint /ws") {
+		t.Errorf("error %q does not name the endpoint", err)
+	}
+}
+
+func TestLoadBackendCertificates(t *testing.T) {
+	dir := t.TempDir()
+	_, certFile, keyFile := writeClientCertificate(t, dir)
+
+	factory := NewHandlerFactory(logging.NoOp)
+	err := factory.LoadBackendCertificates(config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{
+			{Endpoint: "/ws", Method: http.MethodGet, ExtraConfig: config.ExtraConfig{
+				ConfigNamespace: map[string]interface{}{
+					"backend_tls_cert_file": certFile,
+					"backend_tls_key_file":  keyFile,
+				},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	certs, ok := factory.backendCertificates.Load("/ws")
+	if !ok || certs.(*backendCertificates).client == nil {
+		t.Error("client certificate not loaded for /ws")
+	}
+}
@@ -0,0 +1,77 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"nhooyr.io/websocket"
+)
+
+// SubprotocolValidator checks that the messages a client sends are well-formed for the subprotocol
+// negotiated on its connection. Connections whose client sends an invalid message are closed with
+// StatusInvalidFramePayloadData.
+type SubprotocolValidator interface {
+	Validate(messageType websocket.MessageType, payload []byte) error
+}
+
+// SubprotocolValidatorFunc adapts a function to the SubprotocolValidator interface
+type SubprotocolValidatorFunc func(messageType websocket.MessageType, payload []byte) error
+
+// Validate implements SubprotocolValidator
+func (f SubprotocolValidatorFunc) Validate(messageType websocket.MessageType, payload []byte) error {
+	return f(messageType, payload)
+}
+
+// errInvalidJSON is returned by JSONValidator for payloads that are not valid JSON
+var errInvalidJSON = errors.New("message is not valid JSON")
+
+// JSONValidator accepts text messages holding a valid JSON document
+var JSONValidator SubprotocolValidator = SubprotocolValidatorFunc(func(messageType websocket.MessageType, payload []byte) error {
+	if messageType != websocket.MessageText {
+		return fmt.Errorf("expected a text message, got %v", messageType)
+	}
+	if !json.Valid(payload) {
+		return errInvalidJSON
+	}
+	return nil
+})
+
+// RegisterSubprotocolValidator validates the client messages of every connection negotiating
+// subprotocol with v, replacing any validator previously registered for it. Connections
+// negotiating another subprotocol, or none, are not validated.
+func (w *HandlerFactory) RegisterSubprotocolValidator(subprotocol string, v SubprotocolValidator) {
+	w.subprotocolValidators.Store(subprotocol, v)
+}
+
+// subprotocolValidator returns the validator registered for subprotocol, or nil
+func (w *HandlerFactory) subprotocolValidator(subprotocol string) SubprotocolValidator {
+	if subprotocol == "" {
+		return nil
+	}
+	if v, ok := w.subprotocolValidators.Load(subprotocol); ok {
+		return v.(SubprotocolValidator)
+	}
+	return nil
+}
+
+// validationInterceptor rejects the client messages failing a subprotocol validator
+type validationInterceptor struct {
+	subprotocol string
+	validator   SubprotocolValidator
+}
+
+// Intercept implements MessageInterceptor
+func (i *validationInterceptor) Intercept(direction string, messageType websocket.MessageType, payload []byte) (websocket.MessageType, []byte, error) {
+	if direction != directionClientToBackend {
+		return messageType, payload, nil
+	}
+
+	if err := i.validator.Validate(messageType, payload); err != nil {
+		return messageType, payload, &proxyCloseError{
+			code:   websocket.StatusInvalidFramePayloadData,
+			reason: fmt.Sprintf("Invalid %s message", i.subprotocol),
+		}
+	}
+	return messageType, payload, nil
+}
@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+	"nhooyr.io/websocket"
+)
+
+// skipMsgpackValue returns what follows the MessagePack value leading b. Only the
+// types used by the tests are supported: fixmap, fixarray, fixstr and positive fixint.
+func skipMsgpackValue(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("truncated MessagePack value")
+	}
+
+	head, b := b[0], b[1:]
+	switch {
+	case head <= 0x7f:
+		return b, nil
+	case head >= 0xa0 && head <= 0xbf:
+		n := int(head & 0x1f)
+		if len(b) < n {
+			return nil, errors.New("truncated MessagePack string")
+		}
+		return b[n:], nil
+	case head >= 0x80 && head <= 0x8f, head >= 0x90 && head <= 0x9f:
+		n := int(head & 0x0f)
+		if head <= 0x8f {
+			n *= 2
+		}
+		var err error
+		for i := 0; i < n; i++ {
+			if b, err = skipMsgpackValue(b); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, errors.New("unsupported MessagePack type")
+}
+
+var msgpackValidator = SubprotocolValidatorFunc(func(messageType websocket.MessageType, payload []byte) error {
+	if messageType != websocket.MessageBinary {
+		return errors.New("expected a binary message")
+	}
+	rest, err := skipMsgpackValue(payload)
+	if err == nil && len(rest) > 0 {
+		err = errors.New("trailing bytes after the MessagePack value")
+	}
+	return err
+})
+
+func TestSubprotocolValidators(t *testing.T) {
+	factory := NewHandlerFactory(logging.NoOp)
+	factory.RegisterSubprotocolValidator("chat.json", JSONValidator)
+	factory.RegisterSubprotocolValidator("chat.msgpack", msgpackValidator)
+
+	gateway := newTestGateway(t, factory, map[string]interface{}{
+		"subprotocols": []interface{}{"chat.json", "chat.msgpack", "chat.raw"},
+	}, newEchoBackend(t))
+
+	validMsgpack := []byte{0x81, 0xa1, 'a', 0x01}     // {"a": 1}
+	truncatedMsgpack := []byte{0x82, 0xa1, 'a', 0x01} // A map announcing two entries holding one
+
+	tests := []struct {
+		name        string
+		subprotocol string
+		messageType websocket.MessageType
+		valid       []byte
+		invalid     []byte
+	}{
+		{name: "JSON", subprotocol: "chat.json", messageType: websocket.MessageText, valid: []byte(`{"a":1}`), invalid: []byte(`{"a":`)},
+		{name: "MessagePack", subprotocol: "chat.msgpack", messageType: websocket.MessageBinary, valid: validMsgpack, invalid: truncatedMsgpack},
+		{name: "no validator", subprotocol: "chat.raw", messageType: websocket.MessageText, valid: []byte(`{"a":`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialTestGateway(t, gateway, &websocket.DialOptions{Subprotocols: []string{tt.subprotocol}})
+			if client.Subprotocol() != tt.subprotocol {
+				t.Fatalf("negotiated subprotocol = %q, want %q", client.Subprotocol(), tt.subprotocol)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := client.Write(ctx, tt.messageType, tt.valid); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+			if _, message, err := client.Read(ctx); err != nil || string(message) != string(tt.valid) {
+				t.Fatalf("reply to a valid message = %q, %v, want it echoed", message, err)
+			}
+
+			if tt.invalid == nil {
+				return
+			}
+
+			if err := client.Write(ctx, tt.messageType, tt.invalid); err != nil {
+				t.Fatalf("client write failed: %v", err)
+			}
+			_, message, err := client.Read(ctx)
+			if status := websocket.CloseStatus(err); status != websocket.StatusInvalidFramePayloadData {
+				t.Fatalf("after an invalid message, client read %q, %v, want a close with %v", message, err, websocket.StatusInvalidFramePayloadData)
+			}
+		})
+	}
+}